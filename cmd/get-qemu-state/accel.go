@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// accelFailurePattern matches the QEMU stderr lines reporting an unusable
+// accelerator (e.g. no /dev/kvm in a nested VM or a container).
+var accelFailurePattern = regexp.MustCompile(`(?i)could not access kvm kernel module|failed to initialize (kvm|hvf|whpx|nvmm|xen)|kvm (is )?not (supported|available)|no accelerator found`)
+
+// accelError reports QEMU failing to use the accelerator.
+type accelError struct {
+	accel string
+	line  string
+}
+
+func (e *accelError) Error() string {
+	return fmt.Sprintf("QEMU couldn't use accelerator %s: %s", e.accel, e.line)
+}
+
+// accelCandidates returns the accelerators args let QEMU try in order:
+// those of every -accel, of -machine accel= (separated by ":") and
+// -enable-kvm.
+func accelCandidates(args []string) []string {
+	var res []string
+	for i, a := range args {
+		switch a {
+		case "-enable-kvm":
+			res = append(res, "kvm")
+		case "-accel":
+			if i+1 < len(args) {
+				name, _, _ := strings.Cut(args[i+1], ",")
+				res = append(res, name)
+			}
+		case "-machine", "-M":
+			if i+1 < len(args) {
+				if v, ok := option(args[i+1], "accel"); ok {
+					res = append(res, strings.Split(v, ":")...)
+				}
+			}
+		}
+	}
+	return res
+}
+
+// withoutAccel returns args with the accelerator selection (-accel,
+// -enable-kvm and -machine accel=) removed.
+func withoutAccel(args []string) []string {
+	var res []string
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "-enable-kvm":
+			continue
+		case a == "-accel" && i+1 < len(args):
+			i++
+			continue
+		case (a == "-machine" || a == "-M") && i+1 < len(args):
+			var opts []string
+			for _, o := range strings.Split(args[i+1], ",") {
+				if !strings.HasPrefix(o, "accel=") {
+					opts = append(opts, o)
+				}
+			}
+			i++
+			if len(opts) > 0 {
+				res = append(res, a, strings.Join(opts, ","))
+			}
+			continue
+		}
+		res = append(res, args[i])
+	}
+	return res
+}
+
+// capture captures the VM as configured. With -accel-fallback, a capture
+// failing as QEMU can't use the accelerator is retried once with TCG.
+func capture(cfg config) (*result, error) {
+	if cfg.logger == nil {
+		cfg.logger = log.Default()
+	}
+	if cfg.shrink {
+		return captureShrunk(cfg)
+	}
+	res, err := captureOnce(cfg)
+	var aerr *accelError
+	if err == nil || !cfg.accelFallback || !errors.As(err, &aerr) || aerr.accel == "tcg" {
+		return res, err
+	}
+	cfg.logger.Printf("WARNING: %v; retrying with TCG (-accel-fallback). The state may differ from a %s capture and may not restore under %s", err, aerr.accel, aerr.accel)
+	cfg.args = withoutAccel(cfg.args)
+	cfg.accel = "tcg"
+	cfg.accelFallbackFrom = aerr.accel
+	return captureOnce(cfg)
+}
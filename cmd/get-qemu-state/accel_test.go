@@ -0,0 +1,16 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWithoutAccel(t *testing.T) {
+	args := []string{"-M", "q35,accel=kvm:tcg", "-enable-kvm", "-accel", "kvm", "-m", "1G", "-machine", "accel=kvm"}
+	if got, want := withoutAccel(args), []string{"-M", "q35", "-m", "1G"}; !slices.Equal(got, want) {
+		t.Errorf("withoutAccel(%q) = %q; want %q", args, got, want)
+	}
+	if got, want := accelCandidates(args), []string{"kvm", "tcg", "kvm", "kvm", "kvm"}; !slices.Equal(got, want) {
+		t.Errorf("accelCandidates(%q) = %q; want %q", args, got, want)
+	}
+}
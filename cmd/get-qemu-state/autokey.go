@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// autokey types keys to the console when match appears during boot, e.g. to
+// get past a firmware "Press any key to boot" prompt.
+type autokey struct {
+	keys  string
+	match string
+}
+
+// parseAutokey parses a "<keys>@<match>" flag value. keys may contain Go
+// escape sequences such as "\r".
+func parseAutokey(s string) (autokey, error) {
+	keys, match, ok := strings.Cut(s, "@")
+	if !ok || keys == "" || match == "" {
+		return autokey{}, fmt.Errorf("autokey %q must be <keys>@<match>", s)
+	}
+	k, err := strconv.Unquote(`"` + keys + `"`)
+	if err != nil {
+		return autokey{}, fmt.Errorf("autokey %q: invalid keys: %w", s, err)
+	}
+	return autokey{keys: k, match: match}, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// hasBalloon reports whether args add a virtio-balloon device.
+func hasBalloon(args []string) bool {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-device" && strings.HasPrefix(args[i+1], "virtio-balloon") {
+			return true
+		}
+	}
+	return false
+}
+
+// balloonInfo is the guest RAM before and after -balloon.
+type balloonInfo struct {
+	BeforeMiB int64 `json:"beforeMiB"`
+	AfterMiB  int64 `json:"afterMiB"`
+}
+
+func (q *qmp) balloonSize(ctx context.Context) (int64, error) {
+	var info struct {
+		Actual int64 `json:"actual"`
+	}
+	err := q.execute(ctx, "query-balloon", nil, &info)
+	return info.Actual, err
+}
+
+// inflateBalloon asks the guest to shrink its RAM to target bytes and waits
+// until it's reached or the guest stops giving back memory.
+func (q *qmp) inflateBalloon(ctx context.Context, target int64) (*balloonInfo, error) {
+	const (
+		pollInterval = 200 * time.Millisecond
+		settle       = 2 * time.Second
+	)
+	before, err := q.balloonSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.execute(ctx, "balloon", map[string]any{"value": target}, nil); err != nil {
+		return nil, err
+	}
+	cur, lastChange := before, time.Now()
+	for cur > target && time.Since(lastChange) < settle {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("balloon didn't inflate: %w", ctx.Err())
+		case <-time.After(pollInterval):
+		}
+		size, err := q.balloonSize(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if size != cur {
+			cur, lastChange = size, time.Now()
+		}
+	}
+	return &balloonInfo{BeforeMiB: before >> 20, AfterMiB: cur >> 20}, nil
+}
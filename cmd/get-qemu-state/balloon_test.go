@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHasBalloon(t *testing.T) {
+	if !hasBalloon([]string{"-m", "512M", "-device", "virtio-balloon-pci,id=balloon0"}) {
+		t.Error("virtio-balloon-pci isn't detected")
+	}
+	if hasBalloon([]string{"-device", "virtio-net-pci,netdev=vmnic"}) {
+		t.Error("virtio-net-pci is taken as a balloon")
+	}
+}
+
+func TestInflateBalloon(t *testing.T) {
+	f := newFakeQMP(t)
+	f.mu.Lock()
+	f.ram = 512 << 20
+	f.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q, err := dialQMP(ctx, "unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	b, err := q.inflateBalloon(ctx, 256<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.BeforeMiB != 512 || b.AfterMiB != 256 {
+		t.Errorf("got %+v; want 512 MiB -> 256 MiB", b)
+	}
+	cmds := f.executed()
+	if i := slices.Index(cmds, "balloon"); i < 1 || cmds[i-1] != "query-balloon" || cmds[len(cmds)-1] != "query-balloon" {
+		t.Errorf("unexpected command sequence %v", cmds)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// benchStats summarizes the durations of one capture phase over the runs.
+type benchStats struct {
+	P50    time.Duration `json:"p50"`
+	P95    time.Duration `json:"p95"`
+	Max    time.Duration `json:"max"`
+	Mean   time.Duration `json:"mean"`
+	StdDev time.Duration `json:"stddev"`
+}
+
+// benchReport is the result of "bench". Durations are in nanoseconds in JSON.
+type benchReport struct {
+	Runs    int        `json:"runs"`
+	Marker  benchStats `json:"marker"`
+	Migrate benchStats `json:"migrate"`
+	Total   benchStats `json:"total"`
+}
+
+// runBench implements "get-qemu-state bench [flags] qemu". It runs the
+// capture repeatedly and reports the distribution of the phase durations.
+// The tests run it against the stub QEMU of the test binary.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	configure := registerFlags(fs)
+	var (
+		runs    = fs.Int("n", 10, "number of captures")
+		jsonOut = fs.Bool("json", false, "print the report as JSON")
+	)
+	fs.Parse(args)
+
+	cfg, err := configure()
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("specify QEMU binary")
+	}
+	cfg.qemu = fs.Arg(0)
+	if *runs < 1 {
+		return errors.New("-n must be positive")
+	}
+	tmpDir, err := os.MkdirTemp("", "get-qemu-state-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	cfg.output = filepath.Join(tmpDir, "vm.state")
+	cfg.stdout = io.Discard
+	redact := cfg.redactor()
+	cfg.logger = log.New(redact.writer(log.Writer()), log.Prefix(), log.Flags())
+
+	var results []*result
+	for i := 0; i < *runs; i++ {
+		os.Remove(cfg.output)
+		res, err := capture(cfg)
+		if err != nil {
+			return redact.error(fmt.Errorf("run %d: %w", i, err))
+		}
+		cfg.logger.Printf("run %d: marker=%v migrate=%v total=%v", i, res.ReadyAfter, res.MigrateTime, res.Total)
+		results = append(results, res)
+	}
+	r := newBenchReport(results)
+
+	if *jsonOut {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+	fmt.Printf("%d runs\n", r.Runs)
+	fmt.Printf("%-8s %12s %12s %12s %12s %12s\n", "PHASE", "P50", "P95", "MAX", "MEAN", "STDDEV")
+	for _, p := range []struct {
+		name string
+		s    benchStats
+	}{{"marker", r.Marker}, {"migrate", r.Migrate}, {"total", r.Total}} {
+		fmt.Printf("%-8s %12v %12v %12v %12v %12v\n", p.name, p.s.P50, p.s.P95, p.s.Max, p.s.Mean, p.s.StdDev)
+	}
+	if cv := float64(r.Total.StdDev) / float64(r.Total.Mean); cv > 0.1 {
+		log.Printf("WARNING: total time varies by %.0f%% between runs; increase -n for comparable results", cv*100)
+	}
+	return nil
+}
+
+func newBenchReport(results []*result) benchReport {
+	var marker, migrate, total []time.Duration
+	for _, r := range results {
+		marker = append(marker, r.ReadyAfter)
+		migrate = append(migrate, r.MigrateTime)
+		total = append(total, r.Total)
+	}
+	return benchReport{
+		Runs:    len(results),
+		Marker:  newBenchStats(marker),
+		Migrate: newBenchStats(migrate),
+		Total:   newBenchStats(total),
+	}
+}
+
+func newBenchStats(d []time.Duration) benchStats {
+	s := slices.Clone(d)
+	slices.Sort(s)
+	var sum float64
+	for _, v := range s {
+		sum += float64(v)
+	}
+	mean := sum / float64(len(s))
+	var sq float64
+	for _, v := range s {
+		sq += (float64(v) - mean) * (float64(v) - mean)
+	}
+	return benchStats{
+		P50:    percentile(s, 50),
+		P95:    percentile(s, 95),
+		Max:    s[len(s)-1],
+		Mean:   time.Duration(mean),
+		StdDev: time.Duration(math.Sqrt(sq / float64(len(s)))),
+	}
+}
+
+// percentile returns the nearest-rank percentile of the sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBenchStats(t *testing.T) {
+	var d []time.Duration
+	for i := 20; i >= 1; i-- {
+		d = append(d, time.Duration(i)*time.Millisecond)
+	}
+	s := newBenchStats(d)
+	if s.P50 != 10*time.Millisecond || s.P95 != 19*time.Millisecond || s.Max != 20*time.Millisecond {
+		t.Fatalf("unexpected percentiles: %+v", s)
+	}
+	if s.Mean != 10500*time.Microsecond {
+		t.Fatalf("mean = %v; want 10.5ms", s.Mean)
+	}
+	if s := newBenchStats([]time.Duration{time.Second, time.Second}); s.StdDev != 0 {
+		t.Fatalf("stddev of identical runs = %v; want 0", s.StdDev)
+	}
+}
+
+func TestBenchStub(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	argsJSON := filepath.Join(t.TempDir(), "args.json")
+	if err := os.WriteFile(argsJSON, []byte(`["`+stubQEMUCommand+`"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(self, "bench", "-n", "2", "-json", "-args-json", argsJSON, self)
+	cmd.Env = append(os.Environ(), "GET_QEMU_STATE_TEST_MAIN=1")
+	out, err := cmd.Output()
+	if err != nil {
+		var stderr []byte
+		if ee, ok := err.(*exec.ExitError); ok {
+			stderr = ee.Stderr
+		}
+		t.Fatalf("bench failed: %v\n%s", err, stderr)
+	}
+	var r benchReport
+	if err := json.Unmarshal(out, &r); err != nil {
+		t.Fatalf("%v: %q", err, out)
+	}
+	if r.Runs != 2 {
+		t.Errorf("got %d runs; want 2", r.Runs)
+	}
+}
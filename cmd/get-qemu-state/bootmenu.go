@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// defaultBootMenuPrompts are printed by bootloaders waiting for a menu
+// selection: GRUB 2 (with ASCII or Unicode arrows) and SYSLINUX/ISOLINUX.
+var defaultBootMenuPrompts = []string{
+	"Use the ^ and v keys to select which entry is highlighted",
+	"Use the ↑ and ↓ keys to select which entry is highlighted",
+	"Press [Tab] to edit options",
+}
+
+// defaultBootMenuKey boots the highlighted entry, which is the default one
+// until a key moves the highlight.
+const defaultBootMenuKey = "\r"
+
+// watchBootMenu handles the first of prompts appearing on con before ctx is
+// done by policy: "warn" logs it, "fail" fails the capture and
+// "select-default" types key to stdin.
+func watchBootMenu(ctx context.Context, con *console, prompts []string, policy, key string, stdin io.Writer, logger *log.Logger, fail func(error)) {
+	var once sync.Once
+	for _, p := range prompts {
+		w := con.watch(p)
+		go func() {
+			if err := con.wait(ctx, w); err != nil {
+				return // booted without the menu
+			}
+			once.Do(func() { handleBootMenu(p, policy, key, stdin, logger, fail) })
+		}()
+	}
+}
+
+func handleBootMenu(prompt, policy, key string, stdin io.Writer, logger *log.Logger, fail func(error)) {
+	switch policy {
+	case "fail":
+		fail(fmt.Errorf("guest is waiting at a bootloader menu (%q); make the bootloader boot the default entry without waiting (e.g. GRUB_TIMEOUT=0) or use -bootmenu-policy select-default", prompt))
+	case "select-default":
+		logger.Printf("detected a bootloader menu (%q); sending %q to boot the default entry", prompt, key)
+		if _, err := io.WriteString(stdin, key); err != nil {
+			logger.Printf("WARNING: failed to send %q: %v", key, err)
+		}
+	default:
+		logger.Printf("WARNING: guest is at a bootloader menu (%q) and may wait for a selection; use -bootmenu-policy select-default to boot the default entry", prompt)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureBootMenu(t *testing.T) {
+	t.Setenv("STUB_QEMU_BOOT_MENU", "1")
+
+	cfg := stubConfig(t)
+	cfg.bootMenuPolicy = "select-default"
+	cfg.bootTimeout = 30 * time.Second
+	if _, err := capture(cfg); err != nil {
+		t.Fatalf("default entry wasn't booted: %v", err)
+	}
+
+	cfg = stubConfig(t)
+	cfg.bootMenuPolicy = "fail"
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "bootloader menu") {
+		t.Fatalf("got %v; want the menu reported", err)
+	}
+
+	// The prompts are configurable.
+	cfg = stubConfig(t)
+	cfg.bootMenuPolicy = "fail"
+	cfg.bootMenuPrompts = []string{"Press enter to boot the selected OS"}
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), `"Press enter to boot the selected OS"`) {
+		t.Fatalf("got %v; want the configured prompt reported", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// bootStagePatterns mark the start of the boot stages following the
+// firmware on a Linux console. A stage that isn't seen is part of the
+// previous one.
+var bootStagePatterns = []timingPattern{
+	{name: "kernel", re: regexp.MustCompile(`Linux version \S`)},
+	{name: "initramfs", re: regexp.MustCompile(`Run /init as init process`)},
+	{name: "userspace", re: regexp.MustCompile(`Run /\S+/\S+ as init process|systemd\[1\]: `)},
+}
+
+// foldedStack is a stack of frames (root first) and the time spent in it,
+// as a line of the folded stacks read by flamegraph.pl.
+type foldedStack struct {
+	frames []string
+	d      time.Duration
+}
+
+// bootBreakdown breaks a run down into the boot stages (firmware until the
+// first stage mark), split further by the -timing-pattern marks seen in each
+// stage, the pre-script steps and the migration. Marks after readyAfter
+// aren't part of the boot.
+func bootBreakdown(readyAfter time.Duration, stages, marks []timing, steps []stepTiming, migrate time.Duration) []foldedStack {
+	type event struct {
+		at    time.Duration
+		stage bool
+		name  string
+	}
+	var events []event
+	for _, s := range stages {
+		events = append(events, event{at: seconds(s.Seconds), stage: true, name: s.Name})
+	}
+	for _, m := range marks {
+		events = append(events, event{at: seconds(m.Seconds), name: m.Name})
+	}
+	slices.SortStableFunc(events, func(a, b event) int { return cmp.Compare(a.at, b.at) })
+
+	var res []foldedStack
+	add := func(d time.Duration, frames ...string) {
+		if d <= 0 {
+			return
+		}
+		for i, f := range frames {
+			frames[i] = foldedFrame(f)
+		}
+		for i := range res {
+			if slices.Equal(res[i].frames, frames) {
+				res[i].d += d
+				return
+			}
+		}
+		res = append(res, foldedStack{frames: frames, d: d})
+	}
+	stage, mark := "firmware", ""
+	var from time.Duration
+	for _, e := range append(events, event{at: readyAfter}) {
+		to := min(e.at, readyAfter)
+		if mark == "" {
+			add(to-from, "boot", stage)
+		} else {
+			add(to-from, "boot", stage, mark)
+		}
+		from = max(from, to)
+		if e.stage {
+			stage, mark = e.name, ""
+		} else {
+			mark = e.name
+		}
+	}
+	for _, s := range steps {
+		add(seconds(s.Seconds), "provisioning", fmt.Sprintf("line %d: %s", s.Line, s.Step))
+	}
+	add(migrate, "migration")
+	return res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// foldedFrame makes s a frame name: ";" separates frames.
+func foldedFrame(s string) string {
+	return strings.NewReplacer(";", ",", "\n", " ", "\r", " ").Replace(s)
+}
+
+// writeFolded writes stacks as folded stacks with the time in milliseconds,
+// e.g. for "flamegraph.pl --countname ms".
+func writeFolded(w io.Writer, stacks []foldedStack) error {
+	for _, s := range stacks {
+		if _, err := fmt.Fprintf(w, "%s %d\n", strings.Join(s.frames, ";"), s.d.Milliseconds()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBootBreakdown writes stacks to the folded stacks file at path.
+func writeBootBreakdown(path string, stacks []foldedStack) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeFolded(f, stacks); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
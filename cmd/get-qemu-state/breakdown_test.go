@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBootBreakdown(t *testing.T) {
+	stages := []timing{{"kernel", 1}, {"initramfs", 3}, {"userspace", 5}}
+	marks := []timing{{"network", 6}, {"app", 8}, {"late", 12}}
+	steps := []stepTiming{{Line: 1, Step: "send a;b", Seconds: 2}, {Line: 2, Step: "expect ready", Seconds: 0.5}}
+	var buf strings.Builder
+	if err := writeFolded(&buf, bootBreakdown(10*time.Second, stages, marks, steps, 1500*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	want := `boot;firmware 1000
+boot;kernel 2000
+boot;initramfs 2000
+boot;userspace 1000
+boot;userspace;network 2000
+boot;userspace;app 2000
+provisioning;line 1: send a,b 2000
+provisioning;line 2: expect ready 500
+migration 1500
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// Stages not seen are part of the previous one.
+	buf.Reset()
+	writeFolded(&buf, bootBreakdown(4*time.Second, []timing{{"userspace", 3}}, []timing{{"init", 1}}, nil, 0))
+	if want := "boot;firmware 1000\nboot;firmware;init 2000\nboot;userspace 1000\n"; buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestCaptureBootBreakdown(t *testing.T) {
+	t.Setenv("STUB_QEMU_BOOT_DELAY", "200ms")
+	cfg := stubConfig(t)
+	cfg.bootBreakdown = filepath.Join(t.TempDir(), "boot.folded")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.bootBreakdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stub prints the kernel banner at once and runs init after the
+	// boot delay.
+	if !strings.Contains(string(data), "boot;kernel ") || !strings.Contains(string(data), "\nmigration ") {
+		t.Errorf("breakdown misses stages:\n%s", data)
+	}
+}
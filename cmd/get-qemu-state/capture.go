@@ -0,0 +1,1746 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type config struct {
+	qemu string
+	args []string
+
+	output     string
+	outputMode os.FileMode // 0 leaves the mode as created
+	dryRun     bool        // boot until ready and quit without a snapshot
+	splitBytes int64       // split the state into parts of this size if positive
+	chunkMode  string      // of the -split-bytes parts, one of chunkModes
+
+	splitSections  bool // write the state as per-section files in sectionsDir
+	followSymlinks bool
+	noLock         bool          // don't lock <output>.lock
+	lockWait       time.Duration // wait for another capture to release the lock
+	// globalConcurrency (if positive) bounds the captures running on the
+	// host at a time, across invocations, with the slots in slotDir.
+	globalConcurrency int
+	slotDir           string
+
+	migrateAttempts int
+	migrateTimeout  time.Duration
+	migrateBackoff  time.Duration
+	migratePrecheck bool
+	measureRestore  bool
+	hotMap          bool          // write hotMapPath and read it ahead on -measure-restore
+	maxDowntime     time.Duration // fail if the migration downtime exceeds it
+
+	// migrateTimeoutPerGB (if positive) replaces migrateTimeout with one
+	// scaled to the guest RAM (see scaledMigrateTimeout).
+	migrateTimeoutPerGB time.Duration
+
+	markers       []string
+	markerCount   int
+	normalizeCRLF bool // match the markers with \r\n and \r read as \n
+
+	stageMarkerHelper bool
+	// markerFD matches the markers on a virtio serial port of their own
+	// instead of the console (see markerPortArgs).
+	markerFD bool
+
+	waitTCPGuest        int
+	readyHTTP           *url.URL
+	readyHTTPMatch      *regexp.Regexp
+	waitGuestAgent      bool
+	readyQMPEvent       *qmpEventMatcher
+	readyHelper         string
+	readyHelperInterval time.Duration
+	readyHelperTimeout  time.Duration
+	onReady             string
+	onReadyRequired     bool
+	pidFile             string
+	cpuAffinity         []int
+	nice                *int // nice value of QEMU
+	// bootGate (if not nil) matches the console line before which the
+	// markers aren't matched.
+	bootGate       *regexp.Regexp
+	ioprio         int // I/O priority of QEMU (ioprio_set(2)), 0 to leave it
+	consoleFile    string
+	consoleRawFile string // the console before consoleDecode
+	consoleDecode  string // key of consoleDecoders; "" passes the console as is
+	echoFilter     *regexp.Regexp
+	echoExclude    *regexp.Regexp
+	pty            bool
+	qemuStderrFile string
+	logFile        string
+	redactArgs     []string // secrets redacted besides those of argSecrets
+	logRotateBytes int64
+	logRotateKeep  int
+	bootTimeout    time.Duration
+	// deadline (if not zero) is when -max-total-time runs out. It bounds
+	// everything from the start of QEMU to the restore measurement; the
+	// other timeouts stay within it.
+	deadline           time.Time
+	firstOutputTimeout time.Duration
+	settledAfter       time.Duration
+	loginPrompts       []*regexp.Regexp // -wait-login if not empty
+	quietFor           time.Duration
+	readyOnQuiet       time.Duration
+	readyOnQuietMin    int64
+	// readyDebounce is how long a polled readiness condition must hold
+	// before the snapshot (see debouncer).
+	readyDebounce time.Duration
+
+	preScript     string
+	expectTimeout time.Duration
+	checkpoint    string
+	resume        bool
+
+	// dump (if set) is where the guest memory is dumped (ELF) instead of
+	// taking the snapshot, also on a boot timeout.
+	dump string
+
+	// fromState is restored instead of booting the guest, and the output
+	// written as a delta against it with delta.
+	fromState string
+	delta     bool
+
+	// memoryBuffer (if positive) migrates into memory instead of the
+	// partial file, spilling to it if the state exceeds this many bytes.
+	memoryBuffer int64
+	// compress migrates the state through gzip.
+	compress bool
+
+	shrink bool
+	// shrinkFull is the state of the first -shrink pass, restored instead
+	// of booting the guest and kept if the capture isn't smaller.
+	shrinkFull string
+	// shrinkBoot is the result of the first -shrink pass, reported as the
+	// boot of this capture.
+	shrinkBoot *result
+
+	// guestExec are shell commands run in the guest via the guest agent
+	// after the pre-script, each within guestExecTimeout.
+	guestExec        []string
+	guestExecTimeout time.Duration
+	collectLogs      []collectLog // copied from the guest after guestExec
+	// collectGuestFiles are guest paths copied next to the state as
+	// metadata at readiness; skipped if the guest agent is unavailable.
+	collectGuestFiles []string
+
+	// guestShutdownCmd is typed to the console right before the migration;
+	// the VM is paused once guestShutdownMarker appears.
+	guestShutdownCmd     string
+	guestShutdownMarker  string
+	guestShutdownTimeout time.Duration
+
+	manifest       string
+	timingPatterns []timingPattern
+	bootBreakdown  string // folded stacks file of where the time of the run went
+
+	missingFilePatterns []*regexp.Regexp
+	warningErrors       []*regexp.Regexp // QEMU stderr lines failing the capture
+	oomPolicy           string           // "warn" or "fail" on an OOM reported by the guest
+
+	portableMemory bool
+	balloonMiB     int64 // inflate the balloon to this guest RAM size before the snapshot
+	maxGuestMiB    int64 // fail before booting if -m in args is larger
+	// icountShift (if not nil) runs the guest with -icount, and
+	// readyInstructions (if positive) makes it ready once it ran this many
+	// instructions.
+	icountShift       *int
+	readyInstructions int64
+	// memoryGrowth reads the guest memory usage at readiness and before
+	// the snapshot through the guest agent.
+	memoryGrowth bool
+
+	compatMachine string
+	// stableDeviceOrder pins the slots of the PCI devices (pinDeviceAddrs).
+	stableDeviceOrder bool
+	accel             string // accelerator added to args unless they select one
+	accelFallback     bool   // retry with TCG if QEMU can't use the accelerator
+	// accelFallbackFrom is the accelerator QEMU couldn't use, when retrying
+	// with TCG.
+	accelFallbackFrom string
+	fakeTime          time.Time // zero for the real time
+	screenText        bool
+	sectionSizes      int // number of the largest state sections reported
+	autokeys          []autokey
+	// bootMenuPolicy is "warn", "fail" or "select-default" on a bootloader
+	// menu during boot, detected by bootMenuPrompts (defaultBootMenuPrompts
+	// if nil) and selected by typing bootMenuKey (defaultBootMenuKey if
+	// empty).
+	bootMenuPolicy  string
+	bootMenuPrompts []string
+	bootMenuKey     string
+
+	progressInterval time.Duration
+	maxProgressLines int // throttle the progress log after this many lines if positive
+	progressFile     string
+
+	tempDir            string
+	keepPartial        bool
+	finalizeRetries    int // retries of the finalize steps on transient errors
+	cleanStalePartials bool
+	debug              bool
+
+	reproOnFailure bool
+
+	requireCleanExit bool
+
+	// group coordinates the snapshot with the captures of other VMs.
+	group *captureGroup
+
+	// derived maps the flags whose value configure derived from another
+	// setting to that setting, for -print-config: "arch" for the defaults
+	// of -arch, "qemu" for the arch inferred from the QEMU binary name and
+	// "marker-repeat".
+	derived map[string]string
+
+	// stdout receives the guest console. os.Stdout is used if nil.
+	stdout io.Writer
+	// logger receives the log of the capture. The standard logger is used
+	// if nil.
+	logger *log.Logger
+}
+
+// applyMode sets -output-mode to a file written by the capture.
+func (cfg *config) applyMode(path string) error {
+	if cfg.outputMode == 0 {
+		return nil
+	}
+	return cfg.retryFinalize("set the mode of "+path, func() error { return os.Chmod(path, cfg.outputMode) })
+}
+
+// createLog creates a log file rotated as configured by -log-rotate-*.
+func (cfg *config) createLog(path string) (*rotatingFile, error) {
+	return createRotatingFile(path, cfg.logRotateBytes, cfg.logRotateKeep)
+}
+
+func (cfg *config) debugf(format string, v ...any) {
+	if cfg.debug {
+		cfg.logger.Printf(format, v...)
+	}
+}
+
+// result reports how a capture went.
+//
+// All durations, timeouts and the progress elapsed time are measured from
+// time.Now() values through time.Since or context deadlines, which use Go's
+// monotonic clock. Wall clock adjustments on the host (e.g. NTP corrections
+// during a long capture) therefore don't affect them. Don't strip the
+// monotonic reading (Time.Round, Truncate, UTC, In, or serializing) from the
+// timestamps these are derived from.
+type result struct {
+	ReadyAfter  time.Duration // from the QEMU start to the guest being ready
+	MigrateTime time.Duration // from the migrate command to the state file being written
+	// MigratePhases break MigrateTime down if QMP showed the phases.
+	MigratePhases *migrationPhases
+	Downtime      time.Duration // the VM was stopped during the migration (QMP only)
+	Total         time.Duration
+	Timings       []timing
+	ScreenText    string        // the VGA text screen at readiness, with -screen-text
+	Sections      []sectionSize // the largest sections of the state, with -section-sizes
+	RestoreTime   time.Duration // from the start of the restoring QEMU until the VM runs, with -measure-restore
+	OOMKills      []string      // processes killed by the guest OOM killer
+	// PreScriptSteps is the time each pre-script step run took.
+	PreScriptSteps []stepTiming
+	// AccelFallbackFrom is the accelerator QEMU couldn't use before
+	// -accel-fallback retried with TCG.
+	AccelFallbackFrom string
+	// Shrink is the state size before and after -shrink.
+	Shrink *shrinkInfo
+	// Dump is the path of the guest memory dump taken by -dump.
+	Dump string
+	// MemoryGrowth is the guest memory usage growth, with -memory-growth.
+	MemoryGrowth *memoryGrowth
+	// StateBytes is the state if it fit in -memory-buffer.
+	StateBytes []byte
+	// StateSize is the size of the state (or of the -dump) before it's
+	// split or written as a delta. It's 0 with -dry-run and -output -.
+	StateSize int64
+}
+
+func captureOnce(cfg config) (_ *result, err error) {
+	args := cfg.args
+	redact := cfg.redactor()
+
+	// With -output -, the state is migrated to our stdout through a file
+	// descriptor passed over QMP and there's no file to finalize.
+	toStdout := cfg.output == stdoutOutput
+	outputs := []*string{&cfg.manifest, &cfg.bootBreakdown, &cfg.dump, &cfg.checkpoint, &cfg.consoleFile, &cfg.consoleRawFile, &cfg.qemuStderrFile, &cfg.logFile, &cfg.progressFile}
+	if !toStdout {
+		outputs = append(outputs, &cfg.output)
+	}
+	for _, p := range outputs {
+		if *p == "" {
+			continue
+		}
+		if *p, err = resolveOutputPath(*p, cfg.followSymlinks); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.splitBytes > 0 && !cfg.followSymlinks {
+		if _, err := resolveOutputPath(splitIndexPath(cfg.output), false); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.splitSections && !cfg.followSymlinks {
+		if _, err := resolveOutputPath(filepath.Join(sectionsDir(cfg.output), sectionsIndexName), false); err != nil {
+			return nil, err
+		}
+	}
+	if !cfg.noLock && !toStdout {
+		lock, err := lockOutput(cfg.output, cfg.lockWait)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Close()
+	}
+	if cfg.globalConcurrency > 0 {
+		slot, err := acquireSlot(cfg.slotDir, cfg.globalConcurrency, cfg.logger)
+		if err != nil {
+			return nil, err
+		}
+		defer slot.Close()
+	}
+
+	var c *captureRun // once prepared
+	if cfg.reproOnFailure {
+		defer func() {
+			if err == nil {
+				return
+			}
+			phase, qemuArgs := "preparing", args
+			if c != nil {
+				qemuArgs = c.args
+				if c.prog != nil {
+					phase = c.prog.get()
+				}
+			}
+			p := filepath.Join(filepath.Dir(cfg.output), "repro.sh")
+			target, werr := resolveOutputPath(p, cfg.followSymlinks)
+			if werr == nil {
+				werr = writeRepro(target, cfg.qemu, redact.args(qemuArgs), redact.args(cfg.args), phase, errors.New(redact.String(err.Error())))
+			}
+			if werr != nil {
+				cfg.logger.Printf("WARNING: failed to write %s: %v", p, werr)
+				return
+			}
+			cfg.logger.Printf("wrote %s to reproduce the failure", p)
+		}()
+	}
+
+	if cfg.logFile != "" {
+		f, err := cfg.createLog(cfg.logFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create log file: %w", err)
+		}
+		defer f.Close()
+		cfg.logger = log.New(io.MultiWriter(cfg.logger.Writer(), redact.writer(f)), cfg.logger.Prefix(), cfg.logger.Flags())
+	}
+
+	var waitTCPAddr string
+	if cfg.waitTCPGuest != 0 {
+		hostPort, err := freeTCPPort()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick a host port: %w", err)
+		}
+		args, err = injectHostfwd(args, hostPort, cfg.waitTCPGuest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to forward guest port %d: %w", cfg.waitTCPGuest, err)
+		}
+		waitTCPAddr = fmt.Sprintf("127.0.0.1:%d", hostPort)
+		cfg.logger.Printf("forwarding host port %d to guest port %d", hostPort, cfg.waitTCPGuest)
+	}
+
+	var readyHTTPURL string
+	if cfg.readyHTTP != nil {
+		guestPort, err := guestHTTPPort(cfg.readyHTTP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -ready-http: %w", err)
+		}
+		hostPort, err := freeTCPPort()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick a host port: %w", err)
+		}
+		args, err = injectHostfwd(args, hostPort, guestPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to forward guest port %d: %w", guestPort, err)
+		}
+		readyHTTPURL = forwardedURL(cfg.readyHTTP, hostPort)
+		cfg.logger.Printf("forwarding host port %d to guest port %d", hostPort, guestPort)
+	}
+
+	if cfg.compatMachine != "" {
+		if machines, err := supportedMachines(cfg.qemu); err != nil {
+			cfg.logger.Printf("WARNING: failed to list supported machines: %v", err)
+		} else if !slices.Contains(machines, cfg.compatMachine) {
+			cfg.logger.Printf("WARNING: %s doesn't support machine %q; the capture may fail", cfg.qemu, cfg.compatMachine)
+		}
+		args = setMachineType(args, cfg.compatMachine)
+	}
+	if cfg.markerFD {
+		args = append(args, markerPortArgs("null")...)
+	}
+	if cfg.stableDeviceOrder {
+		if args, err = pinDeviceAddrs(args); err != nil {
+			return nil, err
+		}
+	}
+	devices := argsDevices(args)
+
+	accel := argsAccel(args)
+	if cfg.accel != "" {
+		if accel == "" {
+			args = append(args, "-accel", cfg.accel)
+			accel = cfg.accel
+		} else if accel != cfg.accel {
+			return nil, fmt.Errorf("args select accelerator %s, not %s given by -accel", accel, cfg.accel)
+		}
+	}
+	var icount *icountInfo
+	if cfg.icountShift != nil {
+		icount = newICountInfo(*cfg.icountShift, 0)
+		if args, err = setICount(args, icount.Option); err != nil {
+			return nil, err
+		}
+		accel = argsAccel(args)
+		cfg.logger.Printf("running the guest with -icount %s for a deterministic state; restore it with the same -icount", icount.Option)
+	}
+	if accel != "" {
+		cfg.logger.Printf("capturing with %s; the state may not restore under another accelerator", accel)
+	}
+
+	var fakeTimeEnv []string
+	if !cfg.fakeTime.IsZero() {
+		args = setRTCBase(args, cfg.fakeTime)
+		if lib := findLibfaketime(); lib != "" {
+			fakeTimeEnv = faketimeEnv(cfg.fakeTime, lib)
+			cfg.debugf("using %s for QEMU", lib)
+		} else {
+			cfg.logger.Printf("WARNING: libfaketime isn't found; only the guest RTC is set to %v", cfg.fakeTime)
+		}
+	}
+
+	var (
+		script    []byte
+		steps     []step
+		firstStep int
+	)
+	if cfg.preScript != "" {
+		var err error
+		script, err = os.ReadFile(cfg.preScript)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pre-script: %w", err)
+		}
+		steps, err = parsePreScript(script)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pre-script: %w", err)
+		}
+	}
+	if cfg.portableMemory {
+		if err := checkPortableMemory(args); err != nil {
+			return nil, fmt.Errorf("-portable-memory: %w", err)
+		}
+	}
+	if cfg.maxGuestMiB > 0 {
+		mem, err := guestMemoryMiB(args)
+		if err != nil {
+			return nil, err
+		}
+		if mem > cfg.maxGuestMiB {
+			return nil, fmt.Errorf("guest RAM of %d MiB exceeds -max-guest-memory %d MiB and would make a state of up to that size; give the guest less (e.g. -m %dM in args)", mem, cfg.maxGuestMiB, cfg.maxGuestMiB)
+		}
+	}
+	if cfg.migrateTimeoutPerGB > 0 {
+		if mem, err := guestMemoryMiB(args); err != nil {
+			cfg.logger.Printf("WARNING: can't scale the migration timeout to the guest RAM (%v); using -migrate-attempt-timeout %v", err, cfg.migrateTimeout)
+		} else {
+			cfg.migrateTimeout = scaledMigrateTimeout(mem, cfg.migrateTimeoutPerGB)
+			cfg.logger.Printf("migration attempt timeout: %v for %d MiB of guest RAM", cfg.migrateTimeout, mem)
+		}
+	}
+	var agentNetwork, agentAddr string
+	if cfg.waitGuestAgent || len(cfg.guestExec) > 0 || len(cfg.collectLogs) > 0 || len(cfg.collectGuestFiles) > 0 {
+		var ok bool
+		if agentNetwork, agentAddr, ok = guestAgentAddr(args); !ok {
+			return nil, errors.New("-wait-guest-agent, -guest-exec, -collect-logs and -collect-guest-file need a guest agent socket in args (-chardev socket,id=ID,path=PATH,server=on,wait=off -device virtserialport,chardev=ID,name=" + guestAgentPort + ")")
+		}
+	}
+	if cfg.memoryGrowth && agentAddr == "" {
+		if agentNetwork, agentAddr, _ = guestAgentAddr(args); agentAddr == "" {
+			cfg.logger.Printf("WARNING: not measuring the memory growth; -memory-growth needs a guest agent socket in args")
+			cfg.memoryGrowth = false
+		}
+	}
+	if cfg.readyInstructions > 0 {
+		if icount == nil {
+			return nil, errors.New("-ready-instructions needs -icount")
+		}
+		if _, _, ok := qmpAddr(args); !ok {
+			return nil, errors.New("-ready-instructions needs a QMP server socket in args")
+		}
+	}
+	if cfg.readyQMPEvent != nil {
+		if _, _, ok := qmpAddr(args); !ok {
+			return nil, errors.New("-ready-qmp-event needs a QMP server socket in args")
+		}
+	}
+	if cfg.maxDowntime > 0 {
+		if _, _, ok := qmpAddr(args); !ok {
+			return nil, errors.New("-max-downtime-ms needs a QMP server socket in args")
+		}
+	}
+	if cfg.balloonMiB > 0 {
+		if !hasBalloon(args) {
+			return nil, errors.New("-balloon needs a virtio-balloon device in args")
+		}
+		if _, _, ok := qmpAddr(args); !ok {
+			return nil, errors.New("-balloon needs a QMP server socket in args")
+		}
+	}
+	plan, err := planMigration(args, toStdout, cfg.memoryBuffer > 0, cfg.compress)
+	if err != nil {
+		return nil, err
+	}
+	cfg.debugf("migration: %v", plan)
+	hostMem := currentHostMemory(args)
+	// args[incomingFrom:incomingTo] restore the VM, see restoring.
+	incomingFrom := len(args)
+	if cfg.resume {
+		j, err := readJournal(journalPath(cfg.checkpoint))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read checkpoint journal: %w", err)
+		}
+		for _, m := range hostMemoryMismatches(j.HostMemory, hostMem) {
+			cfg.logger.Printf("WARNING: the checkpoint may not be restorable on this host: %s", m)
+		}
+		for _, m := range deviceOrderMismatches(j.Devices, devices) {
+			cfg.logger.Printf("WARNING: the checkpoint may not be restorable with these args: %s", m)
+		}
+		if j.ICount.option() != icount.option() {
+			return nil, fmt.Errorf("the checkpoint was captured with -icount %q, not %q", j.ICount.option(), icount.option())
+		}
+		firstStep, err = resumePoint(j, script, steps)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resume from %s: %w", cfg.checkpoint, err)
+		}
+		cfg.logger.Printf("resuming from %s after %d completed pre-script steps", cfg.checkpoint, firstStep)
+		args = append(args, "-incoming", "file:"+cfg.checkpoint)
+	}
+	if cfg.shrinkFull != "" {
+		firstStep = len(steps) // run in the first pass
+		args = append(args, "-incoming", "file:"+cfg.shrinkFull)
+	}
+	if cfg.fromState != "" {
+		args = append(args, "-incoming", "file:"+cfg.fromState)
+	}
+	incomingTo := len(args)
+	// The VM is restored instead of booted.
+	restoring := cfg.resume || cfg.shrinkFull != "" || cfg.fromState != ""
+	pidPath := pidfileArg(args)
+	if cfg.pidFile != "" && pidPath != cfg.pidFile {
+		if pidPath != "" {
+			return nil, fmt.Errorf("-pidfile %s conflicts with -pidfile %s in args", cfg.pidFile, pidPath)
+		}
+		pidPath = cfg.pidFile
+		args = append(args, "-pidfile", pidPath)
+	}
+	if pidPath != "" {
+		// Don't take the PID of a previous run for the current one.
+		if err := os.Remove(pidPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	cfg.logger.Println(redact.args(args))
+
+	c = newCaptureRun(cfg)
+	c.args, c.incomingFrom, c.incomingTo, c.restoring = args, incomingFrom, incomingTo, restoring
+	c.toStdout, c.plan, c.pidPath, c.fakeTimeEnv = toStdout, plan, pidPath, fakeTimeEnv
+	c.hostMem, c.devices, c.accel, c.icount = hostMem, devices, accel, icount
+	c.script, c.steps, c.firstStep = script, steps, firstStep
+	c.agentNetwork, c.agentAddr = agentNetwork, agentAddr
+	c.waitTCPAddr, c.readyHTTPURL = waitTCPAddr, readyHTTPURL
+	defer func() { c.close(err) }()
+
+	if err := c.launch(); err != nil {
+		return nil, err
+	}
+	c.waitReady()
+	go func() {
+		<-c.snapshotCh
+		m, closeMonitor, err := c.openMonitor()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		defer closeMonitor()
+		if err := c.snapshot(m); err != nil {
+			c.fail(err)
+			return
+		}
+		close(c.doneCh)
+	}()
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.finalize()
+}
+
+// captureRun is a capture of a prepared config in phases: launch starts
+// QEMU, waitReady watches the guest until it's ready, snapshot provisions
+// the ready guest and migrates its state over the monitor, and finalize
+// writes the outputs from what QEMU left. The phases running alongside
+// report their failure to fail; wait returns the first one.
+type captureRun struct {
+	cfg    config
+	redact redactor
+
+	// args are the QEMU args as prepared by captureOnce.
+	// args[incomingFrom:incomingTo] restore the VM, see restoring.
+	args                     []string
+	incomingFrom, incomingTo int
+	// restoring is set if the VM is restored instead of booted.
+	restoring bool
+	// toStdout is set with -output -, when there's no file to finalize.
+	toStdout     bool
+	plan         migrationPlan
+	pidPath      string
+	fakeTimeEnv  []string
+	hostMem      hostMemory
+	devices      []deviceInfo
+	accel        string
+	icount       *icountInfo
+	script       []byte
+	steps        []step
+	firstStep    int
+	agentNetwork string
+	agentAddr    string
+	waitTCPAddr  string
+	readyHTTPURL string
+
+	// Set by launch.
+	tempDir     string
+	partial     string
+	stateBuf    *stateBuffer
+	stateBufW   *os.File // passed to QEMU and closed
+	markerR     *os.File
+	cmd         *exec.Cmd
+	stdin       io.Writer
+	stdout      io.Reader
+	stderrTail  *tailBuffer
+	con         *console
+	rawConsole  io.Writer
+	consolePath string
+	start       time.Time
+	timings     *timingRecorder
+	stages      *timingRecorder
+	ooms        oomRecorder
+	prog        *progress
+	// runCtx is done once -max-total-time runs out, and bootCtx once the
+	// guest is ready or the boot timed out.
+	runCtx     context.Context
+	bootCtx    context.Context
+	cancelBoot context.CancelFunc
+	// qemuPID is the PID of the emulator, which differs from the child's when
+	// QEMU is started by a launcher. It's set before pidKnown is closed.
+	qemuPID  int
+	pidKnown chan struct{}
+
+	errCh chan error
+	// warningErr keeps a -warning-as-error match printed after the
+	// snapshot, when fail isn't watched anymore.
+	warningErr chan error
+	// With -dump, a boot timeout is sent to dumpTimeout to dump the guest
+	// memory before failing.
+	dumpTimeout  chan error
+	snapshotCh   chan struct{} // closed by ready
+	snapshotOnce sync.Once
+	doneCh       chan struct{} // closed once QEMU is told to quit
+
+	// Set by ready and snapshot.
+	readyAfter     time.Duration
+	screen         string
+	ballooned      *balloonInfo
+	migrateTime    time.Duration
+	migratePhases  *migrationPhases  // seen through QMP
+	downtime       *time.Duration    // reported by QMP
+	collected      []string          // logs copied from the guest
+	guestCopies    map[string]string // -collect-guest-file copies by guest path
+	preScriptSteps []stepTiming
+	grown          *memoryGrowth
+
+	// cleanups are run in reverse by close, which sets err to the error
+	// of the capture first.
+	cleanups []func()
+	err      error
+}
+
+// newCaptureRun returns the run of cfg, whose fields set by captureOnce
+// are left to the caller.
+func newCaptureRun(cfg config) *captureRun {
+	return &captureRun{
+		cfg:         cfg,
+		redact:      cfg.redactor(),
+		args:        cfg.args,
+		pidKnown:    make(chan struct{}),
+		errCh:       make(chan error, 1),
+		warningErr:  make(chan error, 1),
+		dumpTimeout: make(chan error, 1),
+		snapshotCh:  make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+}
+
+// fail reports the failure of the capture, unless one is reported already.
+func (c *captureRun) fail(err error) {
+	select {
+	case c.errCh <- err:
+	default:
+	}
+}
+
+// ready starts the snapshot once.
+func (c *captureRun) ready(reason string) {
+	c.snapshotOnce.Do(func() {
+		c.cfg.logger.Println(reason)
+		c.readyAfter = time.Since(c.start)
+		close(c.snapshotCh)
+	})
+}
+
+// onClose adds f to the cleanups run by close.
+func (c *captureRun) onClose(f func()) {
+	c.cleanups = append(c.cleanups, f)
+}
+
+// close runs the cleanups of the capture that ended with err.
+func (c *captureRun) close(err error) {
+	c.err = err
+	for i := len(c.cleanups) - 1; i >= 0; i-- {
+		c.cleanups[i]()
+	}
+}
+
+// launch starts QEMU with the console, the failure detection on it and the
+// progress reporting set up.
+func (c *captureRun) launch() error {
+	cfg := &c.cfg
+	tempDir, err := os.MkdirTemp(cfg.tempDir, "get-qemu-state-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	c.tempDir = tempDir
+	cfg.debugf("using temp dir %s", tempDir)
+	if cfg.keepPartial {
+		c.onClose(func() { cfg.logger.Printf("keeping temp dir %s", tempDir) })
+	} else {
+		c.onClose(func() { os.RemoveAll(tempDir) })
+	}
+
+	if cfg.stageMarkerHelper {
+		dir := filepath.Join(tempDir, "helper")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+		helperArgs, err := stageHelper(dir)
+		if err != nil {
+			return fmt.Errorf("failed to stage the marker helper: %w", err)
+		}
+		c.args = append(c.args, helperArgs...)
+		cfg.markers = append(cfg.markers, helperToken)
+		cfg.logger.Printf("staged %s for the guest (9p mount tag %q)", helperName, helperMountTag)
+	}
+
+	// The state is written next to the output and renamed once QEMU exits
+	// so that the output never contains an incomplete state.
+	if cfg.cleanStalePartials && !c.toStdout {
+		if err := cleanStalePartials(cfg.output, cfg.logger); err != nil {
+			return fmt.Errorf("failed to clean stale partial states: %w", err)
+		}
+	}
+	partial := partialPath(cfg.output)
+	c.partial = partial
+	if !cfg.keepPartial {
+		c.onClose(func() { os.Remove(partial) })
+		if c.plan.compress {
+			c.onClose(func() { os.Remove(compressingPath(partial)) })
+		}
+	}
+	if cfg.memoryBuffer > 0 {
+		if c.stateBuf, c.stateBufW, err = newStateBuffer(cfg.memoryBuffer, partial); err != nil {
+			return fmt.Errorf("failed to create the state buffer: %w", err)
+		}
+		// The buffer ends once QEMU's copy is closed too.
+		c.onClose(func() { c.stateBufW.Close() })
+	}
+
+	launchArgs := c.args
+	if cfg.readyInstructions > 0 {
+		// Restores don't record; args keep the option to restore with.
+		launchArgs = replaceICount(c.args, c.icount.Option+","+replayFileOption(filepath.Join(tempDir, "icount.replay")))
+	}
+	var markerW *os.File
+	if cfg.markerFD {
+		if c.markerR, markerW, err = os.Pipe(); err != nil {
+			return err
+		}
+		c.onClose(func() { c.markerR.Close() })
+		// QEMU's copy is the only one left after the start.
+		c.onClose(func() { markerW.Close() })
+		launchArgs = withMarkerPipe(launchArgs, 3) // the first extra file
+	}
+	cmd := exec.Command(cfg.qemu, launchArgs...)
+	c.cmd = cmd
+	if markerW != nil {
+		cmd.ExtraFiles = []*os.File{markerW}
+	}
+	// Don't wait for the output of children left behind by a launcher.
+	cmd.WaitDelay = time.Second
+	if c.fakeTimeEnv != nil {
+		cmd.Env = append(os.Environ(), c.fakeTimeEnv...)
+	}
+
+	closeSlave := func() {}
+	if cfg.pty {
+		master, slave, err := openPTY()
+		if err != nil {
+			return fmt.Errorf("failed to allocate pty: %w", err)
+		}
+		c.onClose(func() { master.Close() })
+		// The pty is the controlling terminal of QEMU in a new session.
+		cmd.Stdin, cmd.Stdout = slave, slave
+		setControllingTerminal(cmd)
+		c.stdin, c.stdout = master, ptyReader{master}
+		// The console reaches EOF only once no process holds the slave.
+		closeSlave = func() { slave.Close() }
+		c.onClose(closeSlave)
+	} else {
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		c.stdin, c.stdout = in, out
+	}
+
+	c.stderrTail = &tailBuffer{max: 2048}
+	var errOut io.Writer = io.MultiWriter(os.Stderr, c.stderrTail)
+	if cfg.qemuStderrFile != "" {
+		f, err := cfg.createLog(cfg.qemuStderrFile)
+		if err != nil {
+			return fmt.Errorf("failed to create QEMU stderr file: %w", err)
+		}
+		c.onClose(func() { f.Close() })
+		errOut = io.MultiWriter(errOut, f)
+	}
+	errOut = c.redact.writer(errOut)
+	errCon := newConsole(errOut)
+	cmd.Stderr = errCon
+
+	c.consolePath = cfg.consoleFile
+	if c.consolePath == "" && (cfg.readyHelper != "" || cfg.onReady != "") {
+		// The helper and -on-ready are promised a console log even if the
+		// user didn't ask for one.
+		c.consolePath = filepath.Join(tempDir, "console.log")
+	}
+	var consoleOut io.Writer = os.Stdout
+	if cfg.stdout != nil {
+		consoleOut = cfg.stdout
+	}
+	echo := newEchoWriter(consoleOut, cfg.logger)
+	c.onClose(func() { echo.Close(time.Second) })
+	consoleOut = echo
+	if cfg.echoFilter != nil || cfg.echoExclude != nil {
+		f := &echoFilter{w: consoleOut, include: cfg.echoFilter, exclude: cfg.echoExclude}
+		c.onClose(func() { f.Flush() })
+		consoleOut = f
+	}
+	if c.consolePath != "" {
+		f, err := cfg.createLog(c.consolePath)
+		if err != nil {
+			return fmt.Errorf("failed to create console file: %w", err)
+		}
+		c.onClose(func() { f.Close() })
+		consoleOut = io.MultiWriter(consoleOut, f)
+	}
+	con := newConsole(consoleOut)
+	c.con = con
+	if cfg.consoleRawFile != "" {
+		f, err := cfg.createLog(cfg.consoleRawFile)
+		if err != nil {
+			return fmt.Errorf("failed to create raw console file: %w", err)
+		}
+		c.onClose(func() { f.Close() })
+		c.rawConsole = f
+	}
+
+	c.start = time.Now()
+	c.timings = newTimingRecorder(c.start, cfg.timingPatterns)
+	if len(cfg.timingPatterns) > 0 {
+		con.addLineHook(c.timings.line)
+	}
+	c.stages = newTimingRecorder(c.start, bootStagePatterns)
+	if cfg.bootBreakdown != "" {
+		con.addLineHook(c.stages.line)
+	}
+
+	con.addLineHook(func(line string) {
+		process, ok := oomKill(line)
+		if !ok {
+			return
+		}
+		c.ooms.add(process)
+		if cfg.oomPolicy == "fail" {
+			c.fail(fmt.Errorf("guest ran out of memory (%s); give it more memory (-m in args)", line))
+			return
+		}
+		cfg.logger.Printf("WARNING: guest ran out of memory; the state may be broken: %s", line)
+	})
+
+	if _, _, ok := qmpAddr(c.args); !ok {
+		// HMP is expected on stdio; QEMU greets with QMP there instead if args
+		// put QMP on stdio (e.g. -qmp stdio), which would never answer.
+		con.addLineHook(func(line string) {
+			if strings.HasPrefix(strings.TrimSpace(line), `{"QMP":`) {
+				c.fail(errors.New("monitor protocol mismatch: expected HMP, got QMP on stdio; put QMP on a socket (-qmp unix:PATH,server=on,wait=off) or remove it from args"))
+			}
+		})
+	}
+
+	if accels := accelCandidates(c.args); len(accels) == 1 && accels[0] != "tcg" {
+		// QEMU falls back by itself if args give alternatives.
+		errCon.addLineHook(func(line string) {
+			if accelFailurePattern.MatchString(line) {
+				c.fail(&accelError{accel: accels[0], line: line})
+			}
+		})
+	}
+
+	for _, re := range cfg.warningErrors {
+		errCon.addLineHook(func(line string) {
+			if !re.MatchString(line) {
+				return
+			}
+			err := fmt.Errorf("QEMU warned %q, which -warning-as-error %q makes an error", line, re)
+			c.fail(err)
+			select {
+			case c.warningErr <- err:
+			default:
+			}
+		})
+	}
+
+	if len(cfg.missingFilePatterns) > 0 {
+		detectMissing := func(line string) {
+			if p, ok := missingFile(cfg.missingFilePatterns, line); ok {
+				c.fail(fmt.Errorf("QEMU couldn't find %q: %s", p, line))
+			}
+		}
+		con.addLineHook(detectMissing)
+		errCon.addLineHook(detectMissing)
+	}
+
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	if !cfg.deadline.IsZero() {
+		runCtx, cancelRun = context.WithDeadline(context.Background(), cfg.deadline)
+	}
+	c.onClose(cancelRun)
+	bootCtx, cancelBoot := context.WithCancel(runCtx)
+	c.onClose(cancelBoot)
+	c.runCtx, c.bootCtx, c.cancelBoot = runCtx, bootCtx, cancelBoot
+	if cfg.firstOutputTimeout > 0 {
+		go func() {
+			select {
+			case <-con.firstOutput:
+			case <-bootCtx.Done():
+			case <-time.After(cfg.firstOutputTimeout):
+				c.fail(fmt.Errorf("QEMU printed nothing within %v; check that the args enable a console on stdio (e.g. -nographic)", cfg.firstOutputTimeout))
+				cancelBoot()
+			}
+		}()
+	}
+	for _, k := range cfg.autokeys {
+		w := con.watch(k.match)
+		go func() {
+			if err := con.wait(bootCtx, w); err != nil {
+				return // booted without the prompt
+			}
+			cfg.logger.Printf("detected %q; sending %q", k.match, k.keys)
+			if _, err := io.WriteString(c.stdin, k.keys); err != nil {
+				cfg.logger.Printf("WARNING: failed to send %q: %v", k.keys, err)
+			}
+		}()
+	}
+
+	bootMenuPrompts, bootMenuKey := cfg.bootMenuPrompts, cfg.bootMenuKey
+	if bootMenuPrompts == nil {
+		bootMenuPrompts = defaultBootMenuPrompts
+	}
+	if bootMenuKey == "" {
+		bootMenuKey = defaultBootMenuKey
+	}
+	watchBootMenu(bootCtx, con, bootMenuPrompts, cfg.bootMenuPolicy, bootMenuKey, c.stdin, cfg.logger, c.fail)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start: %w", err)
+	}
+	closeSlave()
+	if markerW != nil {
+		markerW.Close()
+	}
+
+	c.qemuPID = cmd.Process.Pid
+	if c.pidPath != "" {
+		go func() {
+			defer close(c.pidKnown)
+			ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+			defer cancel()
+			pid, err := readPIDFile(ctx, c.pidPath)
+			if err != nil {
+				cfg.logger.Printf("WARNING: QEMU didn't write %s; using the child PID %d", c.pidPath, c.qemuPID)
+				return
+			}
+			cfg.debugf("QEMU PID is %d (child PID %d)", pid, c.qemuPID)
+			c.qemuPID = pid
+		}()
+	} else {
+		close(c.pidKnown)
+	}
+
+	if len(cfg.cpuAffinity) > 0 {
+		go func() {
+			<-c.pidKnown
+			if err := setAffinity(c.qemuPID, cfg.cpuAffinity); err != nil {
+				cfg.logger.Printf("WARNING: failed to set the CPU affinity of QEMU: %v", err)
+				return
+			}
+			cfg.debugf("pinned QEMU (PID %d) to CPUs %v", c.qemuPID, cfg.cpuAffinity)
+		}()
+	}
+	if cfg.nice != nil || cfg.ioprio != 0 {
+		go func() {
+			<-c.pidKnown
+			if err := setPriority(c.qemuPID, cfg.nice, cfg.ioprio); err != nil {
+				cfg.logger.Printf("WARNING: failed to set the priority of QEMU: %v", err)
+				return
+			}
+			cfg.debugf("set the priority of QEMU (PID %d)", c.qemuPID)
+		}()
+	}
+
+	prog := newProgress(c.start, con, cfg.logger)
+	c.prog = prog
+	if !cfg.deadline.IsZero() {
+		go func() {
+			<-runCtx.Done()
+			if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+				// QEMU and the host commands are killed on the way out.
+				c.fail(fmt.Errorf("-max-total-time ran out while %s", prog.get()))
+			}
+		}()
+	}
+	if cfg.progressInterval > 0 {
+		progCtx, cancelProg := context.WithCancel(context.Background())
+		c.onClose(cancelProg)
+		go prog.run(progCtx, cfg.progressInterval, cfg.maxProgressLines)
+	}
+	if cfg.progressFile != "" {
+		fileCtx, stopFile := context.WithCancel(context.Background())
+		fileDone := make(chan struct{})
+		go func() {
+			defer close(fileDone)
+			prog.runFile(fileCtx, cfg.progressFile, 500*time.Millisecond)
+		}()
+		c.onClose(func() {
+			stopFile()
+			<-fileDone
+			if !cfg.keepPartial {
+				os.Remove(cfg.progressFile)
+				return
+			}
+			if c.err != nil {
+				prog.set("failed")
+			} else {
+				prog.set("done")
+			}
+			if werr := prog.writeFile(cfg.progressFile); werr != nil {
+				cfg.logger.Printf("WARNING: failed to write the progress file: %v", werr)
+			}
+		})
+	}
+	return nil
+}
+
+// waitReady watches the launched guest and the console until the guest is
+// ready, calling ready, or the boot fails.
+func (c *captureRun) waitReady() {
+	cfg := &c.cfg
+	if cfg.bootTimeout > 0 {
+		go func() {
+			if cfg.firstOutputTimeout > 0 {
+				// The boot timeout starts over with the first output.
+				select {
+				case <-c.con.firstOutput:
+				case <-c.bootCtx.Done():
+					return
+				}
+			}
+			select {
+			case <-time.After(cfg.bootTimeout):
+				err := fmt.Errorf("guest didn't become ready within %v", cfg.bootTimeout)
+				if cfg.dump != "" {
+					// Dump the stuck guest for analysis before failing.
+					c.dumpTimeout <- err
+					c.ready(err.Error())
+					return
+				}
+				c.fail(err)
+				c.cancelBoot()
+			case <-c.bootCtx.Done():
+			}
+		}()
+	}
+	go func() {
+		<-c.snapshotCh
+		c.cancelBoot()
+	}()
+
+	useMarker := cfg.watchReadiness(readiness{
+		ctx:          c.bootCtx,
+		con:          c.con,
+		start:        c.start,
+		args:         c.args,
+		restoring:    c.restoring,
+		tcpAddr:      c.waitTCPAddr,
+		httpURL:      c.readyHTTPURL,
+		agentNetwork: c.agentNetwork,
+		agentAddr:    c.agentAddr,
+		consolePath:  c.consolePath,
+		markerR:      c.markerR,
+		pidKnown:     c.pidKnown,
+		qemuPID:      &c.qemuPID,
+		icount:       c.icount,
+		ready:        c.ready,
+		fail:         c.fail,
+	})
+	go func() {
+		var dst io.Writer = c.con
+		if useMarker && !cfg.markerFD {
+			ms := newMarkerScanner(c.con, cfg.markers, cfg.markerCount, func(m string) {
+				c.ready("detected marker")
+			})
+			if cfg.normalizeCRLF {
+				ms.normalizeCRLF()
+			}
+			if cfg.bootGate != nil {
+				ms.gate = cfg.bootGate
+				ms.onGateOpen = func(line string) {
+					cfg.logger.Printf("boot started (%q); matching the markers from now on", line)
+				}
+			}
+			ms.onMatch = func(m string, n int) {
+				cfg.logger.Printf("marker %q matched (%d/%d)", m, n, cfg.markerCount)
+			}
+			dst = ms
+		}
+		var dec consoleDecoder
+		if cfg.consoleDecode != "" {
+			dec = consoleDecoders[cfg.consoleDecode](dst)
+			dst = dec
+		}
+		if c.rawConsole != nil {
+			dst = io.MultiWriter(c.rawConsole, dst)
+		}
+		_, err := io.Copy(dst, c.stdout)
+		if err == nil && dec != nil {
+			err = dec.Flush()
+		}
+		if err != nil {
+			c.fail(fmt.Errorf("failed to copy stdout: %w", err))
+			return
+		}
+		select {
+		case <-c.snapshotCh:
+		case <-time.After(100 * time.Millisecond):
+			// Give a diagnosis found in the stderr of the exiting QEMU
+			// (e.g. a missing file) a chance to be reported instead.
+			c.fail(errors.New("QEMU closed the console before the guest became ready"))
+		}
+	}()
+}
+
+// openMonitor connects to the monitor of the launched QEMU, QMP if args
+// have a QMP server socket, HMP on stdio otherwise.
+func (c *captureRun) openMonitor() (_ monitor, closeMonitor func(), _ error) {
+	cfg := &c.cfg
+	if !c.plan.qmp {
+		cfg.logger.Printf("using HMP on stdio (no QMP server socket in args)")
+		if cfg.migrateAttempts > 1 {
+			cfg.debugf("migration retries need QMP; migrating once")
+		}
+		return &hmp{w: c.stdin, con: c.con, compress: c.plan.compress}, func() {}, nil
+	}
+	network, addr, _ := qmpAddr(c.args)
+	cfg.logger.Printf("using QMP at %s (found a QMP server socket in args)", addr)
+	dialCtx, cancel := context.WithTimeout(c.runCtx, 10*time.Second)
+	q, err := dialQMP(dialCtx, network, addr)
+	cancel()
+	if err != nil {
+		return nil, nil, err
+	}
+	q.migrateAttempts, q.migrateTimeout, q.migrateBackoff = cfg.migrateAttempts, cfg.migrateTimeout, cfg.migrateBackoff
+	q.logger = cfg.logger
+	q.onMigrationProgress = c.prog.setPercent
+	return q, func() { q.Close() }, nil
+}
+
+// snapshot provisions the ready guest over m, migrates its state as
+// planned (or dumps the guest memory) and tells QEMU to quit.
+func (c *captureRun) snapshot(m monitor) error {
+	cfg := &c.cfg
+	ctx, prog := c.runCtx, c.prog
+	if c.restoring {
+		if err := m.waitRunning(ctx); err != nil {
+			return err
+		}
+	}
+	select {
+	case err := <-c.dumpTimeout:
+		prog.set("dumping guest memory")
+		cfg.logger.Printf("dumping the guest memory to %s", cfg.dump)
+		if derr := m.dumpGuestMemory(ctx, cfg.dump); derr != nil {
+			return fmt.Errorf("%w (and failed to dump the guest memory: %v)", err, derr)
+		}
+		return fmt.Errorf("%w; the guest memory is dumped to %s", err, cfg.dump)
+	default:
+	}
+	var done func(i int) error
+	if cfg.checkpoint != "" {
+		digest := scriptDigest(c.script)
+		done = func(i int) error {
+			if i+1 == len(c.steps) || c.steps[i+1].expect != "" {
+				// The final snapshot follows, or the output awaited by
+				// the next step may be printed before the checkpoint.
+				return nil
+			}
+			cfg.logger.Printf("checkpointing to %s", cfg.checkpoint)
+			if err := m.checkpoint(ctx, cfg.checkpoint); err != nil {
+				return fmt.Errorf("failed to checkpoint: %w", err)
+			}
+			if err := cfg.applyMode(cfg.checkpoint); err != nil {
+				return err
+			}
+			jp := journalPath(cfg.checkpoint)
+			if err := writeJournal(jp, journal{PreScriptDigest: digest, CompletedSteps: i + 1, HostMemory: c.hostMem, Devices: c.devices, ICount: c.icount}); err != nil {
+				return err
+			}
+			return cfg.applyMode(jp)
+		}
+	}
+	if cfg.screenText && !c.restoring {
+		sctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		text, err := screenText(sctx, m, c.tempDir)
+		cancel()
+		switch {
+		case err != nil:
+			cfg.logger.Printf("WARNING: failed to capture the screen text: %v", err)
+		case text == "":
+			cfg.logger.Printf("WARNING: the screen has no text; the display may not be in VGA text mode")
+		default:
+			c.screen = text
+		}
+	}
+	if cfg.onReady != "" {
+		<-c.pidKnown
+		env := []string{
+			fmt.Sprintf("QEMU_PID=%d", c.qemuPID),
+			"QEMU_CONSOLE_LOG=" + c.consolePath,
+		}
+		env = append(env, helperEnv(c.args)...)
+		if err := runLogged(ctx, "on-ready", cfg.onReady, env, cfg.logger); err != nil {
+			if cfg.onReadyRequired {
+				return fmt.Errorf("-on-ready command failed: %w", err)
+			}
+			cfg.logger.Printf("WARNING: -on-ready command failed: %v", err)
+		}
+	}
+	if cfg.migratePrecheck {
+		cfg.logger.Println("checking that the VM can be migrated")
+		pctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := m.precheckMigration(pctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("migration precheck failed: %w", err)
+		}
+	}
+	var memBefore *guestMemory
+	if cfg.memoryGrowth {
+		if mem, err := readGuestMemory(ctx, c.agentNetwork, c.agentAddr); err != nil {
+			cfg.logger.Printf("WARNING: not measuring the memory growth; failed to read the guest memory usage: %v", err)
+		} else {
+			memBefore = &mem
+		}
+	}
+	prog.set("provisioning")
+	timings, err := runPreScript(ctx, c.steps, c.firstStep, c.con, c.stdin, cfg.expectTimeout, cfg.logger, done)
+	c.preScriptSteps = timings
+	if err != nil {
+		return err
+	}
+	if len(cfg.guestExec) > 0 || len(cfg.collectLogs) > 0 || len(cfg.collectGuestFiles) > 0 {
+		if err := c.collectFromGuest(ctx); err != nil {
+			return err
+		}
+	}
+	if memBefore != nil {
+		if mem, err := readGuestMemory(ctx, c.agentNetwork, c.agentAddr); err != nil {
+			cfg.logger.Printf("WARNING: not measuring the memory growth; failed to read the guest memory usage: %v", err)
+		} else {
+			c.grown = memoryGrowthOf(*memBefore, mem)
+			cfg.logger.Printf("guest memory growth since readiness: %v", c.grown)
+		}
+	}
+	if q, ok := m.(*qmp); ok && cfg.balloonMiB > 0 {
+		prog.set("ballooning")
+		bctx, cancel := context.WithTimeout(ctx, time.Minute)
+		b, err := q.inflateBalloon(bctx, cfg.balloonMiB<<20)
+		cancel()
+		if err != nil {
+			return err
+		}
+		// The guest keeps the memory given up in the state; deflate the
+		// balloon after restoring it to give the memory back.
+		cfg.logger.Printf("guest RAM ballooned from %d MiB to %d MiB", b.BeforeMiB, b.AfterMiB)
+		c.ballooned = b
+	}
+	if cfg.guestShutdownCmd != "" {
+		// The app is shut down last so that nothing else needs it, and
+		// the VM is paused right after so that nothing restarts it.
+		prog.set("shutting down the guest app")
+		cfg.logger.Printf("sending %q and waiting for %q", cfg.guestShutdownCmd, cfg.guestShutdownMarker)
+		shutdown := []step{{send: cfg.guestShutdownCmd}, {expect: cfg.guestShutdownMarker}}
+		if _, err := runPreScript(ctx, shutdown, 0, c.con, c.stdin, cfg.guestShutdownTimeout, cfg.logger, func(int) error { return nil }); err != nil {
+			return fmt.Errorf("guest shutdown command: %w", err)
+		}
+		if err := m.stop(ctx); err != nil {
+			return err
+		}
+	}
+	if cfg.group != nil {
+		prog.set("waiting for the other VMs")
+		if err := cfg.group.wait(ctx, cfg.group.ready); err != nil {
+			return err
+		}
+		if err := m.stop(ctx); err != nil {
+			return err
+		}
+		if err := cfg.group.wait(ctx, cfg.group.stopped); err != nil {
+			return err
+		}
+	}
+	if cfg.dump != "" {
+		prog.set("dumping guest memory")
+		cfg.logger.Printf("dumping the guest memory to %s instead of taking the snapshot", cfg.dump)
+		if err := m.dumpGuestMemory(ctx, cfg.dump); err != nil {
+			return fmt.Errorf("failed to dump the guest memory: %w", err)
+		}
+	} else if !cfg.dryRun {
+		if err := c.migrate(ctx, m); err != nil {
+			return err
+		}
+	}
+	prog.set("finishing")
+	cfg.logger.Println("finishing QEMU")
+	return m.quit()
+}
+
+// collectFromGuest runs -guest-exec and copies -collect-logs and
+// -collect-guest-file from the guest through the guest agent.
+func (c *captureRun) collectFromGuest(ctx context.Context) error {
+	cfg := &c.cfg
+	dctx, cancel := context.WithTimeout(ctx, time.Minute)
+	g, err := dialGuestAgent(dctx, c.agentNetwork, c.agentAddr)
+	cancel()
+	if err != nil {
+		if len(cfg.guestExec) == 0 && len(cfg.collectLogs) == 0 {
+			// The guest files are only metadata.
+			cfg.logger.Printf("WARNING: not collecting guest files; the guest agent is unavailable: %v", err)
+			return nil
+		}
+		return err
+	}
+	defer g.Close()
+	g.logger = cfg.logger
+	if len(cfg.guestExec) > 0 {
+		c.prog.set("running guest-exec")
+		if err := runGuestExec(ctx, g, cfg.guestExec, cfg.guestExecTimeout); err != nil {
+			return err
+		}
+	}
+	c.prog.set("collecting logs")
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	if c.collected, err = collectLogs(cctx, g, cfg.collectLogs, filepath.Dir(cfg.output)); err != nil {
+		return err
+	}
+	if len(cfg.collectGuestFiles) > 0 {
+		c.prog.set("collecting guest files")
+		fctx, cancel := context.WithTimeout(ctx, time.Minute)
+		c.guestCopies, err = collectGuestFiles(fctx, g, cfg.collectGuestFiles, guestFilesDir(cfg.output))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to store guest files: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrate migrates the state over m as planned and records how it went.
+func (c *captureRun) migrate(ctx context.Context, m monitor) error {
+	cfg := &c.cfg
+	switch c.plan.fdName {
+	case stdoutFDName:
+		q := m.(*qmp)
+		if err := q.sendFD(stdoutFDName, os.Stdout); err != nil {
+			return fmt.Errorf("failed to pass stdout to QEMU: %w", err)
+		}
+		// A failed attempt may have written to stdout already.
+		q.migrateFD, q.migrateAttempts = stdoutFDName, 1
+		cfg.logger.Println("migrating to stdout")
+	case memoryFDName:
+		q := m.(*qmp)
+		err := q.sendFD(memoryFDName, c.stateBufW)
+		c.stateBufW.Close()
+		if err != nil {
+			return fmt.Errorf("failed to pass the state buffer to QEMU: %w", err)
+		}
+		// A failed attempt may have written to the buffer already.
+		q.migrateFD, q.migrateAttempts = memoryFDName, 1
+		cfg.logger.Printf("migrating to memory (up to %d bytes)", cfg.memoryBuffer)
+	default:
+		if q, ok := m.(*qmp); ok && c.plan.compress {
+			// The pipe of a failed attempt may still rename its
+			// state into place.
+			q.migrateCompressed, q.migrateAttempts = true, 1
+		}
+		if c.plan.compress {
+			c.prog.setState(compressingPath(c.partial))
+		} else {
+			c.prog.setState(c.partial)
+		}
+	}
+	c.prog.set("migrating")
+	migrateStart := time.Now()
+	if err := m.migrate(ctx, c.partial); err != nil {
+		return err
+	}
+	c.migrateTime = time.Since(migrateStart)
+	q, ok := m.(*qmp)
+	if !ok || q.lastMigration == nil {
+		return nil
+	}
+	d := time.Duration(q.lastMigration.Downtime) * time.Millisecond
+	c.downtime = &d
+	cfg.logger.Printf("migration downtime: %v", d)
+	if p := q.lastMigration.phases; p != nil {
+		c.migratePhases = p
+		cfg.logger.Printf("migration phases: %v", p)
+	} else {
+		cfg.debugf("migration phases weren't seen; only the total migration time is reported")
+	}
+	if cfg.maxDowntime > 0 && d > cfg.maxDowntime {
+		return fmt.Errorf("migration downtime %v exceeds -max-downtime-ms %d", d, cfg.maxDowntime.Milliseconds())
+	}
+	return nil
+}
+
+// wait waits for QEMU to exit after the snapshot, or kills it on the first
+// failure and returns that.
+func (c *captureRun) wait() error {
+	cfg := &c.cfg
+	select {
+	case err := <-c.errCh:
+		c.cmd.Process.Kill()
+		select {
+		case <-c.pidKnown:
+			if c.qemuPID != c.cmd.Process.Pid {
+				// Not a child of ours; the launcher may have left it behind.
+				killPID(c.qemuPID)
+			}
+		default:
+		}
+		c.cmd.Wait()
+		return err
+	case <-c.doneCh:
+	}
+
+	if err := c.cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return fmt.Errorf("waiting for qemu: %w", err)
+		}
+		// QEMU exiting nonzero after the quit may indicate a problem with
+		// the migration that wasn't reported otherwise.
+		if cfg.requireCleanExit {
+			return fmt.Errorf("QEMU exited with %d after quit; stderr:\n%s", exitErr.ExitCode(), c.stderrTail)
+		}
+		cfg.logger.Printf("WARNING: QEMU exited with %d after quit", exitErr.ExitCode())
+	}
+	select {
+	case err := <-c.warningErr: // the stderr is read to the end by now
+		return err
+	default:
+	}
+	return nil
+}
+
+// finalize writes the outputs from the state QEMU left and returns the
+// result of the capture.
+func (c *captureRun) finalize() (*result, error) {
+	cfg := &c.cfg
+	partial := c.partial
+	var stateBytes []byte
+	if c.stateBuf != nil {
+		// QEMU closed its end of the pipe by exiting at the latest.
+		state, spilled, err := c.stateBuf.wait()
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive the state: %w", err)
+		}
+		if spilled {
+			cfg.logger.Printf("the state exceeds -memory-buffer %d bytes; spilled it to %s", cfg.memoryBuffer, partial)
+		} else {
+			cfg.debugf("received the state of %d bytes in memory", len(state))
+			stateBytes = state
+		}
+	}
+	var (
+		shrunk *shrinkInfo
+		err    error
+	)
+	if cfg.shrinkFull != "" && !cfg.dryRun {
+		if shrunk, err = cfg.keepSmaller(partial, cfg.shrinkFull); err != nil {
+			return nil, fmt.Errorf("failed to keep the smaller state: %w", err)
+		}
+		if shrunk.KeptFull {
+			c.ballooned = nil
+		}
+	}
+	var sections []sectionSize
+	if cfg.sectionSizes > 0 && !cfg.dryRun {
+		all, err := stateSections(partial)
+		if err != nil {
+			cfg.logger.Printf("WARNING: %v", err)
+		} else {
+			var table strings.Builder
+			writeSectionTable(&table, all, cfg.sectionSizes)
+			cfg.logger.Printf("largest sections of the state:\n%s", table.String())
+			sections = all[:min(cfg.sectionSizes, len(all))]
+		}
+	}
+	var hot *hotMap
+	if cfg.hotMap && !cfg.dryRun {
+		if hot, err = writeHotMap(partial, cfg.output); err != nil {
+			cfg.logger.Printf("WARNING: failed to map the hot pages: %v", err)
+			hot = nil
+		} else {
+			cfg.logger.Printf("%d of %d bytes of the guest RAM are hot; readahead list written to %s", hot.HotBytes, hot.TotalBytes, hotMapPath(cfg.output))
+		}
+	}
+	var restoreTime time.Duration
+	if cfg.measureRestore && !cfg.dryRun {
+		c.prog.set("measuring restore")
+		if hot != nil {
+			n, err := prefetchState(partial, hot.Readahead)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the hot pages ahead: %w", err)
+			}
+			cfg.debugf("read %d bytes of hot pages ahead", n)
+		}
+		cfg.logger.Println("restoring the state to measure the restore time")
+		// The state is restored from the checkpoint when resuming, from
+		// the full state when shrinking or from -from-state; don't let it
+		// take precedence.
+		restoreArgs := slices.Delete(slices.Clone(c.args), c.incomingFrom, c.incomingTo)
+		rctx, cancel := context.WithTimeout(c.runCtx, 5*time.Minute)
+		restoreTime, err = measureRestore(rctx, cfg.qemu, restoreArgs, partial, cfg.logger)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore the captured state: %w", err)
+		}
+		cfg.logger.Printf("state restored in %v", restoreTime)
+	}
+	var stateSize int64
+	switch {
+	case cfg.dryRun, c.toStdout:
+	case stateBytes != nil:
+		stateSize = int64(len(stateBytes))
+	case cfg.dump != "":
+		if fi, err := os.Stat(cfg.dump); err == nil {
+			stateSize = fi.Size()
+		}
+	default:
+		if fi, err := os.Stat(partial); err == nil {
+			stateSize = fi.Size()
+		}
+	}
+	var written []string
+	var sectionsIndex, deltaIndex string
+	switch {
+	case cfg.dryRun, c.toStdout:
+	case cfg.dump != "":
+		written = []string{cfg.dump}
+	case cfg.splitBytes > 0:
+		if cfg.chunkMode == "page-aligned" {
+			written, err = splitPageAligned(partial, cfg.output, cfg.splitBytes)
+			if err != nil {
+				// The stream may not be parsable (e.g. an old machine type).
+				cfg.logger.Printf("WARNING: failed to split the state between guest pages (%v); splitting it sequentially", err)
+			}
+		}
+		if written == nil {
+			written, err = splitFile(partial, cfg.output, cfg.splitBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to split state file: %w", err)
+		}
+		cfg.logger.Printf("split the state into %d parts indexed by %s", len(written)-1, splitIndexPath(cfg.output))
+	case cfg.splitSections:
+		written, err = splitSections(partial, sectionsDir(cfg.output))
+		if err != nil {
+			// The stream may not be parsable (e.g. an old machine type).
+			cfg.logger.Printf("WARNING: failed to split the state by section (%v); writing %s instead", err, cfg.output)
+			if err := cfg.rename(partial, cfg.output); err != nil {
+				return nil, fmt.Errorf("failed to finalize state file: %w", err)
+			}
+			written = []string{cfg.output}
+			break
+		}
+		sectionsIndex = written[len(written)-1]
+		cfg.logger.Printf("split the state into %d sections indexed by %s", len(written)-1, sectionsIndex)
+	case cfg.delta:
+		written, err = writeDelta(partial, cfg.fromState, cfg.output)
+		if err != nil {
+			// The streams may not be parsable (e.g. an old machine type).
+			cfg.logger.Printf("WARNING: failed to write the state as a delta (%v); writing the full state to %s instead", err, cfg.output)
+			if err := cfg.rename(partial, cfg.output); err != nil {
+				return nil, fmt.Errorf("failed to finalize state file: %w", err)
+			}
+			written = []string{cfg.output}
+			break
+		}
+		deltaIndex = written[len(written)-1]
+		if fi, err := os.Stat(cfg.output); err == nil {
+			cfg.logger.Printf("wrote %d bytes not shared with %s, indexed by %s", fi.Size(), cfg.fromState, deltaIndex)
+		}
+	case stateBytes != nil:
+		// The partial file keeps the output from being seen incomplete.
+		if err := os.WriteFile(partial, stateBytes, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write state file: %w", err)
+		}
+		if err := cfg.rename(partial, cfg.output); err != nil {
+			return nil, fmt.Errorf("failed to finalize state file: %w", err)
+		}
+		written = []string{cfg.output}
+	default:
+		if err := cfg.rename(partial, cfg.output); err != nil {
+			return nil, fmt.Errorf("failed to finalize state file: %w", err)
+		}
+		written = []string{cfg.output}
+		if cfg.compress {
+			cfg.logger.Printf("the state is compressed with gzip; restore it with -incoming \"exec:gzip -dc %s\"", cfg.output)
+		}
+	}
+	if hot != nil {
+		written = append(written, hotMapPath(cfg.output))
+	}
+	for _, p := range append(written, c.collected...) {
+		if err := cfg.applyMode(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range c.guestCopies {
+		if err := cfg.applyMode(p); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &result{
+		ReadyAfter:    c.readyAfter,
+		MigrateTime:   c.migrateTime,
+		MigratePhases: c.migratePhases,
+		Total:         time.Since(c.start),
+		Timings:       c.timings.result(),
+		ScreenText:    c.screen,
+		Sections:      sections,
+		RestoreTime:   restoreTime,
+		OOMKills:      c.ooms.result(),
+
+		AccelFallbackFrom: cfg.accelFallbackFrom,
+
+		PreScriptSteps: c.preScriptSteps,
+		Shrink:         shrunk,
+		Dump:           cfg.dump,
+		StateBytes:     stateBytes,
+		StateSize:      stateSize,
+		MemoryGrowth:   c.grown,
+	}
+	if boot := cfg.shrinkBoot; boot != nil {
+		// The guest booted in the first -shrink pass.
+		res.ReadyAfter, res.Timings, res.ScreenText = boot.ReadyAfter, boot.Timings, boot.ScreenText
+		res.PreScriptSteps = boot.PreScriptSteps
+		res.OOMKills = append(boot.OOMKills, res.OOMKills...)
+	}
+	if c.downtime != nil {
+		res.Downtime = *c.downtime
+	}
+	if cfg.bootBreakdown != "" {
+		stacks := bootBreakdown(res.ReadyAfter, c.stages.result(), res.Timings, res.PreScriptSteps, res.MigrateTime)
+		if err := writeBootBreakdown(cfg.bootBreakdown, stacks); err != nil {
+			return nil, fmt.Errorf("failed to write the boot breakdown: %w", err)
+		}
+		if err := cfg.applyMode(cfg.bootBreakdown); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.manifest != "" {
+		var hotMap string
+		if hot != nil {
+			hotMap = hotMapPath(cfg.output)
+		}
+		m := cfg.newManifest(res, manifestInputs{
+			args:          c.redact.args(c.args),
+			hostMem:       c.hostMem,
+			devices:       c.devices,
+			accel:         c.accel,
+			icount:        c.icount,
+			balloon:       c.ballooned,
+			downtime:      c.downtime,
+			collected:     c.collected,
+			guestFiles:    c.guestCopies,
+			sectionsIndex: sectionsIndex,
+			deltaIndex:    deltaIndex,
+			hotMap:        hotMap,
+		})
+		if err := writeManifest(cfg.manifest, m); err != nil {
+			return nil, fmt.Errorf("failed to write manifest: %w", err)
+		}
+		if err := cfg.applyMode(cfg.manifest); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,871 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The test binary doubles as the stub QEMU launched by stubConfig and as
+	// get-qemu-state itself launched by runMain.
+	if len(os.Args) > 1 && os.Args[1] == stubQEMUCommand {
+		s, err := newTestStubQEMU()
+		if err == nil {
+			err = s.run()
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if os.Getenv("GET_QEMU_STATE_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs get-qemu-state with args against the stub QEMU and returns
+// its stdout and stderr.
+func runMain(t *testing.T, args ...string) (string, string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	argsJSON := filepath.Join(t.TempDir(), "args.json")
+	if err := os.WriteFile(argsJSON, []byte(`["`+stubQEMUCommand+`"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args = append([]string{"-args-json", argsJSON}, args...)
+	cmd := exec.Command(self, append(args, self)...)
+	cmd.Env = append(os.Environ(), "GET_QEMU_STATE_TEST_MAIN=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// stubConfig returns a config capturing the stub QEMU into a temporary
+// directory.
+func stubConfig(t *testing.T) config {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config{
+		qemu:        self,
+		args:        []string{stubQEMUCommand},
+		output:      filepath.Join(t.TempDir(), "vm.state"),
+		markers:     []string{defaultWaitString},
+		markerCount: 1,
+		stdout:      io.Discard,
+	}
+}
+
+func TestCapture(t *testing.T) {
+	t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+	cfg := stubConfig(t)
+	res, err := capture(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(cfg.output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 4096 {
+		t.Fatalf("state size = %d; want 4096", fi.Size())
+	}
+	if res.ReadyAfter <= 0 || res.Total < res.ReadyAfter+res.MigrateTime {
+		t.Fatalf("inconsistent durations: %+v", res)
+	}
+}
+
+func TestCaptureOutputMode(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.outputMode = 0640
+	cfg.manifest = filepath.Join(t.TempDir(), "manifest.json")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{cfg.output, cfg.manifest} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Errorf("%s has mode %v; want 0640", p, fi.Mode().Perm())
+		}
+	}
+	if partials, _ := filepath.Glob(cfg.output + ".partial*"); len(partials) > 0 {
+		t.Errorf("partial state files must be gone: %v", partials)
+	}
+}
+
+func TestPrintMarkerSeconds(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		output := filepath.Join(t.TempDir(), "vm.state")
+		args := []string{"-output", output, "-print-marker-seconds", "-progress-interval", "10ms"}
+		if dryRun {
+			args = append(args, "-dry-run")
+		}
+		stdout, stderr, err := runMain(t, args...)
+		if err != nil {
+			t.Fatalf("dry-run=%v: %v\n%s", dryRun, err, stderr)
+		}
+		if !regexp.MustCompile(`^[0-9]+\.[0-9]{3}\n$`).MatchString(stdout) {
+			t.Errorf("dry-run=%v: stdout = %q; want only the seconds", dryRun, stdout)
+		}
+		if _, err := os.Stat(output); dryRun != os.IsNotExist(err) {
+			t.Errorf("dry-run=%v: unexpected state file status: %v", dryRun, err)
+		}
+	}
+}
+
+func TestCaptureFirstOutputTimeout(t *testing.T) {
+	t.Setenv("STUB_QEMU_SILENT_FOR", "10s")
+	cfg := stubConfig(t)
+	cfg.firstOutputTimeout = 200 * time.Millisecond
+	cfg.bootTimeout = time.Minute
+	start := time.Now()
+	_, err := capture(cfg)
+	if err == nil || !strings.Contains(err.Error(), "printed nothing") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("didn't fail fast (%v)", d)
+	}
+}
+
+func TestCaptureBootTimeoutAfterFirstOutput(t *testing.T) {
+	t.Setenv("STUB_QEMU_SILENT_FOR", "300ms")
+	cfg := stubConfig(t)
+	cfg.firstOutputTimeout = time.Second
+	cfg.bootTimeout = 250 * time.Millisecond // shorter than the silence but longer than the boot
+	if _, err := capture(cfg); err != nil {
+		t.Fatalf("the boot timeout must start with the first output: %v", err)
+	}
+}
+
+func TestCaptureMaxTotalTime(t *testing.T) {
+	t.Setenv("STUB_QEMU_MARKER", "never")
+	cfg := stubConfig(t)
+	cfg.deadline = time.Now().Add(300 * time.Millisecond)
+	start := time.Now()
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "-max-total-time ran out while booting") {
+		t.Fatalf("got %v; want -max-total-time to run out during the boot", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("didn't fail fast (%v)", d)
+	}
+
+	// A hanging host command is killed too.
+	t.Setenv("STUB_QEMU_MARKER", "")
+	cfg = stubConfig(t)
+	cfg.onReady = "sleep 60"
+	cfg.onReadyRequired = true
+	cfg.deadline = time.Now().Add(time.Second)
+	start = time.Now()
+	if _, err := capture(cfg); err == nil {
+		t.Fatal("capture outlived -max-total-time")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("-on-ready wasn't killed (%v)", d)
+	}
+}
+
+func TestCapturePIDFile(t *testing.T) {
+	cfg := stubConfig(t)
+	// Start the stub through a shell that forks it like a launcher would.
+	cfg.args = append([]string{"-c", `exec 3<&0; "$0" "$@" <&3 & wait`, cfg.qemu}, cfg.args...)
+	cfg.qemu = "/bin/sh"
+	dir := t.TempDir()
+	cfg.pidFile = filepath.Join(dir, "qemu.pid")
+	helperPID := filepath.Join(dir, "helper.pid")
+	cfg.readyHelper = `echo "$QEMU_PID" > ` + helperPID
+	cfg.readyHelperInterval = 100 * time.Millisecond
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(cfg.pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(helperPID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("QEMU_PID = %q; want %q from the pid file", got, want)
+	}
+}
+
+func TestCaptureWaitLogin(t *testing.T) {
+	for _, prompt := range []string{"localhost login: ", "/ # "} {
+		t.Setenv("STUB_QEMU_PROMPT", prompt)
+		cfg := stubConfig(t)
+		patterns, err := compilePatterns(defaultLoginPrompts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.loginPrompts = patterns
+		cfg.bootTimeout = 5 * time.Second
+		if _, err := capture(cfg); err != nil {
+			t.Fatalf("prompt %q: %v", prompt, err)
+		}
+	}
+}
+
+func TestCapturePTY(t *testing.T) {
+	t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+	t.Setenv("STUB_QEMU_REQUIRE_TTY", "1")
+	cfg := stubConfig(t)
+	cfg.bootTimeout = 5 * time.Second
+	if _, err := capture(cfg); err == nil {
+		t.Fatal("stub accepted pipes as a terminal")
+	}
+	cfg.pty = true
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(cfg.output); err != nil || fi.Size() != 4096 {
+		t.Fatalf("state isn't written over the pty: %v", err)
+	}
+}
+
+func TestCaptureOnReady(t *testing.T) {
+	cfg := stubConfig(t)
+	marker := filepath.Join(t.TempDir(), "ran")
+	cfg.onReady = `test -n "$QEMU_PID" && grep -q "Linux version stub" "$QEMU_CONSOLE_LOG" && touch ` + marker
+	cfg.onReadyRequired = true
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("-on-ready didn't run: %v", err)
+	}
+
+	cfg = stubConfig(t)
+	cfg.onReady = "exit 3"
+	if _, err := capture(cfg); err != nil {
+		t.Fatalf("failed -on-ready is fatal without -on-ready-required: %v", err)
+	}
+	cfg = stubConfig(t)
+	cfg.onReady = "exit 3"
+	cfg.onReadyRequired = true
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "-on-ready") {
+		t.Fatalf("got %v; want -on-ready failure", err)
+	}
+	if _, err := os.Stat(cfg.output); !os.IsNotExist(err) {
+		t.Fatalf("state is written despite the failure: %v", err)
+	}
+}
+
+func TestCaptureRequireCleanExit(t *testing.T) {
+	t.Setenv("STUB_QEMU_QUIT_EXIT_CODE", "2")
+	cfg := stubConfig(t)
+	if _, err := capture(cfg); err != nil {
+		t.Fatalf("nonzero exit after quit is fatal by default: %v", err)
+	}
+	if _, err := os.Stat(cfg.output); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = stubConfig(t)
+	cfg.requireCleanExit = true
+	_, err := capture(cfg)
+	if err == nil {
+		t.Fatal("nonzero exit after quit is accepted with -require-clean-exit")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "exited with 2") || !strings.Contains(msg, "exiting with 2 on quit") {
+		t.Fatalf("error lacks the exit code or the stderr tail: %v", err)
+	}
+}
+
+func TestCaptureMigratePrecheck(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.migratePrecheck = true
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("STUB_QEMU_MIGRATION_BLOCKER", "9p")
+	cfg = stubConfig(t)
+	cfg.migratePrecheck = true
+	_, err := capture(cfg)
+	if err == nil || !strings.Contains(err.Error(), "Migration is disabled when using feature '9p'") {
+		t.Fatalf("got %v; want the precheck to report the migration blocker", err)
+	}
+	if _, err := os.Stat(cfg.output); !os.IsNotExist(err) {
+		t.Fatalf("state is written despite the failed precheck: %v", err)
+	}
+}
+
+func TestCaptureEchoFilter(t *testing.T) {
+	cfg := stubConfig(t)
+	var out bytes.Buffer
+	cfg.stdout = &out
+	cfg.consoleFile = filepath.Join(t.TempDir(), "console.log")
+	cfg.echoExclude = regexp.MustCompile(`Linux version`)
+	if _, err := capture(cfg); err != nil {
+		t.Fatalf("marker didn't fire with the echo filtered: %v", err)
+	}
+	if s := out.String(); strings.Contains(s, "Linux version") || !strings.Contains(s, "Run /init") {
+		t.Fatalf("echoed console isn't filtered: %q", s)
+	}
+	if log, err := os.ReadFile(cfg.consoleFile); err != nil || !strings.Contains(string(log), "Linux version") {
+		t.Fatalf("console file lacks the excluded line (%v): %q", err, log)
+	}
+}
+
+func TestCaptureMaxDowntimeNeedsQMP(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.maxDowntime = 100 * time.Millisecond
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "needs a QMP server socket") {
+		t.Fatalf("got %v; want -max-downtime-ms refused without QMP", err)
+	}
+}
+
+func TestCaptureStdoutNeedsQMP(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.output = stdoutOutput
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "needs a QMP server unix socket") {
+		t.Fatalf("got %v; want -output - refused without QMP", err)
+	}
+}
+
+func TestCaptureMeasureRestore(t *testing.T) {
+	t.Setenv("STUB_QEMU_BOOT_DELAY", "300ms")
+	cfg := stubConfig(t)
+	cfg.measureRestore = true
+	cfg.manifest = filepath.Join(t.TempDir(), "manifest.json")
+	res, err := capture(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stub restores for the boot delay.
+	if res.RestoreTime < 300*time.Millisecond || res.RestoreTime > 5*time.Second {
+		t.Errorf("restore took %v; want ~300ms", res.RestoreTime)
+	}
+	data, err := os.ReadFile(cfg.manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.RestoreSeconds != res.RestoreTime.Seconds() {
+		t.Errorf("manifest has restoreSeconds %v; want %v", m.RestoreSeconds, res.RestoreTime.Seconds())
+	}
+}
+
+func TestMeasureRestoreFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := measureRestore(ctx, "sh", []string{"-c", "echo no such state >&2; exit 1"}, "/nonexistent", log.Default()); err == nil || !strings.Contains(err.Error(), "no such state") {
+		t.Fatalf("got %v; want the failure with the stderr", err)
+	}
+}
+
+func TestCaptureGuestShutdownCmd(t *testing.T) {
+	events := filepath.Join(t.TempDir(), "events")
+	t.Setenv("STUB_QEMU_EVENT_LOG", events)
+	t.Setenv("STUB_QEMU_REPLY", "systemctl stop app=>app stopped")
+	cfg := stubConfig(t)
+	cfg.guestShutdownCmd = "systemctl stop app"
+	cfg.guestShutdownMarker = "app stopped"
+	cfg.guestShutdownTimeout = 10 * time.Second
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, e := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		switch {
+		case e == "console systemctl stop app", e == "reply app stopped", e == "monitor stop", strings.HasPrefix(e, "monitor migrate "):
+			order = append(order, strings.Fields(e)[1])
+		}
+	}
+	if want := []string{"systemctl", "app", "stop", "migrate"}; !slices.Equal(order, want) {
+		t.Fatalf("events %q; want the command, its marker, stop and migrate in this order", data)
+	}
+}
+
+func TestCaptureOOMPolicy(t *testing.T) {
+	t.Setenv("STUB_QEMU_BOOT_LINE", "[    0.200000] Out of memory: Killed process 123 (stress) total-vm:1024kB")
+	cfg := stubConfig(t)
+	cfg.oomPolicy = "warn"
+	res, err := capture(cfg)
+	if err != nil {
+		t.Fatalf("OOM fails the capture with -oom-policy warn: %v", err)
+	}
+	if !slices.Equal(res.OOMKills, []string{"stress"}) {
+		t.Errorf("OOM kills %q; want [stress]", res.OOMKills)
+	}
+
+	cfg = stubConfig(t)
+	cfg.oomPolicy = "fail"
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "Killed process 123 (stress)") {
+		t.Fatalf("got %v; want the capture aborted on the OOM", err)
+	}
+	if _, err := os.Stat(cfg.output); !os.IsNotExist(err) {
+		t.Fatalf("state is written despite the OOM: %v", err)
+	}
+}
+
+func TestCaptureBlockedStdout(t *testing.T) {
+	pr, pw := io.Pipe() // never read
+	defer pr.Close()
+	cfg := stubConfig(t)
+	cfg.stdout = pw
+	cfg.consoleFile = filepath.Join(t.TempDir(), "console.log")
+	start := time.Now()
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("capture took %v with a blocked stdout", d)
+	}
+	if log, err := os.ReadFile(cfg.consoleFile); err != nil || !strings.Contains(string(log), "Linux version") {
+		t.Fatalf("console file misses the output: %q, %v", log, err)
+	}
+}
+
+func TestCaptureSplitSectionsFallback(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.splitSections = true // the stub doesn't write a migration stream
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cfg.output); err != nil {
+		t.Fatalf("no single state file is written for an unparsable stream: %v", err)
+	}
+}
+
+func TestCaptureAccel(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.accel = "tcg"
+	cfg.manifest = filepath.Join(t.TempDir(), "manifest.json")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Accel != "tcg" || !slices.Equal(m.Args[len(m.Args)-2:], []string{"-accel", "tcg"}) {
+		t.Errorf("accel %q, args %q; want -accel tcg added and recorded", m.Accel, m.Args)
+	}
+
+	cfg = stubConfig(t)
+	cfg.accel = "tcg"
+	cfg.args = append(cfg.args, "-enable-kvm")
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "args select accelerator kvm") {
+		t.Fatalf("got %v; want the conflicting accelerators rejected", err)
+	}
+}
+
+func TestCaptureAccelFallback(t *testing.T) {
+	t.Setenv("STUB_QEMU_NO_KVM", "1")
+	cfg := stubConfig(t)
+	cfg.args = append(cfg.args, "-machine", "q35,accel=kvm")
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "couldn't use accelerator kvm: Could not access KVM kernel module") {
+		t.Fatalf("got %v; want KVM reported unusable", err)
+	}
+
+	cfg.accelFallback = true
+	cfg.manifest = filepath.Join(t.TempDir(), "manifest.json")
+	res, err := capture(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.AccelFallbackFrom != "kvm" {
+		t.Errorf("fallback from %q; want kvm", res.AccelFallbackFrom)
+	}
+	data, err := os.ReadFile(cfg.manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Accel != "tcg" || m.AccelFallbackFrom != "kvm" || !slices.Contains(m.Args, "q35") {
+		t.Errorf("manifest accel %q from %q, args %q; want the TCG fallback recorded and the other machine options kept", m.Accel, m.AccelFallbackFrom, m.Args)
+	}
+}
+
+func TestCaptureChattyGuest(t *testing.T) {
+	t.Setenv("STUB_QEMU_CHATTY", "1")
+	t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+	pr, pw := io.Pipe() // a stuck console consumer
+	defer pr.Close()
+	cfg := stubConfig(t)
+	cfg.stdout = pw
+	cfg.consoleFile = filepath.Join(t.TempDir(), "console.log")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(cfg.output)
+	if err != nil || fi.Size() != 4096 {
+		t.Fatalf("state isn't written: %v", err)
+	}
+	if log, err := os.ReadFile(cfg.consoleFile); err != nil || !strings.Contains(string(log), "chatter") {
+		t.Fatalf("console file misses the output written during the migration: %v", err)
+	}
+}
+
+func TestCaptureMaxGuestMemory(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.args = append(cfg.args, "-m", "4G")
+	cfg.maxGuestMiB = 1024
+	_, err := capture(cfg)
+	if err == nil || !strings.Contains(err.Error(), "guest RAM of 4096 MiB exceeds -max-guest-memory 1024 MiB") {
+		t.Fatalf("got %v; want the capture refused", err)
+	}
+
+	cfg = stubConfig(t)
+	cfg.args = append(cfg.args, "-m", "512M")
+	cfg.maxGuestMiB = 1024
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaptureProgressFile(t *testing.T) {
+	t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+	cfg := stubConfig(t)
+	cfg.progressFile = filepath.Join(t.TempDir(), "progress.json")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cfg.progressFile); !os.IsNotExist(err) {
+		t.Fatalf("progress file is left behind: %v", err)
+	}
+
+	cfg = stubConfig(t)
+	cfg.progressFile = filepath.Join(t.TempDir(), "progress.json")
+	cfg.keepPartial = true
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.progressFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r progressReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatalf("invalid progress file %q: %v", data, err)
+	}
+	if r.Phase != "done" || r.Bytes != 4096 || r.Elapsed <= 0 {
+		t.Errorf("final progress %+v; want done with the 4096 bytes of the state", r)
+	}
+}
+
+func TestCaptureWarningAsError(t *testing.T) {
+	t.Setenv("STUB_QEMU_WARNING", "host doesn't support requested feature: CPUID.01H:ECX.vmx")
+	cfg := stubConfig(t)
+	cfg.warningErrors = []*regexp.Regexp{regexp.MustCompile(`doesn't support requested feature`)}
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "-warning-as-error") {
+		t.Fatalf("got %v; want the warning to fail the capture", err)
+	}
+	if _, err := os.Stat(cfg.output); !os.IsNotExist(err) {
+		t.Errorf("state is written despite the warning: %v", err)
+	}
+
+	cfg = stubConfig(t)
+	cfg.warningErrors = []*regexp.Regexp{regexp.MustCompile(`unmigratable`)}
+	if _, err := capture(cfg); err != nil {
+		t.Fatalf("other warnings must not fail the capture: %v", err)
+	}
+}
+
+func TestCaptureMonitorProtocolMismatch(t *testing.T) {
+	t.Setenv("STUB_QEMU_QMP_STDIO", "1")
+	t.Setenv("STUB_QEMU_BOOT_DELAY", "5s")
+	start := time.Now()
+	if _, err := capture(stubConfig(t)); err == nil || !strings.Contains(err.Error(), "monitor protocol mismatch: expected HMP, got QMP") {
+		t.Fatalf("got %v; want the protocol mismatch", err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("mismatch is detected after %v; want before the boot", d)
+	}
+}
+
+func TestCaptureConsoleDecode(t *testing.T) {
+	t.Setenv("STUB_QEMU_GZIP_MARKER", "1")
+	cfg := stubConfig(t)
+	cfg.consoleDecode = "gzip"
+	cfg.consoleRawFile = filepath.Join(t.TempDir(), "console.raw")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(cfg.consoleRawFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, gzipMagic) || bytes.Contains(raw, []byte(defaultWaitString)) {
+		t.Errorf("raw console %q; want the marker gzipped", raw)
+	}
+}
+
+func TestEmptyArgsJSON(t *testing.T) {
+	for _, data := range []string{"[]", "null"} {
+		argsJSON := filepath.Join(t.TempDir(), "args.json")
+		if err := os.WriteFile(argsJSON, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		configure := registerFlags(fs)
+		if err := fs.Parse([]string{"-args-json", argsJSON}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := configure(); err == nil || !strings.Contains(err.Error(), "args JSON produced no arguments; expected QEMU options") {
+			t.Errorf("args JSON %s: got %v; want the empty args rejected", data, err)
+		}
+	}
+}
+
+func TestArchDefaults(t *testing.T) {
+	argsJSON := filepath.Join(t.TempDir(), "args.json")
+	if err := os.WriteFile(argsJSON, []byte(`["-nographic"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		args        []string
+		marker      string
+		bootTimeout time.Duration
+	}{
+		{[]string{"/usr/bin/qemu-system-riscv64"}, defaultWaitString, archDefaults["riscv64"].bootTimeout},
+		{[]string{"-arch", "aarch64", "./qemu"}, defaultWaitString, archDefaults["aarch64"].bootTimeout},
+		{[]string{"-marker", "ready", "-boot-timeout", "0", "qemu-system-x86_64"}, "ready", 0},
+		{[]string{"./qemu"}, defaultWaitString, 0},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		configure := registerFlags(fs)
+		if err := fs.Parse(append([]string{"-args-json", argsJSON}, tt.args...)); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := configure()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if !slices.Equal(cfg.markers, []string{tt.marker}) || cfg.bootTimeout != tt.bootTimeout {
+			t.Errorf("%v: got markers %q and boot timeout %v; want %q and %v", tt.args, cfg.markers, cfg.bootTimeout, tt.marker, tt.bootTimeout)
+		}
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	configure := registerFlags(fs)
+	if err := fs.Parse([]string{"-args-json", argsJSON, "-arch", "mips", "./qemu"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := configure(); err == nil {
+		t.Error("unsupported -arch is accepted")
+	}
+}
+
+func TestCaptureDump(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.dump = filepath.Join(t.TempDir(), "guest.core")
+	res, err := capture(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(cfg.dump); err != nil || !bytes.HasPrefix(data, []byte("\x7fELF")) {
+		t.Fatalf("dump %q, %v; want an ELF core", data, err)
+	}
+	if res.Dump != cfg.dump {
+		t.Errorf("result has dump %q; want %q", res.Dump, cfg.dump)
+	}
+	if _, err := os.Stat(cfg.output); !os.IsNotExist(err) {
+		t.Errorf("the state is written with -dump: %v", err)
+	}
+
+	// A guest not becoming ready is dumped before the failure.
+	t.Setenv("STUB_QEMU_MARKER", "never")
+	cfg = stubConfig(t)
+	cfg.dump = filepath.Join(t.TempDir(), "stuck.core")
+	cfg.bootTimeout = 500 * time.Millisecond
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "the guest memory is dumped to "+cfg.dump) {
+		t.Fatalf("got %v; want the boot timeout reported with the dump", err)
+	}
+	if _, err := os.Stat(cfg.dump); err != nil {
+		t.Errorf("stuck guest isn't dumped: %v", err)
+	}
+}
+
+func TestCaptureMeasureRestoreFromState(t *testing.T) {
+	cfg := stubConfig(t)
+	base := filepath.Join(t.TempDir(), "base.state")
+	cfg.output = base
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	// -pidfile is appended after -incoming and must stay in the restore
+	// args while the -incoming of the base state is left out.
+	cfg = stubConfig(t)
+	cfg.fromState = base
+	cfg.pidFile = filepath.Join(t.TempDir(), "qemu.pid")
+	cfg.measureRestore = true
+	res, err := capture(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RestoreTime <= 0 {
+		t.Errorf("restore took %v", res.RestoreTime)
+	}
+}
+
+// phaseRun returns a captureRun of cfg set up as launch would for the
+// phases after it.
+func phaseRun(t *testing.T, cfg config) *captureRun {
+	cfg.logger = log.New(io.Discard, "", 0)
+	c := newCaptureRun(cfg)
+	c.start = time.Now()
+	c.con = newConsole(io.Discard)
+	c.timings = newTimingRecorder(c.start, nil)
+	c.stages = newTimingRecorder(c.start, nil)
+	c.prog = newProgress(c.start, c.con, cfg.logger)
+	c.partial = partialPath(cfg.output)
+	c.runCtx = context.Background()
+	c.bootCtx, c.cancelBoot = context.WithCancel(c.runCtx)
+	t.Cleanup(c.cancelBoot)
+	close(c.pidKnown)
+	return c
+}
+
+func TestCaptureRunLaunch(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.logger = log.New(io.Discard, "", 0)
+	c := newCaptureRun(cfg)
+	defer c.close(nil)
+	if err := c.launch(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	}()
+	w := c.con.watch("Linux version stub")
+	go io.Copy(c.con, c.stdout)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.con.wait(ctx, w); err != nil {
+		t.Fatalf("the console of the launched QEMU isn't read: %v", err)
+	}
+}
+
+func TestCaptureRunWaitReady(t *testing.T) {
+	c := phaseRun(t, stubConfig(t))
+	c.stdout = strings.NewReader("[    0.000000] Linux version stub\r\n" + defaultWaitString)
+	c.waitReady()
+	select {
+	case <-c.snapshotCh:
+	case err := <-c.errCh:
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the marker isn't detected")
+	}
+
+	c = phaseRun(t, stubConfig(t))
+	c.stdout = strings.NewReader("[    0.000000] Linux version stub\r\n")
+	c.waitReady()
+	select {
+	case <-c.snapshotCh:
+		t.Fatal("ready without the marker")
+	case err := <-c.errCh:
+		if !strings.Contains(err.Error(), "closed the console") {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the closed console isn't detected")
+	}
+}
+
+// recordingMonitor records the commands of snapshot.
+type recordingMonitor struct {
+	monitor
+	calls []string
+}
+
+func (m *recordingMonitor) migrate(ctx context.Context, path string) error {
+	m.calls = append(m.calls, "migrate "+path)
+	return nil
+}
+
+func (m *recordingMonitor) dumpGuestMemory(ctx context.Context, path string) error {
+	m.calls = append(m.calls, "dump "+path)
+	return nil
+}
+
+func (m *recordingMonitor) quit() error {
+	m.calls = append(m.calls, "quit")
+	return nil
+}
+
+func TestCaptureRunSnapshot(t *testing.T) {
+	dump := filepath.Join(t.TempDir(), "vm.dump")
+	for _, tc := range []struct {
+		name   string
+		modify func(cfg *config)
+		want   func(c *captureRun) []string
+	}{
+		{"migrate", func(*config) {}, func(c *captureRun) []string { return []string{"migrate " + c.partial, "quit"} }},
+		{"dry-run", func(cfg *config) { cfg.dryRun = true }, func(*captureRun) []string { return []string{"quit"} }},
+		{"dump", func(cfg *config) { cfg.dump = dump }, func(*captureRun) []string { return []string{"dump " + dump, "quit"} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := stubConfig(t)
+			tc.modify(&cfg)
+			c := phaseRun(t, cfg)
+			m := &recordingMonitor{}
+			if err := c.snapshot(m); err != nil {
+				t.Fatal(err)
+			}
+			if want := tc.want(c); !slices.Equal(m.calls, want) {
+				t.Errorf("got %q; want %q", m.calls, want)
+			}
+		})
+	}
+}
+
+func TestCaptureRunFinalize(t *testing.T) {
+	c := phaseRun(t, stubConfig(t))
+	if err := os.WriteFile(c.partial, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.readyAfter = time.Second
+	res, err := c.finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StateSize != 100 || res.ReadyAfter != time.Second {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if fi, err := os.Stat(c.cfg.output); err != nil || fi.Size() != 100 {
+		t.Fatalf("the state isn't finalized: %v", err)
+	}
+	if _, err := os.Stat(c.partial); !os.IsNotExist(err) {
+		t.Errorf("the partial state is left: %v", err)
+	}
+}
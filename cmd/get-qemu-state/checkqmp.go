@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+// checkQMP launches QEMU with args, connects to the QMP server socket in args,
+// negotiates the capabilities, queries the VM status and quits QEMU, without
+// waiting for the guest. It isolates QMP setup problems from the capture.
+func checkQMP(ctx context.Context, qemu string, args []string) (err error) {
+	network, addr, ok := qmpAddr(args)
+	if !ok {
+		return errors.New("no QMP server socket in args (e.g. -qmp unix:PATH,server=on,wait=off)")
+	}
+	cmd := exec.Command(qemu, slices.Clone(args)...)
+	cmd.WaitDelay = time.Second
+	// Keep the stdio of QEMU open (e.g. -serial mon:stdio) until it quits.
+	if _, err := cmd.StdinPipe(); err != nil {
+		return err
+	}
+	cmd.Stdout = io.Discard
+	stderrTail := &tailBuffer{max: 2048}
+	cmd.Stderr = stderrTail
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start QEMU: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		if err != nil {
+			cmd.Process.Kill()
+			<-exited
+			err = fmt.Errorf("%w; stderr:\n%s", err, stderrTail)
+		}
+	}()
+
+	log.Printf("connecting to QMP at %s", addr)
+	dialCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		// Don't keep retrying once QEMU is gone.
+		select {
+		case err := <-exited:
+			exited <- err
+			cancel()
+		case <-dialCtx.Done():
+		}
+	}()
+	q, err := dialQMP(dialCtx, network, addr)
+	cancel()
+	if err != nil {
+		select {
+		case werr := <-exited:
+			exited <- werr
+			return fmt.Errorf("QEMU exited before QMP was up (%v): %w", werr, err)
+		default:
+		}
+		return err
+	}
+	defer q.Close()
+	log.Printf("QMP handshake succeeded (QEMU %s)", q.version)
+	st, err := q.status(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("query-status: %s", st)
+	if err := q.quit(); err != nil {
+		return err
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			log.Printf("WARNING: QEMU exited with an error after quit: %v", err)
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("QEMU didn't quit: %w", ctx.Err())
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckQMP(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	qmpArg := "unix:" + filepath.Join(t.TempDir(), "qmp.sock") + ",server=on,wait=off"
+	if err := checkQMP(ctx, self, []string{stubQEMUCommand, "-qmp", qmpArg}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkQMP(ctx, self, []string{stubQEMUCommand}); err == nil || !strings.Contains(err.Error(), "no QMP server socket") {
+		t.Fatalf("got %v; want the missing QMP socket reported", err)
+	}
+
+	// QEMU exiting before QMP is up fails the check instead of waiting.
+	start := time.Now()
+	if err := checkQMP(ctx, "/bin/false", []string{"-qmp", qmpArg}); err == nil || !strings.Contains(err.Error(), "QEMU exited before QMP was up") {
+		t.Fatalf("got %v; want QEMU exiting reported", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("check took %v to fail", d)
+	}
+}
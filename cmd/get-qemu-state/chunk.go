@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+)
+
+// pageRun locates guest pages written in full in a part of a state split
+// with -chunk-mode page-aligned: page i of the run (at guest offset
+// GuestOffset+i*pageSize of RAM block Block) is at byte Offset+i*Stride of
+// part Part, as a whole. The index lists the last copy of each page sent in
+// full; pages not listed were last sent as a page of a single repeated byte
+// (normally never touched zero pages) and are only in the stream.
+type pageRun struct {
+	Block       string `json:"block"`
+	GuestOffset int64  `json:"guestOffset"`
+	Count       int    `json:"count"`
+	Part        int    `json:"part"`
+	Offset      int64  `json:"offset"`
+	Stride      int64  `json:"stride"`
+}
+
+// chunkModes are the values of -chunk-mode. "sequential" cuts the parts of
+// -split-bytes anywhere; "page-aligned" cuts them between guest pages and
+// indexes the pages.
+var chunkModes = []string{"sequential", "page-aligned"}
+
+// splitPageAligned writes src as parts of output of about n bytes each like
+// splitFile, but never cuts a guest page written in full, and indexes the
+// pages by their guest offsets. A part is larger than n only where a page
+// is larger than it.
+func splitPageAligned(src, output string, n int64) ([]string, error) {
+	if n <= 0 {
+		return nil, errors.New("part size must be positive")
+	}
+	s := newRAMScanner()
+	s.pages = make(map[string]map[int64]int64)
+	if err := s.scanState(src); err != nil {
+		return nil, err
+	}
+	// All the page copies in the stream, including earlier copies of pages
+	// sent again, are kept whole.
+	starts := s.copies
+	next := func(off int64) int64 {
+		end := off + n
+		// The last page starting before end.
+		i := sort.Search(len(starts), func(i int) bool { return starts[i] >= end }) - 1
+		if i >= 0 && starts[i] < end && end < starts[i]+targetPageSize {
+			if starts[i] > off {
+				return starts[i]
+			}
+			return starts[i] + targetPageSize
+		}
+		return end
+	}
+	return splitFileAt(src, output, next, func(idx *splitIndex) error {
+		idx.PageSize = targetPageSize
+		idx.Pages = pageRuns(s.pages, idx.Parts)
+		return nil
+	})
+}
+
+// pageRuns groups the pages (block -> guest offset -> state offset) into
+// runs of consecutive guest pages at a constant stride in a part.
+func pageRuns(pages map[string]map[int64]int64, parts []splitPart) []pageRun {
+	ends := make([]int64, len(parts)) // state offset after each part
+	var size int64
+	for i, p := range parts {
+		size += p.Size
+		ends[i] = size
+	}
+	var runs []pageRun
+	for _, block := range slices.Sorted(maps.Keys(pages)) {
+		var cur *pageRun
+		for _, addr := range slices.Sorted(maps.Keys(pages[block])) {
+			off := pages[block][addr]
+			part := sort.Search(len(ends), func(i int) bool { return ends[i] > off })
+			partOff := off - (ends[part] - parts[part].Size)
+			if cur != nil && cur.Part == part && addr == cur.GuestOffset+int64(cur.Count)*targetPageSize {
+				if cur.Count == 1 && partOff > cur.Offset {
+					cur.Stride = partOff - cur.Offset
+					cur.Count++
+					continue
+				} else if cur.Count > 1 && partOff == cur.Offset+int64(cur.Count)*cur.Stride {
+					cur.Count++
+					continue
+				}
+			}
+			runs = append(runs, pageRun{Block: block, GuestOffset: addr, Count: 1, Part: part, Offset: partOff, Stride: targetPageSize})
+			cur = &runs[len(runs)-1]
+		}
+	}
+	return runs
+}
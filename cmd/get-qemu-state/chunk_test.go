@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitPageAligned(t *testing.T) {
+	var b stateBuilder
+	b.u32(vmFileMagic)
+	b.u32(vmFileVersion)
+
+	var setup ramRecords
+	setup.be64((1 << 20) | ramSaveFlagMemSize)
+	setup.idstr("pc.ram")
+	setup.be64(1 << 20)
+	setup.be64(ramSaveFlagEOS)
+	b.section(vmSectionStart, 2, "ram", 0, setup.Bytes(), true)
+
+	want := make(map[int64]byte) // guest offset -> fill of the last copy
+	var iter ramRecords
+	for i := int64(0); i < 8; i++ {
+		block := ""
+		if i == 0 {
+			block = "pc.ram"
+		}
+		iter.page(block, i*targetPageSize, byte(i+1))
+		want[i*targetPageSize] = byte(i + 1)
+	}
+	iter.be64(ramSaveFlagEOS)
+	iterOff := int64(b.Len()) + 5 // after the section header
+	b.section(vmSectionPart, 2, "", 0, iter.Bytes(), true)
+
+	var last ramRecords
+	last.page("pc.ram", 0, 9) // sent again
+	want[0] = 9
+	last.zero(7 * targetPageSize) // zeroed
+	delete(want, 7*targetPageSize)
+	last.be64(ramSaveFlagEOS)
+	lastOff := int64(b.Len()) + 5
+	b.section(vmSectionEnd, 2, "", 0, last.Bytes(), true)
+	b.WriteByte(vmEOF)
+
+	dir := t.TempDir()
+	state := filepath.Join(dir, "vm.state")
+	if err := os.WriteFile(state, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "out.state")
+	if _, err := splitPageAligned(state, output, 10000); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(splitIndexPath(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idx splitIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Parts) < 2 || idx.PageSize != targetPageSize {
+		t.Fatalf("index %+v; want several parts and the page size", idx)
+	}
+
+	// No page copy is cut.
+	var cut int64
+	for _, p := range idx.Parts {
+		cut += p.Size
+		for off := range iter.pages {
+			if o := iterOff + off; cut > o && cut < o+targetPageSize {
+				t.Errorf("part ending at %d cuts the page at %d", cut, o)
+			}
+		}
+		for off := range last.pages {
+			if o := lastOff + off; cut > o && cut < o+targetPageSize {
+				t.Errorf("part ending at %d cuts the page at %d", cut, o)
+			}
+		}
+	}
+
+	// The index locates the last copy of each page.
+	got := make(map[int64]byte)
+	for _, r := range idx.Pages {
+		part, err := os.ReadFile(filepath.Join(dir, idx.Parts[r.Part].Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < r.Count; i++ {
+			off := r.Offset + int64(i)*r.Stride
+			page := part[off : off+targetPageSize]
+			if r.Block != "pc.ram" || !bytes.Equal(page, bytes.Repeat(page[:1], targetPageSize)) {
+				t.Fatalf("run %+v page %d isn't a page", r, i)
+			}
+			got[r.GuestOffset+int64(i)*targetPageSize] = page[0]
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("indexed pages %v; want %v", got, want)
+	}
+	for addr, fill := range want {
+		if got[addr] != fill {
+			t.Errorf("page at guest offset %d has %d; want %d", addr, got[addr], fill)
+		}
+	}
+	if len(idx.Pages) >= len(want) {
+		t.Errorf("%d runs for %d pages; want consecutive pages grouped", len(idx.Pages), len(want))
+	}
+
+	joined := filepath.Join(dir, "joined.state")
+	if err := joinParts(splitIndexPath(output), joined); err != nil {
+		t.Fatal(err)
+	}
+	if j, err := os.ReadFile(joined); err != nil || !bytes.Equal(j, b.Bytes()) {
+		t.Fatalf("joined state differs (%v)", err)
+	}
+}
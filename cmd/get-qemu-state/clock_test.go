@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hasMonotonic reports whether t carries a monotonic clock reading, which
+// makes time.Since(t) immune to wall clock changes.
+func hasMonotonic(t time.Time) bool {
+	return strings.Contains(t.String(), " m=")
+}
+
+func TestMonotonicClock(t *testing.T) {
+	// A wall clock jump only affects times without a monotonic reading.
+	start := time.Now()
+	if !hasMonotonic(start) {
+		t.Fatal("time.Now() must have a monotonic reading")
+	}
+	jumped := start.Round(0).Add(-time.Hour) // as if the clock was set back by an hour
+	if hasMonotonic(jumped) || time.Since(jumped) < time.Hour {
+		t.Fatal("a stripped time must follow the wall clock")
+	}
+	if time.Since(start) > time.Minute {
+		t.Fatal("a monotonic time must not follow the wall clock")
+	}
+
+	// The timestamps all elapsed time and deadline math is based on must
+	// keep their monotonic reading.
+	con := newConsole(io.Discard)
+	if !hasMonotonic(con.lastWrite) {
+		t.Errorf("console creation time isn't monotonic")
+	}
+	con.Write([]byte("x"))
+	if !hasMonotonic(con.lastWrite) {
+		t.Errorf("console last write time isn't monotonic")
+	}
+	if !hasMonotonic(newProgress(start, con, log.Default()).start) {
+		t.Errorf("progress start isn't monotonic")
+	}
+	if !hasMonotonic(newTimingRecorder(start, nil).start) {
+		t.Errorf("timing recorder start isn't monotonic")
+	}
+}
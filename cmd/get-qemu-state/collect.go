@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxCollectedLog bounds the bytes copied from a guest log.
+const maxCollectedLog = 64 << 20
+
+// collectLog is a -collect-logs entry.
+type collectLog struct {
+	guest, host string
+	required    bool // fail the capture if the copy fails
+}
+
+// parseCollectLog parses a "<guestpath>:<hostpath>[:required]" flag value.
+func parseCollectLog(s string) (collectLog, error) {
+	c := collectLog{}
+	if rest, ok := strings.CutSuffix(s, ":required"); ok {
+		s, c.required = rest, true
+	}
+	var ok bool
+	c.guest, c.host, ok = strings.Cut(s, ":")
+	if !ok || !strings.HasPrefix(c.guest, "/") || c.host == "" {
+		return collectLog{}, fmt.Errorf("collect-logs %q must be <guestpath>:<hostpath>[:required] with an absolute guest path", s)
+	}
+	return c, nil
+}
+
+// collectLogs copies the guest files of logs to the host through the guest
+// agent. Host paths are relative to dir. Failures of logs not required are
+// only logged. The written paths are returned.
+func collectLogs(ctx context.Context, g *guestAgent, logs []collectLog, dir string) ([]string, error) {
+	var written []string
+	for _, l := range logs {
+		host := l.host
+		if !filepath.IsAbs(host) {
+			host = filepath.Join(dir, host)
+		}
+		err := func() error {
+			data, err := g.readFile(ctx, l.guest)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(host, data, 0644)
+		}()
+		if err != nil {
+			err = fmt.Errorf("failed to collect %s from the guest: %w", l.guest, err)
+			if l.required {
+				return written, err
+			}
+			g.logger.Printf("WARNING: %v", err)
+			continue
+		}
+		g.logger.Printf("collected %s from the guest to %s", l.guest, host)
+		written = append(written, host)
+	}
+	return written, nil
+}
+
+// readFile reads the guest file at path (up to maxCollectedLog bytes).
+func (g *guestAgent) readFile(ctx context.Context, path string) ([]byte, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		g.conn.SetDeadline(dl)
+		defer g.conn.SetDeadline(time.Time{})
+	}
+	var handle int64
+	if err := g.execute("guest-file-open", map[string]any{"path": path, "mode": "r"}, &handle); err != nil {
+		return nil, err
+	}
+	defer g.execute("guest-file-close", map[string]any{"handle": handle}, nil)
+	var data []byte
+	for len(data) < maxCollectedLog {
+		var chunk struct {
+			Count int    `json:"count"`
+			Buf   string `json:"buf-b64"`
+			EOF   bool   `json:"eof"`
+		}
+		if err := g.execute("guest-file-read", map[string]any{"handle": handle, "count": 1 << 20}, &chunk); err != nil {
+			return nil, err
+		}
+		b, err := base64.StdEncoding.DecodeString(chunk.Buf)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+		if chunk.EOF || chunk.Count == 0 {
+			return data, nil
+		}
+	}
+	g.logger.Printf("WARNING: %s is truncated to %d bytes", path, maxCollectedLog)
+	return data[:maxCollectedLog], nil
+}
+
+// guestFilesDir is the directory of the -collect-guest-file copies of the
+// state at output.
+func guestFilesDir(output string) string {
+	return output + ".guest"
+}
+
+// collectGuestFiles copies the guest files at paths through the guest agent
+// under dir, mirroring their guest paths (/proc/cmdline is copied to
+// dir/proc/cmdline). A file that can't be read is only logged. The host paths
+// of the copies are returned keyed by guest path.
+func collectGuestFiles(ctx context.Context, g *guestAgent, paths []string, dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, p := range paths {
+		data, err := g.readFile(ctx, p)
+		if err != nil {
+			g.logger.Printf("WARNING: failed to collect guest file %s: %v", p, err)
+			continue
+		}
+		host := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(p, "/")))
+		if err := os.MkdirAll(filepath.Dir(host), 0755); err != nil {
+			return files, err
+		}
+		if err := os.WriteFile(host, data, 0644); err != nil {
+			return files, err
+		}
+		files[p] = host
+	}
+	return files, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCollectLog(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want collectLog
+	}{
+		{"/var/log/boot.log:boot.log", collectLog{"/var/log/boot.log", "boot.log", false}},
+		{"/tmp/dmesg:/out/dmesg.txt:required", collectLog{"/tmp/dmesg", "/out/dmesg.txt", true}},
+	} {
+		got, err := parseCollectLog(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %+v, %v; want %+v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"boot.log:boot.log", "/var/log/boot.log", "/var/log/boot.log:"} {
+		if _, err := parseCollectLog(in); err == nil {
+			t.Errorf("%q is accepted", in)
+		}
+	}
+}
+
+func TestCollectLogs(t *testing.T) {
+	sock := fakeGuestAgent(t, time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	g, err := dialGuestAgent(ctx, "unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	dir := t.TempDir()
+	logs := []collectLog{
+		{guest: "/var/log/boot.log", host: "boot.log"},
+		{guest: "/var/log/missing.log", host: "missing.log"},
+	}
+	written, err := collectLogs(ctx, g, logs, dir)
+	if err != nil {
+		t.Fatalf("a missing log not required fails the collection: %v", err)
+	}
+	if want := filepath.Join(dir, "boot.log"); len(written) != 1 || written[0] != want {
+		t.Fatalf("written %v; want [%s]", written, want)
+	}
+	if data, err := os.ReadFile(written[0]); err != nil || string(data) != guestFiles["/var/log/boot.log"] {
+		t.Fatalf("collected %q, %v", data, err)
+	}
+
+	logs[1].required = true
+	if _, err := collectLogs(ctx, g, logs, dir); err == nil || !strings.Contains(err.Error(), "No such file") {
+		t.Fatalf("got %v; want the required log failing the collection", err)
+	}
+}
+
+func TestCollectGuestFiles(t *testing.T) {
+	sock := fakeGuestAgent(t, time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	g, err := dialGuestAgent(ctx, "unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	dir := guestFilesDir(filepath.Join(t.TempDir(), "state"))
+	files, err := collectGuestFiles(ctx, g, []string{"/proc/cmdline", "/etc/missing"}, dir)
+	if err != nil {
+		t.Fatalf("a missing guest file fails the collection: %v", err)
+	}
+	want := filepath.Join(dir, "proc", "cmdline")
+	if len(files) != 1 || files["/proc/cmdline"] != want {
+		t.Fatalf("collected %v; want /proc/cmdline at %s", files, want)
+	}
+	if data, err := os.ReadFile(want); err != nil || string(data) != guestFiles["/proc/cmdline"] {
+		t.Fatalf("collected %q, %v", data, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLineLen bounds the bytes buffered for a line.
+const maxLineLen = 4096
+
+// console forwards the guest console output to w and lets callers wait for
+// strings appearing on it.
+type console struct {
+	w io.Writer
+
+	mu        sync.Mutex
+	waiters   map[*waiter]struct{}
+	lineHooks []*func(line string)
+	line      []byte
+	lastWrite time.Time
+	n         int64
+
+	// firstOutput is closed once anything is written.
+	firstOutput chan struct{}
+}
+
+func newConsole(w io.Writer) *console {
+	return &console{
+		w:           w,
+		waiters:     make(map[*waiter]struct{}),
+		lastWrite:   time.Now(),
+		firstOutput: make(chan struct{}),
+	}
+}
+
+func (c *console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.lastWrite = time.Now()
+	if c.n == 0 && len(p) > 0 {
+		close(c.firstOutput)
+	}
+	c.n += int64(len(p))
+	for w := range c.waiters {
+		if w.feed(p) {
+			delete(c.waiters, w)
+		}
+	}
+	for _, b := range p {
+		if b != '\n' {
+			if len(c.line) < maxLineLen {
+				c.line = append(c.line, b)
+			}
+			continue
+		}
+		l := strings.TrimSuffix(string(c.line), "\r")
+		for _, h := range c.lineHooks {
+			(*h)(l)
+		}
+		c.line = c.line[:0]
+	}
+	c.mu.Unlock()
+	return c.w.Write(p)
+}
+
+// quietFor returns how long the console has had no output (or how long it
+// exists if it never had).
+func (c *console) quietFor() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastWrite)
+}
+
+// written returns the number of bytes written to the console.
+func (c *console) written() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// unfinishedLine returns the output after the last newline, such as a prompt
+// waiting for input.
+func (c *console) unfinishedLine() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return string(c.line)
+}
+
+// addLineHook registers f to be called with every complete console line
+// until the returned function is called.
+func (c *console) addLineHook(f func(line string)) (remove func()) {
+	h := &f
+	c.mu.Lock()
+	c.lineHooks = append(c.lineHooks, h)
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		c.lineHooks = slices.DeleteFunc(c.lineHooks, func(e *func(string)) bool { return e == h })
+		c.mu.Unlock()
+	}
+}
+
+// watch starts watching for s. It must be called before triggering the output
+// so that it isn't missed.
+func (c *console) watch(s string) *waiter {
+	w := &waiter{pattern: []byte(s), found: make(chan struct{})}
+	c.mu.Lock()
+	c.waiters[w] = struct{}{}
+	c.mu.Unlock()
+	return w
+}
+
+// wait blocks until the string watched by w appears or ctx is done.
+func (c *console) wait(ctx context.Context, w *waiter) error {
+	select {
+	case <-w.found:
+		return nil
+	case <-ctx.Done():
+		c.unwatch(w)
+		return ctx.Err()
+	}
+}
+
+func (c *console) unwatch(w *waiter) {
+	c.mu.Lock()
+	delete(c.waiters, w)
+	c.mu.Unlock()
+}
+
+type waiter struct {
+	pattern []byte
+	buf     []byte
+	found   chan struct{}
+}
+
+func (w *waiter) feed(p []byte) bool {
+	w.buf = append(w.buf, p...)
+	if bytes.Contains(w.buf, w.pattern) {
+		close(w.found)
+		return true
+	}
+	if keep := len(w.pattern) - 1; len(w.buf) > keep {
+		w.buf = append(w.buf[:0], w.buf[len(w.buf)-keep:]...)
+	}
+	return false
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
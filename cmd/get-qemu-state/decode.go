@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"maps"
+	"slices"
+)
+
+// consoleDecoder decodes the console stream before the readiness detection,
+// the hooks and the echo see it.
+type consoleDecoder interface {
+	io.Writer
+	// Flush writes what's held back at the end of the stream.
+	Flush() error
+}
+
+// consoleDecoders are the decoders of -console-decode besides "raw", which
+// passes the console through as is.
+var consoleDecoders = map[string]func(w io.Writer) consoleDecoder{
+	"gzip": func(w io.Writer) consoleDecoder { return &gzipDecoder{w: w} },
+}
+
+func consoleDecoderNames() []string {
+	return append([]string{"raw"}, slices.Sorted(maps.Keys(consoleDecoders))...)
+}
+
+// maxGzipMember bounds the bytes of a gzip member held back until it's
+// complete. A larger one is passed through undecoded.
+const maxGzipMember = 1 << 20
+
+var gzipMagic = []byte{0x1f, 0x8b, 0x08} // ID1, ID2, CM=deflate
+
+// gzipDecoder replaces the gzip members embedded in the console (e.g. in a
+// debug channel of the guest) with their decompressed contents. Other bytes
+// are passed through as is.
+type gzipDecoder struct {
+	w   io.Writer
+	buf []byte // an incomplete gzip member or the start of its magic
+}
+
+func (d *gzipDecoder) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	var out []byte
+	for len(d.buf) > 0 {
+		i := bytes.Index(d.buf, gzipMagic)
+		if i < 0 {
+			n := len(d.buf) - magicPrefixLen(d.buf)
+			out = append(out, d.buf[:n]...)
+			d.buf = d.buf[n:]
+			break
+		}
+		out = append(out, d.buf[:i]...)
+		d.buf = d.buf[i:]
+		data, n, err := gunzipMember(d.buf)
+		if err == io.ErrUnexpectedEOF && len(d.buf) < maxGzipMember {
+			break // wait for the rest
+		} else if err != nil {
+			// Not a gzip member after all.
+			out = append(out, d.buf[0])
+			d.buf = d.buf[1:]
+			continue
+		}
+		out = append(out, data...)
+		d.buf = d.buf[n:]
+	}
+	d.buf = slices.Clone(d.buf)
+	if _, err := d.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *gzipDecoder) Flush() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	_, err := d.w.Write(d.buf)
+	d.buf = nil
+	return err
+}
+
+// magicPrefixLen returns the length of the longest suffix of b that can start
+// gzipMagic.
+func magicPrefixLen(b []byte) int {
+	for n := min(len(b), len(gzipMagic)-1); n > 0; n-- {
+		if bytes.HasPrefix(gzipMagic, b[len(b)-n:]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// gunzipMember decompresses the gzip member at the start of b and returns its
+// contents and length. io.ErrUnexpectedEOF means b ends in the member.
+func gunzipMember(b []byte) ([]byte, int, error) {
+	r := bytes.NewReader(b)
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	zr.Multistream(false)
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, len(b) - r.Len(), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestGzipDecoder(t *testing.T) {
+	var in []byte
+	in = append(in, "boot\r\n"...)
+	in = append(in, gzipped(t, "debug: ready\r\n")...)
+	in = append(in, "not gzip: \x1f\x8b\x08\x00 done\r\n"...)
+	in = append(in, gzipped(t, "second")...)
+	in = append(in, '\x1f')
+	want := "boot\r\ndebug: ready\r\nnot gzip: \x1f\x8b\x08\x00 done\r\nsecond\x1f"
+
+	for _, size := range []int{1, 7, len(in)} {
+		var out bytes.Buffer
+		d := consoleDecoders["gzip"](&out)
+		for p := in; len(p) > 0; {
+			n := min(size, len(p))
+			if _, err := d.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != want {
+			t.Errorf("decoded %q in writes of %d bytes; want %q", out.String(), size, want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A state captured with -from-state -delta is written as the bytes it
+// doesn't share with the base state: the guest pages sent in full by both
+// with the same content (and the record headers between runs of them) are
+// left out and read from the base by "layer". Other pages, the device state
+// and pages sent more than once are in the delta as they are.
+
+// stateDelta describes a state written by -delta. It's written to
+// <output>.delta.json next to the delta bytes and read by "layer".
+type stateDelta struct {
+	Name     string `json:"name"` // of the delta bytes, relative to the index
+	Base     string `json:"base"`
+	BaseSize int64  `json:"baseSize"`
+	// Size and SHA256 are those of the layered state.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Shared are the [offset, base offset, length] of the ranges of the
+	// state read from the base, in the state order.
+	Shared [][3]int64 `json:"shared"`
+}
+
+func deltaIndexPath(output string) string {
+	return output + ".delta.json"
+}
+
+// maxDeltaGap is the most bytes between two pages shared with the base that
+// are compared to merge the pages into one range, which is enough for the
+// record header of the next page.
+const maxDeltaGap = 64
+
+// sharedRanges returns the ranges of the state at src equal to those of the
+// state at base, made of the last full copies of the guest pages.
+func sharedRanges(src, base string) ([][3]int64, error) {
+	ss, bs := newRAMScanner(), newRAMScanner()
+	ss.pages, bs.pages = make(map[string]map[int64]int64), make(map[string]map[int64]int64)
+	if err := ss.scanState(src); err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	if err := bs.scanState(base); err != nil {
+		return nil, fmt.Errorf("%s: %w", base, err)
+	}
+	sf, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer sf.Close()
+	bf, err := os.Open(base)
+	if err != nil {
+		return nil, err
+	}
+	defer bf.Close()
+
+	equal := func(off, boff, n int64) (bool, error) {
+		a, b := make([]byte, n), make([]byte, n)
+		if _, err := sf.ReadAt(a, off); err != nil {
+			return false, err
+		}
+		if _, err := bf.ReadAt(b, boff); err != nil {
+			return false, err
+		}
+		return bytes.Equal(a, b), nil
+	}
+	var pages [][2]int64 // [offset, base offset]
+	for block, offs := range ss.pages {
+		for addr, off := range offs {
+			if boff, ok := bs.pages[block][addr]; ok {
+				pages = append(pages, [2]int64{off, boff})
+			}
+		}
+	}
+	slices.SortFunc(pages, func(a, b [2]int64) int { return cmp.Compare(a[0], b[0]) })
+	var shared [][3]int64
+	for _, p := range pages {
+		if ok, err := equal(p[0], p[1], targetPageSize); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if n := len(shared); n > 0 {
+			r := &shared[n-1]
+			gap := p[0] - (r[0] + r[2])
+			if gap >= 0 && gap <= maxDeltaGap && p[1]-(r[1]+r[2]) == gap {
+				if ok, err := equal(r[0]+r[2], r[1]+r[2], gap); err != nil {
+					return nil, err
+				} else if ok {
+					r[2] += gap + targetPageSize
+					continue
+				}
+			}
+		}
+		shared = append(shared, [3]int64{p[0], p[1], targetPageSize})
+	}
+	return shared, nil
+}
+
+// writeDelta writes the state at src as a delta against the state at base
+// to output and the index of it. It returns the paths of the written files.
+func writeDelta(src, base, output string) ([]string, error) {
+	shared, err := sharedRanges(src, base)
+	if err != nil {
+		return nil, err
+	}
+	bi, err := os.Stat(base)
+	if err != nil {
+		return nil, err
+	}
+	if base, err = filepath.Abs(base); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	d := stateDelta{
+		Name:     filepath.Base(output),
+		Base:     base,
+		BaseSize: bi.Size(),
+		Size:     size,
+		SHA256:   "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		Shared:   shared,
+	}
+	var readers []io.Reader
+	pos := int64(0)
+	for _, r := range shared {
+		readers = append(readers, io.NewSectionReader(f, pos, r[0]-pos))
+		pos = r[0] + r[2]
+	}
+	readers = append(readers, io.NewSectionReader(f, pos, size-pos))
+	if _, _, err := writePart(output, io.MultiReader(readers...)); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	ip := deltaIndexPath(output)
+	if err := os.WriteFile(ip, append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return []string{output, ip}, nil
+}
+
+// layerState writes the state described by the delta index at indexPath,
+// reading the shared ranges from base (the base of the index if empty), to
+// w, and verifies it.
+func layerState(indexPath, base string, w io.Writer) error {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	var d stateDelta
+	if err := json.Unmarshal(data, &d); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", indexPath, err)
+	}
+	if base == "" {
+		base = d.Base
+	}
+	bf, err := os.Open(base)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+	if bi, err := bf.Stat(); err != nil {
+		return err
+	} else if bi.Size() != d.BaseSize {
+		return fmt.Errorf("base %s has %d bytes but the delta was captured against %d bytes", base, bi.Size(), d.BaseSize)
+	}
+	df, err := os.Open(filepath.Join(filepath.Dir(indexPath), d.Name))
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	h := sha256.New()
+	w = io.MultiWriter(w, h)
+	var size, dpos int64
+	copyN := func(f *os.File, off, n int64) error {
+		m, err := io.Copy(w, io.NewSectionReader(f, off, n))
+		size += m
+		if err == nil && m != n {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	for _, r := range d.Shared {
+		n := r[0] - size
+		if n < 0 {
+			return errors.New("shared ranges overlap")
+		}
+		if err := copyN(df, dpos, n); err != nil {
+			return fmt.Errorf("delta: %w", err)
+		}
+		dpos += n
+		if err := copyN(bf, r[1], r[2]); err != nil {
+			return fmt.Errorf("base: %w", err)
+		}
+	}
+	if err := copyN(df, dpos, d.Size-size); err != nil {
+		return fmt.Errorf("delta: %w", err)
+	}
+	if "sha256:"+hex.EncodeToString(h.Sum(nil)) != d.SHA256 {
+		return errors.New("layered state doesn't match the index (was the base changed?)")
+	}
+	return nil
+}
+
+// runLayer implements "get-qemu-state layer [-base file] -output file|-
+// <output>.delta.json".
+func runLayer(args []string) error {
+	fs := flag.NewFlagSet("layer", flag.ExitOnError)
+	output := fs.String("output", "", "path to the layered state file. - writes it to stdout for restoring it without a copy (-incoming \"exec:get-qemu-state layer -output - <output>.delta.json\"); the verification then fails only after QEMU read it")
+	base := fs.String("base", "", "path to the base state (default: the -from-state path recorded in the index)")
+	fs.Parse(args)
+	if fs.NArg() != 1 || !strings.HasSuffix(fs.Arg(0), ".delta.json") {
+		return errors.New("specify the delta index (<output>.delta.json)")
+	}
+	switch *output {
+	case "":
+		return errors.New("specify -output")
+	case stdoutOutput:
+		return layerState(fs.Arg(0), *base, os.Stdout)
+	}
+	tmp := *output + ".partial"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := layerState(fs.Arg(0), *base, out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *output)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ramState returns a state of a guest with a page of each of fills and a
+// device state of dev.
+func ramState(fills []byte, dev byte) []byte {
+	var b stateBuilder
+	b.u32(vmFileMagic)
+	b.u32(vmFileVersion)
+
+	var setup ramRecords
+	setup.be64((1 << 20) | ramSaveFlagMemSize)
+	setup.idstr("pc.ram")
+	setup.be64(1 << 20)
+	setup.be64(ramSaveFlagEOS)
+	b.section(vmSectionStart, 2, "ram", 0, setup.Bytes(), true)
+
+	var iter ramRecords
+	for i, fill := range fills {
+		block := ""
+		if i == 0 {
+			block = "pc.ram"
+		}
+		iter.page(block, int64(i)*targetPageSize, fill)
+	}
+	iter.be64(ramSaveFlagEOS)
+	b.section(vmSectionPart, 2, "", 0, iter.Bytes(), true)
+	b.section(vmSectionFull, 3, "serial", 0, bytes.Repeat([]byte{dev}, 10), true)
+	b.WriteByte(vmEOF)
+	return b.Bytes()
+}
+
+func TestDelta(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.state")
+	if err := os.WriteFile(base, ramState([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := ramState([]byte{1, 2, 3, 9, 5, 9, 7, 8}, 2)
+	src := filepath.Join(dir, "app.state.partial")
+	if err := os.WriteFile(src, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "app.state")
+	written, err := writeDelta(src, base, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 || written[1] != deltaIndexPath(output) {
+		t.Fatalf("written %v", written)
+	}
+	data, err := os.ReadFile(deltaIndexPath(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d stateDelta
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+	// Pages 0-2, 4 and 6-7 are shared, merged across their record headers.
+	if len(d.Shared) != 3 || d.Shared[0][2] != 3*targetPageSize+2*8 || d.Shared[1][2] != targetPageSize {
+		t.Errorf("shared ranges %v", d.Shared)
+	}
+	if fi, err := os.Stat(output); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() >= 3*targetPageSize {
+		t.Errorf("delta has %d bytes; want only the 2 changed pages and the rest", fi.Size())
+	}
+
+	var layered bytes.Buffer
+	if err := layerState(deltaIndexPath(output), "", &layered); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(layered.Bytes(), want) {
+		t.Error("layered state differs from the captured one")
+	}
+
+	// A changed base is detected.
+	if err := os.WriteFile(base, ramState([]byte{1, 2, 3, 4, 5, 6, 7, 0}, 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := layerState(deltaIndexPath(output), "", &layered); err == nil {
+		t.Error("layered on a changed base")
+	}
+}
+
+func TestCaptureFromState(t *testing.T) {
+	dir := t.TempDir()
+	baseFixture, appFixture := filepath.Join(dir, "base.fixture"), filepath.Join(dir, "app.fixture")
+	app := ramState([]byte{1, 2, 3, 4, 9, 9, 7, 8}, 2)
+	if err := os.WriteFile(baseFixture, ramState([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(appFixture, app, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Boot the base OS.
+	t.Setenv("STUB_QEMU_STATE_FILE", baseFixture)
+	base := stubConfig(t)
+	if _, err := capture(base); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore it, set the app up and capture the delta.
+	t.Setenv("STUB_QEMU_STATE_FILE", appFixture)
+	t.Setenv("STUB_QEMU_REPLY", "make app=>app ready")
+	events := filepath.Join(dir, "events")
+	t.Setenv("STUB_QEMU_EVENT_LOG", events)
+	cfg := stubConfig(t)
+	cfg.fromState, cfg.delta = base.output, true
+	cfg.preScript = filepath.Join(dir, "app.script")
+	if err := os.WriteFile(cfg.preScript, []byte("send make app\nexpect app ready\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.manifest = filepath.Join(dir, "manifest.json")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(events); err != nil || !bytes.Contains(got, []byte("console make app")) {
+		t.Errorf("pre-script didn't run after restoring the base: %q, %v", got, err)
+	}
+	data, err := os.ReadFile(cfg.manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.FromState != base.output || m.Delta != deltaIndexPath(cfg.output) || m.Output != "" {
+		t.Errorf("manifest has fromState %q, delta %q and output %q", m.FromState, m.Delta, m.Output)
+	}
+
+	// Restore the app layered on the base.
+	layered := filepath.Join(dir, "layered.state")
+	if err := runLayer([]string{"-output", layered, m.Delta}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(layered); err != nil || !bytes.Equal(got, app) {
+		t.Errorf("layered state differs from the captured one (%v)", err)
+	}
+}
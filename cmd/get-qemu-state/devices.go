@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// deviceInfo is a -device of the args. QEMU creates the devices in the order
+// of the args, and that order lays out the state: the sections of the
+// devices and, for PCI devices without addr=, their slots, which the guest
+// enumerates and the state records.
+type deviceInfo struct {
+	Driver string `json:"driver"`
+	ID     string `json:"id,omitempty"`
+	Bus    string `json:"bus,omitempty"`
+	Addr   string `json:"addr,omitempty"`
+}
+
+// argsDevices returns the -device options of args in order.
+func argsDevices(args []string) []deviceInfo {
+	var devices []deviceInfo
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] != "-device" {
+			continue
+		}
+		driver, opts, _ := strings.Cut(args[i+1], ",")
+		d := deviceInfo{Driver: driver}
+		d.ID, _ = option(opts, "id")
+		d.Bus, _ = option(opts, "bus")
+		d.Addr, _ = option(opts, "addr")
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+// pciDrivers are the common PCI devices without a -pci suffix.
+var pciDrivers = []string{"e1000", "e1000e", "rtl8139", "VGA", "virtio-vga", "qxl-vga", "qemu-xhci", "nec-usb-xhci", "ich9-ahci", "pci-bridge"}
+
+func isPCIDevice(driver string) bool {
+	return strings.HasSuffix(driver, "-pci") || slices.Contains(pciDrivers, driver)
+}
+
+// Slots given by -stable-device-order. The machines take the low slots for
+// their own devices (e.g. the host bridge at 0 and the VGA at 1 or 2; q35
+// takes 0x1f for the ICH9), so the pinned ones start past them.
+const (
+	firstPinnedSlot = 0x10
+	lastPinnedSlot  = 0x1e
+)
+
+// pinDeviceAddrs implements -stable-device-order. The PCI devices of args on
+// the root bus (without bus=) and without addr= get explicit slots in the
+// order of the args, skipping the slots given explicitly, so that their
+// layout doesn't depend on what else the machine creates meanwhile.
+//
+// QEMU fails if a slot is taken by a device of the machine or -nodefaults
+// isn't used and a default device lands there; give those addr= explicitly.
+// Devices on other buses (e.g. behind pcie-root-port) and non-PCI devices
+// (e.g. virtio-mmio on virt) are created in the order of the args anyway.
+func pinDeviceAddrs(args []string) ([]string, error) {
+	used := make(map[int]bool)
+	for _, d := range argsDevices(args) {
+		if d.Addr != "" && d.Bus == "" {
+			slotS, _, _ := strings.Cut(d.Addr, ".")
+			if slot, err := strconv.ParseInt(slotS, 0, 0); err == nil {
+				used[int(slot)] = true
+			}
+		}
+	}
+	res := slices.Clone(args)
+	slot := firstPinnedSlot
+	for i := 0; i < len(res)-1; i++ {
+		if res[i] != "-device" {
+			continue
+		}
+		driver, opts, _ := strings.Cut(res[i+1], ",")
+		if !isPCIDevice(driver) {
+			continue
+		}
+		if _, ok := option(opts, "bus"); ok {
+			continue
+		}
+		if _, ok := option(opts, "addr"); ok {
+			continue
+		}
+		for used[slot] {
+			slot++
+		}
+		if slot > lastPinnedSlot {
+			return nil, fmt.Errorf("-stable-device-order ran out of PCI slots at %s; give some devices addr= explicitly", driver)
+		}
+		res[i+1] += fmt.Sprintf(",addr=%#x", slot)
+		used[slot] = true
+	}
+	return res, nil
+}
+
+// deviceOrderMismatches describes how the devices of the current args differ
+// from those the state was captured with, which may make it fail to load.
+func deviceOrderMismatches(captured, current []deviceInfo) []string {
+	var res []string
+	if len(captured) != len(current) {
+		res = append(res, fmt.Sprintf("%d devices were captured but %d are given", len(captured), len(current)))
+	}
+	for i := range min(len(captured), len(current)) {
+		if captured[i] != current[i] {
+			res = append(res, fmt.Sprintf("device %d was %s but is %s", i, captured[i], current[i]))
+		}
+	}
+	return res
+}
+
+func (d deviceInfo) String() string {
+	s := d.Driver
+	for _, o := range []struct{ k, v string }{{"id", d.ID}, {"bus", d.Bus}, {"addr", d.Addr}} {
+		if o.v != "" {
+			s += "," + o.k + "=" + o.v
+		}
+	}
+	return s
+}
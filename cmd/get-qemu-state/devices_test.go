@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPinDeviceAddrs(t *testing.T) {
+	args := []string{
+		"-nodefaults",
+		"-device", "virtio-net-pci,netdev=n0,id=net0",
+		"-device", "virtio-blk-pci,drive=d0,addr=0x10",
+		"-device", "virtio-serial-pci,bus=pcie.1",
+		"-device", "virtconsole,chardev=c0",
+		"-device", "e1000",
+	}
+	got, err := pinDeviceAddrs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []deviceInfo{
+		{Driver: "virtio-net-pci", ID: "net0", Addr: "0x11"},
+		{Driver: "virtio-blk-pci", Addr: "0x10"},
+		{Driver: "virtio-serial-pci", Bus: "pcie.1"},
+		{Driver: "virtconsole"},
+		{Driver: "e1000", Addr: "0x12"},
+	}
+	if devices := argsDevices(got); !reflect.DeepEqual(devices, want) {
+		t.Errorf("got %v; want %v", devices, want)
+	}
+	if args[2] != "virtio-net-pci,netdev=n0,id=net0" {
+		t.Errorf("args are modified: %q", args[2])
+	}
+
+	var many []string
+	for range lastPinnedSlot - firstPinnedSlot + 2 {
+		many = append(many, "-device", "virtio-rng-pci")
+	}
+	if _, err := pinDeviceAddrs(many); err == nil {
+		t.Error("pinned more devices than slots")
+	}
+}
+
+func TestDeviceOrderMismatches(t *testing.T) {
+	captured := []deviceInfo{{Driver: "virtio-net-pci", ID: "net0"}, {Driver: "virtio-blk-pci"}}
+	if m := deviceOrderMismatches(captured, captured); len(m) != 0 {
+		t.Errorf("same devices mismatch: %v", m)
+	}
+	swapped := []deviceInfo{captured[1], captured[0]}
+	if m := deviceOrderMismatches(captured, swapped); len(m) != 2 {
+		t.Errorf("got %v; want the 2 swapped devices", m)
+	}
+	if m := deviceOrderMismatches(captured, captured[:1]); len(m) != 1 {
+		t.Errorf("got %v; want the missing device", m)
+	}
+}
+
+func TestCaptureRecordsDevices(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.args = append(cfg.args, "-device", "virtio-net-pci,id=net0", "-device", "virtio-blk-pci,addr=0x10")
+	cfg.stableDeviceOrder = true
+	cfg.manifest = filepath.Join(t.TempDir(), "manifest.json")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	want := []deviceInfo{
+		{Driver: "virtio-net-pci", ID: "net0", Addr: "0x11"},
+		{Driver: "virtio-blk-pci", Addr: "0x10"},
+	}
+	if !reflect.DeepEqual(m.Devices, want) {
+		t.Errorf("manifest has devices %v; want %v", m.Devices, want)
+	}
+}
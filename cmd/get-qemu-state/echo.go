@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// echoFilter forwards to w the lines matching include (if not nil) and not
+// matching exclude (if not nil). Lines are buffered until their newline, so a
+// prompt waiting for input shows up only on Flush.
+type echoFilter struct {
+	w                io.Writer
+	include, exclude *regexp.Regexp
+
+	line []byte
+}
+
+func (f *echoFilter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			f.line = append(f.line, p[:min(len(p), max(maxLineLen-len(f.line), 0))]...)
+			break
+		}
+		f.line = append(f.line, p[:i+1]...)
+		p = p[i+1:]
+		if err := f.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Flush forwards the buffered line, complete or not, if it passes the filter.
+func (f *echoFilter) Flush() error {
+	line := f.line
+	f.line = f.line[:0]
+	if len(line) == 0 {
+		return nil
+	}
+	text := bytes.TrimRight(line, "\r\n")
+	if f.include != nil && !f.include.Match(text) {
+		return nil
+	}
+	if f.exclude != nil && f.exclude.Match(text) {
+		return nil
+	}
+	_, err := f.w.Write(line)
+	return err
+}
+
+// echoBacklog is the number of writes an echoWriter buffers before dropping.
+const echoBacklog = 256
+
+// echoWriter writes to w in the background so that a slow or stuck reader
+// of the echo (e.g. a stopped pager) doesn't backpressure the console, which
+// also carries the HMP monitor, and stall the capture. Output is dropped
+// while echoBacklog writes are pending, and everything after w fails.
+type echoWriter struct {
+	w      io.Writer
+	logger *log.Logger
+	ch     chan []byte
+	done   chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	dropped int64
+}
+
+func newEchoWriter(w io.Writer, logger *log.Logger) *echoWriter {
+	e := &echoWriter{w: w, logger: logger, ch: make(chan []byte, echoBacklog), done: make(chan struct{})}
+	go e.run()
+	return e
+}
+
+func (e *echoWriter) run() {
+	defer close(e.done)
+	var failed bool
+	for p := range e.ch {
+		if failed {
+			continue
+		}
+		if _, err := e.w.Write(p); err != nil {
+			e.logger.Printf("WARNING: failed to echo the console (%v); discarding the rest", err)
+			failed = true
+		}
+	}
+}
+
+// Write never blocks and never fails.
+func (e *echoWriter) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return len(p), nil
+	}
+	select {
+	case e.ch <- bytes.Clone(p):
+	default:
+		if e.dropped == 0 {
+			e.logger.Printf("WARNING: the console echo is blocked; dropping output")
+		}
+		e.dropped += int64(len(p))
+	}
+	return len(p), nil
+}
+
+// Close waits up to timeout for the pending output to be written. Later
+// writes are discarded.
+func (e *echoWriter) Close(timeout time.Duration) {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.ch)
+	}
+	dropped := e.dropped
+	e.mu.Unlock()
+	select {
+	case <-e.done:
+	case <-time.After(timeout):
+		e.logger.Printf("WARNING: gave up flushing the console echo")
+	}
+	if dropped > 0 {
+		e.logger.Printf("dropped %d bytes of the console echo", dropped)
+	}
+}
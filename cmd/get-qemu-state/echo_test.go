@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestEchoFilter(t *testing.T) {
+	var out bytes.Buffer
+	f := &echoFilter{w: &out, include: regexp.MustCompile(`^\[`), exclude: regexp.MustCompile(`audit`)}
+	for _, p := range []string{"[ 0.1] boot\r\nnoise\n[ 0.2] au", "dit: x\n[ 0.3] done\n", "login: "} {
+		f.Write([]byte(p))
+	}
+	if want := "[ 0.1] boot\r\n[ 0.3] done\n"; out.String() != want {
+		t.Fatalf("got %q; want %q", out.String(), want)
+	}
+	f.include = nil
+	f.Flush()
+	if want := "[ 0.1] boot\r\n[ 0.3] done\nlogin: "; out.String() != want {
+		t.Fatalf("unfinished line: got %q; want %q", out.String(), want)
+	}
+}
+
+func TestEchoWriter(t *testing.T) {
+	pr, pw := io.Pipe()
+	e := newEchoWriter(pw, log.Default())
+	start := time.Now()
+	for range echoBacklog * 2 {
+		if n, err := e.Write([]byte("line\n")); n != 5 || err != nil {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("writes to a blocked echo took %v", d)
+	}
+	if e.dropped == 0 {
+		t.Fatalf("nothing is dropped from a blocked echo")
+	}
+
+	// A failing echo is drained without writing.
+	pr.Close()
+	e.Close(5 * time.Second)
+	select {
+	case <-e.done:
+	default:
+		t.Fatalf("echo isn't drained after the reader is closed")
+	}
+}
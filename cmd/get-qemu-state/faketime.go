@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// libfaketimePaths are where distributions install libfaketime.
+var libfaketimePaths = []string{
+	"/usr/lib/x86_64-linux-gnu/faketime/libfaketime.so.1",
+	"/usr/lib/aarch64-linux-gnu/faketime/libfaketime.so.1",
+	"/usr/lib/riscv64-linux-gnu/faketime/libfaketime.so.1",
+	"/usr/lib/faketime/libfaketime.so.1",
+	"/usr/lib64/faketime/libfaketime.so.1",
+	"/usr/local/lib/faketime/libfaketime.so.1",
+}
+
+func findLibfaketime() string {
+	for _, p := range libfaketimePaths {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// setRTCBase makes the guest RTC start at t and advance only while the guest
+// runs, by setting base and clock of -rtc in args (or adding one).
+func setRTCBase(args []string, t time.Time) []string {
+	base := "base=" + t.UTC().Format("2006-01-02T15:04:05")
+	res := append([]string{}, args...)
+	for i := 0; i < len(res)-1; i++ {
+		if res[i] != "-rtc" {
+			continue
+		}
+		opts := []string{base}
+		hasClock := false
+		for _, o := range strings.Split(res[i+1], ",") {
+			switch {
+			case strings.HasPrefix(o, "base="):
+				continue
+			case strings.HasPrefix(o, "clock="):
+				hasClock = true
+			}
+			opts = append(opts, o)
+		}
+		if !hasClock {
+			opts = append(opts, "clock=vm")
+		}
+		res[i+1] = strings.Join(opts, ",")
+		return res
+	}
+	return append(res, "-rtc", base+",clock=vm")
+}
+
+// faketimeEnv returns the env making QEMU itself see t as the start time
+// through libfaketime at lib.
+func faketimeEnv(t time.Time, lib string) []string {
+	return []string{
+		"LD_PRELOAD=" + lib,
+		"FAKETIME=@" + t.UTC().Format("2006-01-02 15:04:05"),
+		"TZ=UTC",
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSetRTCBase(t *testing.T) {
+	ft := time.Date(2024, 1, 2, 12, 34, 56, 0, time.FixedZone("JST", 9*60*60))
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{
+			args: []string{"-m", "512M"},
+			want: []string{"-m", "512M", "-rtc", "base=2024-01-02T03:34:56,clock=vm"},
+		},
+		{
+			args: []string{"-rtc", "base=localtime,driftfix=slew"},
+			want: []string{"-rtc", "base=2024-01-02T03:34:56,driftfix=slew,clock=vm"},
+		},
+		{
+			args: []string{"-rtc", "clock=host"},
+			want: []string{"-rtc", "base=2024-01-02T03:34:56,clock=host"},
+		},
+	} {
+		if got := setRTCBase(tt.args, ft); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("setRTCBase(%v) = %v; want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestFaketimeEnv(t *testing.T) {
+	ft := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	env := faketimeEnv(ft, "/usr/lib/faketime/libfaketime.so.1")
+	for _, want := range []string{"LD_PRELOAD=/usr/lib/faketime/libfaketime.so.1", "FAKETIME=@2024-01-02 03:04:05", "TZ=UTC"} {
+		if !slices.Contains(env, want) {
+			t.Errorf("%q isn't in %v", want, env)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// finalizeBackoff is the wait before the first retry of a finalize step,
+// doubled after each failed retry.
+var finalizeBackoff = 100 * time.Millisecond
+
+// transientFileError reports whether err may come from another process (e.g.
+// a virus scanner or an indexer) briefly holding a file just written.
+func transientFileError(err error) bool {
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryFinalize runs op finalizing a written file, retrying it up to
+// -finalize-retries times while it fails with a transient error.
+func (cfg *config) retryFinalize(what string, op func() error) error {
+	err := op()
+	for i := 0; i < cfg.finalizeRetries && err != nil && transientFileError(err); i++ {
+		wait := finalizeBackoff << i
+		cfg.logger.Printf("WARNING: failed to %s (%v); retrying in %v (%d/%d)", what, err, wait, i+1, cfg.finalizeRetries)
+		time.Sleep(wait)
+		if err = op(); err == nil {
+			cfg.logger.Printf("%s succeeded after %d retries", what, i+1)
+		}
+	}
+	return err
+}
+
+// rename renames the written file oldpath to newpath, retrying on transient
+// errors.
+func (cfg *config) rename(oldpath, newpath string) error {
+	return cfg.retryFinalize("rename "+oldpath, func() error { return os.Rename(oldpath, newpath) })
+}
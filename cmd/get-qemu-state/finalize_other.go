@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// transientErrnos are the errors of a file briefly held by another process.
+// EACCES isn't one of them, as it's a real permission error here.
+var transientErrnos = []error{syscall.EBUSY, syscall.ETXTBSY}
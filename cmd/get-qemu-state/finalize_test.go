@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTransientFileError(t *testing.T) {
+	for _, errno := range transientErrnos {
+		if err := (&os.LinkError{Op: "rename", Old: "a", New: "b", Err: errno}); !transientFileError(err) {
+			t.Errorf("%v: not transient", err)
+		}
+	}
+	for _, err := range []error{
+		nil,
+		errors.New("some error"),
+		&fs.PathError{Op: "rename", Path: "a", Err: syscall.ENOENT},
+		&fs.PathError{Op: "rename", Path: "a", Err: syscall.EINVAL},
+		&fs.PathError{Op: "rename", Path: "a", Err: syscall.EACCES},
+	} {
+		if transientFileError(err) {
+			t.Errorf("%v: transient", err)
+		}
+	}
+}
+
+func TestRetryFinalize(t *testing.T) {
+	defer func(d time.Duration) { finalizeBackoff = d }(finalizeBackoff)
+	finalizeBackoff = time.Millisecond
+
+	cfg := &config{finalizeRetries: 3, logger: log.Default()}
+	calls := 0
+	err := cfg.retryFinalize("rename", func() error {
+		if calls++; calls < 3 {
+			return &os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ETXTBSY}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("got %v after %d calls; want success on the 3rd", err, calls)
+	}
+
+	calls = 0
+	err = cfg.retryFinalize("rename", func() error {
+		calls++
+		return &fs.PathError{Op: "chmod", Path: "a", Err: syscall.EBUSY}
+	})
+	if !errors.Is(err, syscall.EBUSY) || calls != 4 {
+		t.Fatalf("got %v after %d calls; want EBUSY after 3 retries", err, calls)
+	}
+
+	calls = 0
+	err = cfg.retryFinalize("rename", func() error {
+		calls++
+		return &fs.PathError{Op: "rename", Path: "a", Err: syscall.ENOENT}
+	})
+	if !errors.Is(err, syscall.ENOENT) || calls != 1 {
+		t.Fatalf("got %v after %d calls; want ENOENT without retries", err, calls)
+	}
+}
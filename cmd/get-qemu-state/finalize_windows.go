@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// transientErrnos are the errors of a file briefly held by another process.
+// A scanner opening the file without sharing it makes renaming or removing
+// it fail with a sharing violation.
+var transientErrnos = []error{syscall.ERROR_ACCESS_DENIED, windows.ERROR_SHARING_VIOLATION, windows.ERROR_LOCK_VIOLATION}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestTransientFileErrorSharingViolation(t *testing.T) {
+	for _, errno := range []error{windows.ERROR_SHARING_VIOLATION, windows.ERROR_LOCK_VIOLATION} {
+		if err := (&os.LinkError{Op: "rename", Old: "a", New: "b", Err: errno}); !transientFileError(err) {
+			t.Errorf("%v: not transient", err)
+		}
+	}
+}
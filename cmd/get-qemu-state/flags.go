@@ -0,0 +1,21 @@
+package main
+
+import "fmt"
+
+type sliceFlags []string
+
+func (f *sliceFlags) String() string {
+	var s []string = *f
+	return fmt.Sprintf("%v", s)
+}
+
+// Get returns the values, letting them be copied to another flag set one by
+// one.
+func (f *sliceFlags) Get() any {
+	return []string(*f)
+}
+
+func (f *sliceFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
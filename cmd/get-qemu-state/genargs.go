@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archDefaults are the arch-specific parts of the args generated by
+// "generate-args", following config/qemu/args-*.json.template, and the
+// capture defaults for the machine of those args, used by -arch unless
+// -marker, -boot-timeout or -boot-pattern is given. A new arch only needs an
+// entry here.
+var archDefaults = map[string]struct {
+	args    []string
+	kernel  string
+	cmdline string
+
+	// marker is printed by the guest init once it's ready.
+	marker string
+	// bootTimeout leaves room for booting under TCG, which the arches
+	// other than the host's run with.
+	bootTimeout time.Duration
+	// bootPattern matches the first kernel line, after the banners of
+	// QEMU and the firmware, for -ignore-before-boot.
+	bootPattern string
+}{
+	"x86_64": {
+		kernel:      "bzImage",
+		cmdline:     "earlyprintk=ttyS0,115200n8 console=ttyS0,115200n8 root=/dev/vda rootwait acpi=off ro",
+		marker:      defaultWaitString,
+		bootTimeout: 20 * time.Minute,
+		bootPattern: defaultBootPattern,
+	},
+	"aarch64": {
+		args:        []string{"-cpu", "cortex-a53", "-machine", "virt"},
+		kernel:      "Image",
+		cmdline:     "earlyprintk=ttyS0 console=ttyS0 root=/dev/vda rootwait no_console_suspend ro",
+		marker:      defaultWaitString,
+		bootTimeout: 30 * time.Minute,
+		// arm64 kernels print this before the version.
+		bootPattern: "Booting Linux on physical CPU|" + defaultBootPattern,
+	},
+	"riscv64": {
+		args:        []string{"-machine", "virt"},
+		kernel:      "Image",
+		cmdline:     "earlyprintk=ttyS0 console=ttyS0 root=/dev/vda rootwait ro",
+		marker:      defaultWaitString,
+		bootTimeout: 30 * time.Minute,
+		// Printed after the OpenSBI banner.
+		bootPattern: defaultBootPattern,
+	},
+}
+
+// defaultBootPattern matches the first line of the Linux kernel.
+const defaultBootPattern = "Linux version "
+
+// archBootPatterns lists the boot patterns of archDefaults for the help.
+func archBootPatterns() string {
+	var l []string
+	for _, arch := range slices.Sorted(maps.Keys(archDefaults)) {
+		l = append(l, arch+": "+strconv.Quote(archDefaults[arch].bootPattern))
+	}
+	return strings.Join(l, ", ")
+}
+
+// qemuArch returns the arch of a qemu-system-ARCH binary, or "".
+func qemuArch(qemu string) string {
+	arch, ok := strings.CutPrefix(filepath.Base(qemu), "qemu-system-")
+	if !ok {
+		return ""
+	}
+	return arch
+}
+
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "arm64":
+		return "aarch64"
+	case "riscv64":
+		return "riscv64"
+	default:
+		return "x86_64"
+	}
+}
+
+// runGenerateArgs implements "get-qemu-state generate-args [flags]". It
+// prints a starter args JSON to w, to be edited and passed by -args-json.
+func runGenerateArgs(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("generate-args", flag.ContinueOnError)
+	var (
+		arch    = fs.String("arch", hostArch(), "guest architecture (x86_64, aarch64 or riscv64)")
+		kernel  = fs.String("kernel", "", "path to the guest kernel (default: bzImage for x86_64, Image otherwise)")
+		drive   = fs.String("drive", "rootfs.bin", "path to the raw root filesystem image")
+		bios    = fs.String("bios", "", "path to the firmware (e.g. edk2-aarch64-code.fd)")
+		dataDir = fs.String("L", "", "directory QEMU looks up firmware and option ROMs in")
+		appendS = fs.String("append", "", "kernel parameters added to the default ones")
+		memory  = fs.Int("memory", 512, "guest memory size in MiB")
+		smp     = fs.Int("smp", 1, "number of guest CPUs")
+		qmpSock = fs.String("qmp", "", "path to a QMP server socket added to the args, used by get-qemu-state to detect the migration completion reliably")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	d, ok := archDefaults[*arch]
+	if !ok {
+		return fmt.Errorf("unsupported arch %q", *arch)
+	}
+	if *kernel == "" {
+		*kernel = d.kernel
+	}
+	cmdline := d.cmdline
+	if *appendS != "" {
+		cmdline += " " + *appendS
+	}
+
+	// The guest console and the human monitor are multiplexed on stdio with
+	// -nographic, which is what get-qemu-state drives and watches for the
+	// marker printed by the init.
+	a := append([]string{}, d.args...)
+	if *bios != "" {
+		a = append(a, "-bios", *bios)
+	}
+	a = append(a,
+		"-nographic",
+		"-m", strconv.Itoa(*memory)+"M",
+		"-smp", fmt.Sprintf("%d,sockets=%d", *smp, *smp),
+		"-accel", "tcg,tb-size=500,thread=multi",
+	)
+	if *dataDir != "" {
+		a = append(a, "-L", *dataDir)
+	}
+	a = append(a,
+		"-drive", "if=virtio,format=raw,file="+*drive,
+		"-kernel", *kernel,
+		"-append", cmdline,
+	)
+	if *qmpSock != "" {
+		a = append(a, "-qmp", "unix:"+*qmpSock+",server=on,wait=off")
+	}
+
+	data, err := json.MarshalIndent(a, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
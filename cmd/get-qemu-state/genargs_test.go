@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestGenerateArgs(t *testing.T) {
+	for _, arch := range []string{"x86_64", "aarch64", "riscv64"} {
+		var buf bytes.Buffer
+		if err := runGenerateArgs([]string{"-arch", arch, "-drive", "/pack/rootfs.bin", "-qmp", "/tmp/qmp.sock"}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		var args []string
+		if err := json.Unmarshal(buf.Bytes(), &args); err != nil {
+			t.Fatalf("%s: invalid args JSON: %v", arch, err)
+		}
+		if !slices.Contains(args, "-nographic") || !slices.Contains(args, "if=virtio,format=raw,file=/pack/rootfs.bin") {
+			t.Errorf("%s: unexpected args %v", arch, args)
+		}
+		if _, addr, ok := qmpAddr(args); !ok || addr != "/tmp/qmp.sock" {
+			t.Errorf("%s: QMP socket isn't detected in %v", arch, args)
+		}
+	}
+	if err := runGenerateArgs([]string{"-arch", "mips"}, &bytes.Buffer{}); err == nil {
+		t.Error("unsupported arch is accepted")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// The marker helper is a script staged into the guest over 9p by
+// -stage-marker-helper. The guest prints helperToken, which is always
+// accepted as a marker, by running it:
+//
+//	mount -t 9p -o trans=virtio,version=9p2000.L get-qemu-state /mnt &&
+//	  cp /mnt/get-qemu-state-ready /tmp/ && umount /mnt &&
+//	  /tmp/get-qemu-state-ready [/dev/ttyS0]
+//
+// The share must be unmounted before the snapshot as QEMU doesn't migrate a
+// guest with a mounted 9p export. The helper writes to /dev/console unless
+// another device (or file) is given. Being a shell script, it works on any
+// guest architecture.
+const (
+	helperToken    = "get-qemu-state: guest ready 5c2f8d1e"
+	helperMountTag = "get-qemu-state"
+	helperName     = "get-qemu-state-ready"
+)
+
+var helperScript = `#!/bin/sh
+# Signals get-qemu-state that the guest is ready.
+printf '\n%s\n' '` + helperToken + `' > "${1:-/dev/console}"
+`
+
+// stageHelper writes the helper to dir and returns the args sharing dir with
+// the guest.
+func stageHelper(dir string) ([]string, error) {
+	if err := os.WriteFile(filepath.Join(dir, helperName), []byte(helperScript), 0755); err != nil {
+		return nil, err
+	}
+	return []string{"-virtfs", "local,path=" + dir + ",mount_tag=" + helperMountTag + ",security_model=none,readonly=on"}, nil
+}
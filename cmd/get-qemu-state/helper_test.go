@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStageHelper(t *testing.T) {
+	dir := t.TempDir()
+	args, err := stageHelper(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 2 || args[0] != "-virtfs" || !strings.Contains(args[1], "path="+dir+",mount_tag="+helperMountTag) {
+		t.Errorf("unexpected args %v", args)
+	}
+	out := filepath.Join(t.TempDir(), "console")
+	if err := exec.Command(filepath.Join(dir, helperName), out).Run(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), helperToken) {
+		t.Errorf("helper printed %q", data)
+	}
+}
+
+func TestCaptureMarkerHelper(t *testing.T) {
+	t.Setenv("STUB_QEMU_MARKER", helperToken)
+	cfg := stubConfig(t)
+	cfg.stageMarkerHelper = true
+	cfg.bootTimeout = 5 * time.Second
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// hmp drives the QEMU human monitor multiplexed with the guest console on
+// stdio. Its output is read back through the console.
+type hmp struct {
+	w   io.Writer
+	con *console
+	// compress migrates through gzip (see migrationPlan).
+	compress bool
+	active   bool
+}
+
+// enter switches the multiplexed stdio to the monitor.
+func (m *hmp) enter() error {
+	if m.active {
+		return nil
+	}
+	if _, err := m.w.Write([]byte{byte(0x01), byte('c')}); err != nil { // send Ctrl-A C to start the monitor mode
+		return fmt.Errorf("failed to start monitor: %w", err)
+	}
+	m.active = true
+	return nil
+}
+
+// leave switches the multiplexed stdio back to the guest console.
+func (m *hmp) leave() error {
+	if !m.active {
+		return nil
+	}
+	if _, err := m.w.Write([]byte{byte(0x01), byte('c')}); err != nil {
+		return fmt.Errorf("failed to leave monitor: %w", err)
+	}
+	m.active = false
+	return nil
+}
+
+func (m *hmp) run(command string) error {
+	if err := m.enter(); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(m.w, command+"\n"); err != nil {
+		return fmt.Errorf("failed to invoke %q: %w", command, err)
+	}
+	return nil
+}
+
+// waitStatus polls "info status" until the VM reports status. A response
+// with another status is detected by the prompt following it, so that the
+// next poll comes soon after.
+func (m *hmp) waitStatus(ctx context.Context, status string) error {
+	for {
+		w := m.con.watch("VM status: " + status)
+		prompt := m.con.watch("\n(qemu) ")
+		if err := m.run("info status"); err != nil {
+			m.con.unwatch(prompt)
+			return err
+		}
+		pollCtx, cancel := context.WithTimeout(ctx, time.Second)
+		select {
+		case <-w.found:
+		case <-prompt.found:
+		case <-pollCtx.Done():
+		}
+		cancel()
+		m.con.unwatch(prompt)
+		select {
+		case <-w.found:
+			return nil
+		default:
+			m.con.unwatch(w)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("VM didn't reach status %q: %w", status, ctx.Err())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// migrate saves the VM state to path. The VM stays stopped afterwards. HMP
+// doesn't report the completion; QEMU creates the file when the migration
+// starts and the VM is "paused (postmigrate)" once it completed.
+func (m *hmp) migrate(ctx context.Context, path string) error {
+	if m.compress {
+		// The file appears only once gzip is done; there's no point in
+		// reissuing the command until then.
+		if err := m.run("migrate " + hmpQuote(compressURI(path))); err != nil {
+			return err
+		}
+		if err := m.waitStatus(ctx, "paused (postmigrate)"); err != nil {
+			return err
+		}
+		return waitCompressed(ctx, path)
+	}
+	for {
+		if err := m.run(fmt.Sprintf("migrate file:%s", path)); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+		if _, err := os.Stat(path); err == nil {
+			return m.waitStatus(ctx, "paused (postmigrate)")
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to stat state file: %w", err)
+		}
+	}
+}
+
+// waitRunning waits for the VM to run (e.g. after restoring a state) and gives
+// the stdio back to the guest console.
+func (m *hmp) waitRunning(ctx context.Context) error {
+	if err := m.waitStatus(ctx, "running"); err != nil {
+		return err
+	}
+	return m.leave()
+}
+
+// pmemsave saves the memory and gives the stdio back to the guest console once
+// the file is fully written.
+func (m *hmp) pmemsave(ctx context.Context, addr, size int64, path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := m.run(fmt.Sprintf("pmemsave %d %d %s", addr, size, path)); err != nil {
+		return err
+	}
+	for {
+		if fi, err := os.Stat(path); err == nil && fi.Size() >= size {
+			return m.leave()
+		}
+		select {
+		case <-ctx.Done():
+			m.leave()
+			return fmt.Errorf("pmemsave didn't complete: %w", ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// dumpGuestMemory dumps the guest memory and gives the stdio back to the guest
+// console. The monitor processes the next command after the dump completes,
+// so the dump is complete once "info status" answers.
+func (m *hmp) dumpGuestMemory(ctx context.Context, path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := m.run("dump-guest-memory " + path); err != nil {
+		return err
+	}
+	if err := m.waitStatus(ctx, ""); err != nil {
+		m.leave()
+		return fmt.Errorf("dump-guest-memory didn't complete: %w", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		m.leave()
+		return fmt.Errorf("dump-guest-memory didn't write the dump: %w", err)
+	}
+	return m.leave()
+}
+
+// precheckMigration reports the error printed by the monitor, if any, while
+// the migration starts.
+func (m *hmp) precheckMigration(ctx context.Context) error {
+	errCh := make(chan string, 1)
+	removeHook := m.con.addLineHook(func(line string) {
+		if _, msg, ok := strings.Cut(line, "Error: "); ok {
+			select {
+			case errCh <- msg:
+			default:
+			}
+		}
+	})
+	defer removeHook()
+	defer m.leave() // already left once running
+	if err := m.run("migrate file:/dev/null"); err != nil {
+		return err
+	}
+	select {
+	case msg := <-errCh:
+		return errors.New(msg)
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := m.run("migrate_cancel"); err != nil {
+		return err
+	}
+	// The migration may have completed before the cancel; let the guest run
+	// anyway.
+	if err := m.run("cont"); err != nil {
+		return err
+	}
+	return m.waitRunning(ctx)
+}
+
+func (m *hmp) stop(ctx context.Context) error {
+	if err := m.run("stop"); err != nil {
+		return err
+	}
+	return m.waitStatus(ctx, "paused")
+}
+
+func (m *hmp) quit() error {
+	return m.run("quit")
+}
+
+// checkpoint saves the VM state to path and lets the guest continue.
+func (m *hmp) checkpoint(ctx context.Context, path string) error {
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := m.run("migrate file:" + tmp); err != nil {
+		return err
+	}
+	if err := m.waitStatus(ctx, "paused (postmigrate)"); err != nil {
+		return err
+	}
+	if err := m.run("cont"); err != nil {
+		return err
+	}
+	if err := m.leave(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// hmpQuote quotes s as a single string argument of an HMP command.
+func hmpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
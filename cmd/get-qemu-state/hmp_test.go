@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeMonitor prints the reply to every HMP command typed to the returned
+// writer to con, if any.
+func fakeMonitor(t *testing.T, con *console, reply func(command string) string) io.Writer {
+	r, w := io.Pipe()
+	t.Cleanup(func() { w.Close() })
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			if out := reply(strings.ReplaceAll(s.Text(), "\x01c", "")); out != "" {
+				fmt.Fprintf(con, "%s\r\n", out)
+			}
+		}
+	}()
+	return w
+}
+
+func TestHMPPrecheckMigrationCleansUp(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name    string
+		ctx     context.Context
+		reply   string
+		wantErr string
+	}{
+		{"blocked", context.Background(), "Error: Migration is disabled when using feature 'vhost-user'", "Migration is disabled"},
+		{"canceled", canceled, "", context.Canceled.Error()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			con := newConsole(io.Discard)
+			w := fakeMonitor(t, con, func(command string) string {
+				if command == "migrate file:/dev/null" {
+					return tc.reply
+				}
+				return ""
+			})
+			m := &hmp{w: w, con: con}
+			if err := m.precheckMigration(tc.ctx); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got %v; want %q", err, tc.wantErr)
+			}
+			if m.active {
+				t.Error("the monitor wasn't left")
+			}
+			con.mu.Lock()
+			hooks := len(con.lineHooks)
+			con.mu.Unlock()
+			if hooks != 0 {
+				t.Errorf("%d line hooks left", hooks)
+			}
+		})
+	}
+}
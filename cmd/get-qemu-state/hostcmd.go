@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// hostCommand returns a command running command through the shell. It and
+// its children are killed once ctx is done.
+func hostCommand(ctx context.Context, command string, env []string) *exec.Cmd {
+	c := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	c.Env = append(os.Environ(), env...)
+	killWithChildren(c)
+	return c
+}
+
+// runLogged runs command through the shell with each line of its output
+// logged to logger with prefix.
+func runLogged(ctx context.Context, prefix, command string, env []string, logger *log.Logger) error {
+	c := hostCommand(ctx, command, env)
+	pr, pw := io.Pipe()
+	c.Stdout, c.Stderr = pw, pw
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s := bufio.NewScanner(pr)
+		for s.Scan() {
+			logger.Printf("%s: %s", prefix, s.Text())
+		}
+		io.Copy(io.Discard, pr) // a too long line
+	}()
+	err := c.Run()
+	pw.Close()
+	<-done
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hostMemory describes the host memory configuration affecting whether a
+// state can be restored on another host. Guest RAM backed by huge pages is
+// recorded with that page size in the state and can only be loaded into RAM
+// with the same page size.
+type hostMemory struct {
+	PageSize             int    `json:"pageSize"`
+	TransparentHugePages string `json:"transparentHugePages,omitempty"`
+	// MemoryBackend is the -mem-path or memory-backend object used by the
+	// guest RAM ("" for the default anonymous memory).
+	MemoryBackend string `json:"memoryBackend,omitempty"`
+}
+
+func currentHostMemory(args []string) hostMemory {
+	return hostMemory{
+		PageSize:             os.Getpagesize(),
+		TransparentHugePages: transparentHugePages(),
+		MemoryBackend:        memoryBackend(args),
+	}
+}
+
+// transparentHugePages returns the selected THP mode (e.g. "madvise").
+func transparentHugePages() string {
+	data, err := os.ReadFile("/sys/kernel/mm/transparent_hugepage/enabled")
+	if err != nil {
+		return ""
+	}
+	s := string(data)
+	if i := strings.Index(s, "["); i >= 0 {
+		if j := strings.Index(s[i:], "]"); j >= 0 {
+			return s[i+1 : i+j]
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+func memoryBackend(args []string) string {
+	var backends []string
+	for i := 0; i < len(args)-1; i++ {
+		switch {
+		case args[i] == "-mem-path":
+			backends = append(backends, "mem-path="+args[i+1])
+		case args[i] == "-object" && strings.HasPrefix(args[i+1], "memory-backend-"):
+			backends = append(backends, args[i+1])
+		}
+	}
+	return strings.Join(backends, " ")
+}
+
+// checkPortableMemory fails if args back the guest RAM with huge pages.
+func checkPortableMemory(args []string) error {
+	for i := 0; i < len(args)-1; i++ {
+		v := args[i+1]
+		switch {
+		case args[i] == "-mem-path":
+			return fmt.Errorf("-mem-path %s ties the state to the page size of that mount", v)
+		case args[i] == "-object" && strings.HasPrefix(v, "memory-backend-file,"):
+			return fmt.Errorf("file memory backend (%s) ties the state to the page size of its mount", v)
+		case args[i] == "-object" && strings.HasPrefix(v, "memory-backend-memfd,") && strings.Contains(v, "hugetlb=on"):
+			return errors.New("hugetlb memfd memory backend ties the state to the huge page size")
+		}
+	}
+	return nil
+}
+
+// hostMemoryMismatches describes differences between the host memory a state
+// was captured with and the current one that may break the restore.
+func hostMemoryMismatches(captured, current hostMemory) []string {
+	var res []string
+	if captured.PageSize != current.PageSize {
+		res = append(res, fmt.Sprintf("host page size was %d but is %d", captured.PageSize, current.PageSize))
+	}
+	if captured.MemoryBackend != current.MemoryBackend {
+		res = append(res, fmt.Sprintf("memory backend was %q but is %q", captured.MemoryBackend, current.MemoryBackend))
+	}
+	if captured.TransparentHugePages != current.TransparentHugePages && captured.MemoryBackend != "" {
+		res = append(res, fmt.Sprintf("transparent huge pages were %q but are %q", captured.TransparentHugePages, current.TransparentHugePages))
+	}
+	return res
+}
+
+// defaultGuestMemoryMiB is the guest RAM QEMU gives most machines without -m.
+const defaultGuestMemoryMiB = 128
+
+// guestMemoryMiB returns the guest RAM size set by -m in args: "-m 512",
+// "-m 1G" or "-m size=1G,maxmem=4G" (hotpluggable memory isn't counted).
+// The unit is MiB without a suffix.
+func guestMemoryMiB(args []string) (int64, error) {
+	size := ""
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-m" {
+			size = args[i+1] // the last one wins
+		}
+	}
+	if size == "" {
+		return defaultGuestMemoryMiB, nil
+	}
+	if v, ok := option(size, "size"); ok {
+		size = v
+	} else {
+		size, _, _ = strings.Cut(size, ",")
+	}
+	if size == "" {
+		return 0, errors.New("invalid -m without a size")
+	}
+	shift := 20
+	switch strings.ToUpper(size[len(size)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+	case "G":
+		shift = 30
+	case "T":
+		shift = 40
+	default:
+		size += "M"
+	}
+	n, err := strconv.ParseFloat(size[:len(size)-1], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid -m %q", size)
+	}
+	return int64(n * float64(int64(1)<<shift) / (1 << 20)), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostMemory(t *testing.T) {
+	args := []string{"-m", "1G", "-object", "memory-backend-file,id=mem,size=1G,mem-path=/dev/hugepages", "-machine", "memory-backend=mem"}
+	hm := currentHostMemory(args)
+	if hm.PageSize != os.Getpagesize() {
+		t.Errorf("page size = %d; want %d", hm.PageSize, os.Getpagesize())
+	}
+	if want := "memory-backend-file,id=mem,size=1G,mem-path=/dev/hugepages"; hm.MemoryBackend != want {
+		t.Errorf("memory backend = %q; want %q", hm.MemoryBackend, want)
+	}
+	if err := checkPortableMemory(args); err == nil {
+		t.Errorf("file memory backend must not be portable")
+	}
+	if err := checkPortableMemory([]string{"-m", "1G"}); err != nil {
+		t.Errorf("default memory must be portable: %v", err)
+	}
+
+	// The host memory is recorded in the checkpoint journal.
+	p := journalPath(filepath.Join(t.TempDir(), "checkpoint.state"))
+	if err := writeJournal(p, journal{HostMemory: hm}); err != nil {
+		t.Fatal(err)
+	}
+	j, err := readJournal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.HostMemory != hm {
+		t.Fatalf("recorded %+v; want %+v", j.HostMemory, hm)
+	}
+}
+
+func TestHostMemoryMismatches(t *testing.T) {
+	captured := hostMemory{PageSize: 4096, TransparentHugePages: "always"}
+	if m := hostMemoryMismatches(captured, hostMemory{PageSize: 4096, TransparentHugePages: "never"}); len(m) != 0 {
+		t.Errorf("THP doesn't matter for anonymous memory; got %v", m)
+	}
+	if m := hostMemoryMismatches(captured, hostMemory{PageSize: 16384, TransparentHugePages: "always"}); len(m) != 1 {
+		t.Errorf("page size mismatch must be reported; got %v", m)
+	}
+	hugeCaptured := hostMemory{PageSize: 4096, MemoryBackend: "mem-path=/dev/hugepages"}
+	if m := hostMemoryMismatches(hugeCaptured, hostMemory{PageSize: 4096}); len(m) != 1 {
+		t.Errorf("memory backend mismatch must be reported; got %v", m)
+	}
+}
+
+func TestGuestMemoryMiB(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want int64
+	}{
+		{nil, defaultGuestMemoryMiB},
+		{[]string{"-m", "512"}, 512},
+		{[]string{"-m", "512M"}, 512},
+		{[]string{"-m", "2G"}, 2048},
+		{[]string{"-m", "1.5g"}, 1536},
+		{[]string{"-m", "262144k"}, 256},
+		{[]string{"-m", "size=1G,slots=2,maxmem=4G"}, 1024},
+		{[]string{"-m", "256", "-m", "1024"}, 1024},
+	} {
+		got, err := guestMemoryMiB(tt.args)
+		if err != nil || got != tt.want {
+			t.Errorf("guestMemoryMiB(%q) = %d, %v; want %d", tt.args, got, err, tt.want)
+		}
+	}
+	for _, m := range []string{"lots", "size=", "-1G"} {
+		if _, err := guestMemoryMiB([]string{"-m", m}); err == nil {
+			t.Errorf("-m %q is accepted", m)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+)
+
+// The hot map tells which guest RAM the guest touched before the snapshot,
+// so that restoring can read those parts of the state ahead. QEMU sends a
+// page of all the same byte (normally a never touched zero page) as a one
+// byte "zero page" record and other pages in full, so the heuristic is:
+// pages sent in full are hot. Hot pages are recorded at hotMapGranularity
+// per RAM block for reporting, and the byte ranges of the state holding
+// them, merged across the record headers in between, are the readahead
+// list. A page sent again in a later iteration is read ahead again.
+
+// RAM page record flags (migration/ram.c of QEMU).
+const (
+	ramSaveFlagZero     = 0x02
+	ramSaveFlagMemSize  = 0x04
+	ramSaveFlagPage     = 0x08
+	ramSaveFlagEOS      = 0x10
+	ramSaveFlagContinue = 0x20
+)
+
+// targetPageSize is the guest page size of the RAM records, 4KiB on the
+// architectures container2wasm targets.
+const targetPageSize = 4096
+
+// hotMapGranularity is the size of the guest RAM regions the hot map marks
+// as hot or cold.
+const hotMapGranularity = 2 << 20
+
+// hotMap is written to <output>.hotmap.json by -hot-map.
+type hotMap struct {
+	Granularity int64 `json:"granularity"`
+	// HotBytes is the guest RAM in hot regions, of TotalBytes.
+	HotBytes   int64 `json:"hotBytes"`
+	TotalBytes int64 `json:"totalBytes"`
+	// Blocks are the [start, end) offsets of the hot regions of each RAM
+	// block.
+	Blocks map[string][][2]int64 `json:"blocks"`
+	// Readahead are the [offset, length] ranges of the state holding the
+	// hot pages, in the stream order.
+	Readahead [][2]int64 `json:"readahead"`
+}
+
+func hotMapPath(output string) string {
+	return output + ".hotmap.json"
+}
+
+// stateHotMap returns the hot map of the state at path.
+func stateHotMap(path string) (*hotMap, error) {
+	s := newRAMScanner()
+	if err := s.scanState(path); err != nil {
+		return nil, err
+	}
+	m := &hotMap{Granularity: hotMapGranularity, Blocks: make(map[string][][2]int64), Readahead: s.readahead}
+	for _, n := range s.size {
+		m.TotalBytes += n
+	}
+	for block, regions := range s.hot {
+		for _, r := range slices.Sorted(maps.Keys(regions)) {
+			start, end := r*hotMapGranularity, (r+1)*hotMapGranularity
+			if n := s.size[block]; n > start && n < end {
+				end = n
+			}
+			m.HotBytes += end - start
+			if rs := m.Blocks[block]; len(rs) > 0 && rs[len(rs)-1][1] == start {
+				rs[len(rs)-1][1] = end
+				continue
+			}
+			m.Blocks[block] = append(m.Blocks[block], [2]int64{start, end})
+		}
+	}
+	return m, nil
+}
+
+type ramScanner struct {
+	hot       map[string]map[int64]bool // block -> hot region indices
+	size      map[string]int64          // block -> used length
+	readahead [][2]int64
+	// pages (if not nil) are the state offsets of the last full copy of
+	// each page (block -> guest offset -> state offset), and copies those
+	// of all the full copies in the stream order.
+	pages  map[string]map[int64]int64
+	copies []int64
+	block  string
+}
+
+func newRAMScanner() *ramScanner {
+	return &ramScanner{
+		hot:  make(map[string]map[int64]bool),
+		size: make(map[string]int64),
+	}
+}
+
+// scanState scans the RAM sections of the state at path.
+func (s *ramScanner) scanState(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p, err := parseStream(f)
+	if err != nil {
+		return err
+	}
+	for _, c := range p.chunks {
+		if c.name != "ram" {
+			continue
+		}
+		if err := s.scan(f, c); err != nil {
+			return fmt.Errorf("RAM at offset %d: %w", c.off, err)
+		}
+	}
+	return nil
+}
+
+// scan reads the page records of the RAM section chunk c of f.
+func (s *ramScanner) scan(f *os.File, c streamChunk) error {
+	if c.size < 5 {
+		return errors.New("truncated section")
+	}
+	r := &offsetReader{r: bufio.NewReaderSize(io.NewSectionReader(f, c.off, c.size-5), 64<<10), off: c.off} // without the footer
+	typ, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	hdr := 4 // section ID
+	if typ == vmSectionStart || typ == vmSectionFull {
+		if err := r.skip(4); err != nil {
+			return err
+		}
+		n, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		hdr = int(n) + 8 // idstr, instance ID, version ID
+	}
+	if err := r.skip(hdr); err != nil {
+		return err
+	}
+	for {
+		v, err := r.be64()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		addr, flags := int64(v&^(targetPageSize-1)), v&(targetPageSize-1)
+		switch {
+		case flags&ramSaveFlagMemSize != 0:
+			if err := s.readBlocks(r, addr); err != nil {
+				return err
+			}
+			continue
+		case flags&ramSaveFlagEOS != 0:
+			continue
+		}
+		if flags&ramSaveFlagContinue == 0 {
+			if s.block, err = r.idstr(); err != nil {
+				return err
+			}
+		}
+		switch {
+		case flags&ramSaveFlagZero != 0:
+			if s.pages != nil {
+				delete(s.pages[s.block], addr) // overwritten in a later iteration
+			}
+			err = r.skip(1)
+		case flags&ramSaveFlagPage != 0:
+			if s.pages != nil {
+				if s.pages[s.block] == nil {
+					s.pages[s.block] = make(map[int64]int64)
+				}
+				s.pages[s.block][addr] = r.off
+				s.copies = append(s.copies, r.off)
+			}
+			if s.hot[s.block] == nil {
+				s.hot[s.block] = make(map[int64]bool)
+			}
+			s.hot[s.block][addr/hotMapGranularity] = true
+			if ra := s.readahead; len(ra) > 0 && r.off-(ra[len(ra)-1][0]+ra[len(ra)-1][1]) <= targetPageSize {
+				ra[len(ra)-1][1] = r.off + targetPageSize - ra[len(ra)-1][0]
+			} else {
+				s.readahead = append(s.readahead, [2]int64{r.off, targetPageSize})
+			}
+			err = r.skip(targetPageSize)
+		default:
+			// Compressed, XBZRLE or multifd pages aren't used by a
+			// migration to a file with the default capabilities.
+			return fmt.Errorf("unsupported page record flags 0x%x", flags)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readBlocks reads the RAM block list of total bytes at the section start.
+func (s *ramScanner) readBlocks(r *offsetReader, total int64) error {
+	for sum := int64(0); sum < total; {
+		name, err := r.idstr()
+		if err != nil {
+			return err
+		}
+		n, err := r.be64()
+		if err != nil {
+			return err
+		}
+		s.size[name] = int64(n)
+		sum += int64(n)
+	}
+	return nil
+}
+
+// offsetReader tracks the offset of r in the state.
+type offsetReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+func (r *offsetReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.off++
+	}
+	return b, err
+}
+
+func (r *offsetReader) skip(n int) error {
+	d, err := r.r.Discard(n)
+	r.off += int64(d)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *offsetReader) be64() (uint64, error) {
+	var b [8]byte
+	n, err := io.ReadFull(r.r, b[:])
+	r.off += int64(n)
+	if err != nil {
+		return 0, err // io.EOF only at a record boundary
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func (r *offsetReader) idstr() (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	m, err := io.ReadFull(r.r, b)
+	r.off += int64(m)
+	return string(b), err
+}
+
+// writeHotMap writes the hot map of state to hotMapPath(output).
+func writeHotMap(state, output string) (*hotMap, error) {
+	m, err := stateHotMap(state)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return m, os.WriteFile(hotMapPath(output), append(data, '\n'), 0644)
+}
+
+// prefetchState reads the readahead ranges of state into the page cache and
+// returns the bytes read.
+func prefetchState(state string, readahead [][2]int64) (int64, error) {
+	f, err := os.Open(state)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var total int64
+	for _, r := range readahead {
+		n, err := io.Copy(io.Discard, io.NewSectionReader(f, r[0], r[1]))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// runPrefetch implements "get-qemu-state prefetch <state>", warming the page
+// cache with the hot pages listed by <state>.hotmap.json before a restore.
+func runPrefetch(args []string) error {
+	fs := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	mapPath := fs.String("hot-map", "", "path to the hot map (default: <state>.hotmap.json)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("specify the state file")
+	}
+	state := fs.Arg(0)
+	if *mapPath == "" {
+		*mapPath = hotMapPath(state)
+	}
+	data, err := os.ReadFile(*mapPath)
+	if err != nil {
+		return err
+	}
+	var m hotMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", *mapPath, err)
+	}
+	n, err := prefetchState(state, m.Readahead)
+	if err != nil {
+		return err
+	}
+	log.Printf("read %d bytes of hot pages ahead", n)
+	return nil
+}
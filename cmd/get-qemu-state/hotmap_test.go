@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// ramRecords writes RAM page records.
+type ramRecords struct {
+	bytes.Buffer
+	pages map[int64][]byte // state offset (relative to the records) -> page
+}
+
+func (r *ramRecords) be64(v uint64) {
+	binary.Write(r, binary.BigEndian, v)
+}
+
+func (r *ramRecords) idstr(s string) {
+	r.WriteByte(byte(len(s)))
+	r.WriteString(s)
+}
+
+func (r *ramRecords) page(block string, addr int64, fill byte) {
+	flags := uint64(ramSaveFlagPage)
+	if block == "" {
+		flags |= ramSaveFlagContinue
+	}
+	r.be64(uint64(addr) | flags)
+	if block != "" {
+		r.idstr(block)
+	}
+	if r.pages == nil {
+		r.pages = make(map[int64][]byte)
+	}
+	p := bytes.Repeat([]byte{fill}, targetPageSize)
+	r.pages[int64(r.Len())] = p
+	r.Write(p)
+}
+
+func (r *ramRecords) zero(addr int64) {
+	r.be64(uint64(addr) | ramSaveFlagZero | ramSaveFlagContinue)
+	r.WriteByte(0)
+}
+
+func TestHotMap(t *testing.T) {
+	var b stateBuilder
+	b.u32(vmFileMagic)
+	b.u32(vmFileVersion)
+
+	var setup ramRecords
+	setup.be64((16 << 20) | ramSaveFlagMemSize)
+	setup.idstr("pc.ram")
+	setup.be64(15 << 20)
+	setup.idstr("vga.vram")
+	setup.be64(1 << 20)
+	setup.be64(ramSaveFlagEOS)
+	b.section(vmSectionStart, 2, "ram", 0, setup.Bytes(), true)
+
+	var iter ramRecords
+	iter.page("pc.ram", 0, 1)
+	iter.page("", targetPageSize, 2) // contiguous with the previous page
+	iter.zero(2 * targetPageSize)
+	iter.zero(3 << 20)
+	iter.page("", 9<<20, 3)
+	iter.page("vga.vram", 0, 4)
+	iter.be64(ramSaveFlagEOS)
+	iterOff := int64(b.Len()) + 5 // after the section header
+	b.section(vmSectionPart, 2, "", 0, iter.Bytes(), true)
+
+	b.section(vmSectionFull, 3, "virtio-blk", 0, make([]byte, 2*targetPageSize), true)
+
+	var last ramRecords
+	last.page("pc.ram", 14<<20, 5)
+	last.be64(ramSaveFlagEOS)
+	lastOff := int64(b.Len()) + 5
+	b.section(vmSectionEnd, 2, "", 0, last.Bytes(), true)
+	b.section(vmSectionFull, 4, "serial", 0, make([]byte, 10), true)
+	b.WriteByte(vmEOF)
+
+	state := filepath.Join(t.TempDir(), "vm.state")
+	if err := os.WriteFile(state, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := stateHotMap(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBlocks := map[string][][2]int64{
+		"pc.ram":   {{0, 2 << 20}, {8 << 20, 10 << 20}, {14 << 20, 15 << 20}},
+		"vga.vram": {{0, 1 << 20}},
+	}
+	if !reflect.DeepEqual(m.Blocks, wantBlocks) {
+		t.Errorf("hot regions %v; want %v", m.Blocks, wantBlocks)
+	}
+	if m.TotalBytes != 16<<20 || m.HotBytes != 6<<20 {
+		t.Errorf("hot %d of %d bytes; want %d of %d", m.HotBytes, m.TotalBytes, 6<<20, 16<<20)
+	}
+
+	// Every page is read ahead, and nothing but the pages and the
+	// headers in between.
+	var pages int64
+	for off, p := range iter.pages {
+		if !covered(m.Readahead, iterOff+off, targetPageSize) {
+			t.Errorf("page at %d isn't read ahead", iterOff+off)
+		}
+		if !bytes.Equal(b.Bytes()[iterOff+off:iterOff+off+targetPageSize], p) {
+			t.Fatalf("bad fixture at %d", iterOff+off)
+		}
+		pages++
+	}
+	for off := range last.pages {
+		if !covered(m.Readahead, lastOff+off, targetPageSize) {
+			t.Errorf("page at %d isn't read ahead", lastOff+off)
+		}
+		pages++
+	}
+	if len(m.Readahead) != 2 {
+		t.Errorf("readahead %v; want the pages merged across the small records between them but not across the device state", m.Readahead)
+	}
+
+	n, err := prefetchState(state, m.Readahead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < pages*targetPageSize || n > pages*(targetPageSize+32) {
+		t.Errorf("read %d bytes ahead for %d pages", n, pages)
+	}
+
+	// "prefetch" reads the map written next to the state.
+	if _, err := writeHotMap(state, state); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPrefetch([]string{state}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func covered(ranges [][2]int64, off, n int64) bool {
+	for _, r := range ranges {
+		if off >= r[0] && off+n <= r[0]+r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxICountShift is the largest -icount shift QEMU accepts.
+const maxICountShift = 10
+
+// icountInfo records the -icount settings of a capture. The state restores
+// deterministically only with the same settings.
+type icountInfo struct {
+	Shift int `json:"shift"`
+	// Option is the -icount option to restore the state with.
+	Option string `json:"option"`
+	// ReadyInstructions is the instruction count the guest was stopped
+	// at, with -ready-instructions.
+	ReadyInstructions int64 `json:"readyInstructions,omitempty"`
+}
+
+func newICountInfo(shift int, readyInstructions int64) *icountInfo {
+	return &icountInfo{
+		Shift: shift,
+		// The virtual clock follows the instructions only, also while
+		// the guest idles.
+		Option:            fmt.Sprintf("shift=%d,sleep=off,align=off", shift),
+		ReadyInstructions: readyInstructions,
+	}
+}
+
+// argsICount returns the value of the -icount option of args.
+func argsICount(args []string) (string, bool) {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-icount" {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// setICount returns args with -icount option added, and TCG selected if
+// args select no accelerator. -icount only works under TCG, so args
+// selecting another accelerator (even as a fallback) are refused, as are
+// args with another -icount.
+func setICount(args []string, option string) ([]string, error) {
+	if c, ok := argsICount(args); ok && c != option {
+		return nil, fmt.Errorf("args already give -icount %s, not %s", c, option)
+	} else if ok {
+		return args, nil
+	}
+	res := append([]string{}, args...)
+	c := accelCandidates(args)
+	for _, a := range c {
+		if a != "tcg" {
+			return nil, fmt.Errorf("-icount only works under TCG, but args select %s", strings.Join(c, ", "))
+		}
+	}
+	if len(c) == 0 {
+		res = append(res, "-accel", "tcg")
+	}
+	return append(res, "-icount", option), nil
+}
+
+// checkRestoreICount checks that args restore a state captured with
+// captured (nil without -icount) with the same -icount, adding it if args
+// have none.
+func checkRestoreICount(args []string, captured *icountInfo) ([]string, error) {
+	c, ok := argsICount(args)
+	if captured == nil {
+		if ok {
+			return nil, fmt.Errorf("args give -icount %s, but the state was captured without -icount", c)
+		}
+		return args, nil
+	}
+	if ok && c != captured.Option {
+		return nil, fmt.Errorf("args give -icount %s, but the state was captured with -icount %s", c, captured.Option)
+	}
+	return setICount(args, captured.Option)
+}
+
+// replayFileOption is added to the -icount option for -ready-instructions:
+// QEMU reports the instruction count (query-replay) only while recording.
+func replayFileOption(path string) string {
+	return "rr=record,rrfile=" + path
+}
+
+// waitInstructions polls QMP until the guest ran n instructions and stops
+// the VM. The VM stops within a poll of n, not exactly at it.
+func waitInstructions(ctx context.Context, network, addr string, n int64) (int64, error) {
+	q, err := dialQMP(ctx, network, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+	for {
+		var info struct {
+			Mode   string `json:"mode"`
+			ICount *int64 `json:"icount"`
+		}
+		if err := q.execute(ctx, "query-replay", nil, &info); err != nil {
+			return 0, err
+		}
+		if info.ICount == nil {
+			return 0, errors.New("QEMU doesn't report the instruction count; it needs -icount with rr=record")
+		}
+		if *info.ICount >= n {
+			if err := q.stop(ctx); err != nil {
+				return 0, err
+			}
+			if err := q.execute(ctx, "query-replay", nil, &info); err != nil {
+				return 0, err
+			}
+			return *info.ICount, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// replaceICount returns args with the value of -icount replaced by option.
+func replaceICount(args []string, option string) []string {
+	res := append([]string{}, args...)
+	for i := 0; i < len(res)-1; i++ {
+		if res[i] == "-icount" {
+			res[i+1] = option
+		}
+	}
+	return res
+}
+
+// option is the -icount option of info, "" for nil.
+func (info *icountInfo) option() string {
+	if info == nil {
+		return ""
+	}
+	return info.Option
+}
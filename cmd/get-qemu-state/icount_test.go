@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetICount(t *testing.T) {
+	const opt = "shift=3,sleep=off,align=off"
+	for _, tt := range []struct {
+		args []string
+		want []string
+		err  string
+	}{
+		{
+			args: []string{"-m", "512M"},
+			want: []string{"-m", "512M", "-accel", "tcg", "-icount", opt},
+		},
+		{
+			args: []string{"-accel", "tcg,thread=single"},
+			want: []string{"-accel", "tcg,thread=single", "-icount", opt},
+		},
+		{
+			args: []string{"-icount", opt},
+			want: []string{"-icount", opt},
+		},
+		{
+			args: []string{"-icount", "shift=auto"},
+			err:  "args already give -icount shift=auto",
+		},
+		{
+			args: []string{"-enable-kvm"},
+			err:  "-icount only works under TCG, but args select kvm",
+		},
+		{
+			args: []string{"-machine", "q35,accel=kvm:tcg"},
+			err:  "-icount only works under TCG, but args select kvm, tcg",
+		},
+	} {
+		got, err := setICount(tt.args, opt)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("setICount(%q) = %v; want error %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("setICount(%q) = %q, %v; want %q", tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckRestoreICount(t *testing.T) {
+	captured := newICountInfo(2, 0)
+	got, err := checkRestoreICount([]string{"-m", "512M"}, captured)
+	if err != nil || !reflect.DeepEqual(got, []string{"-m", "512M", "-accel", "tcg", "-icount", captured.Option}) {
+		t.Errorf("got %q, %v; want -icount added", got, err)
+	}
+	if _, err := checkRestoreICount([]string{"-icount", "shift=4,sleep=off,align=off"}, captured); err == nil {
+		t.Error("restored with another -icount")
+	}
+	if _, err := checkRestoreICount([]string{"-icount", captured.Option}, nil); err == nil {
+		t.Error("restored a state captured without -icount with it")
+	}
+}
+
+func TestWaitInstructions(t *testing.T) {
+	f := newFakeQMP(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	n, err := waitInstructions(ctx, "unix", f.sock, 5500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n != 6000 || f.status != "paused" {
+		t.Errorf("stopped at %d instructions (status %q); want 6000 and paused", n, f.status)
+	}
+}
+
+func TestCaptureICount(t *testing.T) {
+	shift := 3
+	cfg := stubConfig(t)
+	cfg.icountShift = &shift
+	cfg.manifest = filepath.Join(t.TempDir(), "manifest.json")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.ICount == nil || m.ICount.Shift != 3 || m.Accel != "tcg" {
+		t.Errorf("manifest has icount %+v and accel %q", m.ICount, m.Accel)
+	}
+	if c, ok := argsICount(m.Args); !ok || c != m.ICount.Option {
+		t.Errorf("args %q don't have -icount %s", m.Args, m.ICount.Option)
+	}
+
+	cfg = stubConfig(t)
+	cfg.icountShift = &shift
+	cfg.accel = "kvm"
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "only works under TCG") {
+		t.Errorf("got %v; want -icount refused under KVM", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// defaultDetachKey is Ctrl-], as telnet's escape.
+const defaultDetachKey = 0x1d
+
+// loadConfig configures "load".
+type loadConfig struct {
+	qemu    string
+	args    []string
+	state   string
+	marker  string
+	timeout time.Duration
+
+	// interactive hands the console over to stdin and stdout once the
+	// guest is restored, until detachKey is typed or QEMU exits.
+	interactive bool
+	detachKey   byte
+	stdin       io.Reader
+	stdout      io.Writer
+}
+
+// runLoad implements "get-qemu-state load [-interactive] -args-json <file>
+// [-state <file>] <qemu>". It restores a state captured with the args and
+// reports the restore time, or hands the guest console over.
+func runLoad(args []string) error {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	argsJSON := fs.String("args-json", "", "path to json file containing the args of the capture")
+	cfg := loadConfig{detachKey: defaultDetachKey, stdin: os.Stdin, stdout: os.Stdout}
+	fs.StringVar(&cfg.state, "state", defaultOutputFile, "path to the state to restore")
+	manifestPath := fs.String("manifest", "", "path to the -manifest of the capture, to check that the args restore it with the same -icount (added if the args have none)")
+	fs.StringVar(&cfg.marker, "marker", "", "once the VM runs, type Enter and wait for this console output (e.g. the shell prompt) before handing the console over")
+	fs.DurationVar(&cfg.timeout, "timeout", 5*time.Minute, "fail if the VM doesn't run (and print -marker) within this duration")
+	fs.BoolVar(&cfg.interactive, "interactive", false, "hand the guest console over to the terminal once the guest is restored, in raw mode and with the window size passed on, instead of quitting QEMU. The console is detached (quitting QEMU) by Ctrl-]; SIGINT, SIGTERM and SIGHUP are passed to QEMU")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *argsJSON == "" {
+		return errors.New("specify -args-json and the QEMU binary")
+	}
+	cfg.qemu = fs.Arg(0)
+	data, err := os.ReadFile(*argsJSON)
+	if err != nil {
+		return fmt.Errorf("failed to get args json: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg.args); err != nil {
+		return fmt.Errorf("failed to parse args json: %w", err)
+	}
+	if *manifestPath != "" {
+		data, err := os.ReadFile(*manifestPath)
+		if err != nil {
+			return err
+		}
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", *manifestPath, err)
+		}
+		if cfg.args, err = checkRestoreICount(cfg.args, m.ICount); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(cfg.state); err != nil {
+		return err
+	}
+	if !cfg.interactive {
+		cfg.stdout = os.Stderr // keep stdout for the result
+	}
+	d, err := load(cfg)
+	if err != nil {
+		return err
+	}
+	if !cfg.interactive {
+		fmt.Printf("%.3f\n", d.Seconds())
+	}
+	return nil
+}
+
+// load restores cfg.state with QEMU on a pty like -pty and returns the time
+// until the VM ran. QEMU is quit afterwards unless cfg.interactive.
+func load(cfg loadConfig) (_ time.Duration, err error) {
+	cmd := exec.Command(cfg.qemu, append(slices.Clone(cfg.args), "-incoming", "file:"+cfg.state)...)
+	cmd.WaitDelay = time.Second
+	master, slave, err := openPTY()
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate pty: %w", err)
+	}
+	defer master.Close()
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, os.Stderr
+	setControllingTerminal(cmd)
+	con := newConsole(cfg.stdout)
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		slave.Close()
+		return 0, fmt.Errorf("failed to start: %w", err)
+	}
+	slave.Close()
+	p := &loadedQEMU{process: cmd.Process, exited: make(chan struct{})}
+	go func() {
+		io.Copy(con, ptyReader{master})
+		p.err = cmd.Wait()
+		close(p.exited)
+	}()
+	defer func() {
+		if err != nil {
+			cmd.Process.Kill()
+			<-p.exited
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+	var m monitor = &hmp{w: master, con: con}
+	if network, addr, ok := qmpAddr(cfg.args); ok {
+		q, err := dialQMP(ctx, network, addr)
+		if err != nil {
+			return 0, err
+		}
+		defer q.Close()
+		m = q
+	}
+	if err := m.waitRunning(ctx); err != nil {
+		return 0, fmt.Errorf("VM didn't run: %w", err)
+	}
+	d := time.Since(start)
+	log.Printf("restored %s in %v", cfg.state, d)
+	if cfg.marker != "" {
+		w := con.watch(cfg.marker)
+		if _, err := master.Write([]byte("\r")); err != nil {
+			return 0, err
+		}
+		if err := con.wait(ctx, w); err != nil {
+			return 0, fmt.Errorf("guest didn't print %q: %w", cfg.marker, err)
+		}
+	}
+	if cfg.interactive {
+		return d, attach(cfg, p, master, m)
+	}
+	if err := m.quit(); err != nil {
+		return 0, err
+	}
+	select {
+	case <-p.exited:
+		if p.err != nil {
+			log.Printf("WARNING: restored QEMU exited with an error: %v", p.err)
+		}
+	case <-ctx.Done():
+		return 0, fmt.Errorf("restored QEMU didn't quit: %w", ctx.Err())
+	}
+	return d, nil
+}
+
+// loadedQEMU is the QEMU process of load. err is set once exited is closed.
+type loadedQEMU struct {
+	process *os.Process
+	exited  chan struct{}
+	err     error
+}
+
+// attach passes cfg.stdin to the guest console on master until the detach
+// key, when QEMU is quit, or until QEMU exits. A terminal on stdin is put in
+// raw mode meanwhile and its window size follows to the pty.
+func attach(cfg loadConfig, qemu *loadedQEMU, master *os.File, m monitor) error {
+	if f, ok := cfg.stdin.(*os.File); ok && isTerminal(f) {
+		restore, err := makeTerminalRaw(f)
+		if err != nil {
+			return err
+		}
+		defer restore()
+		resize := make(chan os.Signal, 1)
+		notifyWinsize(resize)
+		defer signal.Stop(resize)
+		go func() {
+			for range resize {
+				if err := copyWinsize(master, f); err != nil {
+					log.Printf("WARNING: failed to pass the window size on: %v", err)
+				}
+			}
+		}()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	log.Printf("console attached; type Ctrl-] to detach, quitting QEMU\r")
+
+	detached := make(chan struct{})
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := cfg.stdin.Read(buf)
+			p := buf[:n]
+			i := bytes.IndexByte(p, cfg.detachKey)
+			if i >= 0 {
+				p = p[:i]
+			}
+			if _, werr := master.Write(p); werr != nil {
+				return
+			}
+			if i >= 0 {
+				close(detached)
+				return
+			}
+			if err != nil {
+				return // QEMU keeps running until it exits
+			}
+		}
+	}()
+	for {
+		select {
+		case <-qemu.exited:
+			return qemu.err
+		case sig := <-sigs:
+			qemu.process.Signal(sig)
+		case <-detached:
+			log.Printf("detached; quitting QEMU\r")
+			if err := m.quit(); err != nil {
+				return err
+			}
+			select {
+			case <-qemu.exited:
+				return qemu.err
+			case <-time.After(10 * time.Second):
+				return errors.New("QEMU didn't quit")
+			}
+		}
+	}
+}
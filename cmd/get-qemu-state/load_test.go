@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadStubConfig(t *testing.T) loadConfig {
+	cfg := stubConfig(t)
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig{
+		qemu:      cfg.qemu,
+		args:      cfg.args,
+		state:     cfg.output,
+		timeout:   time.Minute,
+		detachKey: defaultDetachKey,
+		stdout:    io.Discard,
+	}
+}
+
+func TestLoad(t *testing.T) {
+	cfg := loadStubConfig(t)
+	d, err := load(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d <= 0 {
+		t.Errorf("restore time %v", d)
+	}
+}
+
+func TestLoadInteractive(t *testing.T) {
+	cfg := loadStubConfig(t)
+	events := filepath.Join(t.TempDir(), "events")
+	t.Setenv("STUB_QEMU_EVENT_LOG", events)
+	cfg.interactive = true
+	cfg.stdin = strings.NewReader("hello\r\x1dnot typed\r")
+	if _, err := load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(got, []byte("console hello\n")) || bytes.Contains(got, []byte("not typed")) {
+		t.Errorf("console input isn't passed up to the detach key:\n%s", got)
+	}
+	if !bytes.Contains(got, []byte("monitor quit\n")) {
+		t.Errorf("QEMU isn't quit on detach:\n%s", got)
+	}
+}
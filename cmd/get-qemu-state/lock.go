@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockPath returns the path of the lock file of output.
+func lockPath(output string) string {
+	return output + ".lock"
+}
+
+// lockOutput takes an exclusive lock on the lock file of output, waiting up
+// to wait for another capture to release it. The lock is released by
+// closing the returned file, or by the OS when the process exits however
+// it does (the descriptor isn't inherited by QEMU). The lock file itself is
+// left in place as removing it would race with other captures.
+func lockOutput(output string, wait time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(lockPath(output), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	for {
+		held, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", lockPath(output), err)
+		}
+		if !held {
+			return f, nil
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			if wait > 0 {
+				return nil, fmt.Errorf("another capture is writing %s (waited %v)", output, wait)
+			}
+			return nil, fmt.Errorf("another capture is writing %s", output)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
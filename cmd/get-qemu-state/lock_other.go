@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLock(f *os.File) (held bool, err error) {
+	return false, errors.New("file locks are only supported on unix and windows")
+}
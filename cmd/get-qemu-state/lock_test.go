@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockOutput(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "vm.state")
+	l, err := lockOutput(output, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockOutput(output, 0); err == nil || !strings.Contains(err.Error(), "another capture is writing") {
+		t.Fatalf("got %v; want the lock taken", err)
+	}
+	time.AfterFunc(300*time.Millisecond, func() { l.Close() })
+	start := time.Now()
+	l2, err := lockOutput(output, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("locked after %v while the lock was held for 300ms", d)
+	}
+}
+
+func TestCaptureConcurrentLock(t *testing.T) {
+	t.Setenv("STUB_QEMU_BOOT_DELAY", "1s")
+	first := stubConfig(t)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := capture(first)
+		errCh <- err
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	second := stubConfig(t)
+	second.output = first.output
+	if _, err := capture(second); err == nil || !strings.Contains(err.Error(), "another capture is writing") {
+		t.Fatalf("got %v; want the concurrent capture refused", err)
+	}
+	second.lockWait = 30 * time.Second
+	if _, err := capture(second); err != nil {
+		t.Fatalf("capture waiting for the lock failed: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("first capture failed: %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTryLockWindows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.state.lock")
+	var files []*os.File
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	if held, err := tryLock(files[0]); err != nil || held {
+		t.Fatalf("got held=%v, %v; want the lock taken", held, err)
+	}
+	if held, err := tryLock(files[1]); err != nil || !held {
+		t.Fatalf("got held=%v, %v; want the lock held by the first handle", held, err)
+	}
+	files[0].Close()
+	if held, err := tryLock(files[1]); err != nil || held {
+		t.Fatalf("got held=%v, %v; want the lock taken after the first handle closed", held, err)
+	}
+}
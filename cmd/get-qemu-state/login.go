@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"time"
+)
+
+// defaultLoginPrompts match the unfinished last console line when a guest
+// waits at a login prompt (e.g. "localhost login: ") or a root or user shell
+// prompt (e.g. "/ # ", "user@host:~$ "). They're used by -wait-login unless
+// -login-prompt is given.
+var defaultLoginPrompts = []string{
+	`login: $`,
+	`# $`,
+	`\$ $`,
+}
+
+// promptSettle is how long a prompt must stay the last console output to be
+// taken as the guest waiting for input rather than a line still printing.
+const promptSettle = 200 * time.Millisecond
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// atPrompt reports whether the unfinished console line is a prompt.
+func atPrompt(patterns []*regexp.Regexp, line string) bool {
+	line = ansiEscape.ReplaceAllString(line, "")
+	for _, re := range patterns {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitLogin blocks until the console shows a prompt matching patterns.
+func waitLogin(ctx context.Context, con *console, patterns []*regexp.Regexp) error {
+	const pollInterval = 50 * time.Millisecond
+	for {
+		if con.quietFor() >= promptSettle && atPrompt(patterns, con.unfinishedLine()) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestAtPrompt(t *testing.T) {
+	patterns, err := compilePatterns(defaultLoginPrompts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		line string
+		want bool
+	}{
+		{"localhost login: ", true},
+		{"Welcome to Alpine Linux\r", false},
+		{"/ # ", true},
+		{"root@container:~# ", true},
+		{"user@host:~$ ", true},
+		{"\x1b[01;32muser@host\x1b[00m:\x1b[01;34m~\x1b[00m$ ", true},
+		{"[    1.234567] # of CPUs: 1", false},
+		{"Password: ", false},
+		{"", false},
+	} {
+		if got := atPrompt(patterns, tt.line); got != tt.want {
+			t.Errorf("atPrompt(%q) = %v; want %v", tt.line, got, tt.want)
+		}
+	}
+}
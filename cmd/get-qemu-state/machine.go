@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strings"
+)
+
+// setMachineType pins the machine type in args to machine, keeping the other
+// -machine options. -machine is added if args doesn't have one.
+//
+// QEMU has no knob for the migration stream version itself; versioned machine
+// types (e.g. "pc-q35-7.2") are how it keeps the stream loadable by other
+// QEMU versions.
+func setMachineType(args []string, machine string) []string {
+	res := append([]string{}, args...)
+	for i := 0; i < len(res)-1; i++ {
+		if res[i] != "-machine" && res[i] != "-M" {
+			continue
+		}
+		opts := strings.Split(res[i+1], ",")
+		replaced := false
+		for j, o := range opts {
+			if j == 0 && !strings.Contains(o, "=") {
+				opts[j], replaced = machine, true
+			} else if strings.HasPrefix(o, "type=") {
+				opts[j], replaced = "type="+machine, true
+			}
+		}
+		if !replaced {
+			opts = append([]string{machine}, opts...)
+		}
+		res[i+1] = strings.Join(opts, ",")
+		return res
+	}
+	return append(res, "-machine", machine)
+}
+
+// argsAccel returns the accelerator selected in args by -accel, -machine
+// accel= (the first of the alternatives) or -enable-kvm, or "" if args leave
+// it to QEMU.
+func argsAccel(args []string) string {
+	for i, a := range args {
+		switch a {
+		case "-enable-kvm":
+			return "kvm"
+		case "-accel":
+			if i+1 < len(args) {
+				name, _, _ := strings.Cut(args[i+1], ",")
+				return name
+			}
+		case "-machine", "-M":
+			if i+1 < len(args) {
+				if v, ok := option(args[i+1], "accel"); ok {
+					name, _, _ := strings.Cut(v, ":")
+					return name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// supportedMachines returns the machine types listed by "qemu -machine help".
+func supportedMachines(qemu string) ([]string, error) {
+	out, err := exec.Command(qemu, "-machine", "help").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseMachineHelp(out), nil
+}
+
+func parseMachineHelp(out []byte) []string {
+	var machines []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasSuffix(s.Text(), ":") {
+			continue // "Supported machines are:"
+		}
+		machines = append(machines, fields[0])
+	}
+	return machines
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetMachineType(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{
+			args: []string{"-m", "512M"},
+			want: []string{"-m", "512M", "-machine", "pc-q35-7.2"},
+		},
+		{
+			args: []string{"-machine", "q35,accel=tcg", "-m", "512M"},
+			want: []string{"-machine", "pc-q35-7.2,accel=tcg", "-m", "512M"},
+		},
+		{
+			args: []string{"-M", "accel=tcg,type=q35"},
+			want: []string{"-M", "accel=tcg,type=pc-q35-7.2"},
+		},
+		{
+			args: []string{"-machine", "accel=tcg"},
+			want: []string{"-machine", "pc-q35-7.2,accel=tcg"},
+		},
+	} {
+		if got := setMachineType(tt.args, "pc-q35-7.2"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("setMachineType(%v) = %v; want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestArgsAccel(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-m", "512M"}, ""},
+		{[]string{"-accel", "kvm", "-accel", "tcg"}, "kvm"},
+		{[]string{"-accel", "tcg,thread=multi"}, "tcg"},
+		{[]string{"-machine", "q35,accel=kvm:tcg"}, "kvm"},
+		{[]string{"-M", "virt", "-enable-kvm"}, "kvm"},
+	} {
+		if got := argsAccel(tt.args); got != tt.want {
+			t.Errorf("argsAccel(%v) = %q; want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseMachineHelp(t *testing.T) {
+	out := `Supported machines are:
+microvm              microvm (i386)
+pc                   Standard PC (i440FX + PIIX, 1996) (alias of pc-i440fx-8.2)
+pc-q35-7.2           Standard PC (Q35 + ICH9, 2009)
+none                 empty machine
+`
+	want := []string{"microvm", "pc", "pc-q35-7.2", "none"}
+	if got := parseMachineHelp([]byte(out)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
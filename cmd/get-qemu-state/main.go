@@ -1,120 +1,667 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"maps"
+	"net/url"
 	"os"
 	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	defaultOutputFile = "vm.state"
 	defaultWaitString = "=========="
+
+	// stdoutOutput as -output writes the state to stdout, passed to QEMU
+	// as stdoutFDName.
+	stdoutOutput = "-"
+	stdoutFDName = "gqs-stdout"
+
+	// maxTotalTimeGrace is how long the capture has to stop (killing QEMU)
+	// once -max-total-time ran out before the process exits anyway.
+	maxTotalTimeGrace = 30 * time.Second
 )
 
 func main() {
-	var (
-		outputFile = flag.String("output", defaultOutputFile, "path to output state file")
-		argsJSON   = flag.String("args-json", "", "path to json file containing args")
-	)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			if err := runBench(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "generate-args":
+			if err := runGenerateArgs(os.Args[2:], os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "multi":
+			if err := runMulti(os.Args[2:], os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "prefetch":
+			if err := runPrefetch(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "join":
+			if err := runJoin(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "layer":
+			if err := runLayer(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "load":
+			if err := runLoad(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "repro-check":
+			if err := runReproCheck(os.Args[2:], os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "support-bundle":
+			if err := runSupportBundle(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "sections":
+			if err := runSections(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 
+	configure := registerFlags(flag.CommandLine)
+	printMarkerSeconds := flag.Bool("print-marker-seconds", false, "on success, print only the seconds until the guest became ready to stdout. The guest console goes to stderr")
+	printConfigFlag := flag.Bool("print-config", false, "print the flags as resolved (marked as set on the command line, derived from -arch or the QEMU binary name, or default) and the QEMU args read from -args-json as JSON and exit without launching QEMU")
+	checkQMPFlag := flag.Bool("check-qmp", false, "launch QEMU, connect to the QMP server socket in args, negotiate the capabilities, run query-status and quit QEMU, without waiting for the guest or migrating. Exits 0 only if QMP works")
+	supportBundle := flag.String("support-bundle", "", "before capturing, write what a bug report needs to this directory: the QEMU version, accelerators, machines, CPUs and devices (the -version and help outputs), the host (host.txt, incl. KVM availability) and the redacted args. Queries failing or hanging (up to "+supportBundleTimeout.String()+") are recorded in the bundle and don't stop the capture, whose success doesn't matter to the bundle. \"get-qemu-state support-bundle [-output DIR] QEMU\" writes one without capturing")
+	name := flag.String("name", "", "label of this capture (e.g. the job in a batch run) prefixed to the log lines as [LABEL] and, on Linux, shown as the process name (gqs:LABEL, truncated to 15 bytes) by ps and top")
+	matrix := flag.String("matrix", "", "capture every combination of the axes of this YAML (or JSON) spec, e.g. arch x machine x kernel, and print a report of the captures instead of capturing once. The flags (and QEMU binary, unless the spec has qemu) of the command line and the flags of the spec are used by every combination, with {AXIS} replaced by its value. The spec has axes (AXIS: [VALUE, ...]), qemu, flags (a list of args) and optional (a list of AXIS: VALUE maps matching the combinations whose failure doesn't fail the run)")
+	matrixJobs := flag.Int("matrix-jobs", 1, "number of -matrix captures run at a time")
+	matrixReport := flag.String("matrix-report", "", "path to write the -matrix report as JSON")
 	flag.Parse()
-	args := flag.Args()
-
-	if *outputFile == "" {
-		log.Fatalf("output file must not be empty")
+	if *matrix != "" {
+		if err := runMatrix(*matrix, flag.CommandLine, flag.Arg(0), *matrixJobs, *matrixReport, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	if *argsJSON == "" {
-		log.Fatalf("specify args JSON")
+	if *name != "" {
+		log.SetPrefix("[" + *name + "] ")
+		if err := setProcessName("gqs:" + *name); err != nil {
+			log.Printf("WARNING: failed to set the process name: %v", err)
+		}
 	}
-
-	var extraArgs []string
-	argsData, err := os.ReadFile(*argsJSON)
+	cfg, err := configure()
 	if err != nil {
-		log.Fatalf("failed to get args json: %v", err)
+		log.Fatal(err)
 	}
-	if err := json.Unmarshal(argsData, &extraArgs); err != nil {
-		log.Fatalf("failed to parse args json: %v", err)
+	redact := cfg.redactor()
+	log.SetOutput(redact.writer(log.Writer()))
+	if !cfg.deadline.IsZero() {
+		time.AfterFunc(time.Until(cfg.deadline)+maxTotalTimeGrace, func() {
+			log.Fatalf("-max-total-time ran out and the capture didn't stop within %v; exiting", maxTotalTimeGrace)
+		})
+	}
+	args := flag.Args()
+	if *printConfigFlag {
+		if err := printConfig(os.Stdout, flag.CommandLine, flag.Arg(0), cfg, redact); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) < 1 {
+		log.Fatalf("specify QEMU binary")
+	}
+	cfg.qemu = args[0]
+	if *supportBundle != "" {
+		if err := writeSupportBundle(context.Background(), *supportBundle, cfg.qemu, redact.args(cfg.args)); err != nil {
+			log.Printf("WARNING: failed to write the support bundle: %v", err)
+		} else {
+			log.Printf("wrote the support bundle to %s", *supportBundle)
+		}
+	}
+	if *checkQMPFlag {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := checkQMP(ctx, cfg.qemu, cfg.args)
+		cancel()
+		if err != nil {
+			log.Fatalf("QMP check failed: %v", err)
+		}
+		log.Println("QMP check succeeded")
+		return
+	}
+	if *printMarkerSeconds {
+		if cfg.output == stdoutOutput {
+			log.Fatal("-print-marker-seconds can't be used with -output -")
+		}
+		cfg.stdout = os.Stderr // keep stdout for the result
+	}
+	if cfg.output == stdoutOutput {
+		cfg.stdout = os.Stderr // keep stdout for the state
 	}
-	log.Println(extraArgs)
-
-	cmd := exec.Command(args[0], extraArgs...)
 
-	stdin, err := cmd.StdinPipe()
+	res, err := capture(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+	if *printMarkerSeconds {
+		fmt.Printf("%.3f\n", res.ReadyAfter.Seconds())
 	}
+}
 
-	cmd.Stderr = os.Stderr
+// registerFlags registers the capture flags on fs. The returned function
+// builds the config once fs is parsed. The QEMU binary is left to the caller.
+func registerFlags(fs *flag.FlagSet) func() (config, error) {
+	var cfg config
+	fs.StringVar(&cfg.output, "output", defaultOutputFile, "path to output state file. - migrates the state straight to stdout (e.g. -output - | packer), moving the guest console to stderr; this needs a QMP server unix socket in args and can't be used with the options reading the state afterwards (-split-bytes, -split-sections, -section-sizes, -hot-map, -measure-restore, -shrink)")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "boot the guest until it's ready (and run the pre-script), then quit without taking the snapshot")
+	fs.StringVar(&cfg.dump, "dump", "", "debug a guest instead of snapshotting it: once it's ready (and the pre-script ran), write an ELF core dump of its memory (dump-guest-memory) to this path instead of the state. With -boot-timeout, a guest not becoming ready in time is dumped before failing. The path is recorded in -manifest as \"dump\"")
+	outputMode := fs.String("output-mode", "", "permissions (octal, e.g. 0640) set to the state file and the files written along with it (manifest, checkpoint). The umask applies if unset")
+	fs.Int64Var(&cfg.splitBytes, "split-bytes", 0, "write the state as <output>.part0000, <output>.part0001, ... of at most this many bytes each, indexed by <output>.parts.json. \"get-qemu-state join <output>.parts.json\" reassembles them")
+	fs.StringVar(&cfg.chunkMode, "chunk-mode", "sequential", "how -split-bytes cuts the parts: "+strings.Join(chunkModes, " or ")+". page-aligned never cuts a guest RAM page (a part exceeds -split-bytes only by less than a page) and lists the pages in the index as \"pages\": [{\"block\", \"guestOffset\", \"count\", \"part\", \"offset\", \"stride\"}], page i of a run being at offset+i*stride of the part, so that a restore can fetch just the pages it touches. Pages not listed were sent as zero (single byte) pages")
+	fs.BoolVar(&cfg.splitSections, "split-sections", false, "write the state as a directory <output>.sections with a file per migration section (e.g. to diff device states between captures), indexed by <output>.sections/"+sectionsIndexName+". \"get-qemu-state join <output>.sections/"+sectionsIndexName+"\" reassembles a loadable state. A single file is written if the stream can't be parsed")
+	fs.IntVar(&cfg.migrateAttempts, "migrate-attempts", 3, "number of migrations tried, with more aggressive parameters (bandwidth, downtime limit, auto-converge) each time, before giving up. Retries need QMP in args")
+	fs.DurationVar(&cfg.migrateBackoff, "migrate-retry-backoff", time.Second, "wait before retrying a migration, doubled after each failed attempt (up to "+maxMigrateBackoff.String()+"). Retries restart the migration from scratch; partial transfers aren't resumed")
+	fs.DurationVar(&cfg.migrateTimeout, "migrate-attempt-timeout", 2*time.Minute, "cancel a migration attempt not completing within this duration, e.g. not converging as the guest keeps dirtying its memory (0 means no limit)")
+	fs.DurationVar(&cfg.migrateTimeoutPerGB, "migrate-timeout-per-gb", 0, "scale the migration attempt timeout to the guest RAM set by -m in args: this duration per GiB, at least "+minScaledMigrateTimeout.String()+". Replaces -migrate-attempt-timeout, which is used if the RAM size can't be parsed")
+	fs.DurationVar(&cfg.lockWait, "lock-wait", 0, "wait up to this duration for another capture to the same output to finish. Captures lock <output>.lock and fail immediately by default if it's taken")
+	fs.IntVar(&cfg.globalConcurrency, "global-concurrency", 0, "run at most this many captures on the host at a time, across get-qemu-state invocations (0 means no limit). A capture waits for one of the lock files slot0.lock ... slot<N-1>.lock in -global-concurrency-dir to be free before launching QEMU, and frees it however it ends. Invocations sharing the directory should use the same limit")
+	fs.StringVar(&cfg.slotDir, "global-concurrency-dir", defaultSlotDir(), "directory of the -global-concurrency slots, shared by the invocations limited together")
+	fs.BoolVar(&cfg.noLock, "no-lock", false, "don't lock <output>.lock, allowing concurrent captures to the same output")
+	fs.BoolVar(&cfg.followSymlinks, "follow-symlinks", false, "write the output and the files written along with it (manifest, checkpoint, logs) to the targets of symlinks at their paths. Writing through symlinks is refused by default")
+	maxDowntimeMs := fs.Int64("max-downtime-ms", 0, "fail if the VM was stopped for longer than this during the migration, as reported by QMP (0 means no limit). The downtime is logged and recorded in the manifest whenever QMP is in args")
+	fs.BoolVar(&cfg.measureRestore, "measure-restore", false, "after the capture, restore the state with the same args (-incoming) to measure the time until the VM runs, then quit it. The time is logged and recorded in the manifest; a state failing to restore fails the capture")
+	fs.BoolVar(&cfg.hotMap, "hot-map", false, "write <output>.hotmap.json mapping the guest RAM the guest touched (the pages not sent as zero pages) and the state ranges holding it, which \"get-qemu-state prefetch <output>\" reads ahead to speed up a restore. -measure-restore reads them ahead too")
+	fs.BoolVar(&cfg.migratePrecheck, "migrate-precheck", false, "once the guest is ready, start a migration to /dev/null and cancel it, failing early if the VM can't be migrated (e.g. \"Migration is disabled when using ...\")")
+	argsJSON := fs.String("args-json", "", "path to json file containing args")
+	var markerFlags sliceFlags
+	fs.Var(&markerFlags, "marker", "console string signaling readiness (default \""+defaultWaitString+"\"). Can be specified multiple times; any of them matches. Matched markers aren't echoed")
+	arch := fs.String("arch", "", "guest architecture ("+strings.Join(slices.Sorted(maps.Keys(archDefaults)), ", ")+") selecting the default -marker and -boot-timeout of its machine, as used by container2wasm. Inferred from a qemu-system-ARCH binary name. -marker, -marker-repeat and -boot-timeout override the defaults")
+	markerRepeat := fs.String("marker-repeat", "", "CHAR:COUNT, the marker made of CHAR repeated COUNT times like the default marker (e.g. \"=:20\" for 20 '='). Exclusive with -marker")
+	fs.BoolVar(&cfg.markerFD, "marker-fd", false, "match the markers only on what the guest writes to a virtio serial port added for them (e.g. printf '==========' > /dev/virtio-ports/"+markerPortName+", which needs CONFIG_VIRTIO_CONSOLE in the guest) instead of the console, which is echoed as usual. The port is backed by a pipe while capturing and by a null chardev in the recorded args; restore the state with the port added the same way (-chardev null,id="+markerChardev+" -device virtio-serial -device virtserialport,chardev="+markerChardev+",name="+markerPortName+")")
+	fs.BoolVar(&cfg.stageMarkerHelper, "stage-marker-helper", false, "share a script printing a well-known marker with the guest over 9p (mount tag \""+helperMountTag+"\"), and accept that marker too. The guest runs it from a copy as the share must be unmounted before the snapshot: mount -t 9p -o trans=virtio "+helperMountTag+" /mnt && cp /mnt/"+helperName+" /tmp/ && umount /mnt && /tmp/"+helperName+" [device (default /dev/console)]")
+	ignoreBeforeBoot := fs.Bool("ignore-before-boot", false, "don't match the markers until a console line matches -boot-pattern, skipping the banners QEMU and the firmware (e.g. OpenSBI) print before the kernel in case they contain a marker")
+	bootPattern := fs.String("boot-pattern", "", "regexp matching the console line starting the boot for -ignore-before-boot. Defaults to the first kernel line of the -arch ("+archBootPatterns()+"), "+strconv.Quote(defaultBootPattern)+" without -arch")
+	fs.BoolVar(&cfg.normalizeCRLF, "normalize-crlf", false, "match the markers with \\r\\n and \\r on the console (and in the markers) read as \\n, e.g. for a marker ending with a newline on a serial console printing \\r\\n. The console is still echoed and saved as is")
+	fs.IntVar(&cfg.markerCount, "marker-count", 1, "number of marker matches (of any of the markers) needed before the snapshot")
+	fs.IntVar(&cfg.waitTCPGuest, "wait-tcp-guest", 0, "wait for the guest to accept connections on this TCP port instead of the console marker. A free host port is forwarded to it via the user-mode netdev in args")
+	readyHTTP := fs.String("ready-http", "", "poll this guest HTTP URL (e.g. http://guest:8080/healthz) until it responds with a 2xx status, instead of the console marker. The host part is ignored: a free host port is forwarded to the guest port via the user-mode netdev in args")
+	readyHTTPMatch := fs.String("ready-http-match", "", "regexp the -ready-http response body must also match (e.g. '\"status\": *\"ok\"')")
+	fs.BoolVar(&cfg.waitGuestAgent, "wait-guest-agent", false, "consider the guest ready once qemu-guest-agent answers guest-ping, instead of the console marker. Needs a socket -chardev (server=on) backing a virtserialport named "+guestAgentPort+" in args")
+	readyQMPEvent := fs.String("ready-qmp-event", "", "consider the guest ready once QEMU emits this QMP event (e.g. a device signaling the guest wrote a register), instead of the console marker. Needs a QMP server socket in args, which is connected to from the start; events emitted before the connection are missed")
+	var readyQMPEventData sliceFlags
+	fs.Var(&readyQMPEventData, "ready-qmp-event-data", "FIELD=VALUE the data of -ready-qmp-event must have (FIELD is a dotted path for nested fields; non-string values are compared as JSON, e.g. true). Can be specified multiple times")
+	fs.StringVar(&cfg.readyHelper, "ready-cmd", "", "host shell command polled until it exits 0, used instead of the console marker (e.g. a curl health check). Each run is killed after -ready-helper-timeout or at the boot timeout. QEMU_PID, QEMU_CONSOLE_LOG, QEMU_HOSTFWD_<PROTO>_<GUEST PORT> (host address of each hostfwd rule in args, e.g. QEMU_HOSTFWD_TCP_8080=127.0.0.1:18080) and QEMU_SHARED_DIR_<MOUNT TAG> (host path of each 9p export in args) are passed via env")
+	fs.StringVar(&cfg.readyHelper, "ready-helper", "", "alias of -ready-cmd")
+	cpuAffinity := fs.String("cpu-affinity", "", "pin the QEMU threads to this CPU list (e.g. 0-3,6) after the launch (Linux only; ignored with a warning elsewhere)")
+	nice := fs.Int("nice", 0, "nice value (-20 to 19) of the QEMU threads, set after the launch, e.g. 10 not to starve other jobs on a shared builder. Lowering it needs privileges (Linux only; ignored with a warning elsewhere)")
+	ionice := fs.String("ionice", "", "I/O scheduling class and level of the QEMU threads as CLASS[:LEVEL], like ionice(1): CLASS is realtime, best-effort or idle (or 1, 2 or 3) and LEVEL 0 (highest) to 7 (default 4), e.g. idle or best-effort:7 (Linux only; ignored with a warning elsewhere)")
+	fs.StringVar(&cfg.pidFile, "pidfile", "", "path to the pid file QEMU writes (added to args as -pidfile unless there). Its PID is used instead of the child's, e.g. when QEMU is started by a launcher that forks. A -pidfile in args is used even without this flag")
+	fs.DurationVar(&cfg.readyHelperInterval, "ready-helper-interval", time.Second, "interval between -ready-cmd invocations")
+	fs.DurationVar(&cfg.readyHelperTimeout, "ready-helper-timeout", 10*time.Second, "timeout of each -ready-cmd run, after which it's killed and counts as failed (0 means no limit)")
+	fs.DurationVar(&cfg.settledAfter, "ready-settled-after", 0, "consider the guest ready once it has been up for this duration and -ready-quiet-for holds, instead of the console marker")
+	fs.DurationVar(&cfg.quietFor, "ready-quiet-for", 0, "consider the guest ready once its console has had no output for this duration and -ready-settled-after holds, instead of the console marker")
+	fs.DurationVar(&cfg.readyDebounce, "ready-debounce", 0, "take the guest as ready only once the readiness condition held at every poll for this duration, not to snapshot a condition flickering while the guest starts. Applies to the polled conditions: -ready-cmd, -wait-tcp-guest, -ready-http, -wait-guest-agent, -ready-settled-after/-ready-quiet-for and -ready-on-quiet. The console marker, -wait-login, -ready-qmp-event and -ready-instructions are events that can't turn false and trigger at once")
+	fs.DurationVar(&cfg.readyOnQuiet, "ready-on-quiet", 0, "consider the guest ready once its console has printed -ready-on-quiet-min-bytes and then nothing for this duration, instead of the console marker. A console that never prints is caught by -first-output-timeout or -boot-timeout, not by this")
+	fs.Int64Var(&cfg.readyOnQuietMin, "ready-on-quiet-min-bytes", 512, "console output needed before -ready-on-quiet starts watching for the silence")
+	waitLoginFlag := fs.Bool("wait-login", false, "consider the guest ready once its console waits at a login or shell prompt, instead of the console marker. The prompt is matched by -login-prompt")
+	var loginPromptFlags sliceFlags
+	fs.Var(&loginPromptFlags, "login-prompt", "regexp matched against the unfinished last console line (ANSI escapes removed) for -wait-login (default \""+strings.Join(defaultLoginPrompts, "\", \"")+"\"). Can be specified multiple times; replaces the defaults")
+	fs.BoolVar(&cfg.pty, "pty", false, "connect the QEMU stdio (the guest console and the monitor) to a pseudo-terminal in raw mode instead of pipes, for guests and QEMU features behaving differently without a terminal")
+	fs.StringVar(&cfg.onReady, "on-ready", "", "shell command run on the host once the guest is ready, before the pre-script and the snapshot. Its output is logged. QEMU_PID and QEMU_CONSOLE_LOG (-console-file, or a temporary file holding the console output so far) are passed via env")
+	fs.BoolVar(&cfg.onReadyRequired, "on-ready-required", false, "fail if the -on-ready command fails (it's only logged by default)")
+	echoFilter := fs.String("echo-filter", "", "echo only the guest console lines matching this regexp. The console file and the readiness detection still get every line")
+	echoExclude := fs.String("echo-exclude", "", "don't echo the guest console lines matching this regexp. The console file and the readiness detection still get every line")
+	fs.StringVar(&cfg.consoleFile, "console-file", "", "path to a file where the guest console output is also written")
+	consoleDecode := fs.String("console-decode", "raw", "decode the guest console before the readiness detection, the console file and the echo see it: "+strings.Join(consoleDecoderNames(), " or ")+". gzip replaces gzip members embedded in the console (e.g. by a debug channel of the guest) with their contents")
+	fs.StringVar(&cfg.consoleRawFile, "console-raw-file", "", "path to a file where the guest console output is also written as is, before -console-decode")
+	fs.StringVar(&cfg.qemuStderrFile, "qemu-stderr-file", "", "path to a file where the QEMU stderr is also written")
+	fs.StringVar(&cfg.logFile, "log-file", "", "path to a file where the log of this tool is also written")
+	var redactArgFlags, secretFileFlags sliceFlags
+	fs.Var(&redactArgFlags, "redact-arg", "replace this string (e.g. a secret in args) with "+redacted+" in the logs, -manifest, -print-config and the -repro-on-failure script. The data of -object secret and password= options in args are redacted without it. Can be specified multiple times")
+	fs.Var(&secretFileFlags, "secret-file", "pass the secret in a file to QEMU as -object secret,id=ID,file=PATH (ID=PATH) so that it isn't in args (e.g. for a disk encryption key-secret=ID). Can be specified multiple times")
+	fs.Int64Var(&cfg.logRotateBytes, "log-rotate-bytes", 0, "rotate -console-file, -qemu-stderr-file and -log-file once they would exceed this size (0 disables the rotation). Rotated segments are gzipped to <file>.1.gz (the newest), <file>.2.gz, ...")
+	fs.IntVar(&cfg.logRotateKeep, "log-rotate-keep", 5, "number of rotated segments kept per log file")
+	maxTotalTime := fs.Duration("max-total-time", 0, "fail once this duration passed since the start, whatever the capture is doing (0 means no limit), killing QEMU and the host commands (-on-ready, -ready-helper). The other timeouts apply within it. As a backstop, the process exits "+maxTotalTimeGrace.String()+" later if the capture didn't stop by then")
+	fs.DurationVar(&cfg.bootTimeout, "boot-timeout", 0, "fail if the guest doesn't become ready within this duration (0 means no limit). Defaults to the -arch boot timeout, no limit without -arch")
+	fs.DurationVar(&cfg.firstOutputTimeout, "first-output-timeout", 0, "fail if QEMU prints nothing on the console within this duration (0 means no limit). If set, -boot-timeout starts with the first output")
+	fs.StringVar(&cfg.preScript, "pre-script", "", "path to a script of send/expect/sleep lines run on the guest console before the snapshot")
+	var guestExecFlags sliceFlags
+	fs.Var(&guestExecFlags, "guest-exec", "shell command run in the guest via qemu-guest-agent (guest-exec) after the pre-script, failing the capture if it exits nonzero. Its output is logged. Can be specified multiple times; run in order. Needs the guest agent socket as -wait-guest-agent")
+	var collectLogsFlags sliceFlags
+	var collectGuestFileFlags sliceFlags
+	fs.Var(&collectLogsFlags, "collect-logs", "copy a guest file to the host through qemu-guest-agent before the snapshot, after -guest-exec (which can dump e.g. dmesg to a file) (<guestpath>:<hostpath>[:required]). Relative host paths are next to the output. A failed copy is only logged unless :required. Can be specified multiple times. Needs the guest agent socket as -wait-guest-agent")
+	fs.Var(&collectGuestFileFlags, "collect-guest-file", "copy a guest file (e.g. /proc/cmdline, /etc/os-release or a package list dumped by -guest-exec) through qemu-guest-agent at readiness into <output>.guest/ as metadata of the state, recorded in -manifest. Files that can't be read and an unavailable guest agent are only logged. Can be specified multiple times. Needs the guest agent socket as -wait-guest-agent")
+	fs.DurationVar(&cfg.guestExecTimeout, "guest-exec-timeout", 5*time.Minute, "timeout of each -guest-exec command (0 means no limit)")
+	fs.StringVar(&cfg.guestShutdownCmd, "guest-shutdown-cmd", "", "type this command to the guest console right before the migration (after the pre-script, -guest-exec and -balloon) to shut an app down cleanly, wait for -guest-shutdown-marker and pause the VM. The state then restores with the app stopped, so use this only for apps whose on-disk or external state must be consistent and that are restarted after the restore; a pre-script suffices to merely settle an app")
+	fs.StringVar(&cfg.guestShutdownMarker, "guest-shutdown-marker", "", "console string signaling that -guest-shutdown-cmd completed")
+	fs.DurationVar(&cfg.guestShutdownTimeout, "guest-shutdown-timeout", 5*time.Minute, "timeout of waiting for -guest-shutdown-marker (0 means no limit)")
+	fs.DurationVar(&cfg.expectTimeout, "expect-timeout", 5*time.Minute, "timeout of each expect line of the pre-script (0 means no limit)")
+	fs.StringVar(&cfg.checkpoint, "checkpoint", "", "path to a state file updated between pre-script steps (except before expect lines), with its progress recorded in <path>.journal")
+	fs.BoolVar(&cfg.resume, "resume", false, "restore the -checkpoint state and continue the pre-script from where it left off")
+	fs.StringVar(&cfg.fromState, "from-state", "", "restore this state (e.g. a booted base OS) instead of booting the guest, then run the pre-script and -guest-exec and capture the state. This speeds up iterating on what the pre-script sets up. args must match those of the base capture")
+	fs.BoolVar(&cfg.delta, "delta", false, "with -from-state, write the output as the bytes it doesn't share with the base state (the guest pages left unchanged are left out) and the index of them to <output>.delta.json, recorded in -manifest. Restore it layered on the base with \"get-qemu-state layer -output FILE <output>.delta.json\" (or -output - with -incoming exec:). The full state is written instead if the states can't be parsed")
+	fs.Int64Var(&cfg.memoryBuffer, "memory-buffer", 0, "migrate the state into memory instead of a temporary file and write the output from it at the end, which is faster for small states. A state larger than this many bytes is spilled to the temporary file as usual. Needs a QMP server unix socket in args and can't be used with the options reading the state afterwards")
+	fs.BoolVar(&cfg.compress, "compress", false, "compress the state with gzip as QEMU migrates it (through an exec: migration), for a smaller output restored with -incoming \"exec:gzip -dc FILE\". Needs gzip and can't be used with -output -, -memory-buffer or the options reading the state afterwards")
+	fs.StringVar(&cfg.manifest, "manifest", "", "path to a JSON file describing the capture, written after the snapshot is taken")
+	fs.StringVar(&cfg.bootBreakdown, "boot-breakdown", "", "write where the time of the run went to this file as folded stacks in milliseconds (e.g. for flamegraph.pl --countname ms): the boot stages (firmware, kernel, initramfs and userspace, told by the Linux console), each split by the -timing-pattern marks seen in it, the pre-script steps and the migration")
+	var timingFlags sliceFlags
+	fs.Var(&timingFlags, "timing-pattern", "record in the manifest when a console line first matches (name:regexp). Can be specified multiple times")
+	var autokeyFlags sliceFlags
+	fs.Var(&autokeyFlags, "autokey", "type keys to the console when a string appears during boot (<keys>@<match>, e.g. '\\r@Press any key'). Can be specified multiple times")
+	icount := fs.Int("icount", 0, fmt.Sprintf("run the guest with QEMU -icount shift=N,sleep=off,align=off (N from 0 to %d): the guest executes 2^N ns of virtual time per instruction, independent of the host speed, for states reproducible across hosts. Only works under TCG (added as -accel tcg if args select no accelerator); args selecting another accelerator are refused. Recorded in -manifest; restore the state with the same -icount (get-qemu-state load -manifest checks it)", maxICountShift))
+	fs.Int64Var(&cfg.readyInstructions, "ready-instructions", 0, "with -icount, consider the guest ready once it executed this many instructions and stop it, instead of the console marker. The instruction count is polled through QMP (query-replay, which QEMU answers only while recording, so the guest runs with rr=record to a temporary file), so the guest stops within ~10ms of it. Needs a QMP server socket in args")
+	fs.StringVar(&cfg.bootMenuPolicy, "bootmenu-policy", "warn", "on a bootloader menu waiting for a selection during boot (e.g. GRUB without a timeout, which otherwise ends in the boot timeout): \"warn\" logs it; \"fail\" aborts the capture; \"select-default\" types -bootmenu-key to boot the default entry. A menu with a timeout is detected too")
+	var bootMenuPromptFlags sliceFlags
+	fs.Var(&bootMenuPromptFlags, "bootmenu-prompt", fmt.Sprintf("console string of a bootloader menu, replacing the defaults %q. Can be specified multiple times", defaultBootMenuPrompts))
+	bootMenuKey := fs.String("bootmenu-key", `\r`, "keys typed by -bootmenu-policy select-default, with Go escape sequences")
+	fs.DurationVar(&cfg.progressInterval, "progress-interval", 10*time.Second, "interval of the progress log lines (0 disables them)")
+	fs.IntVar(&cfg.maxProgressLines, "max-progress-lines", 0, fmt.Sprintf("after this many progress log lines, log the progress %d times less often (0 means no limit). Timeouts and watchdogs aren't affected", progressThrottle))
+	fs.StringVar(&cfg.progressFile, "progress-file", "", "path to a JSON file rewritten (atomically) with the current phase, elapsed seconds, state bytes written and, with QMP, migration percentage, for external UIs to poll. It's removed on exit unless -keep-partial, which leaves the final phase (done or failed)")
+	noProgress := fs.Bool("no-progress", false, "disable the progress log lines (start/end logs are kept)")
+	fs.BoolVar(&cfg.requireCleanExit, "require-clean-exit", false, "fail if QEMU exits nonzero after the quit (only logged by default)")
+	fs.BoolVar(&cfg.reproOnFailure, "repro-on-failure", false, "on failure, write repro.sh next to the output, running QEMU with the args used by the capture")
+	fs.StringVar(&cfg.tempDir, "temp-dir", os.TempDir(), "directory where a temp dir for intermediate files is created")
+	fs.BoolVar(&cfg.keepPartial, "keep-partial", false, "keep intermediate files on exit")
+	fs.IntVar(&cfg.finalizeRetries, "finalize-retries", 5, "retry renaming the state into place and setting its mode up to this many times, with a backoff from "+finalizeBackoff.String()+" doubled each time, while it fails as the file is briefly held by another process, e.g. a virus scanner or an indexer (a sharing violation on Windows, EBUSY elsewhere)")
+	fs.BoolVar(&cfg.cleanStalePartials, "clean-stale-partials", false, "on startup, remove the in-progress states (<output>.partial.<pid>-<random>) left by captures of the same output that aren't running anymore")
+	fs.BoolVar(&cfg.debug, "debug", false, "enable debug print")
+	var missingFileFlags sliceFlags
+	fs.Var(&missingFileFlags, "missing-file-pattern", "additional regexp of a QEMU/console message about a missing file, failing the capture immediately. The first submatch is reported as the path. Can be specified multiple times")
+	fs.StringVar(&cfg.oomPolicy, "oom-policy", "warn", "on a guest console line reporting an out-of-memory (e.g. the OOM killer killing a process): \"warn\" logs it and records the killed process in the manifest; \"fail\" aborts the capture")
+	var warningErrorFlags sliceFlags
+	fs.Var(&warningErrorFlags, "warning-as-error", "regexp of a QEMU stderr line (e.g. a warning about a feature disabled for the migration) failing the capture, also if it's printed while migrating or quitting, so that a subtly broken state isn't kept. Can be specified multiple times")
+	noMissingFileDetection := fs.Bool("no-missing-file-detection", false, "don't fail on messages about missing files")
+	fs.BoolVar(&cfg.portableMemory, "portable-memory", false, "fail if the guest RAM is backed by huge pages, which makes the state unloadable on hosts with another page size")
+	fs.IntVar(&cfg.sectionSizes, "section-sizes", 0, "log this many of the largest device/RAM sections of the state and record them in the manifest (0 disables it). \"get-qemu-state sections <state>\" prints them for an existing state")
+	fs.BoolVar(&cfg.screenText, "screen-text", false, "record the text on the guest VGA screen at readiness in the manifest (x86 guests with a display in VGA text mode)")
+	fs.Int64Var(&cfg.balloonMiB, "balloon", 0, "inflate the virtio-balloon to shrink the guest RAM to this size in MiB before the snapshot, making the state smaller. Needs a virtio-balloon device and a QMP server socket in args. The balloon stays inflated in the state")
+	fs.BoolVar(&cfg.memoryGrowth, "memory-growth", false, "read the guest /proc/meminfo through qemu-guest-agent once the guest is ready and right before the snapshot (after the pre-script and -guest-exec, before -balloon), and log and record in -manifest how much memory the provisioning took, to size -m and -balloon. Skipped with a warning if the guest agent isn't available")
+	fs.BoolVar(&cfg.shrink, "shrink", false, "capture twice to make the state smaller: capture the full state to <output>.full, restore it, reclaim guest memory (drop caches, compact memory and fstrim through qemu-guest-agent, then -balloon), capture it again and keep the smaller state, logging the size reduction and recording it in -manifest. The pre-script and -guest-exec run in the first capture only; -balloon, -collect-logs and -collect-guest-file in the second. Needs the guest agent socket as -wait-guest-agent or -balloon")
+	fs.Int64Var(&cfg.maxGuestMiB, "max-guest-memory", 0, "fail before booting if the guest RAM set by -m in args (QEMU's 128 MiB if unset) exceeds this many MiB, as it bounds the state size")
+	fakeTime := fs.String("fake-time", "", "start the guest RTC at this time (RFC3339) and advance it only while the guest runs, for reproducible states. QEMU itself also gets the time through libfaketime if it's installed")
+	fs.StringVar(&cfg.compatMachine, "compat-machine", "", "pin the machine type (e.g. pc-q35-7.2) so that the state is loadable by other QEMU versions supporting it")
+	fs.BoolVar(&cfg.stableDeviceOrder, "stable-device-order", false, "give the PCI devices of args on the root bus (no bus=) without addr= explicit slots from 0x10 in the order of the args, so that the state layout doesn't change with what else the machine creates. QEMU fails if a slot is taken by a machine or default device (use -nodefaults or give those devices addr=); devices behind bridges or root ports and non-PCI devices aren't changed. The device order is recorded in -manifest and in the -checkpoint journal, where -resume warns about a mismatch, either way")
+	fs.BoolVar(&cfg.accelFallback, "accel-fallback", false, "if QEMU reports on stderr that it can't use the accelerator (e.g. \"Could not access KVM kernel module\" on a runner without /dev/kvm), retry the capture once with TCG, recorded as accelFallbackFrom in the manifest. A TCG state may differ from a KVM one")
+	fs.StringVar(&cfg.accel, "accel", "", "accelerator (tcg or kvm) QEMU runs the guest with, added to args as -accel unless they select one, in which case it must match. It's recorded in the manifest as a state captured with KVM may not restore under TCG and vice versa. Args are left untouched if unset")
 
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("failed to start: %v", err)
-	}
+	return func() (config, error) {
+		cfg.derived = make(map[string]string)
+		if cfg.output == "" {
+			return cfg, errors.New("output file must not be empty")
+		}
+		if *argsJSON == "" {
+			return cfg, errors.New("specify args JSON")
+		}
+		if *outputMode != "" {
+			m, err := strconv.ParseUint(*outputMode, 8, 32)
+			if err != nil || m == 0 || m > 0777 {
+				return cfg, fmt.Errorf("invalid -output-mode %q", *outputMode)
+			}
+			cfg.outputMode = os.FileMode(m)
+		}
+		if cfg.splitBytes < 0 {
+			return cfg, errors.New("-split-bytes must not be negative")
+		}
+		if cfg.maxGuestMiB < 0 {
+			return cfg, errors.New("-max-guest-memory must not be negative")
+		}
+		if cfg.accel != "" && cfg.accel != "tcg" && cfg.accel != "kvm" {
+			return cfg, fmt.Errorf("-accel must be tcg or kvm, not %q", cfg.accel)
+		}
+		if cfg.hotMap && (cfg.splitBytes > 0 || cfg.splitSections) {
+			return cfg, errors.New("-hot-map needs the state as a single file; don't combine it with -split-bytes or -split-sections")
+		}
+		if !slices.Contains(chunkModes, cfg.chunkMode) {
+			return cfg, fmt.Errorf("-chunk-mode must be %s, not %q", strings.Join(chunkModes, " or "), cfg.chunkMode)
+		}
+		if cfg.chunkMode != "sequential" && cfg.splitBytes == 0 {
+			return cfg, errors.New("-chunk-mode " + cfg.chunkMode + " needs -split-bytes")
+		}
+		if cfg.splitBytes > 0 && cfg.splitSections {
+			return cfg, errors.New("-split-bytes and -split-sections are exclusive")
+		}
+		if cfg.logRotateBytes < 0 || cfg.logRotateKeep < 0 {
+			return cfg, errors.New("-log-rotate-bytes and -log-rotate-keep must not be negative")
+		}
+		if *cpuAffinity != "" {
+			cpus, err := parseCPUList(*cpuAffinity)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.cpuAffinity = cpus
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "nice":
+				cfg.nice = nice
+			case "icount":
+				cfg.icountShift = icount
+			}
+		})
+		if cfg.nice != nil && (*cfg.nice < -20 || *cfg.nice > 19) {
+			return cfg, fmt.Errorf("-nice must be between -20 and 19: %d", *cfg.nice)
+		}
+		if *ionice != "" {
+			p, err := parseIOPrio(*ionice)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.ioprio = p
+		}
+		if *maxTotalTime < 0 {
+			return cfg, errors.New("-max-total-time must not be negative")
+		} else if *maxTotalTime > 0 {
+			cfg.deadline = time.Now().Add(*maxTotalTime)
+		}
+		if cfg.maxProgressLines < 0 {
+			return cfg, errors.New("-max-progress-lines must not be negative")
+		}
+		if cfg.finalizeRetries < 0 {
+			return cfg, errors.New("-finalize-retries must not be negative")
+		}
+		if cfg.migrateAttempts < 1 {
+			return cfg, errors.New("-migrate-attempts must be positive")
+		}
+		if *fakeTime != "" {
+			t, err := time.Parse(time.RFC3339, *fakeTime)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid -fake-time: %w", err)
+			}
+			cfg.fakeTime = t
+		}
+		if *noProgress {
+			cfg.progressInterval = 0
+		}
+		cfg.markers = markerFlags
+		if *markerRepeat != "" {
+			if len(markerFlags) > 0 {
+				return cfg, errors.New("-marker-repeat and -marker are exclusive")
+			}
+			m, err := repeatMarker(*markerRepeat)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.markers = []string{m}
+			cfg.derived["marker"] = "marker-repeat"
+		}
+		if *arch == "" {
+			if *arch = qemuArch(fs.Arg(0)); *arch != "" {
+				cfg.derived["arch"] = "qemu"
+			}
+		} else if _, ok := archDefaults[*arch]; !ok {
+			return cfg, fmt.Errorf("unsupported -arch %q", *arch)
+		}
+		if d, ok := archDefaults[*arch]; ok {
+			set := make(map[string]bool)
+			fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+			if len(cfg.markers) == 0 {
+				cfg.markers = []string{d.marker}
+				cfg.derived["marker"] = "arch"
+			}
+			if !set["boot-timeout"] {
+				cfg.bootTimeout = d.bootTimeout
+				cfg.derived["boot-timeout"] = "arch"
+			}
+		}
+		if len(cfg.markers) == 0 {
+			cfg.markers = []string{defaultWaitString}
+		}
+		if *bootPattern != "" && !*ignoreBeforeBoot {
+			return cfg, errors.New("-boot-pattern requires -ignore-before-boot")
+		}
+		if *ignoreBeforeBoot {
+			pattern := *bootPattern
+			if pattern == "" {
+				pattern = defaultBootPattern
+				if d, ok := archDefaults[*arch]; ok {
+					pattern = d.bootPattern
+					cfg.derived["boot-pattern"] = "arch"
+				}
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid -boot-pattern: %w", err)
+			}
+			cfg.bootGate = re
+		}
+		if cfg.markerCount < 1 {
+			return cfg, errors.New("-marker-count must be positive")
+		}
+		if slices.Contains(cfg.markers, "") {
+			return cfg, errors.New("marker must not be empty")
+		}
+		if cfg.output == stdoutOutput && (cfg.splitBytes > 0 || cfg.splitSections || cfg.sectionSizes > 0 || cfg.hotMap || cfg.measureRestore || cfg.shrink || len(collectGuestFileFlags) > 0) {
+			return cfg, errors.New("-output - can't be used with -split-bytes, -split-sections, -section-sizes, -hot-map, -measure-restore, -shrink or -collect-guest-file")
+		}
+		if cfg.dump != "" && (cfg.dryRun || cfg.output == stdoutOutput || cfg.splitBytes > 0 || cfg.splitSections || cfg.sectionSizes > 0 || cfg.hotMap || cfg.measureRestore || cfg.shrink) {
+			return cfg, errors.New("-dump can't be used with -dry-run, -output -, -split-bytes, -split-sections, -section-sizes, -hot-map, -measure-restore or -shrink")
+		}
+		if cfg.shrink && (cfg.dryRun || cfg.checkpoint != "" || cfg.guestShutdownCmd != "") {
+			return cfg, errors.New("-shrink can't be used with -dry-run, -checkpoint or -guest-shutdown-cmd")
+		}
+		if cfg.fromState != "" && (cfg.resume || cfg.shrink) {
+			return cfg, errors.New("-from-state can't be used with -resume or -shrink")
+		}
+		if cfg.delta && (cfg.fromState == "" || cfg.dryRun || cfg.output == stdoutOutput || cfg.dump != "" || cfg.splitBytes > 0 || cfg.splitSections || cfg.hotMap) {
+			return cfg, errors.New("-delta requires -from-state and can't be used with -dry-run, -output -, -dump, -split-bytes, -split-sections or -hot-map")
+		}
+		if cfg.icountShift != nil && (*cfg.icountShift < 0 || *cfg.icountShift > maxICountShift) {
+			return cfg, fmt.Errorf("-icount must be between 0 and %d: %d", maxICountShift, *cfg.icountShift)
+		}
+		if cfg.readyInstructions < 0 || (cfg.readyInstructions > 0 && (cfg.icountShift == nil || cfg.resume || cfg.fromState != "")) {
+			return cfg, errors.New("-ready-instructions must be positive, needs -icount and can't be used with -resume or -from-state")
+		}
+		if cfg.migrateTimeoutPerGB < 0 {
+			return cfg, errors.New("-migrate-timeout-per-gb must not be negative")
+		}
+		if cfg.readyDebounce < 0 {
+			return cfg, errors.New("-ready-debounce must not be negative")
+		}
+		if cfg.readyHelperTimeout < 0 {
+			return cfg, errors.New("-ready-helper-timeout must not be negative")
+		}
+		if cfg.globalConcurrency < 0 {
+			return cfg, errors.New("-global-concurrency must not be negative")
+		}
+		if cfg.memoryBuffer < 0 {
+			return cfg, errors.New("-memory-buffer must not be negative")
+		}
+		if cfg.memoryBuffer > 0 && (cfg.dryRun || cfg.output == stdoutOutput || cfg.dump != "" || cfg.splitBytes > 0 || cfg.splitSections || cfg.sectionSizes > 0 || cfg.hotMap || cfg.measureRestore || cfg.shrink || cfg.delta) {
+			return cfg, errors.New("-memory-buffer can't be used with -dry-run, -output -, -dump, -split-bytes, -split-sections, -section-sizes, -hot-map, -measure-restore, -shrink or -delta")
+		}
+		if cfg.compress {
+			if cfg.output == stdoutOutput || cfg.memoryBuffer > 0 || cfg.splitBytes > 0 || cfg.splitSections || cfg.sectionSizes > 0 || cfg.hotMap || cfg.measureRestore || cfg.shrink || cfg.delta {
+				return cfg, errors.New("-compress can't be used with -output -, -memory-buffer, -split-bytes, -split-sections, -section-sizes, -hot-map, -measure-restore, -shrink or -delta")
+			}
+			if _, err := exec.LookPath("gzip"); err != nil {
+				return cfg, fmt.Errorf("-compress needs gzip: %w", err)
+			}
+		}
+		if cfg.resume && cfg.checkpoint == "" {
+			return cfg, errors.New("-resume requires -checkpoint")
+		}
+		for _, f := range timingFlags {
+			p, err := parseTimingPattern(f)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.timingPatterns = append(cfg.timingPatterns, p)
+		}
+		for _, f := range autokeyFlags {
+			k, err := parseAutokey(f)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.autokeys = append(cfg.autokeys, k)
+		}
 
-	snapshotCh := make(chan struct{})
-	doneCh := make(chan struct{})
-	go func() {
-		<-snapshotCh
-		_, err := stdin.Write([]byte{byte(0x01), byte('c')}) // send Ctrl-A C to start the monitor mode
-		if err != nil {
-			log.Fatalf("failed to start monitor: %v", err)
+		cfg.guestExec = guestExecFlags
+		for _, f := range collectLogsFlags {
+			c, err := parseCollectLog(f)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.collectLogs = append(cfg.collectLogs, c)
 		}
-		for {
-			if _, err := io.WriteString(stdin, fmt.Sprintf("migrate file:%s\n", *outputFile)); err != nil {
-				log.Fatalf("failed to invoke migrate: %v", err)
+		for _, f := range collectGuestFileFlags {
+			if !strings.HasPrefix(f, "/") {
+				return cfg, fmt.Errorf("-collect-guest-file must be an absolute guest path: %q", f)
 			}
-			time.Sleep(500 * time.Millisecond)
-			if _, err := os.Stat(*outputFile); err == nil {
-				break // state file exists
-			} else if !errors.Is(err, os.ErrNotExist) {
-				log.Fatalf("failed to stat state file: %v", err)
+			cfg.collectGuestFiles = append(cfg.collectGuestFiles, f)
+		}
+
+		switch cfg.bootMenuPolicy {
+		case "warn", "fail", "select-default":
+		default:
+			return cfg, fmt.Errorf("-bootmenu-policy must be warn, fail or select-default: %q", cfg.bootMenuPolicy)
+		}
+		if slices.Contains(bootMenuPromptFlags, "") {
+			return cfg, errors.New("-bootmenu-prompt must not be empty")
+		}
+		cfg.bootMenuPrompts = bootMenuPromptFlags
+		key, err := strconv.Unquote(`"` + *bootMenuKey + `"`)
+		if err != nil || key == "" {
+			return cfg, fmt.Errorf("invalid -bootmenu-key %q", *bootMenuKey)
+		}
+		cfg.bootMenuKey = key
+		if cfg.oomPolicy != "warn" && cfg.oomPolicy != "fail" {
+			return cfg, fmt.Errorf("-oom-policy must be warn or fail: %q", cfg.oomPolicy)
+		}
+		if (cfg.guestShutdownCmd == "") != (cfg.guestShutdownMarker == "") {
+			return cfg, errors.New("-guest-shutdown-cmd and -guest-shutdown-marker must be used together")
+		}
+		if cfg.measureRestore && cfg.dryRun {
+			return cfg, errors.New("-measure-restore can't be used with -dry-run")
+		}
+		if *maxDowntimeMs < 0 {
+			return cfg, errors.New("-max-downtime-ms must not be negative")
+		}
+		cfg.maxDowntime = time.Duration(*maxDowntimeMs) * time.Millisecond
+
+		if *readyHTTP != "" {
+			u, err := url.Parse(*readyHTTP)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid -ready-http: %w", err)
 			}
+			cfg.readyHTTP = u
 		}
-		log.Println("finishing QEMU")
-		if _, err := io.WriteString(stdin, "quit\n"); err != nil {
-			log.Fatalf("failed to invoke quit: %v", err)
+		if *readyHTTPMatch != "" {
+			if cfg.readyHTTP == nil {
+				return cfg, errors.New("-ready-http-match requires -ready-http")
+			}
+			re, err := regexp.Compile(*readyHTTPMatch)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid -ready-http-match: %w", err)
+			}
+			cfg.readyHTTPMatch = re
 		}
-		close(doneCh)
-	}()
 
-	go func() {
-		p := make([]byte, 1)
-		cnt := 0
-		for {
-			if _, err := stdout.Read(p); err != nil {
-				log.Fatalf("failed to read stdout: %v", err)
+		if *readyQMPEvent != "" {
+			m := &qmpEventMatcher{name: *readyQMPEvent, data: make(map[string]string)}
+			for _, d := range readyQMPEventData {
+				k, v, ok := strings.Cut(d, "=")
+				if !ok || k == "" {
+					return cfg, fmt.Errorf("invalid -ready-qmp-event-data %q: want FIELD=VALUE", d)
+				}
+				m.data[k] = v
 			}
-			if string(p) == "=" {
-				cnt++
-			} else {
-				cnt = 0
+			cfg.readyQMPEvent = m
+		} else if len(readyQMPEventData) > 0 {
+			return cfg, errors.New("-ready-qmp-event-data requires -ready-qmp-event")
+		}
+
+		if *echoFilter != "" {
+			re, err := regexp.Compile(*echoFilter)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid -echo-filter: %w", err)
 			}
-			if cnt == 10 {
-				log.Println("detected marker")
-				break // start snapshotting
+			cfg.echoFilter = re
+		}
+		if *echoExclude != "" {
+			re, err := regexp.Compile(*echoExclude)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid -echo-exclude: %w", err)
 			}
-			if _, err := os.Stdout.Write(p); err != nil {
-				log.Fatalf("failed to copy stdout: %v", err)
+			cfg.echoExclude = re
+		}
+
+		if *consoleDecode != "raw" {
+			if _, ok := consoleDecoders[*consoleDecode]; !ok {
+				return cfg, fmt.Errorf("-console-decode must be %s, not %q", strings.Join(consoleDecoderNames(), " or "), *consoleDecode)
+			}
+			cfg.consoleDecode = *consoleDecode
+		}
+
+		if *waitLoginFlag {
+			prompts := []string(loginPromptFlags)
+			if len(prompts) == 0 {
+				prompts = defaultLoginPrompts
 			}
+			patterns, err := compilePatterns(prompts)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid -login-prompt: %w", err)
+			}
+			cfg.loginPrompts = patterns
+		} else if len(loginPromptFlags) > 0 {
+			return cfg, errors.New("-login-prompt requires -wait-login")
 		}
-		close(snapshotCh)
-		if _, err := io.Copy(os.Stdout, stdout); err != nil {
-			log.Fatalf("failed to copy stdout: %v", err)
+
+		if !*noMissingFileDetection {
+			patterns, err := compilePatterns(append(slices.Clone(defaultMissingFilePatterns), missingFileFlags...))
+			if err != nil {
+				return cfg, fmt.Errorf("invalid -missing-file-pattern: %w", err)
+			}
+			cfg.missingFilePatterns = patterns
 		}
-	}()
 
-	<-doneCh
+		warningErrors, err := compilePatterns(warningErrorFlags)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -warning-as-error: %w", err)
+		}
+		cfg.warningErrors = warningErrors
 
-	if err := cmd.Wait(); err != nil {
-		log.Fatalf("waiting for qemu: %v", err)
+		argsData, err := os.ReadFile(*argsJSON)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to get args json: %w", err)
+		}
+		if err := json.Unmarshal(argsData, &cfg.args); err != nil {
+			return cfg, fmt.Errorf("failed to parse args json: %w", err)
+		}
+		if len(cfg.args) == 0 {
+			// QEMU would be launched bare and fail obscurely.
+			return cfg, fmt.Errorf("args JSON produced no arguments; expected QEMU options in %s", *argsJSON)
+		}
+		for _, f := range secretFileFlags {
+			id, path, ok := strings.Cut(f, "=")
+			if !ok || id == "" || path == "" {
+				return cfg, fmt.Errorf("-secret-file must be ID=PATH: %q", f)
+			}
+			if _, err := os.Stat(path); err != nil {
+				return cfg, fmt.Errorf("invalid -secret-file: %w", err)
+			}
+			cfg.args = append(cfg.args, "-object", "secret,id="+id+",file="+path)
+		}
+		cfg.redactArgs = redactArgFlags
+		return cfg, nil
 	}
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifest describes a finished capture. It's written to -manifest.
+type manifest struct {
+	Output       string   `json:"output,omitempty"` // empty for -dry-run, -dump, -split-bytes and -delta, "-" for stdout
+	SplitIndex   string   `json:"splitIndex,omitempty"`
+	QEMU         string   `json:"qemu"`
+	Args         []string `json:"args"`
+	ReadySeconds float64  `json:"readySeconds"`
+	Timings      []timing `json:"timings,omitempty"`
+
+	// PreScriptSteps is the time each pre-script step took. Steps completed
+	// before a resumed checkpoint aren't included.
+	PreScriptSteps []stepTiming `json:"preScriptSteps,omitempty"`
+
+	// RestoreSeconds is the time taken to restore the state, measured by
+	// -measure-restore.
+	RestoreSeconds float64 `json:"restoreSeconds,omitempty"`
+
+	HostMemory hostMemory `json:"hostMemory"`
+
+	// DowntimeMs is the time the VM was stopped during the migration, as
+	// reported by QMP.
+	DowntimeMs *int64 `json:"downtimeMs,omitempty"`
+	// MigratePhases is the time spent in each phase of the migration, if
+	// QMP showed them.
+	MigratePhases *migrationPhases `json:"migratePhases,omitempty"`
+
+	// CompatMachine is the versioned machine type pinned by -compat-machine.
+	CompatMachine string `json:"compatMachine,omitempty"`
+
+	// Devices are the -device options of args in the order QEMU created
+	// them, which the state layout depends on. Restoring with the devices
+	// in another order (or other slots) may fail or confuse the guest.
+	Devices []deviceInfo `json:"devices,omitempty"`
+
+	// Accel is the accelerator (tcg, kvm, ...) selected by args or -accel.
+	// KVM and TCG states may not restore under each other.
+	Accel string `json:"accel,omitempty"`
+	// AccelFallbackFrom is the accelerator QEMU couldn't use before
+	// -accel-fallback captured with TCG instead.
+	AccelFallbackFrom string `json:"accelFallbackFrom,omitempty"`
+
+	// ICount is the -icount setting the guest ran with. The state restores
+	// deterministically only with the same -icount option.
+	ICount *icountInfo `json:"icount,omitempty"`
+
+	// FakeTime is the time the guest (and QEMU) started at with -fake-time.
+	FakeTime string `json:"fakeTime,omitempty"`
+
+	// Balloon is the guest RAM before and after -balloon.
+	Balloon *balloonInfo `json:"balloon,omitempty"`
+	// MemoryGrowth is the guest memory usage at readiness and before the
+	// snapshot, with -memory-growth.
+	MemoryGrowth *memoryGrowth `json:"memoryGrowth,omitempty"`
+
+	// Shrink is the state size before and after -shrink.
+	Shrink *shrinkInfo `json:"shrink,omitempty"`
+
+	// Dump is the guest memory dump (ELF) taken by -dump instead of the
+	// state.
+	Dump string `json:"dump,omitempty"`
+
+	// Compression is how the output is compressed: "gzip" with -compress.
+	Compression string `json:"compression,omitempty"`
+
+	// FromState is the state restored by -from-state instead of booting,
+	// and Delta the index of the output written as a delta against it.
+	FromState string `json:"fromState,omitempty"`
+	Delta     string `json:"delta,omitempty"`
+
+	// CPUAffinity is the CPUs QEMU was pinned to by -cpu-affinity.
+	CPUAffinity []int `json:"cpuAffinity,omitempty"`
+
+	// OOMKills are the processes the guest OOM killer killed (with
+	// -oom-policy warn), "unknown" for an OOM not naming one.
+	OOMKills []string `json:"oomKills,omitempty"`
+
+	// HotMap is the path of the hot page map written by -hot-map.
+	HotMap string `json:"hotMap,omitempty"`
+
+	// CollectedLogs are the host paths of the guest logs copied by
+	// -collect-logs.
+	CollectedLogs []string `json:"collectedLogs,omitempty"`
+
+	// GuestFiles are the host paths of the guest files copied by
+	// -collect-guest-file, keyed by guest path.
+	GuestFiles map[string]string `json:"guestFiles,omitempty"`
+
+	// Sections are the largest sections of the state, with -section-sizes.
+	Sections []sectionSize `json:"sections,omitempty"`
+
+	// ScreenText is the VGA text screen at readiness, taken by -screen-text.
+	ScreenText string `json:"screenText,omitempty"`
+}
+
+// manifestInputs are what a capture records in the manifest besides its
+// result and config.
+type manifestInputs struct {
+	args       []string // redacted
+	hostMem    hostMemory
+	devices    []deviceInfo
+	accel      string
+	icount     *icountInfo
+	balloon    *balloonInfo
+	downtime   *time.Duration // reported by QMP
+	collected  []string
+	guestFiles map[string]string
+
+	// sectionsIndex and deltaIndex index the output written by
+	// -split-sections and -delta, and hotMap is written by -hot-map.
+	sectionsIndex, deltaIndex, hotMap string
+}
+
+// newManifest returns the manifest of the capture of cfg that got res.
+func (cfg *config) newManifest(res *result, in manifestInputs) *manifest {
+	outputPath, splitIndex := cfg.output, ""
+	if cfg.dryRun || cfg.dump != "" {
+		outputPath = ""
+	} else if cfg.splitBytes > 0 {
+		outputPath, splitIndex = "", splitIndexPath(cfg.output)
+	} else if in.sectionsIndex != "" {
+		outputPath, splitIndex = "", in.sectionsIndex
+	} else if in.deltaIndex != "" {
+		outputPath = ""
+	}
+	var downtimeMs *int64
+	if in.downtime != nil {
+		ms := in.downtime.Milliseconds()
+		downtimeMs = &ms
+	}
+	var compression string
+	if cfg.compress && outputPath != "" {
+		compression = "gzip"
+	}
+	var fakeTime string
+	if !cfg.fakeTime.IsZero() {
+		fakeTime = cfg.fakeTime.UTC().Format(time.RFC3339)
+	}
+	return &manifest{
+		Output:       outputPath,
+		SplitIndex:   splitIndex,
+		QEMU:         cfg.qemu,
+		Args:         in.args,
+		ReadySeconds: res.ReadyAfter.Seconds(),
+		Timings:      res.Timings,
+
+		PreScriptSteps: res.PreScriptSteps,
+		RestoreSeconds: res.RestoreTime.Seconds(),
+		HostMemory:     in.hostMem,
+		DowntimeMs:     downtimeMs,
+		MigratePhases:  res.MigratePhases,
+
+		CompatMachine:     cfg.compatMachine,
+		Devices:           in.devices,
+		Accel:             in.accel,
+		AccelFallbackFrom: cfg.accelFallbackFrom,
+		ICount:            in.icount,
+		FakeTime:          fakeTime,
+
+		Balloon:      in.balloon,
+		MemoryGrowth: res.MemoryGrowth,
+		Shrink:       res.Shrink,
+		Dump:         res.Dump,
+		Compression:  compression,
+		FromState:    cfg.fromState,
+		Delta:        in.deltaIndex,
+		CPUAffinity:  cfg.cpuAffinity,
+		OOMKills:     res.OOMKills,
+		HotMap:       in.hotMap,
+
+		CollectedLogs: in.collected,
+		GuestFiles:    in.guestFiles,
+		Sections:      res.Sections,
+		ScreenText:    res.ScreenText,
+	}
+}
+
+func writeManifest(path string, m *manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// timing is the time a -timing-pattern first matched a console line, relative
+// to the QEMU start.
+type timing struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+type timingPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// parseTimingPattern parses a "name:regexp" flag value.
+func parseTimingPattern(s string) (timingPattern, error) {
+	name, expr, ok := strings.Cut(s, ":")
+	if !ok || name == "" {
+		return timingPattern{}, fmt.Errorf("timing pattern %q must be name:regexp", s)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return timingPattern{}, fmt.Errorf("timing pattern %q: %w", name, err)
+	}
+	return timingPattern{name: name, re: re}, nil
+}
+
+// timingRecorder records when each pattern first matches a console line.
+type timingRecorder struct {
+	start    time.Time
+	patterns []timingPattern
+
+	mu      sync.Mutex
+	timings []timing
+	matched map[string]bool
+}
+
+func newTimingRecorder(start time.Time, patterns []timingPattern) *timingRecorder {
+	return &timingRecorder{start: start, patterns: patterns, matched: make(map[string]bool)}
+}
+
+func (r *timingRecorder) line(l string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.patterns {
+		if !r.matched[p.name] && p.re.MatchString(l) {
+			r.matched[p.name] = true
+			r.timings = append(r.timings, timing{Name: p.name, Seconds: time.Since(r.start).Seconds()})
+		}
+	}
+}
+
+func (r *timingRecorder) result() []timing {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]timing{}, r.timings...)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ktock/container2wasm/cmd/get-qemu-state/marker"
+)
+
+// markerScanner forwards the console stream to w while looking for any of
+// markers. Every match counts towards count, no matter which marker matched;
+// onReady is called with the marker completing the count. Matched markers
+// aren't forwarded, so bytes that may start a marker are held back until they
+// turn out not to be one. Once ready, the stream is passed through as is.
+type markerScanner struct {
+	w       io.Writer
+	markers []string
+	m       *marker.Matcher // of markers
+	count   int
+	onMatch func(marker string, n int)
+	onReady func(marker string)
+
+	// crlf matches the markers with "\r\n" and "\r" in the stream (and the
+	// markers) read as "\n". The stream is still forwarded as is.
+	crlf bool
+
+	// gate (if not nil) disables the matching until a console line matches
+	// it, e.g. to skip the banners of QEMU and the firmware. onGateOpen is
+	// called with that line.
+	gate       *regexp.Regexp
+	onGateOpen func(line string)
+	line       []byte // of the stream while gated
+
+	matches int
+	// pending are the bytes held back, fed[i] telling whether pending[i]
+	// was fed to m (a "\n" following "\r" isn't with crlf).
+	pending []byte
+	fed     []bool
+	lastCR  bool // the last byte of the stream is "\r"
+}
+
+func newMarkerScanner(w io.Writer, markers []string, count int, onReady func(marker string)) *markerScanner {
+	return &markerScanner{w: w, markers: markers, m: marker.NewMatcher(markers), count: count, onReady: onReady}
+}
+
+// normalizeCRLF makes s match regardless of the line ending style.
+func (s *markerScanner) normalizeCRLF() {
+	s.crlf = true
+	var markers []string
+	for _, m := range s.markers {
+		markers = append(markers, strings.ReplaceAll(strings.ReplaceAll(m, "\r\n", "\n"), "\r", "\n"))
+	}
+	s.markers, s.m = markers, marker.NewMatcher(markers)
+}
+
+// feed feeds b of the stream to the matcher, as "\n" for a line ending
+// with crlf, and returns the markers ending at it, longest first. It reports
+// whether b was fed.
+func (s *markerScanner) feed(b byte) (matched []int, fed bool) {
+	cr := s.lastCR
+	s.lastCR = b == '\r'
+	if s.crlf {
+		switch {
+		case b == '\n' && cr:
+			return nil, false // of the "\r\n" fed as "\n" already
+		case b == '\r':
+			b = '\n'
+		}
+	}
+	return s.m.Feed(b), true
+}
+
+// held returns the length of the end of pending holding the last n bytes
+// fed to the matcher.
+func (s *markerScanner) held(n int) int {
+	k := 0
+	for n > 0 {
+		k++
+		if s.fed[len(s.fed)-k] {
+			n--
+		}
+	}
+	return k
+}
+
+// maxGateLine bounds the bytes of a console line matched against the gate.
+const maxGateLine = 4096
+
+func (s *markerScanner) Write(p []byte) (int, error) {
+	if s.ready() {
+		return s.w.Write(p)
+	}
+	if s.gate != nil {
+		i := s.openGate(p)
+		if _, err := s.w.Write(p[:i]); err != nil {
+			return 0, err
+		}
+		if i == len(p) {
+			return len(p), nil
+		}
+		n, err := s.Write(p[i:])
+		return i + n, err
+	}
+	var out []byte
+	for i, b := range p {
+		matched, fed := s.feed(b)
+		s.pending, s.fed = append(s.pending, b), append(s.fed, fed)
+		if len(matched) > 0 {
+			// Forward what precedes the (longest) marker and swallow it.
+			m := s.m.Marker(matched[0])
+			out = append(out, s.pending[:len(s.pending)-s.held(len(m))]...)
+			s.pending, s.fed = s.pending[:0], s.fed[:0]
+			s.m.Reset() // the markers don't overlap
+			s.matches++
+			if s.onMatch != nil {
+				s.onMatch(m, s.matches)
+			}
+			if s.ready() {
+				if _, err := s.w.Write(out); err != nil {
+					return 0, err
+				}
+				s.onReady(m)
+				if _, err := s.w.Write(p[i+1:]); err != nil {
+					return 0, err
+				}
+				return len(p), nil
+			}
+			continue
+		}
+		// Emit the bytes that can't be the start of a marker anymore.
+		n := len(s.pending) - s.held(s.m.Pending())
+		out = append(out, s.pending[:n]...)
+		s.pending = append(s.pending[:0], s.pending[n:]...)
+		s.fed = append(s.fed[:0], s.fed[n:]...)
+	}
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// openGate looks for a line matching the gate in p. If found, the gate is
+// removed and the length of p up to the end of the line is returned.
+// Otherwise len(p) is.
+func (s *markerScanner) openGate(p []byte) int {
+	for i, b := range p {
+		if b != '\n' {
+			if len(s.line) < maxGateLine {
+				s.line = append(s.line, b)
+			}
+			continue
+		}
+		line := strings.TrimSuffix(string(s.line), "\r")
+		s.line = s.line[:0]
+		if s.gate.MatchString(line) {
+			s.gate, s.line = nil, nil
+			if s.onGateOpen != nil {
+				s.onGateOpen(line)
+			}
+			return i + 1
+		}
+	}
+	return len(p)
+}
+
+func (s *markerScanner) ready() bool {
+	return s.matches >= s.count
+}
+
+// repeatMarker returns the marker of a -marker-repeat CHAR:COUNT value, the
+// character repeated COUNT times like the default marker.
+func repeatMarker(v string) (string, error) {
+	i := strings.LastIndex(v, ":")
+	if i < 0 {
+		return "", fmt.Errorf("invalid -marker-repeat %q: want CHAR:COUNT (e.g. =:20)", v)
+	}
+	c, count := v[:i], v[i+1:]
+	if utf8.RuneCountInString(c) != 1 {
+		return "", fmt.Errorf("invalid -marker-repeat %q: %q isn't a single character", v, c)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return "", fmt.Errorf("invalid -marker-repeat %q: count must be a positive integer", v)
+	}
+	return strings.Repeat(c, n), nil
+}
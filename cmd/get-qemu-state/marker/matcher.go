@@ -0,0 +1,91 @@
+package marker
+
+// Matcher finds the occurrences of markers in a stream fed to it a byte at a
+// time, with the Aho-Corasick automaton of the markers. Every occurrence is
+// found, including those of a marker inside or overlapping another one.
+type Matcher struct {
+	markers []string
+	nodes   []node
+	state   int
+}
+
+type node struct {
+	next  map[byte]int
+	fail  int
+	depth int
+	out   []int // the markers ending at this node, longest first
+}
+
+// NewMatcher returns a Matcher of markers. Empty markers never match.
+func NewMatcher(markers []string) *Matcher {
+	m := &Matcher{markers: markers, nodes: []node{{next: map[byte]int{}}}}
+	for i, s := range markers {
+		if s == "" {
+			continue
+		}
+		n := 0
+		for j := 0; j < len(s); j++ {
+			c, ok := m.nodes[n].next[s[j]]
+			if !ok {
+				c = len(m.nodes)
+				m.nodes = append(m.nodes, node{next: map[byte]int{}, depth: m.nodes[n].depth + 1})
+				m.nodes[n].next[s[j]] = c
+			}
+			n = c
+		}
+		m.nodes[n].out = append(m.nodes[n].out, i)
+	}
+	// Link each node to the node of its longest proper suffix, breadth
+	// first so that the suffix's links are set, and inherit its markers,
+	// which are shorter.
+	queue := []int{0}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for b, c := range m.nodes[n].next {
+			if n != 0 {
+				m.nodes[c].fail = m.step(m.nodes[n].fail, b)
+			}
+			m.nodes[c].out = append(m.nodes[c].out, m.nodes[m.nodes[c].fail].out...)
+			queue = append(queue, c)
+		}
+	}
+	return m
+}
+
+// step returns the node reached from n by b.
+func (m *Matcher) step(n int, b byte) int {
+	for {
+		if c, ok := m.nodes[n].next[b]; ok {
+			return c
+		}
+		if n == 0 {
+			return 0
+		}
+		n = m.nodes[n].fail
+	}
+}
+
+// Feed advances the stream by b and returns the indexes of the markers
+// ending at b, longest first. The slice is shared; don't modify it.
+func (m *Matcher) Feed(b byte) []int {
+	m.state = m.step(m.state, b)
+	return m.nodes[m.state].out
+}
+
+// Marker returns the marker of index i.
+func (m *Matcher) Marker(i int) string {
+	return m.markers[i]
+}
+
+// Pending returns the length of the longest end of the stream fed so far
+// that starts a marker, i.e. the bytes a match may still begin with.
+func (m *Matcher) Pending() int {
+	return m.nodes[m.state].depth
+}
+
+// Reset forgets the stream fed so far, e.g. after a match that doesn't
+// overlap the next ones.
+func (m *Matcher) Reset() {
+	m.state = 0
+}
@@ -0,0 +1,47 @@
+// Package marker detects the readiness markers of get-qemu-state in a stream
+// without QEMU, for tools consuming a guest console themselves.
+package marker
+
+import "io"
+
+// Reader passes a stream through from an io.Reader as is while looking for
+// markers. Unlike the console scanner of get-qemu-state, it doesn't swallow
+// them. The callback is called with every occurrence of any marker and the
+// offset in the stream where it starts, in the order the occurrences end
+// (the longest first when several end at the same byte).
+//
+// The callback is called synchronously from Read before the bytes completing
+// the marker are returned, so a slow callback holds back the reader of the
+// stream (and, through it, the writer at the other side, e.g. QEMU). Nothing
+// is buffered; the markers are matched by a Matcher.
+type Reader struct {
+	r       io.Reader
+	m       *Matcher
+	onMatch func(marker string, offset int64)
+
+	off int64 // offset of the end of the stream read so far
+}
+
+// NewReader returns a Reader of r calling onMatch with the occurrences of
+// markers.
+func NewReader(r io.Reader, markers []string, onMatch func(marker string, offset int64)) *Reader {
+	return &Reader{r: r, m: NewMatcher(markers), onMatch: onMatch}
+}
+
+func (mr *Reader) Read(p []byte) (int, error) {
+	n, err := mr.r.Read(p)
+	if n > 0 {
+		mr.scan(p[:n])
+	}
+	return n, err
+}
+
+func (mr *Reader) scan(p []byte) {
+	for _, b := range p {
+		mr.off++
+		for _, i := range mr.m.Feed(b) {
+			m := mr.m.Marker(i)
+			mr.onMatch(m, mr.off-int64(len(m)))
+		}
+	}
+}
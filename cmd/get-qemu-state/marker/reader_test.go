@@ -0,0 +1,60 @@
+package marker
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReader(t *testing.T) {
+	input := "boot\n=====x\n==========login: READY\nREADY=========="
+	type match struct {
+		marker string
+		offset int64
+	}
+	want := []match{
+		{"==========", 12},
+		{"READY", 29},
+		{"READY", 35},
+		{"==========", 40},
+	}
+	for _, r := range []struct {
+		name string
+		r    io.Reader
+	}{
+		{"whole", strings.NewReader(input)},
+		{"byte-by-byte", iotest.OneByteReader(strings.NewReader(input))},
+		{"halves", iotest.HalfReader(strings.NewReader(input))},
+	} {
+		var got []match
+		mr := NewReader(r.r, []string{"==========", "READY"}, func(m string, off int64) {
+			got = append(got, match{m, off})
+		})
+		out, err := io.ReadAll(mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != input {
+			t.Errorf("%s: stream is modified: %q", r.name, out)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got matches %v; want %v", r.name, got, want)
+		}
+	}
+}
+
+func TestReaderInsidePrefix(t *testing.T) {
+	var got []string
+	mr := NewReader(iotest.OneByteReader(strings.NewReader("xxREADY!yy READY-NOW")), []string{"READY-NOW", "DY"}, func(m string, off int64) {
+		got = append(got, fmt.Sprintf("%s@%d", m, off))
+	})
+	if _, err := io.ReadAll(mr); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"DY@5", "DY@14", "READY-NOW@11"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got matches %v; want %v", got, want)
+	}
+}
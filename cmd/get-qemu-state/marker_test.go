@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+func TestMarkerScanner(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		markers   []string
+		count     int
+		crlf      bool
+		input     []string
+		wantOut   string
+		wantReady string
+	}{
+		{
+			name:      "default",
+			markers:   []string{defaultWaitString},
+			count:     1,
+			input:     []string{"boot\n=====x\n", "=====", "=====after"},
+			wantOut:   "boot\n=====x\nafter",
+			wantReady: defaultWaitString,
+		},
+		{
+			name:      "any-of",
+			markers:   []string{"READY-A", "READY-B"},
+			count:     1,
+			input:     []string{"READY-", "C READY-B done"},
+			wantOut:   "READY-C  done",
+			wantReady: "READY-B",
+		},
+		{
+			name:      "inside a longer marker's prefix",
+			markers:   []string{"READY-NOW", "DY"},
+			count:     1,
+			input:     []string{"xxREAD", "Y!yy"},
+			wantOut:   "xxREA!yy",
+			wantReady: "DY",
+		},
+		{
+			name:      "count across markers",
+			markers:   []string{"up:a", "up:b"},
+			count:     2,
+			input:     []string{"up:b\nup:b\n"},
+			wantOut:   "\n\n",
+			wantReady: "up:b",
+		},
+		{
+			name:    "not enough",
+			markers: []string{"up:a", "up:b"},
+			count:   3,
+			input:   []string{"up:a up:b up:"},
+			wantOut: "  ",
+		},
+		{
+			name:      "crlf",
+			markers:   []string{"login:\nready\n"},
+			count:     1,
+			crlf:      true,
+			input:     []string{"boot\r\nlogin:\r", "\nready\r\nafter\r\n"},
+			wantOut:   "boot\r\n\nafter\r\n", // the \r completed the marker
+			wantReady: "login:\nready\n",
+		},
+		{
+			name:      "crlf in marker",
+			markers:   []string{"ready\r\n"},
+			count:     2,
+			crlf:      true,
+			input:     []string{"ready\r", "ready\n"},
+			wantOut:   "",
+			wantReady: "ready\n",
+		},
+		{
+			name:    "no crlf",
+			markers: []string{"login:\nready\n"},
+			count:   1,
+			input:   []string{"login:\r\nready\r\n"},
+			wantOut: "login:\r\nready\r\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			var ready string
+			s := newMarkerScanner(&out, tt.markers, tt.count, func(m string) { ready = m })
+			if tt.crlf {
+				s.normalizeCRLF()
+			}
+			for _, in := range tt.input {
+				if _, err := s.Write([]byte(in)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if out.String() != tt.wantOut {
+				t.Errorf("output = %q; want %q", out.String(), tt.wantOut)
+			}
+			if ready != tt.wantReady {
+				t.Errorf("ready by %q; want %q", ready, tt.wantReady)
+			}
+		})
+	}
+}
+
+func TestRepeatMarker(t *testing.T) {
+	for v, want := range map[string]string{
+		"=:10": defaultWaitString,
+		"#:3":  "###",
+		"::2":  "::",
+		"→:2":  "→→",
+	} {
+		if got, err := repeatMarker(v); err != nil || got != want {
+			t.Errorf("repeatMarker(%q) = %q, %v; want %q", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"=", "=:0", "=:x", "==:3", ":3"} {
+		if _, err := repeatMarker(v); err == nil {
+			t.Errorf("repeatMarker(%q) must fail", v)
+		}
+	}
+}
+
+func TestMarkerScannerGate(t *testing.T) {
+	var out bytes.Buffer
+	var opened string
+	ready := 0
+	s := newMarkerScanner(&out, []string{"=========="}, 1, func(string) { ready++ })
+	s.gate = regexp.MustCompile(defaultBootPattern)
+	s.onGateOpen = func(line string) { opened = line }
+	input := []string{
+		"OpenSBI v1.3 ==========\r\n",
+		"[    0.000000] Linux ver",
+		"sion 6.1.0 (gcc)\r\nbooting\n==",
+		"========\nafter\n",
+	}
+	for _, in := range input {
+		if _, err := s.Write([]byte(in)); err != nil {
+			t.Fatal(err)
+		}
+		if in == input[0] && ready > 0 {
+			t.Fatal("the marker in the banner matched")
+		}
+	}
+	if ready != 1 {
+		t.Fatalf("ready %d times; want once after the boot line", ready)
+	}
+	if opened != "[    0.000000] Linux version 6.1.0 (gcc)" {
+		t.Errorf("gate opened by %q", opened)
+	}
+	if want := "OpenSBI v1.3 ==========\r\n[    0.000000] Linux version 6.1.0 (gcc)\r\nbooting\n\nafter\n"; out.String() != want {
+		t.Errorf("forwarded %q; want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// With -marker-fd, the guest signals readiness on a virtio serial port of
+// its own instead of the console, so console output can't be mistaken for
+// a marker (or split one):
+//
+//	printf '==========' > /dev/virtio-ports/get-qemu-state.marker
+//
+// The guest kernel needs virtio-console (CONFIG_VIRTIO_CONSOLE); the
+// /dev/virtio-ports link is made by udev or mdev, /dev/vport*p1 works
+// without. The port is backed by a pipe QEMU inherits (-add-fd) and only
+// what the guest writes there is matched against the markers; the console
+// is echoed as usual. -stage-marker-helper can write to the port too
+// (get-qemu-state-ready /dev/virtio-ports/get-qemu-state.marker).
+const (
+	markerPortName = "get-qemu-state.marker"
+	markerChardev  = "gqs-marker"
+	// markerFDSet is the -add-fd set of the pipe.
+	markerFDSet = 3779
+)
+
+// markerPortArgs returns the args adding the marker port, backed by
+// backend (e.g. "null").
+func markerPortArgs(backend string) []string {
+	return []string{
+		"-chardev", backend + ",id=" + markerChardev,
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=" + markerChardev + ",name=" + markerPortName,
+	}
+}
+
+// withMarkerPipe returns args (with markerPortArgs("null")) with the port
+// backed by fd of QEMU instead. The state is restored with the null
+// backend: the device needs to be there, not the pipe.
+func withMarkerPipe(args []string, fd int) []string {
+	res := slices.Clone(args)
+	for i := 0; i < len(res)-1; i++ {
+		if res[i] == "-chardev" && res[i+1] == "null,id="+markerChardev {
+			res[i+1] = fmt.Sprintf("file,id=%s,path=/dev/fdset/%d", markerChardev, markerFDSet)
+		}
+	}
+	return append(res, "-add-fd", fmt.Sprintf("fd=%d,set=%d", fd, markerFDSet))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWithMarkerPipe(t *testing.T) {
+	args := append([]string{"-m", "512"}, markerPortArgs("null")...)
+	got := withMarkerPipe(args, 3)
+	want := []string{"-m", "512",
+		"-chardev", "file,id=gqs-marker,path=/dev/fdset/3779",
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=gqs-marker,name=get-qemu-state.marker",
+		"-add-fd", "fd=3,set=3779"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if args[3] != "null,id=gqs-marker" {
+		t.Errorf("args were modified: %q", args)
+	}
+}
+
+func TestCaptureMarkerFD(t *testing.T) {
+	// The console prints the default marker right at the boot; only the
+	// port's counts.
+	delay := 500 * time.Millisecond
+	t.Setenv("STUB_QEMU_PORT_MARKER", defaultWaitString)
+	t.Setenv("STUB_QEMU_PORT_DELAY", delay.String())
+
+	cfg := stubConfig(t)
+	cfg.markerFD = true
+	cfg.manifest = filepath.Join(t.TempDir(), "manifest.json")
+	res, err := capture(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ReadyAfter < delay {
+		t.Errorf("ready after %v; want the marker on the console ignored", res.ReadyAfter)
+	}
+	data, err := os.ReadFile(cfg.manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(m.Args, "null,id=gqs-marker") || slices.Contains(m.Args, "-add-fd") {
+		t.Errorf("args %q don't restore with the null port", m.Args)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// matrixSpec is the YAML (or JSON) spec of -matrix. Each combination of the
+// axis values is captured with "{axis}" in QEMU and the flags replaced by its
+// value, e.g.
+//
+//	axes:
+//	  arch: [x86_64, riscv64]
+//	  kernel: ["6.1", "6.6"]
+//	qemu: qemu-system-{arch}
+//	flags:
+//	  - -args-json
+//	  - args-{arch}-{kernel}.json
+//	  - -output
+//	  - "{arch}-{kernel}.state"
+//	optional:
+//	  - arch: riscv64
+//	    kernel: "6.6"
+type matrixSpec struct {
+	Axes  map[string][]string `json:"axes" yaml:"axes"`
+	QEMU  string              `json:"qemu,omitempty" yaml:"qemu"`
+	Flags []string            `json:"flags" yaml:"flags"`
+	// Optional lists the combinations whose failure doesn't fail the run.
+	// An entry matches the combinations having all of its values.
+	Optional []map[string]string `json:"optional,omitempty" yaml:"optional"`
+}
+
+// matrixCombination is a combination of the axis values.
+type matrixCombination map[string]string
+
+// String returns the combination as "axis=value,..." in the axis order.
+func (c matrixCombination) String() string {
+	var s []string
+	for _, a := range slices.Sorted(maps.Keys(c)) {
+		s = append(s, a+"="+c[a])
+	}
+	return strings.Join(s, ",")
+}
+
+func (c matrixCombination) expand(s string) string {
+	var oldnew []string
+	for _, a := range slices.Sorted(maps.Keys(c)) {
+		oldnew = append(oldnew, "{"+a+"}", c[a])
+	}
+	// The replacer substitutes in a single pass so a value containing
+	// "{axis}" is kept as is instead of depending on the order of the axes.
+	return strings.NewReplacer(oldnew...).Replace(s)
+}
+
+// expandMatrix returns all the combinations of the axis values, varying the
+// last axis (in name order) fastest.
+func expandMatrix(axes map[string][]string) ([]matrixCombination, error) {
+	if len(axes) == 0 {
+		return nil, errors.New("matrix has no axes")
+	}
+	res := []matrixCombination{{}}
+	for _, a := range slices.Sorted(maps.Keys(axes)) {
+		if len(axes[a]) == 0 {
+			return nil, fmt.Errorf("axis %s has no values", a)
+		}
+		var next []matrixCombination
+		for _, c := range res {
+			for _, v := range axes[a] {
+				nc := maps.Clone(c)
+				nc[a] = v
+				next = append(next, nc)
+			}
+		}
+		res = next
+	}
+	return res, nil
+}
+
+// matrixResult is the result of a combination in the "matrix" report.
+type matrixResult struct {
+	Combination    string  `json:"combination"`
+	Required       bool    `json:"required"`
+	OK             bool    `json:"ok"`
+	Error          string  `json:"error,omitempty"`
+	Output         string  `json:"output,omitempty"`
+	ReadySeconds   float64 `json:"readySeconds,omitempty"`
+	MigrateSeconds float64 `json:"migrateSeconds,omitempty"`
+	SizeBytes      int64   `json:"sizeBytes,omitempty"`
+}
+
+// matrixFlags are the flags of the -matrix run itself, not passed to the
+// captures.
+var matrixFlags = []string{"matrix", "matrix-jobs", "matrix-report"}
+
+// runMatrix implements -matrix. It captures every combination of the spec at
+// specPath, jobs at a time, writes the report as a table to w (and as JSON
+// to reportPath if not empty), and fails if a required combination failed.
+// Each combination is captured with the capture flags set in base followed
+// by the flags of the spec, and with the QEMU of the spec or else qemu. The
+// guest consoles aren't printed; use -console-file. The log lines of each
+// combination are prefixed with [axis=value,...].
+func runMatrix(specPath string, base *flag.FlagSet, qemu string, jobs int, reportPath string, w io.Writer) error {
+	if jobs < 1 {
+		return errors.New("-matrix-jobs must be positive")
+	}
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		return err
+	}
+	var spec matrixSpec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("failed to parse matrix spec: %w", err)
+	}
+	if spec.QEMU == "" {
+		spec.QEMU = qemu
+	}
+	if spec.QEMU == "" {
+		return errors.New("specify QEMU binary or qemu in the matrix spec")
+	}
+	combinations, err := expandMatrix(spec.Axes)
+	if err != nil {
+		return err
+	}
+
+	// Parse all the flags first so that a typo doesn't fail the run halfway.
+	cfgs := make([]config, len(combinations))
+	for i, c := range combinations {
+		cfg, err := matrixConfig(base, spec, c)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c, err)
+		}
+		cfgs[i] = cfg
+	}
+	if err := checkMatrixPaths(combinations, cfgs); err != nil {
+		return err
+	}
+
+	captured, errs := runCaptures(cfgs, jobs, func(i int, err error) {
+		cfgs[i].logger.Printf("failed: %v", err)
+	})
+	results := make([]matrixResult, len(combinations))
+	for i, c := range combinations {
+		results[i] = newMatrixResult(cfgs[i], c, !matrixOptional(spec.Optional, c), captured[i], errs[i])
+	}
+
+	if reportPath != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(reportPath, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if err := writeMatrixReport(w, results); err != nil {
+		return err
+	}
+	var failed int
+	for _, r := range results {
+		if r.Required && !r.OK {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d required combinations failed", failed, len(results))
+	}
+	return nil
+}
+
+// matrixConfig returns the config of the capture of c, with "{axis}" in the
+// flags replaced by its value.
+func matrixConfig(base *flag.FlagSet, spec matrixSpec, c matrixCombination) (config, error) {
+	fs := flag.NewFlagSet(c.String(), flag.ContinueOnError)
+	configure := registerFlags(fs)
+	var err error
+	base.Visit(func(f *flag.Flag) {
+		if err != nil || slices.Contains(matrixFlags, f.Name) {
+			return
+		}
+		if fs.Lookup(f.Name) == nil {
+			err = fmt.Errorf("-%s can't be used with -matrix", f.Name)
+			return
+		}
+		values := []string{f.Value.String()}
+		if g, ok := f.Value.(flag.Getter); ok {
+			if v, ok := g.Get().([]string); ok {
+				values = v
+			}
+		}
+		for _, v := range values {
+			if err = fs.Set(f.Name, c.expand(v)); err != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return config{}, err
+	}
+	var flags []string
+	for _, f := range spec.Flags {
+		flags = append(flags, c.expand(f))
+	}
+	if err := fs.Parse(flags); err != nil {
+		return config{}, err
+	}
+	cfg, err := configure()
+	if err != nil {
+		return config{}, err
+	}
+	cfg.qemu = c.expand(spec.QEMU)
+	cfg.stdout = io.Discard
+	cfg.logger = log.New(cfg.redactor().writer(log.Writer()), "["+c.String()+"] ", log.Flags())
+	return cfg, nil
+}
+
+// checkMatrixPaths returns an error if two combinations write the same
+// -output, -log-file or -console-file, which would overwrite each other.
+func checkMatrixPaths(combinations []matrixCombination, cfgs []config) error {
+	seen := make(map[string]matrixCombination)
+	for i, cfg := range cfgs {
+		paths := []struct{ flag, path string }{
+			{"log-file", cfg.logFile},
+			{"console-file", cfg.consoleFile},
+		}
+		if !cfg.dryRun {
+			paths = append(paths, struct{ flag, path string }{"output", cfg.output})
+		}
+		for _, p := range paths {
+			if p.path == "" {
+				continue
+			}
+			key := p.path
+			if key != stdoutOutput {
+				if abs, err := filepath.Abs(key); err == nil {
+					key = abs
+				}
+			}
+			if c, ok := seen[key]; ok {
+				return fmt.Errorf("%s and %s both write %s (-%s); use {axis} in the path", c, combinations[i], p.path, p.flag)
+			}
+			seen[key] = combinations[i]
+		}
+	}
+	return nil
+}
+
+func newMatrixResult(cfg config, c matrixCombination, required bool, res *result, err error) matrixResult {
+	r := matrixResult{Combination: c.String(), Required: required}
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.OK = true
+	r.ReadySeconds = res.ReadyAfter.Seconds()
+	r.MigrateSeconds = res.MigrateTime.Seconds()
+	r.SizeBytes = res.StateSize
+	if !cfg.dryRun && cfg.output != stdoutOutput {
+		r.Output = cfg.output
+	}
+	return r
+}
+
+// matrixOptional reports whether c matches any of the optional entries.
+func matrixOptional(optional []map[string]string, c matrixCombination) bool {
+	for _, o := range optional {
+		match := true
+		for a, v := range o {
+			if c[a] != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func writeMatrixReport(w io.Writer, results []matrixResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "COMBINATION\tREADY\tMIGRATE\tSIZE\tRESULT\n")
+	for _, r := range results {
+		status := "ok"
+		if !r.OK {
+			status = "failed: " + r.Error
+			if !r.Required {
+				status = "failed (optional): " + r.Error
+			}
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t%s\n", r.Combination, status)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%.3fs\t%.3fs\t%d\t%s\n", r.Combination, r.ReadySeconds, r.MigrateSeconds, r.SizeBytes, status)
+	}
+	return tw.Flush()
+}
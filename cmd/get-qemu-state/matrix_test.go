@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	got, err := expandMatrix(map[string][]string{"kernel": {"6.1", "6.6"}, "arch": {"x86_64", "riscv64"}, "machine": {"virt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range got {
+		names = append(names, c.String())
+	}
+	want := []string{
+		"arch=x86_64,kernel=6.1,machine=virt",
+		"arch=x86_64,kernel=6.6,machine=virt",
+		"arch=riscv64,kernel=6.1,machine=virt",
+		"arch=riscv64,kernel=6.6,machine=virt",
+	}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %q; want %q", names, want)
+	}
+	if c := got[2]; c.expand("qemu-system-{arch} {kernel}.img {unknown}") != "qemu-system-riscv64 6.1.img {unknown}" {
+		t.Errorf("unexpected expansion %q", c.expand("qemu-system-{arch} {kernel}.img {unknown}"))
+	}
+
+	// A value containing a placeholder isn't expanded again.
+	nested := matrixCombination{"a": "{b}", "b": "{a}"}
+	if got := nested.expand("{a}-{b}"); got != "{b}-{a}" {
+		t.Errorf("nested placeholders expanded to %q", got)
+	}
+
+	if _, err := expandMatrix(map[string][]string{"arch": nil}); err == nil {
+		t.Errorf("an axis without values is accepted")
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// The "bad" QEMU exits right away.
+	if err := os.Symlink(self, filepath.Join(dir, "good")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/bin/false", filepath.Join(dir, "bad")); err != nil {
+		t.Fatal(err)
+	}
+	argsJSON := filepath.Join(dir, "args.json")
+	if err := os.WriteFile(argsJSON, []byte(`["`+stubQEMUCommand+`"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spec := `axes:
+  vm: [good, bad]
+  n: ["1", "2"]
+flags:
+  - -output
+  - "` + filepath.Join(dir, "{vm}-{n}.state") + `"
+optional:
+  - vm: bad
+    n: "2"
+`
+	specPath := filepath.Join(dir, "matrix.yaml")
+	if err := os.WriteFile(specPath, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reportPath := filepath.Join(dir, "report.json")
+	// The flags of the command line apply to every combination. The state
+	// is split, so its size is only known by the capture.
+	base := flag.NewFlagSet("get-qemu-state", flag.ContinueOnError)
+	registerFlags(base)
+	if err := base.Parse([]string{"-args-json", argsJSON, "-log-file", filepath.Join(dir, "{vm}-{n}.log"), "-no-progress", "-split-bytes", "1000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	err = runMatrix(specPath, base, filepath.Join(dir, "{vm}"), 2, reportPath, &out)
+	if err == nil || !strings.Contains(err.Error(), "1 of 4 required combinations failed") {
+		t.Fatalf("got %v; want the required bad combination to fail the run", err)
+	}
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report []matrixResult
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 4 {
+		t.Fatalf("report has %d combinations; want 4", len(report))
+	}
+	for _, r := range report {
+		good := strings.Contains(r.Combination, "vm=good")
+		if r.OK != good {
+			t.Errorf("%s: ok = %v (%s)", r.Combination, r.OK, r.Error)
+		}
+		if good && (r.SizeBytes != 4096 || r.ReadySeconds <= 0) {
+			t.Errorf("%s: unexpected size %d or ready time %v", r.Combination, r.SizeBytes, r.ReadySeconds)
+		}
+		if r.Required != (r.Combination != "n=2,vm=bad") {
+			t.Errorf("%s: required = %v", r.Combination, r.Required)
+		}
+		if !strings.Contains(out.String(), r.Combination) {
+			t.Errorf("%s isn't in the table:\n%s", r.Combination, out.String())
+		}
+	}
+	// The captures run in parallel log each to its own file.
+	for _, name := range []string{"good-1", "good-2"} {
+		data, err := os.ReadFile(filepath.Join(dir, name+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm, n, _ := strings.Cut(name, "-")
+		prefix := "[n=" + n + ",vm=" + vm + "] "
+		for _, l := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if !strings.HasPrefix(l, prefix) {
+				t.Errorf("%s.log has a line not of its combination: %q", name, l)
+			}
+		}
+	}
+	if !strings.Contains(out.String(), "failed (optional)") {
+		t.Errorf("the optional failure isn't marked:\n%s", out.String())
+	}
+}
+
+func TestMatrixDuplicatePaths(t *testing.T) {
+	dir := t.TempDir()
+	argsJSON := filepath.Join(dir, "args.json")
+	if err := os.WriteFile(argsJSON, []byte(`["-nographic"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		flags   []string
+		wantErr string
+	}{
+		{[]string{"-output", filepath.Join(dir, "vm.state")}, "(-output)"},
+		{[]string{"-output", filepath.Join(dir, "{n}.state"), "-log-file", filepath.Join(dir, "vm.log")}, "(-log-file)"},
+		{[]string{"-output", filepath.Join(dir, "{n}.state"), "-console-file", filepath.Join(dir, "vm.console")}, "(-console-file)"},
+	} {
+		flags, err := json.Marshal(append([]string{"-args-json", argsJSON}, tt.flags...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		specPath := filepath.Join(dir, "matrix.yaml")
+		spec := "axes:\n  n: [\"1\", \"2\"]\nflags: " + string(flags) + "\n"
+		if err := os.WriteFile(specPath, []byte(spec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		base := flag.NewFlagSet("get-qemu-state", flag.ContinueOnError)
+		registerFlags(base)
+		// /bin/false would fail the run if it was started.
+		err = runMatrix(specPath, base, "/bin/false", 1, "", io.Discard)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got %v; want the duplicate %s rejected", tt.flags, err, tt.wantErr)
+		}
+	}
+}
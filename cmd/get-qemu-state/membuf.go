@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// memoryFDName is the name the pipe of -memory-buffer is passed to QEMU as.
+const memoryFDName = "gqs-memory"
+
+// stateBuffer receives a migration through a pipe and keeps it in memory up
+// to max bytes. A larger state is spilled, the bytes received so far and the
+// rest of the stream, to the file at spill. If spilling fails, the rest of
+// the stream is still read so that the migration completes and the failure
+// is reported by wait rather than by QEMU as a broken pipe.
+type stateBuffer struct {
+	max   int64
+	spill string
+	r     *os.File
+
+	// done is closed once the stream ended; buf, spilled and err are set
+	// then.
+	done    chan struct{}
+	buf     []byte
+	spilled bool
+	err     error
+}
+
+// newStateBuffer returns a stateBuffer and the write end of its pipe to pass
+// to QEMU. The buffer is complete once every copy of the write end is closed.
+func newStateBuffer(max int64, spill string) (*stateBuffer, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	b := &stateBuffer{max: max, spill: spill, r: r, done: make(chan struct{})}
+	go func() {
+		defer close(b.done)
+		defer r.Close()
+		b.err = b.receive()
+	}()
+	return b, w, nil
+}
+
+func (b *stateBuffer) receive() error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(b.r, b.max+1)); err != nil {
+		return err
+	}
+	if int64(buf.Len()) <= b.max {
+		b.buf = buf.Bytes()
+		return nil
+	}
+	b.spilled = true
+	if err := b.spillFrom(&buf); err != nil {
+		io.Copy(io.Discard, b.r)
+		return fmt.Errorf("failed to spill the state: %w", err)
+	}
+	return nil
+}
+
+// spillFrom writes head and the rest of the stream to the spill file.
+func (b *stateBuffer) spillFrom(head io.Reader) error {
+	f, err := os.Create(b.spill)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.MultiReader(head, b.r)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// wait waits for the end of the stream and returns the state, or
+// spilled=true if it's in the spill file instead.
+func (b *stateBuffer) wait() (state []byte, spilled bool, err error) {
+	<-b.done
+	return b.buf, b.spilled, b.err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStateBuffer(t *testing.T) {
+	for _, tc := range []struct {
+		size    int
+		spilled bool
+	}{
+		{size: 100},
+		{size: 4096},
+		{size: 4097, spilled: true},
+		{size: 1 << 20, spilled: true},
+	} {
+		spill := filepath.Join(t.TempDir(), "vm.state.partial")
+		b, w, err := newStateBuffer(4096, spill)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := bytes.Repeat([]byte{0xab}, tc.size)
+		if _, err := w.Write(want); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		state, spilled, err := b.wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spilled != tc.spilled {
+			t.Errorf("%d bytes: spilled=%v; want %v", tc.size, spilled, tc.spilled)
+			continue
+		}
+		if spilled {
+			state, err = os.ReadFile(spill)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := os.Stat(spill); err == nil {
+			t.Errorf("%d bytes: spilled to the file too", tc.size)
+		}
+		if !bytes.Equal(state, want) {
+			t.Errorf("%d bytes: got %d bytes back", tc.size, len(state))
+		}
+	}
+}
+
+func TestStateBufferSpillFailure(t *testing.T) {
+	// The spill file can't be created.
+	spill := filepath.Join(t.TempDir(), "missing", "vm.state.partial")
+	for _, tc := range []struct {
+		size    int
+		wantErr bool
+	}{
+		{size: 4096}, // in memory; the spill file isn't needed
+		{size: 1 << 20, wantErr: true},
+	} {
+		b, w, err := newStateBuffer(4096, spill)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// QEMU writes the whole state, more than the pipe holds, without a
+		// broken pipe.
+		if _, err := w.Write(bytes.Repeat([]byte{0xab}, tc.size)); err != nil {
+			t.Fatalf("%d bytes: %v", tc.size, err)
+		}
+		w.Close()
+		state, _, err := b.wait()
+		if tc.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "failed to spill the state") {
+				t.Errorf("%d bytes: got %v; want the spill failure", tc.size, err)
+			}
+		} else if err != nil || len(state) != tc.size {
+			t.Errorf("%d bytes: got %d bytes, %v", tc.size, len(state), err)
+		}
+	}
+}
+
+func TestCaptureMemoryBuffer(t *testing.T) {
+	t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+	for _, tc := range []struct {
+		max     int64
+		inBytes bool
+	}{
+		{max: 1 << 20, inBytes: true},
+		{max: 1024}, // spilled to disk
+	} {
+		cfg := stubConfig(t)
+		cfg.args = append(cfg.args, "-qmp", "unix:"+filepath.Join(t.TempDir(), "qmp.sock")+",server=on,wait=off")
+		cfg.memoryBuffer = tc.max
+		res, err := capture(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(cfg.output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 4096 {
+			t.Errorf("-memory-buffer %d: output has %d bytes", tc.max, len(data))
+		}
+		if got := res.StateBytes != nil; got != tc.inBytes {
+			t.Errorf("-memory-buffer %d: StateBytes set: %v; want %v", tc.max, got, tc.inBytes)
+		} else if tc.inBytes && !bytes.Equal(res.StateBytes, data) {
+			t.Errorf("-memory-buffer %d: StateBytes differ from the output", tc.max)
+		}
+		if _, err := os.Stat(partialPath(cfg.output)); err == nil {
+			t.Errorf("-memory-buffer %d: partial file is left", tc.max)
+		}
+	}
+}
+
+func TestCaptureMemoryBufferNeedsQMP(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.memoryBuffer = 1 << 20
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "needs a QMP server unix socket") {
+		t.Fatalf("got %v; want -memory-buffer refused without QMP", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// guestMemory is a reading of the guest /proc/meminfo.
+type guestMemory struct {
+	TotalKiB     int64 `json:"totalKiB"`
+	AvailableKiB int64 `json:"availableKiB"`
+	CachedKiB    int64 `json:"cachedKiB"` // page cache
+	AnonKiB      int64 `json:"anonKiB"`   // process memory not backed by files
+}
+
+func (m guestMemory) usedKiB() int64 {
+	return m.TotalKiB - m.AvailableKiB
+}
+
+// parseMeminfo parses /proc/meminfo. MemAvailable is estimated like the
+// kernel did before it was added (Linux 3.14) if it's missing.
+func parseMeminfo(data []byte) (guestMemory, error) {
+	fields := make(map[string]int64)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		name, rest, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(rest), " kB"), 10, 64)
+		if err != nil {
+			continue
+		}
+		fields[name] = v
+	}
+	total, ok := fields["MemTotal"]
+	if !ok {
+		return guestMemory{}, fmt.Errorf("no MemTotal in /proc/meminfo")
+	}
+	m := guestMemory{TotalKiB: total, CachedKiB: fields["Cached"], AnonKiB: fields["AnonPages"]}
+	if v, ok := fields["MemAvailable"]; ok {
+		m.AvailableKiB = v
+	} else {
+		m.AvailableKiB = fields["MemFree"] + fields["Buffers"] + fields["Cached"]
+	}
+	return m, nil
+}
+
+// readGuestMemory reads the guest /proc/meminfo through the guest agent.
+func readGuestMemory(ctx context.Context, network, addr string) (guestMemory, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	g, err := dialGuestAgent(ctx, network, addr)
+	if err != nil {
+		return guestMemory{}, err
+	}
+	defer g.Close()
+	data, err := g.readFile(ctx, "/proc/meminfo")
+	if err != nil {
+		return guestMemory{}, err
+	}
+	return parseMeminfo(data)
+}
+
+// memoryGrowth is the guest memory usage at readiness (Before) and right
+// before the snapshot (After), with -memory-growth. The deltas are After
+// minus Before, negative if the usage shrank.
+type memoryGrowth struct {
+	Before    guestMemory `json:"before"`
+	After     guestMemory `json:"after"`
+	UsedKiB   int64       `json:"usedKiB"`
+	CachedKiB int64       `json:"cachedKiB"`
+	AnonKiB   int64       `json:"anonKiB"`
+}
+
+func memoryGrowthOf(before, after guestMemory) *memoryGrowth {
+	return &memoryGrowth{
+		Before:    before,
+		After:     after,
+		UsedKiB:   after.usedKiB() - before.usedKiB(),
+		CachedKiB: after.CachedKiB - before.CachedKiB,
+		AnonKiB:   after.AnonKiB - before.AnonKiB,
+	}
+}
+
+func (g *memoryGrowth) String() string {
+	return fmt.Sprintf("used %+d MiB (%d of %d MiB at the snapshot), page cache %+d MiB, anonymous %+d MiB",
+		g.UsedKiB/1024, g.After.usedKiB()/1024, g.After.TotalKiB/1024, g.CachedKiB/1024, g.AnonKiB/1024)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMemoryGrowth(t *testing.T) {
+	before, err := parseMeminfo([]byte(`MemTotal:        1014264 kB
+MemFree:          850000 kB
+MemAvailable:     900000 kB
+Buffers:            2000 kB
+Cached:            60000 kB
+AnonPages:         30000 kB
+HugePages_Total:       0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A kernel without MemAvailable.
+	after, err := parseMeminfo([]byte(`MemTotal:        1014264 kB
+MemFree:          500000 kB
+Buffers:            4000 kB
+Cached:           196000 kB
+AnonPages:        230000 kB
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.AvailableKiB != 700000 {
+		t.Errorf("estimated available %d KiB; want 700000", after.AvailableKiB)
+	}
+	got := memoryGrowthOf(before, after)
+	want := &memoryGrowth{Before: before, After: after, UsedKiB: 200000, CachedKiB: 136000, AnonKiB: 200000}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if s := memoryGrowthOf(after, before).String(); s != "used -195 MiB (111 of 990 MiB at the snapshot), page cache -132 MiB, anonymous -195 MiB" {
+		t.Errorf("got %q", s)
+	}
+
+	if _, err := parseMeminfo([]byte("MemFree: 1 kB\n")); err == nil {
+		t.Error("parsed meminfo without MemTotal")
+	}
+}
+
+func TestCaptureMemoryGrowthWithoutAgent(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.memoryGrowth = true
+	res, err := capture(cfg)
+	if err != nil {
+		t.Fatalf("capture failed instead of skipping the memory growth: %v", err)
+	}
+	if res.MemoryGrowth != nil {
+		t.Errorf("got memory growth %v without a guest agent", res.MemoryGrowth)
+	}
+}
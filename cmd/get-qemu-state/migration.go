@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// migrationPlan is how the state leaves QEMU and how its completion is told,
+// decided by planMigration alone:
+//
+//	output          monitor    migrate to                 completion
+//	file            QMP        file:<partial>             query-migrate "completed"
+//	file            HMP        file:<partial>             VM status "paused (postmigrate)"
+//	file -compress  QMP        exec:gzip to <partial>.gz  query-migrate "completed", then <partial> renamed
+//	file -compress  HMP        exec:gzip to <partial>.gz  VM status "paused (postmigrate)", then <partial> renamed
+//	-output -       QMP unix   fd:gqs-stdout              query-migrate "completed"
+//	-memory-buffer  QMP unix   fd:gqs-memory              query-migrate "completed"
+//
+// The fd: migrations pass the file descriptor over the QMP unix socket and
+// are refused without one. The state file appearing is never taken as the
+// completion of a file: migration: QEMU creates it when the migration
+// starts. QEMU tells an exec: migration completed once the state is written
+// to the pipe, while gzip may still be writing it, so the pipe renames
+// <partial>.gz to <partial> after gzip exits and the capture waits for the
+// rename too.
+type migrationPlan struct {
+	// fdName is the name of the file descriptor migrated to (passed by
+	// qmp.sendFD), "" to migrate to the partial state file.
+	fdName string
+	// compress pipes the state through gzip into the partial state file.
+	compress bool
+	// qmp tells the completion from query-migrate instead of the VM status
+	// over HMP.
+	qmp bool
+}
+
+// planMigration returns the migrationPlan of a capture with args, migrating
+// to stdout or to the -memory-buffer pipe if those are set, and compressing
+// the state with -compress.
+func planMigration(args []string, toStdout, memoryBuffer, compress bool) (migrationPlan, error) {
+	network, _, hasQMP := qmpAddr(args)
+	p := migrationPlan{qmp: hasQMP, compress: compress}
+	switch {
+	case compress && (toStdout || memoryBuffer):
+		return p, errors.New("-compress can't be used with -output - or -memory-buffer")
+	case toStdout:
+		if !hasQMP || network != "unix" {
+			return p, errors.New("-output - needs a QMP server unix socket in args to pass stdout to QEMU")
+		}
+		p.fdName = stdoutFDName
+	case memoryBuffer:
+		if !hasQMP || network != "unix" {
+			return p, errors.New("-memory-buffer needs a QMP server unix socket in args to pass the buffer pipe to QEMU")
+		}
+		p.fdName = memoryFDName
+	}
+	return p, nil
+}
+
+func (p migrationPlan) String() string {
+	uri := "file:<partial>"
+	switch {
+	case p.fdName != "":
+		uri = "fd:" + p.fdName
+	case p.compress:
+		uri = "exec:gzip to <partial>.gz"
+	}
+	completion := `VM status "paused (postmigrate)" over HMP`
+	if p.qmp {
+		completion = `query-migrate "completed"`
+	}
+	if p.compress {
+		completion += " and the rename to <partial>"
+	}
+	return fmt.Sprintf("%s, completion from %s", uri, completion)
+}
+
+// compressURI returns the exec: URI migrating the state through gzip to
+// path. gzip writes <path>.gz, which is renamed to path once gzip exited.
+func compressURI(path string) string {
+	tmp := compressingPath(path)
+	return "exec:gzip -c > " + shellQuote(tmp) + " && mv -f " + shellQuote(tmp) + " " + shellQuote(path)
+}
+
+// compressingPath returns the file gzip writes the state to path in.
+func compressingPath(path string) string {
+	return path + ".gz"
+}
+
+// waitCompressed waits for the pipe of compressURI to rename the compressed
+// state to path.
+func waitCompressed(ctx context.Context, path string) error {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to stat state file: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gzip didn't finish writing the state: %w", ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// minScaledMigrateTimeout is the least timeout -migrate-timeout-per-gb
+// gives: a small guest still has the setup and the device states to
+// migrate.
+const minScaledMigrateTimeout = 30 * time.Second
+
+// scaledMigrateTimeout returns the migration attempt timeout of a guest with
+// memMiB of RAM at perGB per GiB.
+func scaledMigrateTimeout(memMiB int64, perGB time.Duration) time.Duration {
+	return max(minScaledMigrateTimeout, time.Duration(float64(perGB)*float64(memMiB)/1024))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanMigration(t *testing.T) {
+	unixQMP := []string{"-qmp", "unix:/tmp/qmp.sock,server=on,wait=off"}
+	tcpQMP := []string{"-qmp", "tcp:127.0.0.1:4444,server=on,wait=off"}
+	for _, tc := range []struct {
+		args         []string
+		toStdout     bool
+		memoryBuffer bool
+		compress     bool
+		want         migrationPlan
+		wantErr      string
+	}{
+		{args: nil, want: migrationPlan{}},
+		{args: unixQMP, want: migrationPlan{qmp: true}},
+		{args: tcpQMP, want: migrationPlan{qmp: true}},
+		{args: unixQMP, toStdout: true, want: migrationPlan{fdName: stdoutFDName, qmp: true}},
+		{args: unixQMP, memoryBuffer: true, want: migrationPlan{fdName: memoryFDName, qmp: true}},
+		{args: nil, compress: true, want: migrationPlan{compress: true}},
+		{args: tcpQMP, compress: true, want: migrationPlan{compress: true, qmp: true}},
+		{args: nil, toStdout: true, wantErr: "-output - needs"},
+		{args: tcpQMP, toStdout: true, wantErr: "-output - needs"},
+		{args: tcpQMP, memoryBuffer: true, wantErr: "-memory-buffer needs"},
+		{args: unixQMP, toStdout: true, compress: true, wantErr: "-compress can't"},
+		{args: unixQMP, memoryBuffer: true, compress: true, wantErr: "-compress can't"},
+	} {
+		got, err := planMigration(tc.args, tc.toStdout, tc.memoryBuffer, tc.compress)
+		if tc.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("%q stdout=%v buffer=%v compress=%v: got %v; want %q", tc.args, tc.toStdout, tc.memoryBuffer, tc.compress, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%q stdout=%v buffer=%v compress=%v: got %+v, %v; want %+v", tc.args, tc.toStdout, tc.memoryBuffer, tc.compress, got, err, tc.want)
+		}
+	}
+}
+
+func TestCaptureMigrationCompletion(t *testing.T) {
+	// The state file appears with half of the state long before the
+	// migration completes.
+	t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+	t.Setenv("STUB_QEMU_MIGRATE_DELAY", "1s")
+	for _, monitor := range []string{"HMP", "QMP"} {
+		t.Run(monitor, func(t *testing.T) {
+			cfg := stubConfig(t)
+			if monitor == "QMP" {
+				cfg.args = append(cfg.args, "-qmp", "unix:"+filepath.Join(t.TempDir(), "qmp.sock")+",server=on,wait=off")
+			}
+			if _, err := capture(cfg); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(cfg.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != 4096 {
+				t.Errorf("state is %d bytes; want the completed 4096", fi.Size())
+			}
+		})
+	}
+}
+
+func TestCaptureCompressedMigrationCompletion(t *testing.T) {
+	gzipPath, err := exec.LookPath("gzip")
+	if err != nil {
+		t.Skip("gzip isn't available")
+	}
+	// QEMU reports the migration completed once the state is in the pipe,
+	// while this gzip is still sleeping before reading it.
+	bin := t.TempDir()
+	script := "#!/bin/sh\nsleep 1\nexec " + shellQuote(gzipPath) + " \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "gzip"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+	for _, monitor := range []string{"HMP", "QMP"} {
+		t.Run(monitor, func(t *testing.T) {
+			cfg := stubConfig(t)
+			cfg.compress = true
+			if monitor == "QMP" {
+				cfg.args = append(cfg.args, "-qmp", "unix:"+filepath.Join(t.TempDir(), "qmp.sock")+",server=on,wait=off")
+			}
+			if _, err := capture(cfg); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(cfg.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state) != 4096 {
+				t.Errorf("state is %d bytes; want the completed 4096", len(state))
+			}
+			entries, err := os.ReadDir(filepath.Dir(cfg.output))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.Contains(e.Name(), ".partial.") {
+					t.Errorf("%s is left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestScaledMigrateTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want time.Duration
+	}{
+		{nil, minScaledMigrateTimeout}, // the default 128 MiB
+		{[]string{"-m", "512"}, minScaledMigrateTimeout},
+		{[]string{"-m", "2G"}, 40 * time.Second},
+		{[]string{"-m", "3072"}, 60 * time.Second},
+		{[]string{"-m", "size=16G,maxmem=64G"}, 320 * time.Second},
+		{[]string{"-m", "1T"}, 1024 * 20 * time.Second},
+	} {
+		mem, err := guestMemoryMiB(tc.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := scaledMigrateTimeout(mem, 20*time.Second); got != tc.want {
+			t.Errorf("%q: got %v; want %v", tc.args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// defaultMissingFilePatterns match QEMU and firmware messages about files
+// that can't be found. The first submatch is the path.
+var defaultMissingFilePatterns = []string{
+	`[Cc]ould not open '([^']+)'`,
+	`could not load (?:PC )?BIOS '([^']+)'`,
+	`could not load kernel '([^']+)'`,
+	`could not load initrd '([^']+)'`,
+	`failed to find romfile "([^"]+)"`,
+	`[Cc]ould not open option rom '([^']+)'`,
+}
+
+func compilePatterns(exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, e := range exprs {
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", e, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// missingFile returns the path reported missing in line, if any.
+func missingFile(patterns []*regexp.Regexp, line string) (string, bool) {
+	for _, re := range patterns {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if len(m) > 1 {
+			return m[1], true
+		}
+		return m[0], true
+	}
+	return "", false
+}
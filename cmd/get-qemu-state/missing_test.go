@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestMissingFile(t *testing.T) {
+	patterns, err := compilePatterns(defaultMissingFilePatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		line string
+		want string
+	}{
+		{"qemu-system-x86_64: -drive if=virtio,format=raw,file=/pack/rootfs.bin: Could not open '/pack/rootfs.bin': No such file or directory", "/pack/rootfs.bin"},
+		{"qemu-system-x86_64: could not load PC BIOS 'bios-256k.bin'", "bios-256k.bin"},
+		{"qemu: could not load kernel '/pack/bzImage': No such file or directory", "/pack/bzImage"},
+		{`qemu-system-x86_64: -device virtio-net-pci,netdev=vmnic: failed to find romfile "efi-virtio.rom"`, "efi-virtio.rom"},
+	} {
+		got, ok := missingFile(patterns, tt.line)
+		if !ok || got != tt.want {
+			t.Errorf("missingFile(%q) = %q, %v; want %q", tt.line, got, ok, tt.want)
+		}
+	}
+	if p, ok := missingFile(patterns, "[    0.000000] Linux version 6.1.0"); ok {
+		t.Errorf("unexpected match %q", p)
+	}
+
+	custom, err := compilePatterns([]string{`cannot stat (\S+)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := missingFile(custom, "cannot stat /pack/info"); !ok || got != "/pack/info" {
+		t.Errorf("custom pattern: got %q, %v", got, ok)
+	}
+}
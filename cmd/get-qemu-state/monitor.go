@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// monitor controls QEMU for taking the snapshot. It's implemented by hmp and
+// qmp.
+type monitor interface {
+	// migrate saves the VM state to path and leaves the VM stopped.
+	migrate(ctx context.Context, path string) error
+	// checkpoint saves the VM state to path and lets the guest continue.
+	checkpoint(ctx context.Context, path string) error
+	// waitRunning waits for the VM to run, e.g. after restoring a state.
+	waitRunning(ctx context.Context) error
+	// precheckMigration starts a migration to nowhere and cancels it, to
+	// find out early if the VM can't be migrated (e.g. a device blocks it).
+	// The guest keeps running afterwards.
+	precheckMigration(ctx context.Context) error
+	// stop pauses the VM.
+	stop(ctx context.Context) error
+	// dumpGuestMemory writes an ELF core dump of the guest memory to path
+	// (dump-guest-memory). The VM runs again afterwards if it was running.
+	dumpGuestMemory(ctx context.Context, path string) error
+	// pmemsave saves size bytes of the guest physical memory at addr to path.
+	pmemsave(ctx context.Context, addr, size int64, path string) error
+	quit() error
+}
+
+// qmpAddr returns the address of a QMP server socket defined in args, either
+// by -qmp or by -mon mode=control on a socket -chardev. ok is false if there's
+// no QMP socket QEMU listens on.
+func qmpAddr(args []string) (network, addr string, ok bool) {
+	chardevs := make(map[string]string) // id -> options
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-chardev" {
+			if kind, opts, _ := strings.Cut(args[i+1], ","); kind == "socket" {
+				if id, ok := option(opts, "id"); ok {
+					chardevs[id] = opts
+				}
+			}
+		}
+	}
+	for i := 0; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-qmp":
+			target, opts, _ := strings.Cut(args[i+1], ",")
+			if !isServer(opts) {
+				continue
+			}
+			if p, ok := strings.CutPrefix(target, "unix:"); ok {
+				return "unix", p, true
+			} else if a, ok := strings.CutPrefix(target, "tcp:"); ok {
+				return "tcp", a, true
+			}
+		case "-mon":
+			opts := args[i+1]
+			if mode, _ := option(opts, "mode"); mode != "control" {
+				continue
+			}
+			id, _ := option(opts, "chardev")
+			cd, ok := chardevs[id]
+			if !ok || !isServer(cd) {
+				continue
+			}
+			if p, ok := option(cd, "path"); ok {
+				return "unix", p, true
+			}
+			host, _ := option(cd, "host")
+			if port, ok := option(cd, "port"); ok {
+				return "tcp", host + ":" + port, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// option returns the value of key in comma-separated QEMU options.
+func option(opts, key string) (string, bool) {
+	for _, o := range strings.Split(opts, ",") {
+		if k, v, _ := strings.Cut(o, "="); k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func isServer(opts string) bool {
+	v, ok := option(opts, "server")
+	return ok && (v == "" || v == "on")
+}
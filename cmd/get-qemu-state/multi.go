@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"text/tabwriter"
+)
+
+// barrier is passed once all of its n parties arrived.
+type barrier struct {
+	n int
+
+	mu      sync.Mutex
+	arrived int
+	done    chan struct{}
+}
+
+func newBarrier(n int) *barrier {
+	return &barrier{n: n, done: make(chan struct{})}
+}
+
+func (b *barrier) arrive() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.arrived++
+	if b.arrived == b.n {
+		close(b.done)
+	}
+	return b.done
+}
+
+// captureGroup coordinates the captures of several VMs snapshotted together.
+// Each capture waits at ready once its guest is ready (and provisioned by the
+// pre-script), stops its VM, and waits at stopped before migrating, so that
+// all the states are taken at the same point. A failing capture aborts the
+// others.
+type captureGroup struct {
+	ready, stopped *barrier
+
+	abortOnce sync.Once
+	aborted   chan struct{}
+	err       error
+}
+
+func newCaptureGroup(n int) *captureGroup {
+	return &captureGroup{
+		ready:   newBarrier(n),
+		stopped: newBarrier(n),
+		aborted: make(chan struct{}),
+	}
+}
+
+// wait arrives at b and blocks until the other captures arrive too.
+func (g *captureGroup) wait(ctx context.Context, b *barrier) error {
+	select {
+	case <-b.arrive():
+		return nil
+	case <-g.aborted:
+		return fmt.Errorf("coordinated capture aborted: %w", g.err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *captureGroup) abort(err error) {
+	g.abortOnce.Do(func() {
+		g.err = err
+		close(g.aborted)
+	})
+}
+
+// multiVM is an entry of the "multi" spec.
+type multiVM struct {
+	Name  string   `json:"name"`
+	QEMU  string   `json:"qemu"`
+	Flags []string `json:"flags"` // capture flags, e.g. -args-json, -output and -marker
+}
+
+// runMulti implements "get-qemu-state multi -spec <file>". It captures the VMs
+// listed in the spec concurrently and snapshots them together once all of
+// them are ready, then writes the result of each to w. The guest consoles
+// aren't printed; use -console-file. The log lines of each VM are prefixed
+// with [name].
+func runMulti(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("multi", flag.ExitOnError)
+	specPath := fs.String("spec", "", `path to a JSON array of the VMs ({"name": ..., "qemu": ..., "flags": [...]})`)
+	fs.Parse(args)
+	if *specPath == "" {
+		return errors.New("specify -spec")
+	}
+	data, err := os.ReadFile(*specPath)
+	if err != nil {
+		return err
+	}
+	var vms []multiVM
+	if err := json.Unmarshal(data, &vms); err != nil {
+		return fmt.Errorf("failed to parse spec: %w", err)
+	}
+	if len(vms) == 0 {
+		return errors.New("spec has no VMs")
+	}
+
+	group := newCaptureGroup(len(vms))
+	cfgs := make([]config, len(vms))
+	for i, vm := range vms {
+		vfs := flag.NewFlagSet(vm.Name, flag.ContinueOnError)
+		configure := registerFlags(vfs)
+		if err := vfs.Parse(vm.Flags); err != nil {
+			return fmt.Errorf("VM %s: %w", vm.Name, err)
+		}
+		cfg, err := configure()
+		if err != nil {
+			return fmt.Errorf("VM %s: %w", vm.Name, err)
+		}
+		if cfg.globalConcurrency > 0 {
+			// A VM waiting for a slot would keep the others waiting too.
+			return fmt.Errorf("VM %s: -global-concurrency can't be used by the VMs of a group, which run together", vm.Name)
+		}
+		cfg.qemu = vm.QEMU
+		cfg.stdout = io.Discard
+		cfg.logger = log.New(cfg.redactor().writer(log.Writer()), "["+vm.Name+"] ", log.Flags())
+		cfg.group = group
+		cfgs[i] = cfg
+	}
+
+	results, errs := runCaptures(cfgs, len(cfgs), func(i int, err error) {
+		group.abort(fmt.Errorf("VM %s: %w", vms[i].Name, err))
+	})
+	if err := writeMultiResults(w, vms, cfgs, results, errs); err != nil {
+		return err
+	}
+	return group.err
+}
+
+// runCaptures runs the captures of cfgs, jobs at a time, and returns the
+// result and the error of each. failed is called as soon as a capture fails.
+// The errors are redacted as they're printed (and abort the others in a
+// group, whose logs don't redact the secrets of this capture).
+func runCaptures(cfgs []config, jobs int, failed func(i int, err error)) ([]*result, []error) {
+	results := make([]*result, len(cfgs))
+	errs := make([]error, len(cfgs))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, cfg := range cfgs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = capture(cfg)
+			if errs[i] = cfg.redactor().error(errs[i]); errs[i] != nil && failed != nil {
+				failed(i, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// writeMultiResults writes a table of the result of each VM.
+func writeMultiResults(w io.Writer, vms []multiVM, cfgs []config, results []*result, errs []error) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "VM\tREADY\tMIGRATE\tRESULT\n")
+	for i, vm := range vms {
+		if errs[i] != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\tfailed: %v\n", vm.Name, errs[i])
+			continue
+		}
+		r := results[i]
+		out := cfgs[i].output
+		if cfgs[i].dryRun {
+			out = "dry run"
+		}
+		fmt.Fprintf(tw, "%s\t%.3fs\t%.3fs\t%s\n", vm.Name, r.ReadyAfter.Seconds(), r.MigrateTime.Seconds(), out)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeMultiSpec writes the spec of vms to a temporary file. Each VM runs
+// qemu with args given by a generated args JSON and extra flags.
+func writeMultiSpec(t *testing.T, vms map[string][]string, qemu map[string]string, flags map[string][]string) (string, map[string]string) {
+	dir := t.TempDir()
+	outputs := make(map[string]string)
+	var spec []multiVM
+	for name, args := range vms {
+		argsJSON := filepath.Join(dir, name+"-args.json")
+		data, err := json.Marshal(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(argsJSON, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		outputs[name] = filepath.Join(dir, name+".state")
+		spec = append(spec, multiVM{
+			Name:  name,
+			QEMU:  qemu[name],
+			Flags: append([]string{"-args-json", argsJSON, "-output", outputs[name], "-no-progress"}, flags[name]...),
+		})
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "spec.json")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p, outputs
+}
+
+func TestMulti(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, outputs := writeMultiSpec(t,
+		map[string][]string{"service": {stubQEMUCommand}, "db": {stubQEMUCommand}},
+		map[string]string{"service": self, "db": self},
+		nil)
+	var out strings.Builder
+	if err := runMulti([]string{"-spec", spec}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for name, p := range outputs {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("VM %s: %v", name, err)
+		}
+		if !strings.Contains(out.String(), p) {
+			t.Errorf("VM %s isn't reported:\n%s", name, out.String())
+		}
+	}
+}
+
+func TestMultiNeverReady(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, outputs := writeMultiSpec(t,
+		map[string][]string{"service": {stubQEMUCommand}, "db": {"-c", "sleep 10"}},
+		map[string]string{"service": self, "db": "/bin/sh"},
+		map[string][]string{"db": {"-boot-timeout", "500ms"}})
+	var out strings.Builder
+	err = runMulti([]string{"-spec", spec}, &out)
+	if err == nil || !strings.Contains(err.Error(), "VM db: guest didn't become ready") {
+		t.Fatalf("got %v; want the failure of VM db", err)
+	}
+	for _, want := range []string{"failed: guest didn't become ready", "failed: coordinated capture aborted"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("%q isn't reported:\n%s", want, out.String())
+		}
+	}
+	for name, p := range outputs {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("VM %s is captured alone: %v", name, err)
+		}
+	}
+}
+
+func TestMultiLogFiles(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	logs := map[string]string{"service": filepath.Join(dir, "service.log"), "db": filepath.Join(dir, "db.log")}
+	spec, _ := writeMultiSpec(t,
+		map[string][]string{"service": {stubQEMUCommand}, "db": {stubQEMUCommand}},
+		map[string]string{"service": self, "db": self},
+		map[string][]string{"service": {"-log-file", logs["service"]}, "db": {"-log-file", logs["db"]}})
+	if err := runMulti([]string{"-spec", spec}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	// Each log file has the lines of its VM only.
+	for name, p := range logs {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		for _, l := range lines {
+			if !strings.HasPrefix(l, "["+name+"] ") {
+				t.Errorf("%s has a line not of VM %s: %q", p, name, l)
+			}
+		}
+		if len(lines) < 3 {
+			t.Errorf("%s has only %d lines", p, len(lines))
+		}
+	}
+}
+
+func TestMultiRedact(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	// The secret is in the error of starting db's QEMU.
+	missing := filepath.Join(t.TempDir(), "hunter2", "qemu")
+	spec, _ := writeMultiSpec(t,
+		map[string][]string{"service": {stubQEMUCommand}, "db": {stubQEMUCommand}},
+		map[string]string{"service": self, "db": missing},
+		map[string][]string{"db": {"-redact-arg", "hunter2"}})
+	var out strings.Builder
+	err = runMulti([]string{"-spec", spec}, &out)
+	if err == nil || !strings.Contains(err.Error(), redacted) {
+		t.Fatalf("got %v; want the failure of VM db redacted", err)
+	}
+	for what, s := range map[string]string{"error": err.Error(), "results": out.String(), "log": logs.String()} {
+		if strings.Contains(s, "hunter2") {
+			t.Errorf("the %s has the secret:\n%s", what, s)
+		}
+	}
+}
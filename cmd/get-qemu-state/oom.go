@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+)
+
+var (
+	// oomKillPattern matches the kernel report of the process killed by the
+	// OOM killer ("Kill process" before Linux 4.19, "Killed process" since).
+	// It follows the "invoked oom-killer" line of the allocating process.
+	oomKillPattern = regexp.MustCompile(`[Oo]ut of memory: Kill(?:ed)? process \d+ \(([^)]*)\)`)
+	// oomPattern matches other out-of-memory reports, e.g. the panic when
+	// nothing can be killed.
+	oomPattern = regexp.MustCompile(`[Oo]ut of memory`)
+)
+
+// oomKill returns the name of the process reported killed by the OOM killer
+// in line, empty if line reports an OOM without naming one.
+func oomKill(line string) (process string, ok bool) {
+	if m := oomKillPattern.FindStringSubmatch(line); m != nil {
+		return m[1], true
+	}
+	return "", oomPattern.MatchString(line)
+}
+
+// oomRecorder records the OOM kills reported on the console.
+type oomRecorder struct {
+	mu    sync.Mutex
+	kills []string // process names, "unknown" if not reported
+}
+
+func (r *oomRecorder) add(process string) {
+	if process == "" {
+		process = "unknown"
+	}
+	r.mu.Lock()
+	r.kills = append(r.kills, process)
+	r.mu.Unlock()
+}
+
+func (r *oomRecorder) result() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.kills...)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestOOMKill(t *testing.T) {
+	for _, tt := range []struct {
+		line    string
+		process string
+		ok      bool
+	}{
+		{"[   12.345678] Out of memory: Killed process 123 (npm install) total-vm:1234kB, anon-rss:1000kB", "npm install", true},
+		{"[    8.000000] Out of memory: Kill process 42 (java) score 900 or sacrifice child", "java", true},
+		{"[    9.000000] Memory cgroup out of memory: Killed process 7 (node) total-vm:1kB", "node", true},
+		{"[   10.000000] Kernel panic - not syncing: System is deadlocked on memory; Out of memory and no killable processes...", "", true},
+		{"[   11.000000] Run /init as init process", "", false},
+	} {
+		process, ok := oomKill(tt.line)
+		if process != tt.process || ok != tt.ok {
+			t.Errorf("oomKill(%q) = %q, %v; want %q, %v", tt.line, process, ok, tt.process, tt.ok)
+		}
+	}
+}
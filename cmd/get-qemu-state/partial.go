@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// partialPath returns a name for the in-progress state of output, unique
+// among the captures sharing the directory. It embeds the PID so that
+// cleanStalePartials can tell whether the capture writing it is gone. The
+// file isn't created, as the HMP migration is detected by its appearance.
+func partialPath(output string) string {
+	return fmt.Sprintf("%s.partial.%d-%08x", output, os.Getpid(), rand.Uint32())
+}
+
+// cleanStalePartials removes the in-progress states of output left behind
+// by captures that aren't running anymore.
+func cleanStalePartials(output string, logger *log.Logger) error {
+	// The directory is listed rather than globbed, as output may have glob
+	// metacharacters that can't be escaped on Windows.
+	dir, prefix := filepath.Dir(output), filepath.Base(output)+".partial."
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		rest, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok {
+			continue
+		}
+		pid, _, _ := strings.Cut(rest, "-")
+		n, err := strconv.Atoi(pid)
+		if err != nil || n <= 0 {
+			continue // not ours
+		}
+		if processExists(n) {
+			continue // alive (or not ours to signal)
+		}
+		p := filepath.Join(dir, e.Name())
+		logger.Printf("removing stale %s", p)
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
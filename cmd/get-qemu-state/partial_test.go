@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartialPath(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "vm.state")
+	if a, b := partialPath(output), partialPath(output); a == b {
+		t.Fatalf("partial paths collide: %s", a)
+	}
+}
+
+func TestCleanStalePartials(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "vm[1].state")
+	live := partialPath(output)
+	stale := fmt.Sprintf("%s.partial.%d-0000beef", output, 1<<30) // above any pid_max
+	other := filepath.Join(dir, "vm[1].state.partial.notes")
+	for _, p := range []string{live, stale, other} {
+		if err := os.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cleanStalePartials(output, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale partial isn't removed: %v", err)
+	}
+	for _, p := range []string{live, other} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%s must be kept: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pidfileArg returns the path given to QEMU's -pidfile in args, if any.
+func pidfileArg(args []string) string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-pidfile" {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// readPIDFile waits for QEMU to write its PID to path.
+func readPIDFile(ctx context.Context, path string) (int, error) {
+	for {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 {
+				return pid, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// step is a line of a pre-script. Pre-scripts run after the guest becomes
+// ready and before the snapshot is taken. Each line is one of:
+//
+//	send TEXT        type TEXT followed by a newline to the guest console
+//	expect TEXT      wait until TEXT appears on the guest console
+//	sleep DURATION   wait for DURATION (e.g. "500ms")
+//
+// Empty lines and lines starting with "#" are ignored.
+type step struct {
+	line   int
+	send   string
+	expect string
+	sleep  time.Duration
+}
+
+func (s step) String() string {
+	switch {
+	case s.send != "":
+		return "send " + s.send
+	case s.expect != "":
+		return "expect " + s.expect
+	default:
+		return "sleep " + s.sleep.String()
+	}
+}
+
+func parsePreScript(data []byte) ([]step, error) {
+	var steps []step
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		directive, arg, _ := strings.Cut(l, " ")
+		s := step{line: n}
+		switch directive {
+		case "send":
+			s.send = arg
+		case "expect":
+			if arg == "" {
+				return nil, fmt.Errorf("line %d: expect needs a string", n)
+			}
+			s.expect = arg
+		case "sleep":
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			s.sleep = d
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive %q", n, directive)
+		}
+		steps = append(steps, s)
+	}
+	return steps, scanner.Err()
+}
+
+// stepTiming is the time a pre-script step took. An expect is timed from when
+// it's reached, though it's armed (and its text may appear) earlier.
+type stepTiming struct {
+	Line    int     `json:"line"`
+	Step    string  `json:"step"`
+	Seconds float64 `json:"seconds"`
+	Failed  bool    `json:"failed,omitempty"`
+}
+
+// runPreScript runs steps starting from steps[from] and returns the time
+// each step run took, including the one that failed. done is called after
+// each step completes.
+func runPreScript(ctx context.Context, steps []step, from int, con *console, in io.Writer, expectTimeout time.Duration, logger *log.Logger, done func(i int) error) ([]stepTiming, error) {
+	var timings []stepTiming
+	var next *waiter
+	defer func() {
+		if next != nil {
+			con.unwatch(next)
+		}
+	}()
+	for i := from; i < len(steps); i++ {
+		s := steps[i]
+		logger.Printf("pre-script line %d: %v", s.line, s)
+		start := time.Now()
+		timings = append(timings, stepTiming{Line: s.line, Step: s.String()})
+		t := &timings[len(timings)-1]
+		if err := runStep(ctx, steps, i, con, in, expectTimeout, &next); err != nil {
+			t.Seconds, t.Failed = time.Since(start).Seconds(), true
+			return timings, err
+		}
+		t.Seconds = time.Since(start).Seconds()
+		if done != nil {
+			if err := done(i); err != nil {
+				return timings, err
+			}
+		}
+	}
+	return timings, nil
+}
+
+// runStep runs steps[i]. *next is the waiter armed for the expect of
+// steps[i] by the previous step, and is set to the one armed for the
+// following step.
+func runStep(ctx context.Context, steps []step, i int, con *console, in io.Writer, expectTimeout time.Duration, next **waiter) error {
+	s := steps[i]
+	w := *next
+	*next = nil
+	if s.expect != "" && w == nil {
+		w = con.watch(s.expect)
+	}
+	// Arm the following expect before acting so the output caused by this
+	// step isn't missed.
+	if s.expect == "" && i+1 < len(steps) && steps[i+1].expect != "" {
+		*next = con.watch(steps[i+1].expect)
+	}
+	switch {
+	case s.expect != "":
+		expectCtx, cancel := ctx, context.CancelFunc(func() {})
+		if expectTimeout > 0 {
+			expectCtx, cancel = context.WithTimeout(ctx, expectTimeout)
+		}
+		err := con.wait(expectCtx, w)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("pre-script line %d: %q didn't appear: %w", s.line, s.expect, err)
+		}
+	case s.sleep > 0:
+		select {
+		case <-time.After(s.sleep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	default:
+		if _, err := io.WriteString(in, s.send+"\n"); err != nil {
+			return fmt.Errorf("pre-script line %d: %w", s.line, err)
+		}
+	}
+	return nil
+}
+
+// journal records the pre-script progress covered by a checkpoint.
+type journal struct {
+	PreScriptDigest string     `json:"preScriptDigest"`
+	CompletedSteps  int        `json:"completedSteps"`
+	HostMemory      hostMemory `json:"hostMemory"`
+	// Devices are checked on resume like HostMemory.
+	Devices []deviceInfo `json:"devices,omitempty"`
+	// ICount must match on resume.
+	ICount *icountInfo `json:"icount,omitempty"`
+}
+
+func journalPath(checkpoint string) string {
+	return checkpoint + ".journal"
+}
+
+func scriptDigest(data []byte) string {
+	d := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(d[:])
+}
+
+func writeJournal(path string, j journal) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readJournal(path string) (journal, error) {
+	var j journal
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return j, err
+	}
+	err = json.Unmarshal(data, &j)
+	return j, err
+}
+
+// resumePoint returns the first pre-script step that the checkpoint doesn't
+// cover yet.
+func resumePoint(j journal, script []byte, steps []step) (int, error) {
+	if j.PreScriptDigest != scriptDigest(script) {
+		return 0, fmt.Errorf("pre-script was modified after the checkpoint was taken")
+	}
+	if j.CompletedSteps < 0 || j.CompletedSteps > len(steps) {
+		return 0, fmt.Errorf("journal records %d completed steps but the pre-script has %d", j.CompletedSteps, len(steps))
+	}
+	return j.CompletedSteps, nil
+}
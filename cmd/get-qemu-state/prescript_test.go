@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testPreScript = `# provision
+send apk add curl
+expect ran: apk add curl
+sleep 10ms
+send touch /ready
+expect ran: touch /ready
+`
+
+// fakeGuest echoes "ran: <line>" to con for every line typed to the returned
+// writer.
+func fakeGuest(t *testing.T, con *console) io.Writer {
+	r, w := io.Pipe()
+	t.Cleanup(func() { w.Close() })
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			fmt.Fprintf(con, "ran: %s\r\n", s.Text())
+		}
+	}()
+	return w
+}
+
+func TestParsePreScript(t *testing.T) {
+	steps, err := parsePreScript([]byte(testPreScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []step{
+		{line: 2, send: "apk add curl"},
+		{line: 3, expect: "ran: apk add curl"},
+		{line: 4, sleep: 10 * time.Millisecond},
+		{line: 5, send: "touch /ready"},
+		{line: 6, expect: "ran: touch /ready"},
+	}
+	if !reflect.DeepEqual(steps, want) {
+		t.Fatalf("got %+v; want %+v", steps, want)
+	}
+	if _, err := parsePreScript([]byte("type foo\n")); err == nil {
+		t.Fatalf("unknown directive must be rejected")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	p := journalPath(filepath.Join(t.TempDir(), "checkpoint.state"))
+	want := journal{PreScriptDigest: scriptDigest([]byte(testPreScript)), CompletedSteps: 3, Devices: []deviceInfo{{Driver: "virtio-net-pci", ID: "net0"}}}
+	if err := writeJournal(p, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readJournal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	steps, err := parsePreScript([]byte(testPreScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := journalPath(filepath.Join(t.TempDir(), "checkpoint.state"))
+
+	// First run "crashes" after the first expect.
+	con := newConsole(io.Discard)
+	in := fakeGuest(t, con)
+	digest := scriptDigest([]byte(testPreScript))
+	crash := fmt.Errorf("crash")
+	_, err = runPreScript(context.Background(), steps, 0, con, in, time.Second, log.Default(), func(i int) error {
+		if err := writeJournal(p, journal{PreScriptDigest: digest, CompletedSteps: i + 1}); err != nil {
+			return err
+		}
+		if i == 1 {
+			return crash
+		}
+		return nil
+	})
+	if err != crash {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Resumed run continues from the third step.
+	j, err := readJournal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := resumePoint(j, []byte(testPreScript), steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 2 {
+		t.Fatalf("resuming from step %d; want 2", from)
+	}
+	con = newConsole(io.Discard)
+	in = fakeGuest(t, con)
+	var ran []int
+	if _, err := runPreScript(context.Background(), steps, from, con, in, time.Second, log.Default(), func(i int) error {
+		ran = append(ran, i)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{2, 3, 4}; !reflect.DeepEqual(ran, want) {
+		t.Fatalf("ran steps %v; want %v", ran, want)
+	}
+
+	if _, err := resumePoint(j, []byte(testPreScript+"send echo\n"), steps); err == nil {
+		t.Fatalf("resuming with a modified pre-script must fail")
+	}
+}
+
+func TestPreScriptExpectTimeout(t *testing.T) {
+	steps, err := parsePreScript([]byte("expect never\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := newConsole(io.Discard)
+	if _, err := runPreScript(context.Background(), steps, 0, con, io.Discard, 50*time.Millisecond, log.Default(), nil); err == nil {
+		t.Fatalf("expect must time out")
+	}
+}
+
+func TestPreScriptTimings(t *testing.T) {
+	steps, err := parsePreScript([]byte("send boot\nexpect ran: boot\nsleep 100ms\nexpect never\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := newConsole(io.Discard)
+	timings, err := runPreScript(context.Background(), steps, 0, con, fakeGuest(t, con), 50*time.Millisecond, log.Default(), nil)
+	if err == nil {
+		t.Fatalf("expect must time out")
+	}
+	if len(timings) != 4 {
+		t.Fatalf("got timings %+v; want the 4 steps", timings)
+	}
+	for i, tm := range timings {
+		if tm.Line != steps[i].line || tm.Step != steps[i].String() {
+			t.Errorf("timing %d is of line %d %q; want line %d %q", i, tm.Line, tm.Step, steps[i].line, steps[i])
+		}
+		if tm.Failed != (i == 3) {
+			t.Errorf("line %d failed=%v", tm.Line, tm.Failed)
+		}
+	}
+	if s := timings[2].Seconds; s < 0.1 || s > 1 {
+		t.Errorf("sleep 100ms took %vs", s)
+	}
+	if s := timings[3].Seconds; s < 0.05 || s > 1 {
+		t.Errorf("expect timing out after 50ms took %vs", s)
+	}
+}
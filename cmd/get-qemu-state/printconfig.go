@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// configValue is a resolved flag value with where it came from: "flag" if
+// set on the command line, the setting it was derived from (e.g. "arch")
+// if configure derived it, "default" otherwise.
+type configValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// printConfig writes the flags of fs as resolved into cfg and the QEMU
+// command line as JSON, with the secrets replaced by redact.
+func printConfig(w io.Writer, fs *flag.FlagSet, qemu string, cfg config, redact redactor) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	// The flags bound to cfg show its values; these aren't bound to it.
+	resolved := map[string]string{"marker": fmt.Sprint(cfg.markers)}
+	if cfg.bootGate != nil {
+		resolved["boot-pattern"] = cfg.bootGate.String()
+	}
+	flags := make(map[string]configValue)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := configValue{Value: f.Value.String(), Source: "default"}
+		if r, ok := resolved[f.Name]; ok {
+			v.Value = r
+		}
+		v.Value = redact.String(v.Value)
+		if set[f.Name] {
+			v.Source = "flag"
+		} else if d, ok := cfg.derived[f.Name]; ok {
+			v.Source = d
+		}
+		flags[f.Name] = v
+	})
+	data, err := json.MarshalIndent(struct {
+		QEMU  string                 `json:"qemu"`
+		Args  []string               `json:"args"` // from -args-json
+		Flags map[string]configValue `json:"flags"`
+	}{qemu, redact.args(cfg.args), flags}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
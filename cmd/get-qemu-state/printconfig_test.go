@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type printedConfig struct {
+	QEMU  string                 `json:"qemu"`
+	Args  []string               `json:"args"`
+	Flags map[string]configValue `json:"flags"`
+}
+
+// runPrintConfig runs get-qemu-state -print-config with args.
+func runPrintConfig(t *testing.T, args ...string) printedConfig {
+	stdout, stderr, err := runMain(t, append([]string{"-print-config"}, args...)...)
+	if err != nil {
+		t.Fatalf("%v: %s", err, stderr)
+	}
+	var cfg printedConfig
+	if err := json.Unmarshal([]byte(stdout), &cfg); err != nil {
+		t.Fatalf("invalid JSON %q: %v", stdout, err)
+	}
+	return cfg
+}
+
+func TestPrintConfig(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "vm.state")
+	cfg := runPrintConfig(t, "-output", output, "-marker", "a", "-marker", "b")
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("QEMU was launched: %v", err)
+	}
+	if len(cfg.Args) != 1 || cfg.Args[0] != stubQEMUCommand || cfg.QEMU == "" {
+		t.Errorf("unexpected QEMU command line %q %v", cfg.QEMU, cfg.Args)
+	}
+	for name, want := range map[string]configValue{
+		"output":         {output, "flag"},
+		"marker":         {"[a b]", "flag"},
+		"marker-count":   {"1", "default"},
+		"expect-timeout": {"5m0s", "default"},
+	} {
+		if got := cfg.Flags[name]; got != want {
+			t.Errorf("-%s = %+v; want %+v", name, got, want)
+		}
+	}
+}
+
+func TestPrintConfigArch(t *testing.T) {
+	d := archDefaults["riscv64"]
+	cfg := runPrintConfig(t, "-arch", "riscv64", "-ignore-before-boot")
+	for name, want := range map[string]configValue{
+		"arch":         {"riscv64", "flag"},
+		"marker":       {fmt.Sprint([]string{d.marker}), "arch"},
+		"boot-timeout": {d.bootTimeout.String(), "arch"},
+		"boot-pattern": {d.bootPattern, "arch"},
+	} {
+		if got := cfg.Flags[name]; got != want {
+			t.Errorf("-%s = %+v; want %+v", name, got, want)
+		}
+	}
+
+	cfg = runPrintConfig(t, "-arch", "riscv64", "-boot-timeout", "1m")
+	if got, want := cfg.Flags["boot-timeout"], (configValue{"1m0s", "flag"}); got != want {
+		t.Errorf("-boot-timeout = %+v; want %+v", got, want)
+	}
+	cfg = runPrintConfig(t)
+	if got, want := cfg.Flags["marker"], (configValue{fmt.Sprint([]string{defaultWaitString}), "default"}); got != want {
+		t.Errorf("-marker = %+v; want %+v", got, want)
+	}
+}
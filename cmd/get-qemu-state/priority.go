@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// I/O scheduling classes of ioprio_set(2).
+const (
+	ioprioClassRT   = 1
+	ioprioClassBE   = 2
+	ioprioClassIdle = 3
+
+	ioprioClassShift = 13
+)
+
+var ioprioClasses = map[string]int{
+	"realtime":    ioprioClassRT,
+	"best-effort": ioprioClassBE,
+	"idle":        ioprioClassIdle,
+}
+
+// parseIOPrio parses a -ionice CLASS[:LEVEL] value into an ioprio_set(2)
+// priority. CLASS is realtime, best-effort or idle (or 1, 2 or 3 as with
+// ionice(1)) and LEVEL 0 (highest) to 7, 4 by default. idle has no levels.
+func parseIOPrio(s string) (int, error) {
+	name, levelS, hasLevel := strings.Cut(s, ":")
+	class, ok := ioprioClasses[name]
+	if !ok {
+		n, err := strconv.Atoi(name)
+		if err != nil || n < ioprioClassRT || n > ioprioClassIdle {
+			return 0, fmt.Errorf("invalid -ionice class %q; want realtime, best-effort or idle", name)
+		}
+		class = n
+	}
+	level := 4
+	if hasLevel {
+		n, err := strconv.Atoi(levelS)
+		if err != nil || n < 0 || n > 7 {
+			return 0, fmt.Errorf("invalid -ionice level %q; want 0 to 7", levelS)
+		}
+		level = n
+	}
+	if class == ioprioClassIdle {
+		level = 0
+	}
+	return class<<ioprioClassShift | level, nil
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+const ioprioWhoProcess = 1
+
+// setPriority sets the nice value (unless nil) and the I/O priority (unless
+// 0, as parsed by parseIOPrio) of all threads of pid. Threads created
+// afterwards inherit them from their creator.
+func setPriority(pid int, nice *int, ioprio int) error {
+	return forEachThread(pid, func(tid int) error {
+		if nice != nil {
+			if err := unix.Setpriority(unix.PRIO_PROCESS, tid, *nice); err != nil {
+				return err
+			}
+		}
+		if ioprio != 0 {
+			if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+				return errno
+			}
+		}
+		return nil
+	})
+}
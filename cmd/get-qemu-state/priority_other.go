@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func setPriority(pid int, nice *int, ioprio int) error {
+	return errors.New("-nice and -ionice are only supported on Linux")
+}
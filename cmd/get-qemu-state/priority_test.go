@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseIOPrio(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want int
+	}{
+		{"idle", 3 << 13},
+		{"best-effort:7", 2<<13 | 7},
+		{"best-effort", 2<<13 | 4},
+		{"1:0", 1 << 13},
+	} {
+		got, err := parseIOPrio(tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("parseIOPrio(%q) = %#x, %v; want %#x", tt.s, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"", "fast", "4", "best-effort:8", "idle:x"} {
+		if _, err := parseIOPrio(s); err == nil {
+			t.Errorf("parseIOPrio(%q) succeeded", s)
+		}
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("-nice and -ionice are only supported on Linux")
+	}
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	nice := 15
+	ioprio, _ := parseIOPrio("best-effort:7")
+	if err := setPriority(cmd.Process.Pid, &nice, ioprio); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fields after the command name in parentheses start with the
+	// state (3rd); the nice value is the 19th.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if fields[19-3] != "15" {
+		t.Errorf("nice value is %s; want 15", fields[19-3])
+	}
+}
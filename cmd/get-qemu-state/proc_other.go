@@ -0,0 +1,40 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func killWithChildren(c *exec.Cmd) {
+	// only the process itself is killed, as by default
+}
+
+func killPID(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+func unixRights(f *os.File) ([]byte, error) {
+	return nil, errors.New("passing a file descriptor to QEMU is only supported on unix")
+}
+
+func receivedFDs(oob []byte) []int {
+	return nil
+}
+
+var oobSpace = 0
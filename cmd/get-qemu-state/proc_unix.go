@@ -0,0 +1,52 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// killWithChildren makes c run in a process group of its own, killed as a
+// whole when c is canceled.
+func killWithChildren(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// killPID kills the process pid, which needn't be a child.
+func killPID(pid int) error {
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// processExists tells whether the process pid may still be running.
+func processExists(pid int) bool {
+	return !errors.Is(syscall.Kill(pid, 0), syscall.ESRCH)
+}
+
+// unixRights returns the control message passing f over a unix socket.
+func unixRights(f *os.File) ([]byte, error) {
+	return syscall.UnixRights(int(f.Fd())), nil
+}
+
+// receivedFDs returns the file descriptors passed in the control messages
+// oob.
+func receivedFDs(oob []byte) []int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	var fds []int
+	for _, m := range msgs {
+		f, _ := syscall.ParseUnixRights(&m)
+		fds = append(fds, f...)
+	}
+	return fds
+}
+
+// oobSpace is the size of the control message passing a file descriptor.
+var oobSpace = syscall.CmsgSpace(4)
@@ -0,0 +1,13 @@
+//go:build linux
+
+package main
+
+import "os"
+
+// setProcessName sets the name ps and top show for this process, truncated to
+// 15 bytes by the kernel. prctl(PR_SET_NAME) would only rename the calling
+// thread, which isn't necessarily the main one in Go; the comm of
+// /proc/self is the main thread's.
+func setProcessName(name string) error {
+	return os.WriteFile("/proc/self/comm", []byte(name), 0)
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func setProcessName(name string) error {
+	return nil // only supported on Linux
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestName(t *testing.T) {
+	dir := t.TempDir()
+	comm := filepath.Join(dir, "comm")
+	_, stderr, err := runMain(t, "-name", "job-1", "-output", filepath.Join(dir, "vm.state"), "-ready-cmd", `cat /proc/$PPID/comm > `+comm+`; true`)
+	if err != nil {
+		t.Fatalf("%v: %s", err, stderr)
+	}
+	var n int
+	for _, l := range strings.Split(stderr, "\n") {
+		if strings.Contains(l, "finishing QEMU") {
+			if !strings.HasPrefix(l, "[job-1] ") {
+				t.Errorf("log line %q isn't prefixed", l)
+			}
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("no log line found in %q", stderr)
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	got, err := os.ReadFile(comm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.TrimSpace(string(got)); s != "gqs:job-1" {
+		t.Errorf("process name %q; want gqs:job-1", s)
+	}
+}
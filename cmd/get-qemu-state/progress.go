@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// progress tracks the current phase of the capture and periodically logs it.
+type progress struct {
+	start   time.Time
+	con     *console
+	changed chan struct{} // signaled on a phase change
+	logf    func(format string, v ...any)
+
+	mu      sync.Mutex
+	phase   string
+	state   string   // the state being written, once migrating
+	bytes   int64    // the last size of state seen
+	percent *float64 // of the migration, if the monitor reports it
+}
+
+func newProgress(start time.Time, con *console, logger *log.Logger) *progress {
+	return &progress{start: start, con: con, phase: "booting", changed: make(chan struct{}, 1), logf: logger.Printf}
+}
+
+func (p *progress) set(phase string) {
+	p.mu.Lock()
+	p.phase = phase
+	p.mu.Unlock()
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// setState sets the path of the state being written, whose size is reported
+// as the transferred bytes.
+func (p *progress) setState(path string) {
+	p.mu.Lock()
+	p.state = path
+	p.mu.Unlock()
+}
+
+func (p *progress) setPercent(percent float64) {
+	p.mu.Lock()
+	p.percent = &percent
+	p.mu.Unlock()
+}
+
+func (p *progress) get() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.phase
+}
+
+// progressThrottle is how many times less often the progress is logged
+// after -max-progress-lines.
+const progressThrottle = 10
+
+// run logs the progress every interval until ctx is done. After maxLines
+// lines (if positive), it's logged progressThrottle times less often. The
+// watchdogs don't depend on it.
+func (p *progress) run(ctx context.Context, interval time.Duration, maxLines int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for n := 0; ; {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.logf("progress: phase=%s elapsed=%v console=%dB", p.get(), time.Since(p.start).Round(time.Second), p.con.written())
+			if n++; n == maxLines {
+				p.logf("progress logging throttled after %d lines; logging every %v from now on", n, interval*progressThrottle)
+				t.Reset(interval * progressThrottle)
+			}
+		}
+	}
+}
+
+// progressReport is the content of -progress-file.
+type progressReport struct {
+	Phase   string   `json:"phase"`
+	Elapsed float64  `json:"elapsedSeconds"`
+	Percent *float64 `json:"percent,omitempty"` // of the migration, with QMP
+	Bytes   int64    `json:"bytes"`             // of the state written so far
+}
+
+func (p *progress) report() progressReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != "" {
+		// The state is gone once renamed to the output.
+		if fi, err := os.Stat(p.state); err == nil {
+			p.bytes = fi.Size()
+		}
+	}
+	return progressReport{Phase: p.phase, Elapsed: time.Since(p.start).Seconds(), Percent: p.percent, Bytes: p.bytes}
+}
+
+// writeFile replaces path with the current progress atomically, so a reader
+// never sees a partial file.
+func (p *progress) writeFile(path string) error {
+	data, err := json.Marshal(p.report())
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runFile rewrites path every interval and on phase changes until ctx is
+// done.
+func (p *progress) runFile(ctx context.Context, path string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := p.writeFile(path); err != nil {
+			p.logf("WARNING: failed to write the progress file: %v", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-p.changed:
+		}
+	}
+}
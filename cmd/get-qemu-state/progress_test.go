@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressThrottle(t *testing.T) {
+	p := newProgress(time.Now(), newConsole(io.Discard), log.Default())
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	p.logf = func(format string, v ...any) {
+		mu.Lock()
+		lines = append(lines, fmt.Sprintf(format, v...))
+		mu.Unlock()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	p.run(ctx, 10*time.Millisecond, 3)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var progress, throttled int
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "progress: "):
+			progress++
+		case strings.HasPrefix(l, "progress logging throttled"):
+			if progress != 3 {
+				t.Errorf("throttled after %d lines; want 3", progress)
+			}
+			throttled++
+		}
+	}
+	// 3 lines in the first 30ms, then one per 100ms.
+	if throttled != 1 || progress < 3 || progress > 5 {
+		t.Fatalf("logged %d progress lines and %d throttle notices in 200ms: %q", progress, throttled, lines)
+	}
+}
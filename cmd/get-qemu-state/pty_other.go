@@ -0,0 +1,38 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+)
+
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, errors.New("-pty is only supported on Linux")
+}
+
+func setControllingTerminal(c *exec.Cmd) {}
+
+type ptyReader struct {
+	f *os.File
+}
+
+func (r ptyReader) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+func makeTerminalRaw(f *os.File) (restore func(), err error) {
+	return nil, errors.New("raw terminals are only supported on Linux")
+}
+
+func copyWinsize(master, src *os.File) error {
+	return errors.New("window sizes are only supported on Linux")
+}
+
+func notifyWinsize(c chan os.Signal) {}
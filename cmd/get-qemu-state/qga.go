@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+// guestAgentPort is the name of the virtio-serial port qemu-guest-agent
+// listens on.
+const guestAgentPort = "org.qemu.guest_agent.0"
+
+// guestAgentAddr returns the address of the socket -chardev backing the guest
+// agent port (-device virtserialport,chardev=ID,name=org.qemu.guest_agent.0)
+// in args. ok is false if there's none QEMU listens on.
+func guestAgentAddr(args []string) (network, addr string, ok bool) {
+	chardevs := make(map[string]string) // id -> options
+	var id string
+	for i := 0; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-chardev":
+			if kind, opts, _ := strings.Cut(args[i+1], ","); kind == "socket" {
+				if cid, ok := option(opts, "id"); ok {
+					chardevs[cid] = opts
+				}
+			}
+		case "-device":
+			if name, _ := option(args[i+1], "name"); name == guestAgentPort {
+				id, _ = option(args[i+1], "chardev")
+			}
+		}
+	}
+	cd, ok := chardevs[id]
+	if id == "" || !ok || !isServer(cd) {
+		return "", "", false
+	}
+	if p, ok := option(cd, "path"); ok {
+		return "unix", p, true
+	}
+	host, _ := option(cd, "host")
+	if port, ok := option(cd, "port"); ok {
+		return "tcp", host + ":" + port, true
+	}
+	return "", "", false
+}
+
+// guestAgent is a client of qemu-guest-agent. Unlike QMP, the agent doesn't
+// greet and may not run yet (or have stale input) when connected, so the
+// session is started by guest-sync-delimited.
+type guestAgent struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// logger receives the guest-exec output and what collecting guest
+	// files skips.
+	logger *log.Logger
+}
+
+// dialGuestAgent connects to the guest agent at network/addr and waits until
+// it responds, retrying until ctx is done.
+func dialGuestAgent(ctx context.Context, network, addr string) (*guestAgent, error) {
+	var d net.Dialer
+	var conn net.Conn
+	for {
+		var err error
+		if conn, err = d.DialContext(ctx, network, addr); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to connect to the guest agent at %s: %w", addr, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	g := &guestAgent{conn: conn, r: bufio.NewReader(conn), logger: log.Default()}
+	for {
+		err := g.sync(time.Second)
+		if err == nil {
+			return g, nil
+		}
+		if ctx.Err() != nil {
+			conn.Close()
+			return nil, fmt.Errorf("guest agent didn't respond (%v): %w", err, ctx.Err())
+		}
+	}
+}
+
+func (g *guestAgent) Close() error {
+	return g.conn.Close()
+}
+
+// sync synchronizes with the agent, discarding any response to earlier
+// requests. The agent prefixes its response with 0xff, which also resets its
+// parser when sent first.
+func (g *guestAgent) sync(timeout time.Duration) error {
+	id := rand.Int64N(1 << 50)
+	req := fmt.Sprintf(`{"execute":"guest-sync-delimited","arguments":{"id":%d}}`+"\n", id)
+	g.conn.SetDeadline(time.Now().Add(timeout))
+	defer g.conn.SetDeadline(time.Time{})
+	if _, err := g.conn.Write(append([]byte{0xff}, req...)); err != nil {
+		return err
+	}
+	for {
+		if _, err := g.r.ReadBytes(0xff); err != nil {
+			return err
+		}
+		line, err := g.r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			Return int64 `json:"return"`
+		}
+		if json.Unmarshal(line, &resp) == nil && resp.Return == id {
+			return nil
+		}
+	}
+}
+
+// execute runs command and decodes its return value into ret (if not nil).
+func (g *guestAgent) execute(command string, args any, ret any) error {
+	req := map[string]any{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := g.conn.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to send %s: %w", command, err)
+	}
+	line, err := g.r.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read response of %s: %w", command, err)
+	}
+	var resp qmpMessage // the agent speaks the QMP wire protocol
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("invalid response of %s: %w", command, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s failed: %w", command, resp.Error)
+	}
+	if ret == nil || resp.Return == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Return, ret)
+}
+
+// waitGuestAgent blocks until the guest agent at network/addr answers
+// guest-ping, at every ping for debounce. A failed ping reconnects.
+func waitGuestAgent(ctx context.Context, network, addr string, debounce time.Duration) error {
+	d := debouncer{window: debounce}
+	for {
+		g, err := dialGuestAgent(ctx, network, addr)
+		if err != nil {
+			return err
+		}
+		if dl, ok := ctx.Deadline(); ok {
+			g.conn.SetDeadline(dl)
+		}
+		err = pingGuestAgent(ctx, g, &d)
+		g.Close()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// pingGuestAgent pings g until d is met or a ping fails.
+func pingGuestAgent(ctx context.Context, g *guestAgent, d *debouncer) error {
+	for {
+		err := g.execute("guest-ping", nil, nil)
+		if d.observe(err == nil) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// exec runs command with /bin/sh in the guest, logging its output, and fails
+// if it exits nonzero.
+func (g *guestAgent) exec(ctx context.Context, command string) error {
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		g.conn.SetDeadline(dl)
+		defer g.conn.SetDeadline(time.Time{})
+	}
+	args := map[string]any{"path": "/bin/sh", "arg": []string{"-c", command}, "capture-output": true}
+	if err := g.execute("guest-exec", args, &started); err != nil {
+		return err
+	}
+	for {
+		var st struct {
+			Exited   bool   `json:"exited"`
+			ExitCode int    `json:"exitcode"`
+			Signal   int    `json:"signal"`
+			OutData  string `json:"out-data"`
+			ErrData  string `json:"err-data"`
+		}
+		if err := g.execute("guest-exec-status", map[string]any{"pid": started.PID}, &st); err != nil {
+			return err
+		}
+		if st.Exited {
+			for _, d := range []string{st.OutData, st.ErrData} {
+				out, _ := base64.StdEncoding.DecodeString(d)
+				for _, l := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+					if l != "" {
+						g.logger.Printf("guest-exec: %s", l)
+					}
+				}
+			}
+			if st.Signal != 0 {
+				return fmt.Errorf("%q was killed by signal %d in the guest", command, st.Signal)
+			} else if st.ExitCode != 0 {
+				return fmt.Errorf("%q exited with %d in the guest", command, st.ExitCode)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%q didn't exit in the guest: %w", command, ctx.Err())
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// runGuestExec runs commands in order in the guest, each within timeout (if
+// positive).
+func runGuestExec(ctx context.Context, g *guestAgent, commands []string, timeout time.Duration) error {
+	for _, c := range commands {
+		g.logger.Printf("running %q in the guest", c)
+		cctx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			cctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err := g.exec(cctx, c)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
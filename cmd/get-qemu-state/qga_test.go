@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuestAgentAddr(t *testing.T) {
+	for _, tt := range []struct {
+		args          []string
+		network, addr string
+	}{
+		{[]string{"-chardev", "socket,id=qga0,path=/tmp/qga.sock,server=on,wait=off", "-device", "virtio-serial", "-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0"}, "unix", "/tmp/qga.sock"},
+		{[]string{"-device", "virtserialport,name=org.qemu.guest_agent.0,chardev=a", "-chardev", "socket,id=a,host=127.0.0.1,port=4444,server=on"}, "tcp", "127.0.0.1:4444"},
+		{[]string{"-chardev", "socket,id=qga0,path=/tmp/qga.sock", "-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0"}, "", ""},
+		{[]string{"-chardev", "socket,id=c,path=/tmp/x.sock,server=on", "-device", "virtserialport,chardev=c,name=other"}, "", ""},
+	} {
+		network, addr, ok := guestAgentAddr(tt.args)
+		if network != tt.network || addr != tt.addr || ok != (tt.addr != "") {
+			t.Errorf("%v: got %q %q %v; want %q %q", tt.args, network, addr, ok, tt.network, tt.addr)
+		}
+	}
+}
+
+// fakeGuestAgent serves the guest agent protocol once up, ignoring the
+// requests received before like a port nobody reads in the guest.
+func fakeGuestAgent(t *testing.T, up time.Time) string {
+	sock := filepath.Join(t.TempDir(), "qga.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveGuestAgent(conn, up)
+		}
+	}()
+	return sock
+}
+
+// guestFiles are the files the fake guest agent serves.
+var guestFiles = map[string]string{
+	"/var/log/boot.log": "[ OK ] Started nginx.\n",
+	"/proc/cmdline":     "console=ttyS0 root=/dev/vda\n",
+}
+
+func serveGuestAgent(conn net.Conn, up time.Time) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	enc := json.NewEncoder(conn)
+	polls := make(map[int]int)      // by PID
+	files := make(map[int64]string) // unread content by handle
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		if time.Now().Before(up) {
+			continue
+		}
+		var req struct {
+			Execute   string `json:"execute"`
+			Arguments struct {
+				ID     int64    `json:"id"`
+				PID    int      `json:"pid"`
+				Arg    []string `json:"arg"`
+				Path   string   `json:"path"`
+				Handle int64    `json:"handle"`
+				Count  int      `json:"count"`
+			} `json:"arguments"`
+		}
+		if err := json.Unmarshal(line[strings.LastIndexByte(string(line), 0xff)+1:], &req); err != nil {
+			continue
+		}
+		switch req.Execute {
+		case "guest-sync-delimited":
+			conn.Write([]byte{0xff})
+			enc.Encode(map[string]any{"return": req.Arguments.ID})
+		case "guest-ping":
+			enc.Encode(map[string]any{"return": map[string]any{}})
+		case "guest-exec":
+			// The PID encodes the exit code.
+			pid := 100
+			if req.Arguments.Arg[1] == "false" {
+				pid = 101
+			}
+			enc.Encode(map[string]any{"return": map[string]any{"pid": pid}})
+		case "guest-exec-status":
+			pid := req.Arguments.PID
+			if polls[pid]++; polls[pid] < 2 {
+				enc.Encode(map[string]any{"return": map[string]any{"exited": false}})
+				continue
+			}
+			enc.Encode(map[string]any{"return": map[string]any{"exited": true, "exitcode": pid - 100, "out-data": base64.StdEncoding.EncodeToString([]byte("warmed up\n"))}})
+		case "guest-file-open":
+			content, ok := guestFiles[req.Arguments.Path]
+			if !ok {
+				enc.Encode(map[string]any{"error": map[string]any{"class": "GenericError", "desc": "failed to open file '" + req.Arguments.Path + "': No such file or directory"}})
+				continue
+			}
+			files[1] = content
+			enc.Encode(map[string]any{"return": 1})
+		case "guest-file-read":
+			// Read in small chunks to exercise the loop.
+			content := files[req.Arguments.Handle]
+			n := min(len(content), 5, req.Arguments.Count)
+			files[req.Arguments.Handle] = content[n:]
+			enc.Encode(map[string]any{"return": map[string]any{"count": n, "buf-b64": base64.StdEncoding.EncodeToString([]byte(content[:n])), "eof": n == len(content)}})
+		case "guest-file-close":
+			delete(files, req.Arguments.Handle)
+			enc.Encode(map[string]any{"return": map[string]any{}})
+		default:
+			enc.Encode(map[string]any{"error": map[string]any{"class": "CommandNotFound", "desc": req.Execute}})
+		}
+	}
+}
+
+func TestWaitGuestAgent(t *testing.T) {
+	start := time.Now()
+	sock := fakeGuestAgent(t, start.Add(500*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := waitGuestAgent(ctx, "unix", sock, 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Fatalf("agent taken as responsive after %v; want >=500ms", d)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := waitGuestAgent(ctx, "unix", fakeGuestAgent(t, time.Now().Add(time.Hour)), 0); err == nil {
+		t.Fatal("silent agent is taken as responsive")
+	}
+}
+
+func TestRunGuestExec(t *testing.T) {
+	sock := fakeGuestAgent(t, time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	g, err := dialGuestAgent(ctx, "unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if err := runGuestExec(ctx, g, []string{"echo warm"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	err = runGuestExec(ctx, g, []string{"echo warm", "false"}, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), `"false" exited with 1`) {
+		t.Fatalf("got %v; want the second command failing", err)
+	}
+}
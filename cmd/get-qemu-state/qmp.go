@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// qmp is a client of the QEMU machine protocol.
+type qmp struct {
+	conn net.Conn
+	dec  *json.Decoder
+
+	// version is the QEMU version in the greeting.
+	version string
+
+	// migrateAttempts bounds the migrations tried with escalating
+	// parameters, each cancelled if it doesn't complete within
+	// migrateTimeout (if positive). Retries wait migrateBackoff, doubled
+	// after each failed attempt.
+	migrateAttempts int
+	migrateTimeout  time.Duration
+	migrateBackoff  time.Duration
+	// migrateFD is the name of a file descriptor passed by sendFD that
+	// migrations go to instead of the path.
+	migrateFD string
+	// migrateCompressed migrates through gzip to the path (see
+	// migrationPlan).
+	migrateCompressed bool
+	// logger receives the retries of migrate.
+	logger *log.Logger
+
+	// lastMigration is the info of the last completed migration.
+	lastMigration *migrationInfo
+	// onMigrationProgress (if not nil) is called with the percentage of
+	// the RAM transferred whenever query-migrate reports it.
+	onMigrationProgress func(percent float64)
+
+	// desync is set once a command was given up, leaving a response that
+	// would be taken for that of the next command.
+	desync error
+
+	mu     sync.Mutex
+	events []qmpEvent
+}
+
+type qmpEvent struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+type qmpMessage struct {
+	QMP    json.RawMessage `json:"QMP,omitempty"`
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *qmpError       `json:"error,omitempty"`
+	qmpEvent
+}
+
+// dialQMP connects to the QMP server at network/addr and negotiates the
+// capabilities. As QEMU creates the socket after starting, the connection is
+// retried until ctx is done.
+func dialQMP(ctx context.Context, network, addr string) (*qmp, error) {
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			if dl, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(dl)
+			}
+			r := bufio.NewReader(conn)
+			if err := probeQMP(r); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			q := &qmp{conn: conn, dec: json.NewDecoder(r), logger: log.Default()}
+			if err := q.handshake(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn.SetDeadline(time.Time{})
+			return q, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to connect to QMP at %s: %w", addr, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// hmpBanner starts the greeting of HMP.
+const hmpBanner = "QEMU "
+
+// probeQMP checks that the monitor at r greets with QMP's JSON rather than
+// HMP's banner, which would leave every command unanswered.
+func probeQMP(r *bufio.Reader) error {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return fmt.Errorf("failed to read QMP greeting: %w", err)
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.Discard(1)
+			continue
+		case '{':
+			return nil
+		}
+		line, _ := r.ReadString('\n')
+		if strings.HasPrefix(line, hmpBanner) || strings.Contains(line, "(qemu)") {
+			return fmt.Errorf("monitor protocol mismatch: expected QMP, got HMP (%q); use -qmp or -mon mode=control for the socket", strings.TrimSpace(line))
+		}
+		return fmt.Errorf("monitor protocol mismatch: expected QMP, got %q", strings.TrimSpace(line))
+	}
+}
+
+func (q *qmp) handshake(ctx context.Context) error {
+	var greeting qmpMessage
+	if err := q.dec.Decode(&greeting); err != nil {
+		return fmt.Errorf("failed to read QMP greeting: %w", err)
+	}
+	if greeting.QMP == nil {
+		return errors.New("QMP greeting not received")
+	}
+	var info struct {
+		Version struct {
+			QEMU struct {
+				Major, Minor, Micro int
+			} `json:"qemu"`
+		} `json:"version"`
+	}
+	if json.Unmarshal(greeting.QMP, &info) == nil {
+		v := info.Version.QEMU
+		q.version = fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Micro)
+	}
+	return q.execute(ctx, "qmp_capabilities", nil, nil)
+}
+
+func (q *qmp) Close() error {
+	return q.conn.Close()
+}
+
+// execute runs command and decodes its return value into ret (if not nil).
+// Events received meanwhile are kept for takeEvents. The command is given up
+// once ctx is done by expiring the connection deadline; as its response may
+// still come, the commands after it fail.
+func (q *qmp) execute(ctx context.Context, command string, args any, ret any) error {
+	if q.desync != nil {
+		return q.desync
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", command, err)
+	}
+	req := map[string]any{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	expired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		q.conn.SetDeadline(time.Now())
+		close(expired)
+	})
+	if _, err = q.conn.Write(append(data, '\n')); err != nil {
+		err = fmt.Errorf("failed to send %s: %w", command, err)
+	} else {
+		err = q.response(command, ret)
+	}
+	if !stop() {
+		<-expired
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			// The response made it before the deadline.
+			q.conn.SetDeadline(time.Time{})
+			return err
+		}
+		q.desync = fmt.Errorf("QMP connection unusable after giving up %s: %w", command, ctx.Err())
+		return fmt.Errorf("%s: %w", command, ctx.Err())
+	}
+	return err
+}
+
+// response reads the response of command into ret, buffering the events
+// received meanwhile.
+func (q *qmp) response(command string, ret any) error {
+	for {
+		var msg qmpMessage
+		if err := q.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("failed to read response of %s: %w", command, err)
+		}
+		switch {
+		case msg.Event != "":
+			q.mu.Lock()
+			q.events = append(q.events, msg.qmpEvent)
+			q.mu.Unlock()
+		case msg.Error != nil:
+			return fmt.Errorf("%s failed: %w", command, msg.Error)
+		case msg.Return != nil:
+			if ret == nil {
+				return nil
+			}
+			return json.Unmarshal(msg.Return, ret)
+		}
+	}
+}
+
+// sendFD passes f to QEMU as name (getfd), e.g. for a migration to "fd:name".
+// QMP must be on a unix socket.
+func (q *qmp) sendFD(name string, f *os.File) error {
+	uc, ok := q.conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("passing a file descriptor to QEMU needs QMP on a unix socket")
+	}
+	data, err := json.Marshal(map[string]any{"execute": "getfd", "arguments": map[string]any{"fdname": name}})
+	if err != nil {
+		return err
+	}
+	rights, err := unixRights(f)
+	if err != nil {
+		return err
+	}
+	if _, _, err := uc.WriteMsgUnix(append(data, '\n'), rights, nil); err != nil {
+		return fmt.Errorf("failed to send getfd: %w", err)
+	}
+	return q.response("getfd", nil)
+}
+
+// takeEvents returns the events received so far and forgets them.
+func (q *qmp) takeEvents() []qmpEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ev := q.events
+	q.events = nil
+	return ev
+}
+
+type migrationInfo struct {
+	Status    string `json:"status"`
+	ErrorDesc string `json:"error-desc,omitempty"`
+	TotalTime int64  `json:"total-time,omitempty"` // ms
+	Downtime  int64  `json:"downtime,omitempty"`   // ms
+	RAM       *struct {
+		Total     int64 `json:"total"`
+		Remaining int64 `json:"remaining"`
+	} `json:"ram,omitempty"`
+
+	// phases of a completed migration, nil if they weren't seen.
+	phases *migrationPhases
+}
+
+// statusChange is a migration status seen first at the time since the
+// migrate command.
+type statusChange struct {
+	status string
+	at     time.Duration
+}
+
+// migrationPhases is the time a migration spent in setup (e.g. serializing
+// the device setup, until the transfer started), transferring the RAM
+// ("active") and completing (with the VM stopped, sending the device state
+// and the remaining RAM). The boundaries are as precise as the polling of
+// query-migrate.
+type migrationPhases struct {
+	SetupMs      int64 `json:"setupMs"`
+	TransferMs   int64 `json:"transferMs"`
+	CompletionMs int64 `json:"completionMs"`
+}
+
+// migrationPhasesOf returns the phases of a completed migration from its
+// status changes, or nil if the transfer wasn't seen (e.g. the migration
+// completed before the first query-migrate).
+func migrationPhasesOf(changes []statusChange) *migrationPhases {
+	var active, completing, completed *statusChange
+	for i := range changes {
+		c := &changes[i]
+		switch {
+		case c.status == "active" && active == nil:
+			active = c
+		case c.status == "completed":
+			completed = c
+		case active != nil && completing == nil && c.status != "active":
+			// pre-switchover or device
+			completing = c
+		}
+	}
+	if active == nil || completed == nil {
+		return nil
+	}
+	if completing == nil {
+		completing = completed
+	}
+	return &migrationPhases{
+		SetupMs:      active.at.Milliseconds(),
+		TransferMs:   (completing.at - active.at).Milliseconds(),
+		CompletionMs: (completed.at - completing.at).Milliseconds(),
+	}
+}
+
+func (p *migrationPhases) String() string {
+	d := func(ms int64) time.Duration { return time.Duration(ms) * time.Millisecond }
+	return fmt.Sprintf("setup %v, transfer %v, completion %v", d(p.SetupMs), d(p.TransferMs), d(p.CompletionMs))
+}
+
+// migrateParams are the parameters of a migration attempt. Zero values leave
+// the QEMU defaults.
+type migrateParams struct {
+	MaxBandwidth  int64 `json:"max-bandwidth,omitempty"`  // bytes/s
+	DowntimeLimit int64 `json:"downtime-limit,omitempty"` // ms
+	AutoConverge  bool  `json:"-"`
+}
+
+// maxMigrateBackoff caps the wait before a migration retry.
+const maxMigrateBackoff = 30 * time.Second
+
+// migrateEscalation lists the parameters of the successive migration attempts
+// of a guest that keeps running (and dirtying its memory) meanwhile. The last
+// one is repeated if more attempts are allowed.
+var migrateEscalation = []migrateParams{
+	{},
+	{MaxBandwidth: 1 << 30, DowntimeLimit: 1000, AutoConverge: true},
+	{MaxBandwidth: 10 << 30, DowntimeLimit: 10000, AutoConverge: true},
+}
+
+// migrate saves the VM state to path (or migrateFD) and waits for the
+// completion reported by query-migrate. The VM stays stopped afterwards. A
+// migration failing or not converging is retried with the parameters
+// escalated as migrateEscalation.
+//
+// A retry restarts the migration from scratch, overwriting path; nothing of
+// a partially transferred state is resumed. The only guarantee is that path
+// holds a complete state once migrate succeeds.
+func (q *qmp) migrate(ctx context.Context, path string) error {
+	attempts := max(q.migrateAttempts, 1)
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if q.migrateBackoff > 0 {
+				select {
+				case <-ctx.Done():
+					return err
+				case <-time.After(min(q.migrateBackoff<<(i-1), maxMigrateBackoff)):
+				}
+			}
+			p := migrateEscalation[min(i, len(migrateEscalation)-1)]
+			q.logger.Printf("retrying the migration (attempt %d/%d) with max-bandwidth=%d downtime-limit=%dms auto-converge=%v", i+1, attempts, p.MaxBandwidth, p.DowntimeLimit, p.AutoConverge)
+			if err := q.setMigrateParams(ctx, p); err != nil {
+				return err
+			}
+		}
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if q.migrateTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, q.migrateTimeout)
+		}
+		var info *migrationInfo
+		info, err = q.migrateInfo(attemptCtx, path)
+		cancel()
+		if err == nil {
+			q.lastMigration = info
+			return nil
+		} else if ctx.Err() != nil {
+			return err
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("migration didn't complete within %v", q.migrateTimeout)
+			if cerr := q.cancelMigration(ctx); cerr != nil {
+				return cerr
+			}
+		}
+		q.logger.Printf("migration attempt %d/%d failed: %v", i+1, attempts, err)
+	}
+	return err
+}
+
+func (q *qmp) setMigrateParams(ctx context.Context, p migrateParams) error {
+	if err := q.execute(ctx, "migrate-set-parameters", p, nil); err != nil {
+		return err
+	}
+	caps := []map[string]any{{"capability": "auto-converge", "state": p.AutoConverge}}
+	return q.execute(ctx, "migrate-set-capabilities", map[string]any{"capabilities": caps}, nil)
+}
+
+// cancelMigration cancels the ongoing migration and waits for it to stop.
+func (q *qmp) cancelMigration(ctx context.Context) error {
+	if err := q.execute(ctx, "migrate_cancel", nil, nil); err != nil {
+		return err
+	}
+	for {
+		var info migrationInfo
+		if err := q.execute(ctx, "query-migrate", nil, &info); err != nil {
+			return err
+		}
+		switch info.Status {
+		case "cancelled", "failed", "completed":
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (q *qmp) migrateInfo(ctx context.Context, path string) (*migrationInfo, error) {
+	uri := "file:" + path
+	switch {
+	case q.migrateFD != "":
+		uri = "fd:" + q.migrateFD
+	case q.migrateCompressed:
+		uri = compressURI(path)
+	}
+	start := time.Now()
+	if err := q.execute(ctx, "migrate", map[string]any{"uri": uri}, nil); err != nil {
+		return nil, err
+	}
+	var changes []statusChange
+	for {
+		var info migrationInfo
+		if err := q.execute(ctx, "query-migrate", nil, &info); err != nil {
+			return nil, err
+		}
+		if n := len(changes); n == 0 || changes[n-1].status != info.Status {
+			changes = append(changes, statusChange{info.Status, time.Since(start)})
+		}
+		if q.onMigrationProgress != nil && info.RAM != nil && info.RAM.Total > 0 {
+			q.onMigrationProgress(float64(info.RAM.Total-info.RAM.Remaining) * 100 / float64(info.RAM.Total))
+		}
+		switch info.Status {
+		case "completed":
+			info.phases = migrationPhasesOf(changes)
+			if q.migrateCompressed {
+				if err := waitCompressed(ctx, path); err != nil {
+					return nil, err
+				}
+			}
+			return &info, nil
+		case "failed", "cancelled":
+			return nil, fmt.Errorf("migration %s: %s", info.Status, info.ErrorDesc)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (q *qmp) status(ctx context.Context) (string, error) {
+	var st struct {
+		Status string `json:"status"`
+	}
+	err := q.execute(ctx, "query-status", nil, &st)
+	return st.Status, err
+}
+
+func (q *qmp) waitRunning(ctx context.Context) error {
+	for {
+		st, err := q.status(ctx)
+		if err != nil {
+			return err
+		}
+		if st == "running" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("VM didn't start running (status %q): %w", st, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// checkpoint saves the VM state to path and lets the guest continue.
+func (q *qmp) checkpoint(ctx context.Context, path string) error {
+	tmp := path + ".tmp"
+	if err := q.migrate(ctx, tmp); err != nil {
+		return err
+	}
+	if err := q.execute(ctx, "cont", nil, nil); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (q *qmp) pmemsave(ctx context.Context, addr, size int64, path string) error {
+	return q.execute(ctx, "pmemsave", map[string]any{"val": addr, "size": size, "filename": path}, nil)
+}
+
+func (q *qmp) dumpGuestMemory(ctx context.Context, path string) error {
+	// Not detached, so the response follows the completion.
+	return q.execute(ctx, "dump-guest-memory", map[string]any{"paging": false, "protocol": "file:" + path}, nil)
+}
+
+func (q *qmp) precheckMigration(ctx context.Context) error {
+	if err := q.execute(ctx, "migrate", map[string]any{"uri": "file:/dev/null"}, nil); err != nil {
+		return err
+	}
+	if err := q.cancelMigration(ctx); err != nil {
+		return err
+	}
+	var info migrationInfo
+	if err := q.execute(ctx, "query-migrate", nil, &info); err != nil {
+		return err
+	}
+	if info.Status == "failed" {
+		return fmt.Errorf("migration failed: %s", info.ErrorDesc)
+	}
+	// The migration may have completed before the cancel.
+	if st, err := q.status(ctx); err != nil {
+		return err
+	} else if st != "running" {
+		return q.execute(ctx, "cont", nil, nil)
+	}
+	return nil
+}
+
+func (q *qmp) stop(ctx context.Context) error {
+	return q.execute(ctx, "stop", nil, nil)
+}
+
+func (q *qmp) quit() error {
+	// QEMU may close the connection before responding.
+	if err := q.execute(context.Background(), "quit", nil, nil); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
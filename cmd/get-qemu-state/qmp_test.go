@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQMPAddr(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		network string
+		addr    string
+		ok      bool
+	}{
+		{
+			args: []string{"-nographic", "-m", "512M"},
+		},
+		{
+			args:    []string{"-qmp", "unix:/tmp/qmp.sock,server,wait=off"},
+			network: "unix",
+			addr:    "/tmp/qmp.sock",
+			ok:      true,
+		},
+		{
+			args:    []string{"-qmp", "tcp:127.0.0.1:4444,server=on,wait=off"},
+			network: "tcp",
+			addr:    "127.0.0.1:4444",
+			ok:      true,
+		},
+		{
+			args: []string{"-qmp", "unix:/tmp/qmp.sock"}, // QEMU connects as a client
+		},
+		{
+			args: []string{"-qmp", "stdio"},
+		},
+		{
+			args:    []string{"-chardev", "socket,id=mon0,path=/tmp/mon.sock,server=on,wait=off", "-mon", "chardev=mon0,mode=control"},
+			network: "unix",
+			addr:    "/tmp/mon.sock",
+			ok:      true,
+		},
+		{
+			args:    []string{"-chardev", "socket,id=mon0,host=127.0.0.1,port=4444,server=on,wait=off", "-mon", "chardev=mon0,mode=control"},
+			network: "tcp",
+			addr:    "127.0.0.1:4444",
+			ok:      true,
+		},
+		{
+			args: []string{"-chardev", "socket,id=mon0,path=/tmp/mon.sock,server=on,wait=off", "-mon", "chardev=mon0,mode=readline"},
+		},
+		{
+			args: []string{"-chardev", "stdio,id=char0,mux=on", "-mon", "chardev=char0,mode=control"},
+		},
+	} {
+		network, addr, ok := qmpAddr(tt.args)
+		if network != tt.network || addr != tt.addr || ok != tt.ok {
+			t.Errorf("qmpAddr(%v) = %q, %q, %v; want %q, %q, %v", tt.args, network, addr, ok, tt.network, tt.addr, tt.ok)
+		}
+	}
+}
+
+// fakeQMP serves the QMP commands used by the capture on a unix socket. A
+// migration writes its file and completes after a couple of query-migrate
+// unless set up to fail.
+// pmemsave writes memory regardless of the range.
+type fakeQMP struct {
+	sock string
+
+	mu       sync.Mutex
+	commands []string
+	status   string
+	memory   []byte // saved by pmemsave
+
+	// failMigrations and hangMigrations make the next migrations fail or
+	// stay active until cancelled.
+	failMigrations int
+	hangMigrations int
+	// migrationBlocker makes migrate fail as with an unmigratable device.
+	migrationBlocker string
+	// stallStatus leaves query-status unanswered.
+	stallStatus bool
+
+	// ram shrinks by 64MiB a query-balloon towards the balloon target.
+	ram, balloonTarget int64
+
+	// icount grows by 1000 instructions a query-replay while running.
+	icount int64
+
+	// negotiationEvents are emitted before the qmp_capabilities response,
+	// laterEvents 50ms after it.
+	negotiationEvents, laterEvents []qmpEvent
+}
+
+func newFakeQMP(t *testing.T) *fakeQMP {
+	f := &fakeQMP{sock: filepath.Join(t.TempDir(), "qmp.sock"), status: "running"}
+	l, err := net.Listen("unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeQMP) serve(conn net.Conn) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	fr := &fdReader{conn: conn.(*net.UnixConn)}
+	dec := json.NewDecoder(fr)
+	named := make(map[string]*os.File) // by getfd
+	enc.Encode(map[string]any{"QMP": map[string]any{"version": map[string]any{}, "capabilities": []string{}}})
+	var (
+		polls     int
+		migStatus string
+	)
+	for {
+		var req struct {
+			Execute   string `json:"execute"`
+			Arguments struct {
+				URI      string `json:"uri"`
+				Filename string `json:"filename"`
+				Value    int64  `json:"value"`
+				FDName   string `json:"fdname"`
+			} `json:"arguments"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, req.Execute)
+		if req.Execute == "query-status" && f.stallStatus {
+			f.mu.Unlock()
+			continue
+		}
+		var (
+			ret  any = map[string]any{}
+			qerr *qmpError
+		)
+		switch req.Execute {
+		case "migrate":
+			polls, migStatus = 0, "active"
+			switch {
+			case f.migrationBlocker != "":
+				qerr = &qmpError{Class: "GenericError", Desc: "Migration is disabled when using feature '" + f.migrationBlocker + "' but not its migration mode"}
+			case f.failMigrations > 0:
+				f.failMigrations--
+				migStatus = "failed"
+			case f.hangMigrations > 0:
+				f.hangMigrations--
+				migStatus = "hanging"
+			default:
+				f.status = "postmigrate"
+				if name, ok := strings.CutPrefix(req.Arguments.URI, "fd:"); ok {
+					named[name].Write([]byte("state"))
+					named[name].Close()
+				} else {
+					os.WriteFile(strings.TrimPrefix(req.Arguments.URI, "file:"), []byte("state"), 0644)
+				}
+				enc.Encode(map[string]any{"event": "STOP"})
+			}
+		case "migrate_cancel":
+			migStatus = "cancelled"
+		case "query-migrate":
+			polls++
+			switch {
+			case migStatus == "failed":
+				ret = map[string]any{"status": "failed", "error-desc": "fake failure"}
+			case migStatus == "hanging":
+				ret = map[string]any{"status": "active"}
+			case migStatus == "cancelled":
+				ret = map[string]any{"status": "cancelled"}
+			case polls < 3:
+				ret = map[string]any{"status": "active", "ram": map[string]any{"total": 1000, "remaining": 1000 - 400*polls}}
+			default:
+				ret = map[string]any{"status": "completed", "total-time": 12, "downtime": 3}
+			}
+		case "query-status":
+			ret = map[string]any{"status": f.status}
+		case "cont":
+			f.status = "running"
+		case "stop":
+			f.status = "paused"
+		case "query-replay":
+			if f.status == "running" {
+				f.icount += 1000
+			}
+			ret = map[string]any{"mode": "record", "icount": f.icount}
+		case "balloon":
+			f.balloonTarget = req.Arguments.Value
+		case "query-balloon":
+			if f.balloonTarget > 0 && f.ram > f.balloonTarget {
+				f.ram = max(f.ram-64<<20, f.balloonTarget)
+			}
+			ret = map[string]any{"actual": f.ram}
+		case "getfd":
+			if len(fr.fds) == 0 {
+				qerr = &qmpError{Class: "GenericError", Desc: "No file descriptor supplied via SCM_RIGHTS"}
+				break
+			}
+			named[req.Arguments.FDName] = os.NewFile(uintptr(fr.fds[0]), req.Arguments.FDName)
+			fr.fds = fr.fds[1:]
+		case "pmemsave":
+			os.WriteFile(req.Arguments.Filename, f.memory, 0644)
+		case "qmp_capabilities":
+			for _, ev := range f.negotiationEvents {
+				enc.Encode(ev)
+			}
+		}
+		later := f.laterEvents
+		f.mu.Unlock()
+		if qerr != nil {
+			enc.Encode(map[string]any{"error": qerr})
+			continue
+		}
+		enc.Encode(map[string]any{"return": ret})
+		if req.Execute == "qmp_capabilities" && len(later) > 0 {
+			time.Sleep(50 * time.Millisecond)
+			for _, ev := range later {
+				enc.Encode(ev)
+			}
+		}
+		if req.Execute == "quit" {
+			return
+		}
+	}
+}
+
+func (f *fakeQMP) executed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func TestQMP(t *testing.T) {
+	f := newFakeQMP(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q, err := dialQMP(ctx, "unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	var percents []float64
+	q.onMigrationProgress = func(p float64) { percents = append(percents, p) }
+	state := filepath.Join(t.TempDir(), "vm.state")
+	info, err := q.migrateInfo(ctx, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != "completed" || info.TotalTime != 12 {
+		t.Errorf("unexpected migration info %+v", info)
+	}
+	if !slices.Equal(percents, []float64{40, 80}) {
+		t.Errorf("migration progress %v; want [40 80]", percents)
+	}
+	if p := info.phases; p == nil || p.TransferMs < 100 {
+		t.Errorf("migration phases %+v; want the transfer over 2 polls", p)
+	}
+	q.onMigrationProgress = nil
+	if _, err := os.Stat(state); err != nil {
+		t.Errorf("state file isn't written: %v", err)
+	}
+	if ev := q.takeEvents(); len(ev) != 1 || ev[0].Event != "STOP" {
+		t.Errorf("got events %+v; want STOP", ev)
+	}
+	if st, err := q.status(context.Background()); err != nil || st != "postmigrate" {
+		t.Errorf("status = %q, %v; want postmigrate", st, err)
+	}
+
+	cp := filepath.Join(t.TempDir(), "checkpoint")
+	if err := q.checkpoint(ctx, cp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cp); err != nil {
+		t.Errorf("checkpoint isn't written: %v", err)
+	}
+	if q.lastMigration == nil || q.lastMigration.Downtime != 3 {
+		t.Errorf("last migration %+v; want the downtime recorded", q.lastMigration)
+	}
+	if err := q.waitRunning(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.quit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.executed(); got[0] != "qmp_capabilities" || got[len(got)-1] != "quit" {
+		t.Errorf("unexpected commands %v", got)
+	}
+}
+
+func TestQMPExecuteContext(t *testing.T) {
+	f := newFakeQMP(t)
+	q, err := dialQMP(context.Background(), "unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	// A command answered in time leaves the connection usable.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	_, err = q.status(ctx)
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.status(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	f.stallStatus = true
+	f.mu.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := q.status(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v; want the unanswered command given up", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("the command was given up after %v", d)
+	}
+	// The late response would be taken for that of the next command.
+	if err := q.stop(context.Background()); err == nil {
+		t.Error("the connection is used after giving up a command")
+	}
+}
+
+func TestMigrationPhases(t *testing.T) {
+	ms := time.Millisecond
+	for _, tt := range []struct {
+		changes []statusChange
+		want    *migrationPhases
+	}{
+		{
+			changes: []statusChange{{"setup", 10 * ms}, {"active", 300 * ms}, {"device", 2300 * ms}, {"completed", 2500 * ms}},
+			want:    &migrationPhases{SetupMs: 300, TransferMs: 2000, CompletionMs: 200},
+		},
+		{
+			// The completion wasn't seen between two polls.
+			changes: []statusChange{{"active", 5 * ms}, {"pre-switchover", 105 * ms}, {"device", 205 * ms}, {"completed", 305 * ms}},
+			want:    &migrationPhases{SetupMs: 5, TransferMs: 100, CompletionMs: 200},
+		},
+		{
+			changes: []statusChange{{"active", 5 * ms}, {"completed", 105 * ms}},
+			want:    &migrationPhases{SetupMs: 5, TransferMs: 100},
+		},
+		{
+			// Completed before the first poll.
+			changes: []statusChange{{"completed", 5 * ms}},
+		},
+		{
+			changes: []statusChange{{"setup", 5 * ms}, {"completed", 105 * ms}},
+		},
+	} {
+		got := migrationPhasesOf(tt.changes)
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("migrationPhasesOf(%v) = %+v; want %+v", tt.changes, got, tt.want)
+		}
+	}
+}
+
+func TestQMPMigrateRetry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	f := newFakeQMP(t)
+	f.mu.Lock()
+	f.failMigrations, f.hangMigrations = 1, 1
+	f.mu.Unlock()
+	q, err := dialQMP(ctx, "unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.migrateAttempts, q.migrateTimeout = 3, 500*time.Millisecond
+	state := filepath.Join(t.TempDir(), "vm.state")
+	if err := q.migrate(ctx, state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(state); err != nil {
+		t.Fatal(err)
+	}
+	var migrates, escalations, cancels int
+	for _, c := range f.executed() {
+		switch c {
+		case "migrate":
+			migrates++
+		case "migrate-set-parameters":
+			escalations++
+		case "migrate_cancel":
+			cancels++
+		}
+	}
+	if migrates != 3 || escalations != 2 || cancels != 1 {
+		t.Errorf("got %d migrates, %d escalations and %d cancels; want 3, 2 and 1", migrates, escalations, cancels)
+	}
+
+	f = newFakeQMP(t)
+	f.mu.Lock()
+	f.failMigrations = 3
+	f.mu.Unlock()
+	q2, err := dialQMP(ctx, "unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.Close()
+	q2.migrateAttempts, q2.migrateBackoff = 3, 100*time.Millisecond
+	start := time.Now()
+	if err := q2.migrate(ctx, state); err == nil || !strings.Contains(err.Error(), "fake failure") {
+		t.Fatalf("got %v; want the last migration error", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("3 attempts took %v; want >=300ms of backoff (100ms, 200ms)", d)
+	}
+}
+
+func TestQMPPrecheckMigration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	f := newFakeQMP(t)
+	q, err := dialQMP(ctx, "unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.precheckMigration(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := q.status(context.Background()); err != nil || st != "running" {
+		t.Fatalf("VM is left %q (%v) after the precheck; want running", st, err)
+	}
+
+	f = newFakeQMP(t)
+	f.mu.Lock()
+	f.migrationBlocker = "vhost-user"
+	f.mu.Unlock()
+	q2, err := dialQMP(ctx, "unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.Close()
+	if err := q2.precheckMigration(ctx); err == nil || !strings.Contains(err.Error(), "Migration is disabled when using feature 'vhost-user'") {
+		t.Fatalf("got %v; want the migration blocker", err)
+	}
+}
+
+func TestQMPProtocolMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sock := filepath.Join(t.TempDir(), "hmp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("QEMU 9.0.0 monitor - type 'help' for more information\r\n(qemu) "))
+			defer conn.Close()
+		}
+	}()
+	if _, err := dialQMP(ctx, "unix", sock); err == nil || !strings.Contains(err.Error(), "monitor protocol mismatch: expected QMP, got HMP") {
+		t.Fatalf("got %v; want the protocol mismatch", err)
+	}
+}
+
+func TestQMPMigrateToFD(t *testing.T) {
+	f := newFakeQMP(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q, err := dialQMP(ctx, "unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	err = q.sendFD(stdoutFDName, w)
+	w.Close() // QEMU has its own copy
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.migrateFD = stdoutFDName
+	if err := q.migrate(ctx, "/nonexistent/vm.state"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "state" {
+		t.Fatalf("read %q, %v from the passed fd; want the state", data, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// qmpEventMatcher matches the QMP event signaling readiness (-ready-qmp-event).
+type qmpEventMatcher struct {
+	name string
+	// data are the values of the event data fields (dotted paths for nested
+	// ones) that must match. Strings are compared as is, other values as
+	// JSON (e.g. true, 3).
+	data map[string]string
+}
+
+func (m *qmpEventMatcher) match(ev qmpEvent) bool {
+	if ev.Event != m.name {
+		return false
+	}
+	for path, want := range m.data {
+		raw := ev.Data
+		for _, k := range strings.Split(path, ".") {
+			var obj map[string]json.RawMessage
+			if json.Unmarshal(raw, &obj) != nil {
+				return false
+			}
+			var ok bool
+			if raw, ok = obj[k]; !ok {
+				return false
+			}
+		}
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			s = string(raw)
+		}
+		if s != want {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *qmpEventMatcher) String() string {
+	var s []string
+	for _, k := range slices.Sorted(maps.Keys(m.data)) {
+		s = append(s, k+"="+m.data[k])
+	}
+	if len(s) == 0 {
+		return m.name
+	}
+	return m.name + " (" + strings.Join(s, ", ") + ")"
+}
+
+// readEvent blocks until the next event arrives. No command may be in flight.
+func (q *qmp) readEvent() (qmpEvent, error) {
+	for {
+		var msg qmpMessage
+		if err := q.dec.Decode(&msg); err != nil {
+			return qmpEvent{}, fmt.Errorf("failed to read QMP event: %w", err)
+		}
+		if msg.Event != "" {
+			return msg.qmpEvent, nil
+		}
+	}
+}
+
+// waitQMPEvent connects to QMP at network/addr and blocks until QEMU emits an
+// event matching m or ctx is done. The connection is closed before returning
+// so that the capture can connect again.
+func waitQMPEvent(ctx context.Context, network, addr string, m *qmpEventMatcher) error {
+	q, err := dialQMP(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	// Events arriving before the handshake completed are buffered.
+	for _, ev := range q.takeEvents() {
+		if m.match(ev) {
+			return nil
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { q.conn.SetDeadline(time.Now()) })
+	defer stop()
+	for {
+		ev, err := q.readEvent()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if m.match(ev) {
+			return nil
+		}
+	}
+}
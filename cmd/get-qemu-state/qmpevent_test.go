@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestQMPEventMatcher(t *testing.T) {
+	m := &qmpEventMatcher{name: "GPIO", data: map[string]string{"line": "3", "state.level": "true", "id": "gpio0"}}
+	for _, tc := range []struct {
+		event, data string
+		want        bool
+	}{
+		{"GPIO", `{"id": "gpio0", "line": 3, "state": {"level": true}}`, true},
+		{"GPIO", `{"id": "gpio0", "line": 4, "state": {"level": true}}`, false},
+		{"GPIO", `{"id": "gpio0", "line": 3}`, false},
+		{"STOP", `{"id": "gpio0", "line": 3, "state": {"level": true}}`, false},
+	} {
+		if got := m.match(qmpEvent{Event: tc.event, Data: json.RawMessage(tc.data)}); got != tc.want {
+			t.Errorf("match(%s %s) = %v; want %v", tc.event, tc.data, got, tc.want)
+		}
+	}
+	if !(&qmpEventMatcher{name: "READY"}).match(qmpEvent{Event: "READY"}) {
+		t.Error("event without data doesn't match the name alone")
+	}
+}
+
+func TestWaitQMPEvent(t *testing.T) {
+	m := &qmpEventMatcher{name: "DEVICE_READY", data: map[string]string{"device": "sig0"}}
+	other := qmpEvent{Event: "DEVICE_READY", Data: json.RawMessage(`{"device": "other"}`)}
+	ready := qmpEvent{Event: "DEVICE_READY", Data: json.RawMessage(`{"device": "sig0"}`)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	f := newFakeQMP(t)
+	f.mu.Lock()
+	f.negotiationEvents = []qmpEvent{other, ready}
+	f.mu.Unlock()
+	if err := waitQMPEvent(ctx, "unix", f.sock, m); err != nil {
+		t.Fatalf("event during the negotiation: %v", err)
+	}
+
+	f = newFakeQMP(t)
+	f.mu.Lock()
+	f.laterEvents = []qmpEvent{other, ready}
+	f.mu.Unlock()
+	if err := waitQMPEvent(ctx, "unix", f.sock, m); err != nil {
+		t.Fatalf("event after the negotiation: %v", err)
+	}
+
+	f = newFakeQMP(t)
+	f.mu.Lock()
+	f.laterEvents = []qmpEvent{other}
+	f.mu.Unlock()
+	sctx, scancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer scancel()
+	if err := waitQMPEvent(sctx, "unix", f.sock, m); err != context.DeadlineExceeded {
+		t.Fatalf("got %v; want the wait to time out without the event", err)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ktock/container2wasm/cmd/get-qemu-state/marker"
+)
+
+// debouncer debounces a polled readiness condition (-ready-debounce): the
+// condition is met once it held at every poll for window, so that one
+// flickering while the guest starts isn't taken as readiness.
+type debouncer struct {
+	window time.Duration
+	since  time.Time // of the first of the polls the condition held at
+}
+
+// observe records a poll of the condition and reports whether it held for
+// the window. A zero window takes the first poll it holds at.
+func (d *debouncer) observe(ok bool) bool {
+	if !ok {
+		d.since = time.Time{}
+		return false
+	}
+	if d.since.IsZero() {
+		d.since = time.Now()
+	}
+	return time.Since(d.since) >= d.window
+}
+
+// waitHelper runs command through the shell every interval until it exits 0
+// at every run for debounce. A run not exiting within runTimeout (if
+// positive) is killed with its children and counts as failed. The running
+// helper and its children are killed once ctx is done.
+func waitHelper(ctx context.Context, command string, interval, runTimeout, debounce time.Duration, env []string) error {
+	d := debouncer{window: debounce}
+	for {
+		runCtx, cancel := ctx, context.CancelFunc(func() {})
+		if runTimeout > 0 {
+			runCtx, cancel = context.WithTimeout(ctx, runTimeout)
+		}
+		c := hostCommand(runCtx, command, env)
+		c.Stdout = os.Stderr // keep stdout for the console
+		c.Stderr = os.Stderr
+		err := c.Run()
+		cancel()
+		if d.observe(err == nil) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// helperEnv returns the environment describing args to -ready-cmd:
+// QEMU_HOSTFWD_<PROTO>_<GUEST PORT>=<host addr>:<host port> for each hostfwd
+// rule of the user-mode network and QEMU_SHARED_DIR_<MOUNT TAG>=<path> for
+// each 9p export. Names are upper-cased with characters other than letters,
+// digits and underscores replaced by underscores.
+func helperEnv(args []string) []string {
+	var env []string
+	fsdevs := make(map[string]string) // id -> path
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-fsdev" {
+			id, _ := option(args[i+1], "id")
+			fsdevs[id], _ = option(args[i+1], "path")
+		}
+	}
+	for i := 0; i < len(args)-1; i++ {
+		v := args[i+1]
+		switch args[i] {
+		case "-netdev", "-nic":
+			if v != "user" && !strings.HasPrefix(v, "user,") {
+				continue
+			}
+			for _, o := range strings.Split(v, ",") {
+				rule, ok := strings.CutPrefix(o, "hostfwd=")
+				if !ok {
+					continue
+				}
+				// [tcp|udp]:[hostaddr]:hostport-[guestaddr]:guestport
+				proto, rest, ok := strings.Cut(rule, ":")
+				if !ok {
+					continue
+				}
+				host, guest, ok := strings.Cut(rest, "-")
+				if !ok {
+					continue
+				}
+				if proto == "" {
+					proto = "tcp"
+				}
+				if strings.HasPrefix(host, ":") {
+					host = "127.0.0.1" + host
+				}
+				guestPort := guest[strings.LastIndex(guest, ":")+1:]
+				env = append(env, fmt.Sprintf("QEMU_HOSTFWD_%s_%s=%s", envName(proto), envName(guestPort), host))
+			}
+		case "-virtfs":
+			tag, _ := option(v, "mount_tag")
+			path, _ := option(v, "path")
+			env = append(env, fmt.Sprintf("QEMU_SHARED_DIR_%s=%s", envName(tag), path))
+		case "-device":
+			if fsdev, ok := option(v, "fsdev"); ok {
+				tag, _ := option(v, "mount_tag")
+				env = append(env, fmt.Sprintf("QEMU_SHARED_DIR_%s=%s", envName(tag), fsdevs[fsdev]))
+			}
+		}
+	}
+	return env
+}
+
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// waitSettled blocks until the guest has been up for at least upFor since
+// start and its console has been quiet for at least quietFor, for debounce.
+// Both conditions must hold at the same time; output resets the quiet period
+// even after upFor elapsed.
+func waitSettled(ctx context.Context, con *console, start time.Time, upFor, quietFor, debounce time.Duration) error {
+	const pollInterval = 50 * time.Millisecond
+	d := debouncer{window: debounce}
+	for {
+		if d.observe(time.Since(start) >= upFor && con.quietFor() >= quietFor) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// waitQuiet blocks until the console has printed at least minBytes and then
+// had no output for quietFor, for debounce.
+func waitQuiet(ctx context.Context, con *console, quietFor time.Duration, minBytes int64, debounce time.Duration) error {
+	const pollInterval = 50 * time.Millisecond
+	d := debouncer{window: debounce}
+	for {
+		if d.observe(con.written() >= minBytes && con.quietFor() >= quietFor) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// readiness is what the readiness conditions of a capture are watched
+// through.
+type readiness struct {
+	ctx       context.Context // done once the guest is ready or the boot timed out
+	con       *console
+	start     time.Time // of QEMU
+	args      []string
+	restoring bool // the VM restores a state instead of booting
+
+	tcpAddr, httpURL        string    // the host ends of -wait-tcp-guest and -ready-http
+	agentNetwork, agentAddr string    // of the guest agent, for -wait-guest-agent
+	consolePath             string    // promised to -ready-helper
+	markerR                 io.Reader // the marker port, with -marker-fd
+
+	pidKnown <-chan struct{}
+	qemuPID  *int        // set before pidKnown is closed
+	icount   *icountInfo // records the instructions run, with -ready-instructions
+
+	// ready starts the snapshot for reason and fail fails the capture.
+	ready func(reason string)
+	fail  func(err error)
+}
+
+// watchReadiness starts watching the readiness conditions of cfg, calling
+// r.ready once one is met (at once when restoring). It reports whether the
+// console markers signal readiness instead, which the caller scans the
+// console for; with -marker-fd, the marker port is watched here.
+func (cfg *config) watchReadiness(r readiness) (useMarker bool) {
+	settled := cfg.settledAfter > 0 || cfg.quietFor > 0
+	waitLoginPrompt := len(cfg.loginPrompts) > 0
+	useMarker = r.tcpAddr == "" && r.httpURL == "" && !cfg.waitGuestAgent && cfg.readyQMPEvent == nil && cfg.readyHelper == "" && !settled && !waitLoginPrompt && cfg.readyOnQuiet == 0 && cfg.readyInstructions == 0 && !r.restoring
+	if cfg.resume {
+		r.ready("restoring checkpoint")
+	} else if cfg.fromState != "" {
+		r.ready("restoring the base state")
+	} else if r.restoring {
+		r.ready("restoring the full state")
+	}
+	if cfg.readyHelper != "" {
+		go func() {
+			<-r.pidKnown
+			env := []string{
+				fmt.Sprintf("QEMU_PID=%d", *r.qemuPID),
+				"QEMU_CONSOLE_LOG=" + r.consolePath,
+			}
+			env = append(env, helperEnv(r.args)...)
+			if err := waitHelper(r.ctx, cfg.readyHelper, cfg.readyHelperInterval, cfg.readyHelperTimeout, cfg.readyDebounce, env); err != nil {
+				return // reported by the boot timeout
+			}
+			r.ready("ready helper succeeded")
+		}()
+	}
+	if settled {
+		go func() {
+			if err := waitSettled(r.ctx, r.con, r.start, cfg.settledAfter, cfg.quietFor, cfg.readyDebounce); err != nil {
+				return // reported by the boot timeout
+			}
+			r.ready(fmt.Sprintf("guest has been up for %v and quiet for %v", cfg.settledAfter, cfg.quietFor))
+		}()
+	}
+	if cfg.readyOnQuiet > 0 {
+		go func() {
+			if err := waitQuiet(r.ctx, r.con, cfg.readyOnQuiet, cfg.readyOnQuietMin, cfg.readyDebounce); err != nil {
+				return // reported by the boot timeout
+			}
+			r.ready(fmt.Sprintf("console has been quiet for %v after %d bytes", cfg.readyOnQuiet, r.con.written()))
+		}()
+	}
+	if waitLoginPrompt {
+		go func() {
+			if err := waitLogin(r.ctx, r.con, cfg.loginPrompts); err != nil {
+				return // reported by the boot timeout
+			}
+			r.ready(fmt.Sprintf("guest is at a prompt (%q)", r.con.unfinishedLine()))
+		}()
+	}
+	if r.tcpAddr != "" {
+		go func() {
+			if err := waitTCP(r.ctx, r.tcpAddr, 500*time.Millisecond, cfg.readyDebounce); err != nil {
+				return // reported by the boot timeout
+			}
+			r.ready(fmt.Sprintf("guest port %d is accepting connections", cfg.waitTCPGuest))
+		}()
+	}
+	if cfg.waitGuestAgent {
+		go func() {
+			if err := waitGuestAgent(r.ctx, r.agentNetwork, r.agentAddr, cfg.readyDebounce); err != nil {
+				return // reported by the boot timeout
+			}
+			r.ready("guest agent is responsive")
+		}()
+	}
+	if cfg.readyQMPEvent != nil {
+		go func() {
+			network, addr, _ := qmpAddr(r.args)
+			if err := waitQMPEvent(r.ctx, network, addr, cfg.readyQMPEvent); err != nil {
+				if r.ctx.Err() == nil {
+					r.fail(fmt.Errorf("failed to wait for QMP event %s: %w", cfg.readyQMPEvent, err))
+				}
+				return
+			}
+			r.ready(fmt.Sprintf("QEMU emitted %s", cfg.readyQMPEvent))
+		}()
+	}
+	if cfg.readyInstructions > 0 && !r.restoring {
+		go func() {
+			network, addr, _ := qmpAddr(r.args)
+			n, err := waitInstructions(r.ctx, network, addr, cfg.readyInstructions)
+			if err != nil {
+				if r.ctx.Err() == nil {
+					r.fail(fmt.Errorf("failed to wait for %d instructions: %w", cfg.readyInstructions, err))
+				}
+				return
+			}
+			r.icount.ReadyInstructions = n
+			r.ready(fmt.Sprintf("guest ran %d instructions", n))
+		}()
+	}
+	if r.httpURL != "" {
+		go func() {
+			if err := waitHTTP(r.ctx, r.httpURL, cfg.readyHTTPMatch, 500*time.Millisecond, cfg.readyDebounce); err != nil {
+				return // reported by the boot timeout
+			}
+			r.ready(fmt.Sprintf("guest %s is healthy", cfg.readyHTTP))
+		}()
+	}
+
+	if useMarker && cfg.markerFD {
+		go func() {
+			// The port isn't a terminal; what the guest writes arrives as
+			// is, without line endings to normalize.
+			var n int
+			var end int64 // of the last counted match, which don't overlap
+			mr := marker.NewReader(r.markerR, cfg.markers, func(m string, offset int64) {
+				if offset < end || n >= cfg.markerCount {
+					return
+				}
+				n, end = n+1, offset+int64(len(m))
+				cfg.logger.Printf("marker %q matched on the marker port (%d/%d)", m, n, cfg.markerCount)
+				if n == cfg.markerCount {
+					r.ready("detected marker on the marker port")
+				}
+			})
+			io.Copy(io.Discard, mr) // until QEMU exits
+		}()
+	}
+	return useMarker
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitHelper(t *testing.T) {
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	time.AfterFunc(300*time.Millisecond, func() {
+		if err := os.WriteFile(readyFile, nil, 0600); err != nil {
+			t.Errorf("failed to create ready file: %v", err)
+		}
+	})
+	start := time.Now()
+	err := waitHelper(context.Background(), `test -e "$READY_FILE"`, 50*time.Millisecond, 0, 0, []string{"READY_FILE=" + readyFile})
+	if err != nil {
+		t.Fatalf("helper failed: %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("helper succeeded too early (%v)", d)
+	}
+}
+
+func TestWaitHelperDebounce(t *testing.T) {
+	// The helper flickers (succeeds every other run) for its first 6 runs,
+	// then keeps succeeding.
+	count := filepath.Join(t.TempDir(), "count")
+	helper := `n=$(cat "$COUNT" 2>/dev/null || echo 0); n=$((n+1)); echo $n > "$COUNT"; [ $n -ge 8 ] || [ $((n % 2)) -eq 1 ]`
+	start := time.Now()
+	if err := waitHelper(context.Background(), helper, 50*time.Millisecond, 0, 300*time.Millisecond, []string{"COUNT=" + count}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := strconv.Atoi(strings.TrimSpace(string(data))); n <= 7 {
+		t.Errorf("ready after %d runs; want the flickering runs ignored", n)
+	}
+	if d := time.Since(start); d < 6*50*time.Millisecond+300*time.Millisecond {
+		t.Errorf("ready after %v; want the stable runs for 300ms", d)
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	d := debouncer{}
+	if !d.observe(true) {
+		t.Fatal("no window: want the first success taken")
+	}
+	d = debouncer{window: 100 * time.Millisecond}
+	if d.observe(true) {
+		t.Fatal("taken before the window")
+	}
+	time.Sleep(120 * time.Millisecond)
+	if d.observe(false) || d.observe(true) {
+		t.Fatal("a failure must restart the window")
+	}
+	time.Sleep(120 * time.Millisecond)
+	if !d.observe(true) {
+		t.Fatal("not taken after holding for the window")
+	}
+}
+
+func TestWaitHelperTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := waitHelper(ctx, "sleep 10", 50*time.Millisecond, 0, 0, nil); err == nil {
+		t.Fatalf("helper must fail on timeout")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("helper wasn't killed on timeout (took %v)", d)
+	}
+}
+
+func TestWaitHelperRunTimeout(t *testing.T) {
+	// The first run hangs; the next one succeeds.
+	dir := t.TempDir()
+	helper := `if [ -e "$DIR/ran" ]; then exit 0; fi; touch "$DIR/ran"; sleep 10`
+	start := time.Now()
+	if err := waitHelper(context.Background(), helper, 50*time.Millisecond, 200*time.Millisecond, 0, []string{"DIR=" + dir}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("the hung run wasn't killed (took %v)", d)
+	}
+}
+
+func TestWaitSettled(t *testing.T) {
+	con := newConsole(io.Discard)
+	start := time.Now()
+	// The guest prints for 500ms, longer than the minimum uptime.
+	printed := make(chan struct{})
+	go func() {
+		defer close(printed)
+		for time.Since(start) < 500*time.Millisecond {
+			con.Write([]byte("booting\n"))
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	err := waitSettled(context.Background(), con, start, 300*time.Millisecond, 200*time.Millisecond, 0)
+	d := time.Since(start)
+	<-printed
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d < 700*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("settled after %v; want ~700ms (last output + quiet period)", d)
+	}
+
+	// A console quiet from the beginning still waits for the uptime.
+	quietStart := time.Now()
+	if err := waitSettled(context.Background(), newConsole(io.Discard), quietStart, 300*time.Millisecond, 10*time.Millisecond, 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(quietStart); d < 300*time.Millisecond {
+		t.Fatalf("settled after %v; want >=300ms", d)
+	}
+}
+
+func TestWaitQuiet(t *testing.T) {
+	// A console that never printed isn't taken as quiet.
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := waitQuiet(ctx, newConsole(io.Discard), 50*time.Millisecond, 1, 0); err == nil {
+		t.Fatal("silent console is taken as ready")
+	}
+
+	con := newConsole(io.Discard)
+	start := time.Now()
+	// A short banner, a pause and then the boot log.
+	go func() {
+		con.Write([]byte("BIOS\n"))
+		time.Sleep(300 * time.Millisecond)
+		for i := 0; i < 10; i++ {
+			con.Write([]byte("[    0.000000] booting\n"))
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	if err := waitQuiet(context.Background(), con, 200*time.Millisecond, 100, 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 700*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("quiet after %v; want ~700ms (boot log + quiet period, not the pause after the banner)", d)
+	}
+}
+
+func TestHelperEnv(t *testing.T) {
+	args := []string{
+		"-m", "512M",
+		"-netdev", "user,id=net0,hostfwd=tcp:127.0.0.1:18080-:8080,hostfwd=udp::15353-10.0.2.15:53",
+		"-virtfs", "local,path=/srv/share,mount_tag=host-share,security_model=none",
+		"-fsdev", "local,id=fs1,path=/srv/data,security_model=none",
+		"-device", "virtio-9p-pci,fsdev=fs1,mount_tag=data",
+	}
+	want := []string{
+		"QEMU_HOSTFWD_TCP_8080=127.0.0.1:18080",
+		"QEMU_HOSTFWD_UDP_53=127.0.0.1:15353",
+		"QEMU_SHARED_DIR_HOST_SHARE=/srv/share",
+		"QEMU_SHARED_DIR_DATA=/srv/data",
+	}
+	if got := helperEnv(args); !slices.Equal(got, want) {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// guestHTTPPort returns the guest port addressed by the -ready-http URL.
+func guestHTTPPort(u *url.URL) (int, error) {
+	p := u.Port()
+	if p == "" {
+		switch u.Scheme {
+		case "http":
+			return 80, nil
+		case "https":
+			return 443, nil
+		}
+		return 0, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return strconv.Atoi(p)
+}
+
+// forwardedURL returns u with its host replaced by the loopback address
+// forwarded to the guest at hostPort.
+func forwardedURL(u *url.URL, hostPort int) string {
+	f := *u
+	f.Host = net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort))
+	return f.String()
+}
+
+// waitHTTP polls rawURL until it responds with a 2xx status and a body
+// matching match (if not nil) at every poll for debounce. Errors such as a
+// refused connection while the guest starts are retried.
+func waitHTTP(ctx context.Context, rawURL string, match *regexp.Regexp, interval, debounce time.Duration) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	d := debouncer{window: debounce}
+	for {
+		err := httpReady(ctx, client, rawURL, match)
+		if d.observe(err == nil) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				return fmt.Errorf("%s didn't stay healthy for %v: %w", rawURL, debounce, ctx.Err())
+			}
+			return fmt.Errorf("%s isn't ready (%v): %w", rawURL, err, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+func httpReady(ctx context.Context, client *http.Client, rawURL string, match *regexp.Regexp) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	if match != nil && !match.Match(body) {
+		return fmt.Errorf("body doesn't match %q", match)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestWaitHTTP(t *testing.T) {
+	port, err := freeTCPPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	// Nothing listens at first, then the service starts unhealthy.
+	time.AfterFunc(300*time.Millisecond, func() {
+		l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Errorf("failed to listen: %v", err)
+			return
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch d := time.Since(start); {
+			case d < 600*time.Millisecond:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case d < 900*time.Millisecond:
+				fmt.Fprint(w, `{"status":"starting"}`)
+			default:
+				fmt.Fprint(w, `{"status":"ok"}`)
+			}
+		})}
+		go srv.Serve(l)
+		t.Cleanup(func() { srv.Close() })
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	u := fmt.Sprintf("http://127.0.0.1:%d/healthz", port)
+	if err := waitHTTP(ctx, u, regexp.MustCompile(`"status": *"ok"`), 50*time.Millisecond, 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Fatalf("ready after %v; want >=900ms (healthy body)", d)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := waitHTTP(ctx, u, regexp.MustCompile(`never`), 50*time.Millisecond, 0); err == nil {
+		t.Fatal("unmatched body is taken as ready")
+	}
+}
+
+func TestForwardedURL(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		port int
+		want string
+	}{
+		{"http://guest:8080/healthz", 8080, "http://127.0.0.1:4000/healthz"},
+		{"https://guest/ready?x=1", 443, "https://127.0.0.1:4000/ready?x=1"},
+		{"http://guest/", 80, "http://127.0.0.1:4000/"},
+	} {
+		u, err := url.Parse(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port, err := guestHTTPPort(u); err != nil || port != tt.port {
+			t.Errorf("%s: guest port %d, %v; want %d", tt.in, port, err, tt.port)
+		}
+		if got := forwardedURL(u, 4000); got != tt.want {
+			t.Errorf("%s: forwarded to %s; want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// writeRepro writes a shell script running QEMU the way the failed capture
+// did, for reproducing the failure by hand.
+func writeRepro(path, qemu string, args, origArgs []string, phase string, failure error) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n")
+	fmt.Fprintf(&b, "# get-qemu-state failed while %s: %s\n", phase, strings.ReplaceAll(failure.Error(), "\n", "\n# "))
+	fmt.Fprintf(&b, "# The args below include the flags added by get-qemu-state. The args given to it were:\n")
+	fmt.Fprintf(&b, "#   %s\n", shellJoin(origArgs))
+	fmt.Fprintf(&b, "# The guest console and the monitor (Ctrl-A c) are on stdio.\n")
+	if slices.ContainsFunc(args, func(a string) bool { return strings.Contains(a, redacted) }) {
+		fmt.Fprintf(&b, "# Secrets in the args are replaced with %s; put them back (or pass them with -object secret,file=) to run it.\n", redacted)
+	}
+	fmt.Fprintf(&b, "cd %s || exit 1\n", shellQuote(wd))
+	fmt.Fprintf(&b, "exec %s\n", shellJoin(append([]string{qemu}, args...)))
+	return os.WriteFile(path, []byte(b.String()), 0755)
+}
+
+func shellJoin(args []string) string {
+	q := make([]string, len(args))
+	for i, a := range args {
+		q[i] = shellQuote(a)
+	}
+	return strings.Join(q, " ")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteRepro(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "repro.sh")
+	args := []string{`%s\n`, "-append", "console=ttyS0 init=/sbin/tini -- /sbin/init", "it's", `"$HOME"`, ""}
+	if err := writeRepro(p, "printf", args, args[1:3], "booting", errors.New("guest didn't become ready\nsecond line")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "failed while booting: guest didn't become ready\n# second line\n") {
+		t.Errorf("failure isn't noted:\n%s", data)
+	}
+	out, err := exec.Command(p).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"), args[1:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("script ran with %q; want %q", got, want)
+	}
+}
+
+func TestCaptureReproOnFailure(t *testing.T) {
+	t.Setenv("STUB_QEMU_SILENT_FOR", "5s")
+	cfg := stubConfig(t)
+	cfg.firstOutputTimeout = 200 * time.Millisecond
+	cfg.reproOnFailure = true
+	if _, err := capture(cfg); err == nil {
+		t.Fatal("capture succeeded")
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(cfg.output), "repro.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); !strings.Contains(s, "failed while booting") || !strings.Contains(s, shellJoin(append([]string{cfg.qemu}, cfg.args...))) {
+		t.Errorf("unexpected script:\n%s", s)
+	}
+}
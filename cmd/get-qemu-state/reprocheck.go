@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+)
+
+// reproReport compares two states captured the same way, e.g. to check that
+// -icount captures are reproducible.
+type reproReport struct {
+	Old       string `json:"old"`
+	New       string `json:"new"`
+	OldBytes  int64  `json:"oldBytes"`
+	NewBytes  int64  `json:"newBytes"`
+	Identical bool   `json:"identical"`
+	// DifferingBytes counts the offsets the states differ at, the bytes
+	// past the end of the shorter one included.
+	DifferingBytes int64 `json:"differingBytes"`
+	// FirstDifference is the offset of the first differing byte, -1 if
+	// the states are identical.
+	FirstDifference int64 `json:"firstDifference"`
+	// Sections are the differing sections, the most differing first. They
+	// are left out if a state can't be parsed (ParseError).
+	Sections   []sectionDiff `json:"sections,omitempty"`
+	ParseError string        `json:"parseError,omitempty"`
+}
+
+// sectionDiff compares the bytes of a section (its chunks concatenated) in
+// two states. A section missing in a state has no bytes there.
+type sectionDiff struct {
+	Name           string `json:"name"`
+	OldBytes       int64  `json:"oldBytes"`
+	NewBytes       int64  `json:"newBytes"`
+	DifferingBytes int64  `json:"differingBytes"`
+}
+
+// compareStates compares the states at oldPath and newPath byte for byte,
+// and section by section if they differ.
+func compareStates(oldPath, newPath string) (*reproReport, error) {
+	oldF, err := os.Open(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	defer oldF.Close()
+	newF, err := os.Open(newPath)
+	if err != nil {
+		return nil, err
+	}
+	defer newF.Close()
+	r := &reproReport{Old: oldPath, New: newPath}
+	if r.OldBytes, err = fileSize(oldF); err != nil {
+		return nil, err
+	}
+	if r.NewBytes, err = fileSize(newF); err != nil {
+		return nil, err
+	}
+	r.DifferingBytes, r.FirstDifference, err = countDifferences(io.NewSectionReader(oldF, 0, r.OldBytes), io.NewSectionReader(newF, 0, r.NewBytes))
+	if err != nil {
+		return nil, err
+	}
+	r.Identical = r.DifferingBytes == 0
+	if r.Identical {
+		return r, nil
+	}
+
+	oldChunks, err := stateChunks(oldF)
+	if err != nil {
+		r.ParseError = fmt.Sprintf("%s: %v", oldPath, err)
+		return r, nil
+	}
+	newChunks, err := stateChunks(newF)
+	if err != nil {
+		r.ParseError = fmt.Sprintf("%s: %v", newPath, err)
+		return r, nil
+	}
+	var names []string
+	for _, c := range append(slices.Clone(oldChunks), newChunks...) {
+		if !slices.Contains(names, c.name) {
+			names = append(names, c.name)
+		}
+	}
+	for _, name := range names {
+		oldR, oldN := sectionReader(oldF, oldChunks, name)
+		newR, newN := sectionReader(newF, newChunks, name)
+		n, _, err := countDifferences(oldR, newR)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			r.Sections = append(r.Sections, sectionDiff{Name: name, OldBytes: oldN, NewBytes: newN, DifferingBytes: n})
+		}
+	}
+	slices.SortStableFunc(r.Sections, func(a, b sectionDiff) int { return cmp.Compare(b.DifferingBytes, a.DifferingBytes) })
+	return r, nil
+}
+
+func fileSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// sectionReader returns a reader of the chunks of section name in f and
+// their size.
+func sectionReader(f *os.File, chunks []streamChunk, name string) (io.Reader, int64) {
+	var (
+		rs   []io.Reader
+		size int64
+	)
+	for _, c := range chunks {
+		if c.name == name {
+			rs = append(rs, io.NewSectionReader(f, c.off, c.size))
+			size += c.size
+		}
+	}
+	return io.MultiReader(rs...), size
+}
+
+// countDifferences returns the number of offsets a and b differ at, the
+// bytes past the end of the shorter one included, and the first of them (-1
+// if none).
+func countDifferences(a, b io.Reader) (n, first int64, err error) {
+	first = -1
+	bufA, bufB := make([]byte, 64<<10), make([]byte, 64<<10)
+	var off int64
+	for {
+		na, errA := io.ReadFull(a, bufA)
+		nb, errB := io.ReadFull(b, bufB)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return 0, 0, errA
+		}
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return 0, 0, errB
+		}
+		common := min(na, nb)
+		if !bytes.Equal(bufA[:common], bufB[:common]) {
+			for i := 0; i < common; i++ {
+				if bufA[i] != bufB[i] {
+					if first < 0 {
+						first = off + int64(i)
+					}
+					n++
+				}
+			}
+		}
+		if na != nb {
+			if first < 0 {
+				first = off + int64(common)
+			}
+			n += int64(max(na, nb) - common)
+		}
+		off += int64(max(na, nb))
+		if errA != nil && errB != nil {
+			return n, first, nil
+		}
+	}
+}
+
+// writeReproReport writes r for humans.
+func writeReproReport(w io.Writer, r *reproReport) error {
+	if r.Identical {
+		_, err := fmt.Fprintf(w, "%s and %s are byte-identical (%d bytes)\n", r.Old, r.New, r.OldBytes)
+		return err
+	}
+	fmt.Fprintf(w, "%s (%d bytes) and %s (%d bytes) differ in %d bytes, the first at offset %d\n", r.Old, r.OldBytes, r.New, r.NewBytes, r.DifferingBytes, r.FirstDifference)
+	if r.ParseError != "" {
+		_, err := fmt.Fprintf(w, "can't break the difference down by section: %s\n", r.ParseError)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "DIFFERING\tOLD\tNEW\t SECTION\n")
+	for _, s := range r.Sections {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t %s\n", s.DifferingBytes, s.OldBytes, s.NewBytes, s.Name)
+	}
+	return tw.Flush()
+}
+
+// errStatesDiffer is returned by runReproCheck after reporting differing
+// states, for a nonzero exit status.
+var errStatesDiffer = errors.New("the states differ")
+
+func runReproCheck(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("repro-check", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("specify the two state files to compare")
+	}
+	r, err := compareStates(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	} else {
+		err = writeReproReport(w, r)
+	}
+	if err != nil {
+		return err
+	}
+	if !r.Identical {
+		return errStatesDiffer
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// reproState writes a state fixture with ram (in two parts) and a serial
+// section to a temporary file.
+func reproState(t *testing.T, ram []byte, serial []byte) string {
+	var b stateBuilder
+	b.u32(vmFileMagic)
+	b.u32(vmFileVersion)
+	b.section(vmSectionStart, 2, "ram", 0, make([]byte, 100), true)
+	b.section(vmSectionPart, 2, "", 0, ram, true)
+	b.section(vmSectionFull, 3, "serial", 0, serial, true)
+	b.section(vmSectionEnd, 2, "", 0, make([]byte, 8), true)
+	b.WriteByte(vmEOF)
+	p := filepath.Join(t.TempDir(), "vm.state")
+	if err := os.WriteFile(p, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestReproCheckIdentical(t *testing.T) {
+	ram := bytes.Repeat([]byte{0xaa}, 100<<10) // more than a read buffer
+	old, new := reproState(t, ram, make([]byte, 10)), reproState(t, ram, make([]byte, 10))
+	var out bytes.Buffer
+	if err := runReproCheck([]string{old, new}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "are byte-identical") {
+		t.Errorf("got %q; want the states reported identical", out.String())
+	}
+}
+
+func TestReproCheckDivergent(t *testing.T) {
+	ram := bytes.Repeat([]byte{0xaa}, 100<<10)
+	changed := bytes.Clone(ram)
+	changed[10] = 0
+	changed[80<<10] = 0 // in the second read buffer
+	changed[len(changed)-1] = 0
+	old := reproState(t, ram, make([]byte, 10))
+	new := reproState(t, changed, make([]byte, 12))
+
+	var out bytes.Buffer
+	if err := runReproCheck([]string{"-json", old, new}, &out); !errors.Is(err, errStatesDiffer) {
+		t.Fatalf("got %v; want the states reported differing", err)
+	}
+	var r reproReport
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	// The serial section differs most as its footer shifts by the 2 bytes.
+	if r.Identical || len(r.Sections) != 2 {
+		t.Fatalf("got %+v; want ram and serial reported", r)
+	}
+	if s := r.Sections[0]; s.Name != "serial" || s.NewBytes-s.OldBytes != 2 || s.DifferingBytes < 2 {
+		t.Errorf("got %+v; want serial 2 bytes longer", s)
+	}
+	if s := r.Sections[1]; s.Name != "ram" || s.OldBytes != s.NewBytes || s.DifferingBytes != 3 {
+		t.Errorf("got %+v; want the 3 changed ram bytes", s)
+	}
+	if r.NewBytes-r.OldBytes != 2 || r.FirstDifference < 0 {
+		t.Errorf("got sizes %d, %d and first difference %d", r.OldBytes, r.NewBytes, r.FirstDifference)
+	}
+
+	out.Reset()
+	runReproCheck([]string{old, new}, &out)
+	for _, s := range []string{"differ in", " ram\n", " serial\n"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("human report doesn't contain %q:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestReproCheckUnparsable(t *testing.T) {
+	dir := t.TempDir()
+	old, new := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	os.WriteFile(old, []byte("not a state"), 0644)
+	os.WriteFile(new, []byte("not a state!"), 0644)
+	r, err := compareStates(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Identical || r.DifferingBytes != 1 || r.FirstDifference != 11 || r.ParseError == "" || r.Sections != nil {
+		t.Errorf("got %+v; want the trailing byte reported without sections", r)
+	}
+}
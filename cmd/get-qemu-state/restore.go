@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+// measureRestore restores state with QEMU started with args (those of the
+// capture) and returns the time from the start until the VM runs. The
+// restored VM is quit right away.
+func measureRestore(ctx context.Context, qemu string, args []string, state string, logger *log.Logger) (_ time.Duration, err error) {
+	cmd := exec.Command(qemu, append(slices.Clone(args), "-incoming", "file:"+state)...)
+	cmd.WaitDelay = time.Second
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	con := newConsole(io.Discard)
+	cmd.Stdout = con
+	stderrTail := &tailBuffer{max: 2048}
+	cmd.Stderr = stderrTail
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		if err != nil {
+			cmd.Process.Kill()
+			<-exited
+			err = fmt.Errorf("%w; stderr:\n%s", err, stderrTail)
+		}
+	}()
+
+	var m monitor = &hmp{w: stdin, con: con}
+	if network, addr, ok := qmpAddr(args); ok {
+		q, err := dialQMP(ctx, network, addr)
+		if err != nil {
+			return 0, err
+		}
+		defer q.Close()
+		m = q
+	}
+	if err := m.waitRunning(ctx); err != nil {
+		return 0, err
+	}
+	d := time.Since(start)
+	if err := m.quit(); err != nil {
+		return 0, err
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			logger.Printf("WARNING: restored QEMU exited with an error: %v", err)
+		}
+	case <-ctx.Done():
+		return 0, fmt.Errorf("restored QEMU didn't quit: %w", ctx.Err())
+	}
+	return d, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readGzip(t *testing.T, path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+	r, err := createRotatingFile(path, 100, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines [][]byte
+	for i := 0; i < 50; i++ {
+		l := []byte(fmt.Sprintf("line %02d of the console\n", i)) // 24 bytes
+		lines = append(lines, l)
+		if _, err := r.Write(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 4 lines fit in a segment. The last 2 lines are in the current file and
+	// the 3 kept segments hold the 12 lines before them.
+	var got []byte
+	for i := 3; i >= 1; i-- {
+		got = append(got, readGzip(t, fmt.Sprintf("%s.%d.gz", path, i))...)
+	}
+	cur, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, cur...)
+	if want := bytes.Join(lines[36:], nil); !bytes.Equal(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if _, err := os.Stat(path + ".4.gz"); !os.IsNotExist(err) {
+		t.Errorf("more segments than kept: %v", err)
+	}
+}
+
+func TestRotatingFileDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+	r, err := createRotatingFile(path, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), 1000)
+	r.Write(data)
+	r.Close()
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("rotated without -log-rotate-bytes: %v", err)
+	}
+	if m, _ := filepath.Glob(path + ".*"); len(m) != 0 {
+		t.Fatalf("unexpected segments %v", m)
+	}
+}
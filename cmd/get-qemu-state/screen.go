@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The VGA text mode buffer: 80x25 cells of a character byte and an attribute
+// byte each.
+const (
+	vgaTextAddr = 0xb8000
+	vgaCols     = 80
+	vgaRows     = 25
+)
+
+// screenText returns the text on the guest VGA screen. It's empty if the
+// display isn't in text mode (or there's no VGA at all).
+func screenText(ctx context.Context, m monitor, tempDir string) (string, error) {
+	p := filepath.Join(tempDir, "screen.bin")
+	if err := m.pmemsave(ctx, vgaTextAddr, vgaCols*vgaRows*2, p); err != nil {
+		return "", err
+	}
+	mem, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	return vgaText(mem), nil
+}
+
+// vgaText decodes a VGA text buffer. Characters other than printable ASCII
+// (e.g. CP437 line drawing) become spaces, trailing spaces and empty lines are
+// trimmed.
+func vgaText(mem []byte) string {
+	var lines []string
+	for r := 0; r < vgaRows && (r+1)*vgaCols*2 <= len(mem); r++ {
+		row := mem[r*vgaCols*2 : (r+1)*vgaCols*2]
+		var b strings.Builder
+		for c := 0; c < vgaCols; c++ {
+			ch := row[c*2]
+			if ch < 0x20 || ch > 0x7e {
+				ch = ' '
+			}
+			b.WriteByte(ch)
+		}
+		lines = append(lines, strings.TrimRight(b.String(), " "))
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// vgaBuffer returns a VGA text buffer showing lines in light gray.
+func vgaBuffer(lines ...string) []byte {
+	mem := make([]byte, vgaCols*vgaRows*2)
+	for i := 0; i < len(mem); i += 2 {
+		mem[i], mem[i+1] = ' ', 0x07
+	}
+	for r, l := range lines {
+		for c := 0; c < len(l); c++ {
+			mem[(r*vgaCols+c)*2] = l[c]
+		}
+	}
+	return mem
+}
+
+func TestVGAText(t *testing.T) {
+	mem := vgaBuffer("Welcome to the guest", "", "\xc9\xcd\xbb login: ")
+	if got, want := vgaText(mem), "Welcome to the guest\n\n    login:"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got := vgaText(make([]byte, vgaCols*vgaRows*2)); got != "" {
+		t.Errorf("blank memory gives %q", got)
+	}
+}
+
+func TestScreenText(t *testing.T) {
+	f := newFakeQMP(t)
+	f.memory = vgaBuffer("SeaBIOS", "Booting from ROM...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q, err := dialQMP(ctx, "unix", f.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	text, err := screenText(ctx, q, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SeaBIOS\nBooting from ROM..."; text != want {
+		t.Errorf("got %q; want %q", text, want)
+	}
+}
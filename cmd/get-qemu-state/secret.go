@@ -0,0 +1,113 @@
+package main
+
+import (
+	"cmp"
+	"io"
+	"slices"
+	"strings"
+)
+
+// redacted replaces the secrets of args in the logs, -manifest, -print-config
+// and the -repro-on-failure script.
+const redacted = "REDACTED"
+
+// argSecrets returns the secrets given inline in args: the data of secret
+// objects (-object secret,id=...,data=...) and passwords (e.g. -spice
+// password=...). -secret-file passes a secret to QEMU without args holding
+// it.
+func argSecrets(args []string) []string {
+	var res []string
+	for i, a := range args {
+		isSecret := i > 0 && (args[i-1] == "-object" || args[i-1] == "--object") &&
+			(strings.HasPrefix(a, "secret,") || strings.Contains(","+a+",", ",qom-type=secret,"))
+		for _, o := range strings.Split(a, ",") {
+			k, v, ok := strings.Cut(o, "=")
+			if !ok || v == "" {
+				continue
+			}
+			if (k == "data" && isSecret) || (k == "password" && v != "on" && v != "off") {
+				res = append(res, v)
+			}
+		}
+	}
+	return res
+}
+
+// redactor replaces secrets in text. The zero value replaces nothing.
+type redactor struct {
+	r *strings.Replacer
+}
+
+// newRedactor returns a redactor of secrets, the longest first so that a
+// secret containing another one is replaced as a whole.
+func newRedactor(secrets []string) redactor {
+	secrets = slices.DeleteFunc(slices.Clone(secrets), func(s string) bool { return s == "" })
+	if len(secrets) == 0 {
+		return redactor{}
+	}
+	slices.SortFunc(secrets, func(a, b string) int { return cmp.Compare(len(b), len(a)) })
+	var oldnew []string
+	for _, s := range secrets {
+		oldnew = append(oldnew, s, redacted)
+	}
+	return redactor{strings.NewReplacer(oldnew...)}
+}
+
+func (r redactor) String(s string) string {
+	if r.r == nil {
+		return s
+	}
+	return r.r.Replace(s)
+}
+
+// args returns a copy of args with the secrets replaced.
+func (r redactor) args(args []string) []string {
+	res := make([]string, len(args))
+	for i, a := range args {
+		res[i] = r.String(a)
+	}
+	return res
+}
+
+// error returns err with the secrets replaced in its message. The result
+// still unwraps to err.
+func (r redactor) error(err error) error {
+	if err == nil || r.r == nil {
+		return err
+	}
+	return &redactedError{msg: r.r.Replace(err.Error()), err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// writer returns w replacing the secrets in each write. Secrets split across
+// writes aren't replaced; the log package writes a line at once.
+func (r redactor) writer(w io.Writer) io.Writer {
+	if r.r == nil {
+		return w
+	}
+	return &redactWriter{r: r.r, w: w}
+}
+
+type redactWriter struct {
+	r *strings.Replacer
+	w io.Writer
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	if _, err := w.r.WriteString(w.w, string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactor returns the redactor of the secrets of args and -redact-arg.
+func (cfg *config) redactor() redactor {
+	return newRedactor(append(argSecrets(cfg.args), cfg.redactArgs...))
+}
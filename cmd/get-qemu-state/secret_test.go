@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArgSecrets(t *testing.T) {
+	args := []string{
+		"-object", "secret,id=sec0,data=hunter2,format=raw",
+		"-object", "qom-type=secret,id=sec1,data=swordfish",
+		"-object", "memory-backend-ram,id=mem,size=1G",
+		"-drive", "file=disk.luks,key-secret=sec0,data=notasecret",
+		"-spice", "port=5900,password=opensesame",
+		"-vnc", ":0,password=on",
+	}
+	want := []string{"hunter2", "swordfish", "opensesame"}
+	if got := argSecrets(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	r := newRedactor([]string{"abc", "abcdef", ""})
+	if got := r.String("x=abcdef,y=abc"); got != "x="+redacted+",y="+redacted {
+		t.Errorf("got %q", got)
+	}
+	var buf bytes.Buffer
+	r.writer(&buf).Write([]byte("key abcdef\n"))
+	if buf.String() != "key "+redacted+"\n" {
+		t.Errorf("wrote %q", buf.String())
+	}
+	if got := (redactor{}).args([]string{"abc"}); got[0] != "abc" {
+		t.Errorf("zero redactor replaced %q", got[0])
+	}
+}
+
+func TestCaptureRedactsSecrets(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.args = append(cfg.args, "-object", "secret,id=sec0,data=hunter2", "-drive", "file=https://host/disk?token=tok123")
+	cfg.redactArgs = []string{"tok123"}
+	dir := t.TempDir()
+	cfg.logFile = filepath.Join(dir, "capture.log")
+	cfg.manifest = filepath.Join(dir, "manifest.json")
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{cfg.logFile, cfg.manifest} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := string(data)
+		if strings.Contains(s, "hunter2") || strings.Contains(s, "tok123") {
+			t.Errorf("%s leaks a secret:\n%s", p, s)
+		}
+		if !strings.Contains(s, "data="+redacted) || !strings.Contains(s, "token="+redacted) {
+			t.Errorf("%s doesn't show the redacted args:\n%s", p, s)
+		}
+	}
+}
+
+func TestSecretFile(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(key, []byte("hunter2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, err := runMain(t, "-print-config", "-secret-file", "sec0="+key, "-redact-arg", "ready-xyz", "-marker", "ready-xyz")
+	if err != nil {
+		t.Fatalf("%v: %s", err, stderr)
+	}
+	if !strings.Contains(stdout, `"secret,id=sec0,file=`+key+`"`) {
+		t.Errorf("secret object isn't added to args:\n%s", stdout)
+	}
+	if strings.Contains(stdout, "ready-xyz") || !strings.Contains(stdout, "["+redacted+"]") {
+		t.Errorf("-redact-arg value isn't redacted in the flags:\n%s", stdout)
+	}
+
+	if _, stderr, err := runMain(t, "-print-config", "-secret-file", key); err == nil || !strings.Contains(stderr, "ID=PATH") {
+		t.Errorf("got %v (%s); want -secret-file without ID rejected", err, stderr)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"text/tabwriter"
+)
+
+// Migration stream constants (migration/savevm.c of QEMU).
+const (
+	vmFileMagic   = 0x5145564d // "QEVM"
+	vmFileVersion = 3
+
+	vmEOF           = 0x00
+	vmSectionStart  = 0x01
+	vmSectionPart   = 0x02
+	vmSectionEnd    = 0x03
+	vmSectionFull   = 0x04
+	vmDescription   = 0x06
+	vmConfiguration = 0x07
+	vmCommand       = 0x08
+	vmSectionFooter = 0x7e
+)
+
+// sectionSize is the bytes taken in the state by a device (or RAM) section,
+// including its headers and footers.
+type sectionSize struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// sectionSizes walks the migration stream in r and returns the bytes taken
+// by each section, the largest first.
+//
+// The section data isn't self-describing, so its end is found by looking for
+// the section footer that QEMU (since 2.4, unless the machine type is older)
+// writes after each section and checking that a plausible section header
+// follows. Streams without footers are reported as errors. The configuration
+// (machine type) before the first section and the JSON description after the
+// end are reported as "configuration" and "vmdescription".
+func sectionSizes(r io.Reader) ([]sectionSize, error) {
+	p, err := parseStream(r)
+	if err != nil {
+		return nil, err
+	}
+	var res []sectionSize
+	for name, n := range p.sizes {
+		res = append(res, sectionSize{Name: name, Bytes: n})
+	}
+	slices.SortFunc(res, func(a, b sectionSize) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Name, b.Name))
+	})
+	return res, nil
+}
+
+func parseStream(r io.Reader) (*streamParser, error) {
+	p := &streamParser{
+		r:     bufio.NewReaderSize(r, 64<<10),
+		names: make(map[uint32]string),
+		sizes: make(map[string]int64),
+	}
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("failed to parse the migration stream at offset %d: %w", p.off, err)
+	}
+	return p, nil
+}
+
+type streamParser struct {
+	r      *bufio.Reader
+	off    int64
+	names  map[uint32]string // section ID to name
+	sizes  map[string]int64
+	chunks []streamChunk // in the stream order
+}
+
+// streamChunk is a range of the stream belonging to a section. The header
+// and the EOF mark are chunks too.
+type streamChunk struct {
+	name      string
+	off, size int64
+}
+
+// add accounts the stream from start to the current offset to name.
+func (p *streamParser) add(name string, start int64) {
+	p.sizes[name] += p.off - start
+	p.chunks = append(p.chunks, streamChunk{name, start, p.off - start})
+}
+
+func (p *streamParser) parse() error {
+	hdr, err := p.read(8)
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(hdr) != vmFileMagic {
+		return errors.New("not a QEMU migration stream")
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != vmFileVersion {
+		return fmt.Errorf("unsupported stream version %d", v)
+	}
+	p.chunks = append(p.chunks, streamChunk{"header", 0, p.off})
+	if b, err := p.r.Peek(1); err == nil && b[0] == vmConfiguration {
+		// The layout of the configuration varies across versions; skip to
+		// the first section.
+		start := p.off
+		for {
+			b, _ := p.r.Peek(p.r.Size())
+			if len(b) == 0 {
+				return io.ErrUnexpectedEOF
+			}
+			if p.plausibleHeader(b) {
+				break
+			}
+			p.discard(1)
+		}
+		p.add("configuration", start)
+	}
+
+	for {
+		start := p.off
+		t, err := p.read(1)
+		if err != nil {
+			return err
+		}
+		var name string
+		switch t[0] {
+		case vmEOF:
+			p.chunks = append(p.chunks, streamChunk{"eof", start, 1})
+			if b, err := p.r.Peek(1); err == nil && b[0] == vmDescription {
+				return p.skipDescription()
+			}
+			return nil
+		case vmSectionStart, vmSectionFull:
+			h, err := p.read(5)
+			if err != nil {
+				return err
+			}
+			id := binary.BigEndian.Uint32(h)
+			idstr, err := p.read(int(h[4]))
+			if err != nil {
+				return err
+			}
+			name = string(idstr)
+			inst, err := p.read(8) // instance ID, version ID
+			if err != nil {
+				return err
+			}
+			if n := binary.BigEndian.Uint32(inst); n != 0 {
+				name = fmt.Sprintf("%s/%d", name, n)
+			}
+			p.names[id] = name
+			if err := p.skipToFooter(id); err != nil {
+				return fmt.Errorf("section %q: %w", name, err)
+			}
+		case vmSectionPart, vmSectionEnd:
+			h, err := p.read(4)
+			if err != nil {
+				return err
+			}
+			id := binary.BigEndian.Uint32(h)
+			var ok bool
+			if name, ok = p.names[id]; !ok {
+				return fmt.Errorf("unknown section ID %d", id)
+			}
+			if err := p.skipToFooter(id); err != nil {
+				return fmt.Errorf("section %q: %w", name, err)
+			}
+		case vmCommand:
+			h, err := p.read(4) // command, length
+			if err != nil {
+				return err
+			}
+			if _, err := p.read(int(binary.BigEndian.Uint16(h[2:]))); err != nil {
+				return err
+			}
+			name = "commands"
+		default:
+			return fmt.Errorf("unexpected section type 0x%02x", t[0])
+		}
+		p.add(name, start)
+	}
+}
+
+func (p *streamParser) skipDescription() error {
+	start := p.off
+	h, err := p.read(5)
+	if err != nil {
+		return err
+	}
+	if err := p.discard(int(binary.BigEndian.Uint32(h[1:]))); err != nil {
+		return err
+	}
+	p.add("vmdescription", start)
+	return nil
+}
+
+// skipToFooter skips the data of section id and its footer.
+func (p *streamParser) skipToFooter(id uint32) error {
+	for {
+		b, err := p.r.Peek(max(p.r.Buffered(), 1))
+		if len(b) == 0 {
+			if err == io.EOF {
+				return errors.New("no section footer (stream of an old machine type?)")
+			}
+			return err
+		}
+		i := bytes.IndexByte(b, vmSectionFooter)
+		if i < 0 {
+			p.discard(len(b))
+			continue
+		}
+		p.discard(i + 1)
+		next, _ := p.r.Peek(p.r.Size())
+		if len(next) >= 4 && binary.BigEndian.Uint32(next) == id && p.plausibleNext(next[4:]) {
+			return p.discard(4)
+		}
+	}
+}
+
+// plausibleNext reports whether b may start what follows a section footer.
+func (p *streamParser) plausibleNext(b []byte) bool {
+	if len(b) == 0 {
+		return false // the stream ends with EOF
+	}
+	switch b[0] {
+	case vmEOF, vmCommand:
+		return true
+	case vmSectionStart, vmSectionFull:
+		return p.plausibleHeader(b)
+	case vmSectionPart, vmSectionEnd:
+		if len(b) < 5 {
+			return false
+		}
+		_, ok := p.names[binary.BigEndian.Uint32(b[1:])]
+		return ok
+	}
+	return false
+}
+
+// plausibleHeader reports whether b starts with a section start header:
+// type, section ID, idstr (length-prefixed printable ASCII), instance ID and
+// version ID.
+func (p *streamParser) plausibleHeader(b []byte) bool {
+	if len(b) < 6 || (b[0] != vmSectionStart && b[0] != vmSectionFull) {
+		return false
+	}
+	n := int(b[5])
+	if n == 0 || len(b) < 6+n+8 {
+		return false
+	}
+	for _, c := range b[6 : 6+n] {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return binary.BigEndian.Uint32(b[6+n+4:]) < 1<<16 // version ID
+}
+
+func (p *streamParser) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	p.off += int64(n)
+	return b, nil
+}
+
+func (p *streamParser) discard(n int) error {
+	d, err := p.r.Discard(n)
+	p.off += int64(d)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// stateSections returns the section sizes of the state file at path.
+func stateSections(path string) ([]sectionSize, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return sectionSizes(f)
+}
+
+// stateChunks returns the chunks of the state file f in the stream order,
+// any bytes after the stream being a "trailer" chunk.
+func stateChunks(f *os.File) ([]streamChunk, error) {
+	p, err := parseStream(f)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	chunks := p.chunks
+	if p.off < fi.Size() {
+		chunks = append(chunks, streamChunk{"trailer", p.off, fi.Size() - p.off})
+	}
+	return chunks, nil
+}
+
+// writeSectionTable writes the top sizes as a table with their shares of
+// the total.
+func writeSectionTable(w io.Writer, sizes []sectionSize, top int) error {
+	var total int64
+	for _, s := range sizes {
+		total += s.Bytes
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "BYTES\tSHARE\t SECTION\n")
+	for _, s := range sizes[:min(top, len(sizes))] {
+		fmt.Fprintf(tw, "%d\t%.1f%%\t %s\n", s.Bytes, float64(s.Bytes)*100/float64(max(total, 1)), s.Name)
+	}
+	return tw.Flush()
+}
+
+func runSections(args []string) error {
+	fs := flag.NewFlagSet("sections", flag.ExitOnError)
+	top := fs.Int("top", 10, "number of sections printed")
+	split := fs.String("split", "", "instead of printing the sizes, write each section to its own file in this directory, indexed by "+sectionsIndexName+". \"get-qemu-state join DIR/"+sectionsIndexName+"\" reassembles the state")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("specify the state file")
+	}
+	if *split != "" {
+		written, err := splitSections(fs.Arg(0), *split)
+		if err != nil {
+			return err
+		}
+		log.Printf("wrote %d sections to %s", len(written)-1, *split)
+		return nil
+	}
+	sizes, err := stateSections(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return writeSectionTable(os.Stdout, sizes, *top)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stateBuilder writes a migration stream fixture.
+type stateBuilder struct {
+	bytes.Buffer
+}
+
+func (b *stateBuilder) u32(v uint32) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+// section writes a section and returns its size.
+func (b *stateBuilder) section(typ byte, id uint32, idstr string, instance uint32, data []byte, footer bool) int64 {
+	n := b.Len()
+	b.WriteByte(typ)
+	b.u32(id)
+	if typ == vmSectionStart || typ == vmSectionFull {
+		b.WriteByte(byte(len(idstr)))
+		b.WriteString(idstr)
+		b.u32(instance)
+		b.u32(4) // version
+	}
+	b.Write(data)
+	if footer {
+		b.WriteByte(vmSectionFooter)
+		b.u32(id)
+	}
+	return int64(b.Len() - n)
+}
+
+func TestSectionSizes(t *testing.T) {
+	var b stateBuilder
+	b.u32(vmFileMagic)
+	b.u32(vmFileVersion)
+	b.WriteByte(vmConfiguration)
+	b.u32(10)
+	b.WriteString("pc-q35-9.0")
+	b.Write([]byte{0x05, 0x10}) // a subsection the parser doesn't know
+	b.WriteString("configuration/x")
+	b.u32(1)
+	config := int64(b.Len() - 8)
+
+	// RAM data may contain what looks like its footer.
+	page := bytes.Repeat([]byte{0xaa}, 4096)
+	copy(page[100:], []byte{vmSectionFooter, 0, 0, 0, 2, 0xff})
+	copy(page[200:], []byte{vmSectionFooter, 0, 0, 0, 2, vmSectionPart, 0, 0, 0, 9})
+
+	ram := b.section(vmSectionStart, 2, "ram", 0, make([]byte, 100), true)
+	ram += b.section(vmSectionPart, 2, "", 0, page, true)
+	blk := b.section(vmSectionFull, 3, "0000:00:02.0/virtio-blk", 0, make([]byte, 50), true)
+	serial := b.section(vmSectionFull, 4, "serial", 1, make([]byte, 10), true)
+	ram += b.section(vmSectionEnd, 2, "", 0, make([]byte, 8), true)
+	b.WriteByte(vmEOF)
+	desc := `{"page_size":4096,"devices":[]}`
+	b.WriteByte(vmDescription)
+	b.u32(uint32(len(desc)))
+	b.WriteString(desc)
+
+	got, err := sectionSizes(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sectionSize{
+		{"ram", ram},
+		{"0000:00:02.0/virtio-blk", blk},
+		{"configuration", config},
+		{"vmdescription", int64(5 + len(desc))},
+		{"serial/1", serial},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v; want %+v", got, want)
+	}
+
+	var table strings.Builder
+	if err := writeSectionTable(&table, got, 2); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(table.String()), "\n"); len(lines) != 3 || !strings.HasSuffix(lines[1], " ram") {
+		t.Errorf("unexpected table:\n%s", table.String())
+	}
+}
+
+func TestSectionSizesErrors(t *testing.T) {
+	var b stateBuilder
+	b.u32(vmFileMagic)
+	b.u32(vmFileVersion)
+	b.section(vmSectionFull, 3, "virtio-blk", 0, make([]byte, 50), false)
+	b.WriteByte(vmEOF)
+	if _, err := sectionSizes(bytes.NewReader(b.Bytes())); err == nil || !strings.Contains(err.Error(), "no section footer") {
+		t.Errorf("got %v; want an error about the missing footers", err)
+	}
+
+	if _, err := sectionSizes(strings.NewReader("not a state")); err == nil || !strings.Contains(err.Error(), "not a QEMU migration stream") {
+		t.Errorf("got %v; want an error about the magic", err)
+	}
+}
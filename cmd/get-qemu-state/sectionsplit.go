@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sectionsIndexName is the name of the index in a directory written by
+// splitSections. It's a splitIndex, so "join" reassembles the state from it.
+const sectionsIndexName = "sections.json"
+
+func sectionsDir(output string) string {
+	return output + ".sections"
+}
+
+// splitSections writes each section of the state at src to its own file in
+// dir, so that device states can be compared across captures. The chunks of
+// a section sent in several parts (RAM) are concatenated in its file and
+// listed in the stream order by the index. It returns the paths of the
+// written files, the index last.
+func splitSections(src, dir string) ([]string, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunks, err := stateChunks(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// Sections of a previous capture would be mistaken for ours.
+	stale, err := filepath.Glob(filepath.Join(dir, "*.bin"))
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stale {
+		if err := os.Remove(s); err != nil {
+			return nil, err
+		}
+	}
+
+	type sectionFile struct {
+		f    *os.File
+		name string
+		size int64
+	}
+	files := make(map[string]*sectionFile) // section name -> file
+	used := make(map[string]bool)
+	defer func() {
+		for _, sf := range files {
+			sf.f.Close()
+		}
+	}()
+	var (
+		idx   splitIndex
+		paths []string
+		total = sha256.New()
+	)
+	for _, c := range chunks {
+		sf, ok := files[c.name]
+		if !ok {
+			name := sectionFileName(c.name)
+			for i := 2; used[name]; i++ {
+				name = fmt.Sprintf("%s~%d.bin", strings.TrimSuffix(sectionFileName(c.name), ".bin"), i)
+			}
+			used[name] = true
+			p := filepath.Join(dir, name)
+			out, err := os.Create(p)
+			if err != nil {
+				return nil, err
+			}
+			sf = &sectionFile{f: out, name: name}
+			files[c.name] = sf
+			paths = append(paths, p)
+		}
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(sf.f, h, total), io.NewSectionReader(f, c.off, c.size)); err != nil {
+			return nil, err
+		}
+		idx.Parts = append(idx.Parts, splitPart{Name: sf.name, Offset: sf.size, Size: c.size, SHA256: "sha256:" + hex.EncodeToString(h.Sum(nil))})
+		sf.size += c.size
+		idx.Size += c.size
+	}
+	for _, sf := range files {
+		if err := sf.f.Close(); err != nil {
+			return nil, err
+		}
+	}
+	idx.SHA256 = "sha256:" + hex.EncodeToString(total.Sum(nil))
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	ip := filepath.Join(dir, sectionsIndexName)
+	if err := os.WriteFile(ip, append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return append(paths, ip), nil
+}
+
+// sectionFileName returns the file name of section (e.g.
+// "0000:00:02.0/virtio-blk" -> "0000_00_02.0_virtio-blk.bin").
+func sectionFileName(section string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, section) + ".bin"
+}
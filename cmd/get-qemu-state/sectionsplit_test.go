@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSplitSections(t *testing.T) {
+	var b stateBuilder
+	b.u32(vmFileMagic)
+	b.u32(vmFileVersion)
+	ram := b.section(vmSectionStart, 2, "ram", 0, bytes.Repeat([]byte{1}, 100), true)
+	b.section(vmSectionFull, 3, "0000:00:02.0/virtio-blk", 0, bytes.Repeat([]byte{2}, 50), true)
+	ram += b.section(vmSectionPart, 2, "", 0, bytes.Repeat([]byte{3}, 4096), true)
+	b.section(vmSectionFull, 4, "serial", 1, bytes.Repeat([]byte{4}, 10), true)
+	ram += b.section(vmSectionEnd, 2, "", 0, bytes.Repeat([]byte{5}, 8), true)
+	b.WriteByte(vmEOF)
+	b.WriteString("trailing")
+	state := b.Bytes()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "vm.state")
+	if err := os.WriteFile(src, state, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := sectionsDir(src)
+	if err := os.MkdirAll(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(out, "stale.bin"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	written, err := splitSections(src, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range written {
+		names = append(names, filepath.Base(p))
+	}
+	want := []string{"header.bin", "ram.bin", "0000_00_02.0_virtio-blk.bin", "serial_1.bin", "eof.bin", "trailer.bin", sectionsIndexName}
+	if !slices.Equal(names, want) {
+		t.Fatalf("wrote %q; want %q", names, want)
+	}
+	if _, err := os.Stat(filepath.Join(out, "stale.bin")); !os.IsNotExist(err) {
+		t.Errorf("stale section isn't removed: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(out, "ram.bin")); err != nil || fi.Size() != ram {
+		t.Errorf("ram.bin isn't the %d bytes of all the RAM chunks: %v", ram, err)
+	}
+
+	joined := filepath.Join(dir, "joined.state")
+	if err := joinParts(filepath.Join(out, sectionsIndexName), joined); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(joined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, state) {
+		t.Fatalf("joined state differs from the original")
+	}
+
+	// Any edit is caught on join.
+	if err := os.WriteFile(filepath.Join(out, "serial_1.bin"), bytes.Repeat([]byte{9}, 32), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := joinParts(filepath.Join(out, sectionsIndexName), joined+"2"); err == nil {
+		t.Fatalf("join succeeded with an edited section")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// shrinkReclaim are run in the restored guest by the second -shrink pass to
+// give memory back before the re-capture. Freed page cache is sent as is
+// unless the balloon takes it; compacting helps the balloon find free pages.
+var shrinkReclaim = []string{
+	"sync && echo 3 > /proc/sys/vm/drop_caches",
+	"echo 1 > /proc/sys/vm/compact_memory || true",
+	"fstrim -a || true",
+}
+
+// shrinkInfo is the state size before and after -shrink.
+type shrinkInfo struct {
+	FullBytes   int64 `json:"fullBytes"`
+	ShrunkBytes int64 `json:"shrunkBytes"`
+	// KeptFull is set if the re-capture wasn't smaller and the full state
+	// was kept.
+	KeptFull bool `json:"keptFull,omitempty"`
+}
+
+func fullStatePath(output string) string {
+	return output + ".full"
+}
+
+// captureShrunk implements -shrink. The guest is captured as configured to
+// fullStatePath, which is then restored, made to give memory back
+// (shrinkReclaim through the guest agent, then -balloon) and captured again
+// to the output. The full state is kept instead if the re-capture isn't
+// smaller.
+func captureShrunk(cfg config) (_ *result, err error) {
+	_, _, hasAgent := guestAgentAddr(cfg.args)
+	if !hasAgent && cfg.balloonMiB == 0 {
+		return nil, errors.New("-shrink needs a guest agent socket in args (as -wait-guest-agent) or -balloon to reclaim the guest memory")
+	}
+	if cfg.output, err = resolveOutputPath(cfg.output, cfg.followSymlinks); err != nil {
+		return nil, err
+	}
+	if !cfg.noLock {
+		lock, err := lockOutput(cfg.output, cfg.lockWait)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Close()
+	}
+	if cfg.logFile != "" {
+		f, err := cfg.createLog(cfg.logFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create log file: %w", err)
+		}
+		defer f.Close()
+		cfg.logger = log.New(io.MultiWriter(cfg.logger.Writer(), cfg.redactor().writer(f)), cfg.logger.Prefix(), cfg.logger.Flags())
+	}
+	full := fullStatePath(cfg.output)
+	defer os.Remove(full)
+
+	// The first pass boots the guest and runs the pre-script and
+	// -guest-exec; what describes the final state is left to the second.
+	first := cfg
+	first.shrink, first.noLock, first.logFile = false, true, ""
+	first.output, first.manifest = full, ""
+	first.splitBytes, first.splitSections = 0, false
+	first.hotMap, first.measureRestore, first.sectionSizes = false, false, 0
+	first.balloonMiB = 0
+	first.collectLogs, first.collectGuestFiles = nil, nil
+	cfg.logger.Printf("capturing the full state to %s (-shrink first pass)", full)
+	boot, err := capture(first)
+	if err != nil {
+		return nil, err
+	}
+
+	second := cfg
+	second.shrink, second.noLock, second.logFile = false, true, ""
+	second.shrinkFull, second.shrinkBoot = full, boot
+	second.guestExec, second.waitGuestAgent = nil, false
+	if hasAgent {
+		second.guestExec = shrinkReclaim
+	}
+	// Keep the logs of the boot.
+	second.consoleFile, second.consoleRawFile, second.qemuStderrFile = "", "", ""
+	if boot.AccelFallbackFrom != "" {
+		second.args = withoutAccel(second.args)
+		second.accel, second.accelFallbackFrom = "tcg", boot.AccelFallbackFrom
+	}
+	cfg.logger.Printf("restoring %s to capture it again after reclaiming memory (-shrink second pass)", full)
+	res, err := captureOnce(second)
+	if err != nil {
+		return nil, err
+	}
+	res.Total += boot.Total
+	return res, nil
+}
+
+// keepSmaller compares the re-captured state at partial with the full state
+// and moves the full state to partial if the re-capture isn't smaller.
+func (cfg *config) keepSmaller(partial, full string) (*shrinkInfo, error) {
+	fi, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+	pi, err := os.Stat(partial)
+	if err != nil {
+		return nil, err
+	}
+	s := &shrinkInfo{FullBytes: fi.Size(), ShrunkBytes: pi.Size()}
+	if s.ShrunkBytes < s.FullBytes {
+		cfg.logger.Printf("shrunk the state from %d to %d bytes (%.1f%% smaller)", s.FullBytes, s.ShrunkBytes, 100*float64(s.FullBytes-s.ShrunkBytes)/float64(s.FullBytes))
+		return s, nil
+	}
+	cfg.logger.Printf("WARNING: the re-captured state (%d bytes) isn't smaller than the full state (%d bytes); keeping the full state", s.ShrunkBytes, s.FullBytes)
+	s.KeptFull = true
+	return s, cfg.rename(full, partial)
+}
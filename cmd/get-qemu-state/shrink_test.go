@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureShrink(t *testing.T) {
+	for _, tt := range []struct {
+		restoredSize string
+		wantSize     int64
+		keptFull     bool
+	}{
+		{"1024", 1024, false},
+		{"8192", 4096, true},
+	} {
+		t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+		t.Setenv("STUB_QEMU_RESTORED_STATE_SIZE", tt.restoredSize)
+		sock := fakeGuestAgent(t, time.Now())
+		cfg := stubConfig(t)
+		cfg.args = append(cfg.args, "-chardev", "socket,id=qga0,path="+sock+",server=on,wait=off", "-device", "virtserialport,chardev=qga0,name="+guestAgentPort)
+		cfg.shrink = true
+		cfg.manifest = filepath.Join(t.TempDir(), "manifest.json")
+		res, err := capture(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(cfg.output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != tt.wantSize {
+			t.Errorf("restored size %s: kept a state of %d bytes; want %d", tt.restoredSize, fi.Size(), tt.wantSize)
+		}
+		if _, err := os.Stat(fullStatePath(cfg.output)); !os.IsNotExist(err) {
+			t.Errorf("the full state is left behind: %v", err)
+		}
+		want := shrinkInfo{FullBytes: 4096, ShrunkBytes: fi.Size(), KeptFull: tt.keptFull}
+		if tt.keptFull {
+			want.ShrunkBytes = 8192
+		}
+		if res.Shrink == nil || *res.Shrink != want {
+			t.Errorf("restored size %s: got %+v; want %+v", tt.restoredSize, res.Shrink, want)
+		}
+		if res.ReadyAfter < 100*time.Millisecond {
+			t.Errorf("ready after %v; want the boot of the first pass", res.ReadyAfter)
+		}
+		data, err := os.ReadFile(cfg.manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Shrink == nil || *m.Shrink != want {
+			t.Errorf("manifest has shrink %+v; want %+v", m.Shrink, want)
+		}
+	}
+}
+
+func TestCaptureShrinkNeedsReclaim(t *testing.T) {
+	cfg := stubConfig(t)
+	cfg.shrink = true
+	if _, err := capture(cfg); err == nil || !strings.Contains(err.Error(), "-shrink needs a guest agent socket") {
+		t.Fatalf("got %v; want -shrink refused without a way to reclaim memory", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultSlotDir is where -global-concurrency keeps its slots, shared by all
+// the captures of the host.
+func defaultSlotDir() string {
+	return filepath.Join(os.TempDir(), "get-qemu-state.slots")
+}
+
+// slotPath returns the path of the lock file of slot i in dir.
+func slotPath(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("slot%d.lock", i))
+}
+
+// acquireSlot takes one of the first n slots of dir, a host-wide semaphore
+// of lock files slot0.lock, slot1.lock, ..., waiting as long as all of them
+// are flocked by other captures. Like with lockOutput, the slot is released
+// by closing the returned file, or by the kernel when the process exits
+// however it does.
+func acquireSlot(dir string, n int, logger *log.Logger) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("failed to create the slot directory: %w", err)
+	}
+	var waitStart time.Time
+	for {
+		for i := 0; i < n; i++ {
+			f, err := os.OpenFile(slotPath(dir, i), os.O_RDWR|os.O_CREATE, 0666)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open slot: %w", err)
+			}
+			held, err := tryLock(f)
+			if err == nil && !held {
+				if !waitStart.IsZero() {
+					logger.Printf("took capture slot %d after waiting %v", i, time.Since(waitStart).Round(time.Millisecond))
+				}
+				return f, nil
+			}
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to lock %s: %w", slotPath(dir, i), err)
+			}
+		}
+		if waitStart.IsZero() {
+			waitStart = time.Now()
+			logger.Printf("all %d capture slots in %s are taken (-global-concurrency); waiting for one", n, dir)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
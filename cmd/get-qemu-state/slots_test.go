@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireSlot(t *testing.T) {
+	dir := t.TempDir()
+	s0, err := acquireSlot(dir, 2, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := acquireSlot(dir, 2, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	time.AfterFunc(300*time.Millisecond, func() { s0.Close() })
+	start := time.Now()
+	s2, err := acquireSlot(dir, 2, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("took a slot after %v while both were held for 300ms", d)
+	}
+	if s2.Name() != slotPath(dir, 0) {
+		t.Errorf("took %s; want the released slot", s2.Name())
+	}
+}
+
+func TestGlobalConcurrency(t *testing.T) {
+	// Separate invocations contend for 2 slots; the captures of the stub
+	// QEMU booting for 1s run in two waves.
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	argsJSON := filepath.Join(dir, "args.json")
+	if err := os.WriteFile(argsJSON, []byte(`["`+stubQEMUCommand+`"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const n = 4
+	cmds := make([]*exec.Cmd, n)
+	stderrs := make([]bytes.Buffer, n)
+	start := time.Now()
+	for i := range cmds {
+		cmds[i] = exec.Command(self, "-args-json", argsJSON, "-output", filepath.Join(dir, "vm.state."+string(rune('a'+i))),
+			"-global-concurrency", "2", "-global-concurrency-dir", filepath.Join(dir, "slots"), self)
+		cmds[i].Env = append(os.Environ(), "GET_QEMU_STATE_TEST_MAIN=1", "STUB_QEMU_BOOT_DELAY=1s")
+		cmds[i].Stderr = &stderrs[i]
+		if err := cmds[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waited := 0
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("capture %d failed: %v\n%s", i, err, stderrs[i].String())
+		}
+		if strings.Contains(stderrs[i].String(), "capture slots") {
+			waited++
+		}
+	}
+	if d := time.Since(start); d < 2*time.Second {
+		t.Errorf("%d captures took %v; want at most 2 at a time", n, d)
+	}
+	if waited < n-2 {
+		t.Errorf("%d captures waited for a slot; want at least %d", waited, n-2)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitIndex describes a state split by -split-bytes. It's written to
+// <output>.parts.json next to the parts and read by "join".
+type splitIndex struct {
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+	Parts  []splitPart `json:"parts"`
+
+	// PageSize and Pages locate the guest RAM pages in the parts, with
+	// -chunk-mode page-aligned.
+	PageSize int64     `json:"pageSize,omitempty"`
+	Pages    []pageRun `json:"pages,omitempty"`
+}
+
+type splitPart struct {
+	Name   string `json:"name"` // relative to the index
+	Offset int64  `json:"offset,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func splitIndexPath(output string) string {
+	return output + ".parts.json"
+}
+
+func partPath(output string, i int) string {
+	return fmt.Sprintf("%s.part%04d", output, i)
+}
+
+// splitFile writes src as parts of output of at most n bytes each and the
+// index of them. It returns the paths of the written files.
+func splitFile(src, output string, n int64) ([]string, error) {
+	if n <= 0 {
+		return nil, errors.New("part size must be positive")
+	}
+	return splitFileAt(src, output, func(off int64) int64 { return off + n }, nil)
+}
+
+// splitFileAt writes src as parts of output, each ending at next(its start
+// offset), and the index of them, completed by annotate (if not nil).
+func splitFileAt(src, output string, next func(off int64) int64, annotate func(idx *splitIndex) error) ([]string, error) {
+	// Parts of a previous capture would be mistaken for ours.
+	stale, err := filepath.Glob(output + ".part[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range stale {
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		idx   splitIndex
+		paths []string
+		total = sha256.New()
+	)
+	for i := 0; ; i++ {
+		p := partPath(output, i)
+		n := next(idx.Size) - idx.Size
+		written, digest, err := writePart(p, io.TeeReader(io.LimitReader(f, n), total))
+		if err != nil {
+			return nil, err
+		}
+		if written == 0 && i > 0 {
+			// The previous part ended exactly at the end.
+			if err := os.Remove(p); err != nil {
+				return nil, err
+			}
+			break
+		}
+		paths = append(paths, p)
+		idx.Parts = append(idx.Parts, splitPart{Name: filepath.Base(p), Size: written, SHA256: digest})
+		idx.Size += written
+		if written < n {
+			break
+		}
+	}
+	idx.SHA256 = "sha256:" + hex.EncodeToString(total.Sum(nil))
+	if annotate != nil {
+		if err := annotate(&idx); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	ip := splitIndexPath(output)
+	if err := os.WriteFile(ip, append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return append(paths, ip), nil
+}
+
+func writePart(path string, r io.Reader) (int64, string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		f.Close()
+		return 0, "", err
+	}
+	if err := f.Close(); err != nil {
+		return 0, "", err
+	}
+	return n, "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// joinParts reassembles the parts listed in the index at indexPath into dst,
+// verifying their sizes and digests.
+func joinParts(indexPath, dst string) error {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	var idx splitIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", indexPath, err)
+	}
+	tmp := dst + ".partial"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	total := sha256.New()
+	var size int64
+	for _, part := range idx.Parts {
+		f, err := os.Open(filepath.Join(filepath.Dir(indexPath), part.Name))
+		if err != nil {
+			out.Close()
+			return err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(out, h, total), io.NewSectionReader(f, part.Offset, part.Size))
+		f.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if n != part.Size || "sha256:"+hex.EncodeToString(h.Sum(nil)) != part.SHA256 {
+			out.Close()
+			return fmt.Errorf("part %s doesn't match the index", part.Name)
+		}
+		size += n
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if size != idx.Size || "sha256:"+hex.EncodeToString(total.Sum(nil)) != idx.SHA256 {
+		return errors.New("joined state doesn't match the index")
+	}
+	return os.Rename(tmp, dst)
+}
+
+// runJoin implements "get-qemu-state join [-output file] <output>.parts.json"
+// (or <output>.sections/sections.json).
+func runJoin(args []string) error {
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	output := fs.String("output", "", "path to the joined state file (default: the index path without .parts.json or .sections/"+sectionsIndexName+")")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("specify the parts index (<output>.parts.json or <output>.sections/" + sectionsIndexName + ")")
+	}
+	indexPath := fs.Arg(0)
+	dst := *output
+	if dst == "" {
+		var ok bool
+		if dst, ok = strings.CutSuffix(indexPath, ".parts.json"); !ok {
+			if dst, ok = strings.CutSuffix(indexPath, ".sections/"+sectionsIndexName); !ok {
+				return errors.New("specify -output")
+			}
+		}
+	}
+	return joinParts(indexPath, dst)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitJoin(t *testing.T) {
+	for _, tt := range []struct {
+		size  int
+		n     int64
+		parts int
+	}{
+		{size: 10000, n: 4096, parts: 3},
+		{size: 8192, n: 4096, parts: 2},
+		{size: 100, n: 4096, parts: 1},
+		{size: 0, n: 4096, parts: 1},
+	} {
+		dir := t.TempDir()
+		data := make([]byte, tt.size)
+		rand.New(rand.NewSource(int64(tt.size))).Read(data)
+		src := filepath.Join(dir, "vm.state.partial")
+		if err := os.WriteFile(src, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		output := filepath.Join(dir, "vm.state")
+		written, err := splitFile(src, output, tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(written) != tt.parts+1 {
+			t.Errorf("size %d: got %d files; want %d parts and the index", tt.size, len(written), tt.parts)
+		}
+		for _, p := range written[:len(written)-1] {
+			if fi, err := os.Stat(p); err != nil || fi.Size() > tt.n {
+				t.Errorf("size %d: bad part %s: %v", tt.size, p, err)
+			}
+		}
+		joined := filepath.Join(dir, "joined")
+		if err := joinParts(splitIndexPath(output), joined); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(joined)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("size %d: joined state differs from the original", tt.size)
+		}
+	}
+}
+
+func TestJoinCorruptedPart(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, bytes.Repeat([]byte("state"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "vm.state")
+	if _, err := splitFile(src, output, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partPath(output, 1), bytes.Repeat([]byte("x"), 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	joined := filepath.Join(dir, "joined")
+	if err := joinParts(splitIndexPath(output), joined); err == nil {
+		t.Fatal("joined a corrupted part")
+	}
+	if _, err := os.Stat(joined); !os.IsNotExist(err) {
+		t.Errorf("joined state left after failure: %v", err)
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stubQEMUCommand is the first argument making the test binary the stub QEMU
+// (see TestMain), emulating the subset of QEMU that get-qemu-state relies on.
+const stubQEMUCommand = "stub-qemu"
+
+// stubQEMU boots a fake guest printing the marker after the boot delay and
+// serves the HMP commands multiplexed on stdio (Ctrl-A C). QEMU arguments
+// are ignored except -incoming, which replaces the boot with an "inmigrate"
+// status for the boot delay, -pidfile, and a QMP server socket (-qmp), which
+// serves the capabilities negotiation, query-status, getfd, migrate and quit.
+// The tests extend it through the hooks.
+type stubQEMU struct {
+	bootDelay time.Duration
+	marker    string
+	stateSize int // of the zero bytes written by "migrate"
+	// migrateDelay keeps a "migrate file:PATH" (or exec:COMMAND) active
+	// with half the state written for this long.
+	migrateDelay time.Duration
+
+	// state returns what "migrate" writes instead of the zero bytes.
+	state func() ([]byte, error)
+	// start is called before anything is printed.
+	start func() error
+	// boot is called before the guest boots, reading the console from in.
+	boot func(in *bufio.Reader) error
+	// ready prints the marker instead of printing it as is.
+	ready func(marker string) error
+	// console is called with each line typed to the console.
+	console func(line string)
+	// monitor is called with each HMP command, telling whether it handled
+	// the command.
+	monitor func(command string) bool
+}
+
+// newStubQEMU returns the stub QEMU configured by the environment:
+//
+//	STUB_QEMU_BOOT_DELAY       delays the marker (default 100ms)
+//	STUB_QEMU_MARKER           printed instead of the default marker
+//	STUB_QEMU_STATE_SIZE       bytes written by "migrate" (default 1MiB)
+func newStubQEMU() (*stubQEMU, error) {
+	s := &stubQEMU{bootDelay: 100 * time.Millisecond, marker: defaultWaitString, stateSize: 1 << 20}
+	if v := os.Getenv("STUB_QEMU_BOOT_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		s.bootDelay = d
+	}
+	if m := os.Getenv("STUB_QEMU_MARKER"); m != "" {
+		s.marker = m
+	}
+	if v := os.Getenv("STUB_QEMU_STATE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		s.stateSize = n
+	}
+	return s, nil
+}
+
+// migrationState returns what "migrate" writes.
+func (s *stubQEMU) migrationState() ([]byte, error) {
+	if s.state != nil {
+		return s.state()
+	}
+	return make([]byte, s.stateSize), nil
+}
+
+func (s *stubQEMU) run() error {
+	if s.start != nil {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
+	if p := pidfileArg(os.Args); p != "" {
+		if err := os.WriteFile(p, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+			return err
+		}
+	}
+	if network, addr, ok := qmpAddr(os.Args); ok {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		go s.serveQMP(l)
+	}
+	in := bufio.NewReader(os.Stdin)
+	incoming := slices.Contains(os.Args, "-incoming")
+	if !incoming {
+		if s.boot != nil {
+			if err := s.boot(in); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("[    0.000000] Linux version stub\r\n")
+		time.Sleep(s.bootDelay)
+		fmt.Printf("[    0.100000] Run /init as init process\r\n")
+		if s.ready != nil {
+			if err := s.ready(s.marker); err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("%s", s.marker)
+		}
+	}
+
+	status := "running"
+	var migration stubMigration // until "info status" saw it complete
+	restoredAt := time.Now().Add(s.bootDelay)
+	if incoming {
+		status = "inmigrate"
+	}
+	monitor := false
+	var line, consoleLine []byte
+	for {
+		b, err := in.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if b == 0x01 {
+			if c, err := in.ReadByte(); err == nil && c == 'c' {
+				monitor = !monitor
+				if monitor {
+					fmt.Printf("QEMU 0.0.0 monitor - type 'help' for more information\r\n(qemu) ")
+				}
+			}
+			continue
+		}
+		if !monitor {
+			os.Stdout.Write([]byte{b}) // echo like a terminal
+			if b != '\n' && b != '\r' {
+				consoleLine = append(consoleLine, b)
+				continue
+			}
+			if l := string(consoleLine); l != "" && s.console != nil {
+				s.console(l)
+			}
+			consoleLine = consoleLine[:0]
+			continue
+		}
+		if b != '\n' {
+			line = append(line, b)
+			continue
+		}
+		command := strings.TrimSpace(string(line))
+		line = line[:0]
+		switch {
+		case s.monitor != nil && s.monitor(command):
+		case strings.HasPrefix(command, "migrate "):
+			uri := strings.TrimPrefix(command, "migrate ")
+			if strings.HasPrefix(uri, `"`) {
+				if uri, err = strconv.Unquote(uri); err != nil {
+					fmt.Printf("Error: %v\r\n", err)
+					break
+				}
+			}
+			data, err := s.migrationState()
+			if err != nil {
+				fmt.Printf("Error: %v\r\n", err)
+				break
+			}
+			if migration, err = startStubMigration(uri, data, s.migrateDelay); err != nil {
+				fmt.Printf("Error: %v\r\n", err)
+			}
+		case command == "info status":
+			if status == "inmigrate" && time.Now().After(restoredAt) {
+				status = "running"
+			}
+			if migration != nil {
+				if done, err := migration.poll(); err != nil {
+					fmt.Printf("Error: %v\r\n", err)
+				} else if done {
+					status, migration = "paused (postmigrate)", nil
+				}
+			}
+			fmt.Printf("VM status: %s\r\n", status)
+		case command == "cont":
+			status, migration = "running", nil
+		case command == "migrate_cancel":
+			migration = nil
+		case command == "stop":
+			status = "paused"
+		case command == "quit":
+			return nil
+		case command == "":
+		default:
+			fmt.Printf("unknown command: '%s'\r\n", command)
+		}
+		fmt.Printf("(qemu) ")
+	}
+}
+
+// serveQMP serves the minimal QMP of the stub QEMU on l.
+func (s *stubQEMU) serveQMP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			enc := json.NewEncoder(conn)
+			var fr *fdReader
+			dec := json.NewDecoder(conn)
+			if uc, ok := conn.(*net.UnixConn); ok {
+				fr = &fdReader{conn: uc}
+				dec = json.NewDecoder(fr)
+			}
+			named := make(map[string]*os.File) // by getfd
+			var migration stubMigration
+			enc.Encode(map[string]any{"QMP": map[string]any{"version": map[string]any{"qemu": map[string]int{"major": 0, "minor": 0, "micro": 0}}, "capabilities": []string{}}})
+			for {
+				var req struct {
+					Execute   string `json:"execute"`
+					Arguments struct {
+						URI    string `json:"uri"`
+						FDName string `json:"fdname"`
+					} `json:"arguments"`
+				}
+				if err := dec.Decode(&req); err != nil {
+					return
+				}
+				switch req.Execute {
+				case "getfd":
+					if fr == nil || len(fr.fds) == 0 {
+						enc.Encode(map[string]any{"error": qmpError{Class: "GenericError", Desc: "No file descriptor supplied via SCM_RIGHTS"}})
+						break
+					}
+					named[req.Arguments.FDName] = os.NewFile(uintptr(fr.fds[0]), req.Arguments.FDName)
+					fr.fds = fr.fds[1:]
+					enc.Encode(map[string]any{"return": map[string]any{}})
+				case "migrate":
+					data, err := s.migrationState()
+					if err == nil {
+						if name, ok := strings.CutPrefix(req.Arguments.URI, "fd:"); ok && named[name] != nil {
+							_, err = named[name].Write(data)
+							named[name].Close()
+							delete(named, name)
+						} else {
+							migration, err = startStubMigration(req.Arguments.URI, data, s.migrateDelay)
+						}
+					}
+					if err != nil {
+						enc.Encode(map[string]any{"error": qmpError{Class: "GenericError", Desc: err.Error()}})
+						break
+					}
+					enc.Encode(map[string]any{"return": map[string]any{}})
+				case "query-migrate":
+					if migration != nil {
+						if done, err := migration.poll(); err != nil {
+							enc.Encode(map[string]any{"return": map[string]any{"status": "failed", "error-desc": err.Error()}})
+							break
+						} else if !done {
+							enc.Encode(map[string]any{"return": map[string]any{"status": "active"}})
+							break
+						}
+						migration = nil
+					}
+					enc.Encode(map[string]any{"return": map[string]any{"status": "completed", "total-time": 1, "downtime": 1}})
+				case "qmp_capabilities":
+					enc.Encode(map[string]any{"return": map[string]any{}})
+				case "query-status":
+					enc.Encode(map[string]any{"return": map[string]any{"status": "running", "running": true}})
+				case "quit":
+					enc.Encode(map[string]any{"return": map[string]any{}})
+					os.Exit(0)
+				default:
+					enc.Encode(map[string]any{"error": qmpError{Class: "CommandNotFound", Desc: "The command " + req.Execute + " has not been found"}})
+				}
+			}
+		}()
+	}
+}
+
+// fdReader reads a unix socket keeping the file descriptors passed along.
+type fdReader struct {
+	conn *net.UnixConn
+	fds  []int
+}
+
+func (r *fdReader) Read(p []byte) (int, error) {
+	oob := make([]byte, oobSpace)
+	n, oobn, _, _, err := r.conn.ReadMsgUnix(p, oob)
+	r.fds = append(r.fds, receivedFDs(oob[:oobn])...)
+	return n, err
+}
+
+// stubMigration is a migration of the stub QEMU.
+type stubMigration interface {
+	// poll writes the rest of the state if the migration is due and
+	// reports whether it completed.
+	poll() (bool, error)
+}
+
+// startStubMigration starts migrating data to a file: or exec: URI.
+func startStubMigration(uri string, data []byte, delay time.Duration) (stubMigration, error) {
+	if command, ok := strings.CutPrefix(uri, "exec:"); ok {
+		m, err := startStubExecMigration(command, data, delay)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return startStubFileMigration(strings.TrimPrefix(uri, "file:"), data, delay)
+}
+
+// stubFileMigration is a "migrate file:PATH" of the stub QEMU. The file is
+// created with the first half of the state at once and the rest is written
+// by the first poll after delay, so that the file exists before the
+// migration completes like with QEMU.
+type stubFileMigration struct {
+	path string
+	data []byte
+	due  time.Time
+}
+
+func startStubFileMigration(path string, data []byte, delay time.Duration) (*stubFileMigration, error) {
+	m := &stubFileMigration{path: path, data: data, due: time.Now().Add(delay)}
+	return m, os.WriteFile(path, data[:len(data)/2], 0644)
+}
+
+// poll writes the rest of the state if the migration is due and reports
+// whether it completed.
+func (m *stubFileMigration) poll() (bool, error) {
+	if time.Now().Before(m.due) {
+		return false, nil
+	}
+	return true, os.WriteFile(m.path, m.data, 0644)
+}
+
+// stubExecMigration is a "migrate exec:COMMAND" of the stub QEMU. Like
+// QEMU, it completes once the state is written to the pipe to the command,
+// which may still be running.
+type stubExecMigration struct {
+	cmd  *exec.Cmd
+	w    io.WriteCloser
+	data []byte
+	due  time.Time
+}
+
+func startStubExecMigration(command string, data []byte, delay time.Duration) (*stubExecMigration, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	m := &stubExecMigration{cmd: cmd, w: w, data: data[len(data)/2:], due: time.Now().Add(delay)}
+	if _, err := w.Write(data[:len(data)/2]); err != nil {
+		w.Close()
+		cmd.Wait()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *stubExecMigration) poll() (bool, error) {
+	if m.data == nil {
+		return true, nil
+	}
+	if time.Now().Before(m.due) {
+		return false, nil
+	}
+	_, err := m.w.Write(m.data)
+	m.data = nil
+	if cerr := m.w.Close(); err == nil {
+		err = cerr
+	}
+	go m.cmd.Wait() // reaped whenever it exits
+	return true, err
+}
+
+// newTestStubQEMU returns the stub QEMU of the tests, configured by the
+// knobs of newStubQEMU and:
+//
+//	STUB_QEMU_SILENT_FOR       delays any output
+//	STUB_QEMU_BOOT_LINE        printed as a line before the marker
+//	STUB_QEMU_BOOT_MENU=1      shows a GRUB menu before the boot, waiting for Enter
+//	STUB_QEMU_GZIP_MARKER=1    prints the marker gzip-compressed
+//	STUB_QEMU_PROMPT           printed after the marker
+//	STUB_QEMU_CHATTY=1         keeps the guest printing after the marker, also while the monitor is focused like QEMU does
+//	STUB_QEMU_QMP_STDIO=1      greets with QMP on stdio like -qmp stdio
+//	STUB_QEMU_NO_KVM=1         fails like QEMU without /dev/kvm if args select KVM
+//	STUB_QEMU_REQUIRE_TTY=1    fails unless stdin is a terminal
+//	STUB_QEMU_RESTORED_STATE_SIZE replaces STUB_QEMU_STATE_SIZE with -incoming
+//	STUB_QEMU_STATE_FILE       copied by "migrate" instead of the zero bytes
+//	STUB_QEMU_WARNING          printed to stderr as a QEMU warning by "migrate"
+//	STUB_QEMU_MIGRATION_BLOCKER makes "migrate" fail, naming this feature
+//	STUB_QEMU_MIGRATE_DELAY    keeps a "migrate file:PATH" active with half the state written for this long
+//	STUB_QEMU_QUIT_EXIT_CODE   exit code of "quit" (default 0)
+//	STUB_QEMU_REPLY=LINE=>TEXT prints TEXT 200ms after LINE is typed to the console
+//	STUB_QEMU_EVENT_LOG        file where the console lines and monitor commands are appended
+//	STUB_QEMU_PORT_MARKER      written after the boot to the fd given by -add-fd, like a guest writing to a serial port
+//	STUB_QEMU_PORT_DELAY       delays STUB_QEMU_PORT_MARKER
+//
+// It also refuses -incoming given more than once, to catch args restoring
+// two states, and writes an ELF header for "dump-guest-memory".
+func newTestStubQEMU() (*stubQEMU, error) {
+	s, err := newStubQEMU()
+	if err != nil {
+		return nil, err
+	}
+	incoming := slices.Contains(os.Args, "-incoming")
+	if v := os.Getenv("STUB_QEMU_RESTORED_STATE_SIZE"); v != "" && incoming {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		s.stateSize = n
+	}
+	if p := os.Getenv("STUB_QEMU_STATE_FILE"); p != "" {
+		s.state = func() ([]byte, error) { return os.ReadFile(p) }
+	}
+	if v := os.Getenv("STUB_QEMU_MIGRATE_DELAY"); v != "" {
+		if s.migrateDelay, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+
+	s.start = func() error {
+		if i := slices.Index(os.Args, "-incoming"); i >= 0 && slices.Contains(os.Args[i+1:], "-incoming") {
+			return errors.New("-incoming given more than once")
+		}
+		if v := os.Getenv("STUB_QEMU_SILENT_FOR"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			time.Sleep(d)
+		}
+		if os.Getenv("STUB_QEMU_NO_KVM") == "1" && argsAccel(os.Args) == "kvm" {
+			fmt.Fprintf(os.Stderr, "Could not access KVM kernel module: No such file or directory\n")
+			fmt.Fprintf(os.Stderr, "qemu-system-stub: failed to initialize kvm: No such file or directory\n")
+			os.Exit(1)
+		}
+		if os.Getenv("STUB_QEMU_REQUIRE_TTY") == "1" && !isTerminal(os.Stdin) {
+			return errors.New("stdin isn't a terminal")
+		}
+		if os.Getenv("STUB_QEMU_QMP_STDIO") == "1" {
+			fmt.Printf(`{"QMP": {"version": {"qemu": {"micro": 0, "minor": 0, "major": 9}}, "capabilities": []}}` + "\r\n")
+		}
+		return nil
+	}
+	if os.Getenv("STUB_QEMU_BOOT_MENU") == "1" {
+		s.boot = func(in *bufio.Reader) error {
+			fmt.Printf("\x1b[2J\x1b[1;1H                             GNU GRUB  version 2.06\r\n\r\n")
+			fmt.Printf(" +----------------------------------------------------------------------------+\r\n")
+			fmt.Printf(" |*Stub GNU/Linux                                                             |\r\n")
+			fmt.Printf(" +----------------------------------------------------------------------------+\r\n\r\n")
+			fmt.Printf("      Use the ^ and v keys to select which entry is highlighted.\r\n")
+			fmt.Printf("      Press enter to boot the selected OS, `e' to edit the commands\r\n")
+			fmt.Printf("      before booting or `c' for a command-line.\r\n")
+			for {
+				b, err := in.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b == '\r' || b == '\n' {
+					return nil
+				}
+			}
+		}
+	}
+	s.ready = func(marker string) error {
+		if l := os.Getenv("STUB_QEMU_BOOT_LINE"); l != "" {
+			fmt.Printf("%s\r\n", l)
+		}
+		if os.Getenv("STUB_QEMU_GZIP_MARKER") == "1" {
+			zw, _ := gzip.NewWriterLevel(os.Stdout, gzip.BestCompression)
+			fmt.Fprintf(zw, "%s", marker)
+			zw.Close()
+		} else {
+			fmt.Printf("%s", marker)
+		}
+		if p := os.Getenv("STUB_QEMU_PROMPT"); p != "" {
+			fmt.Printf("\r\n%s", p)
+		}
+		if m := os.Getenv("STUB_QEMU_PORT_MARKER"); m != "" {
+			if err := writeStubPort(m); err != nil {
+				return err
+			}
+		}
+		if os.Getenv("STUB_QEMU_CHATTY") == "1" {
+			go func() {
+				for i := 0; ; i++ {
+					fmt.Printf("\r\n[    1.%06d] chatter %s", i, strings.Repeat("x", 200))
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+		return nil
+	}
+
+	logEvent := func(kind, s string) {
+		if p := os.Getenv("STUB_QEMU_EVENT_LOG"); p != "" {
+			if f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+				fmt.Fprintf(f, "%s %s\n", kind, s)
+				f.Close()
+			}
+		}
+	}
+	replyTo, reply, _ := strings.Cut(os.Getenv("STUB_QEMU_REPLY"), "=>")
+	s.console = func(l string) {
+		logEvent("console", l)
+		if replyTo != "" && l == replyTo {
+			time.Sleep(200 * time.Millisecond)
+			logEvent("reply", reply)
+			fmt.Printf("\r\n%s\r\n", reply)
+		}
+	}
+	s.monitor = func(command string) bool {
+		if command != "" {
+			logEvent("monitor", command)
+		}
+		switch {
+		case strings.HasPrefix(command, "migrate file:") && os.Getenv("STUB_QEMU_MIGRATION_BLOCKER") != "":
+			fmt.Printf("Error: Migration is disabled when using feature '%s' but not its migration mode\r\n", os.Getenv("STUB_QEMU_MIGRATION_BLOCKER"))
+			return true
+		case strings.HasPrefix(command, "migrate file:"):
+			if w := os.Getenv("STUB_QEMU_WARNING"); w != "" {
+				fmt.Fprintf(os.Stderr, "qemu-system-stub: warning: %s\n", w)
+			}
+		case strings.HasPrefix(command, "dump-guest-memory "):
+			if err := os.WriteFile(strings.TrimPrefix(command, "dump-guest-memory "), []byte("\x7fELF"), 0644); err != nil {
+				fmt.Printf("Error: %v\r\n", err)
+			}
+			return true
+		case command == "quit":
+			if v := os.Getenv("STUB_QEMU_QUIT_EXIT_CODE"); v != "" {
+				code, _ := strconv.Atoi(v)
+				fmt.Fprintf(os.Stderr, "qemu-system-stub: exiting with %d on quit\n", code)
+				os.Exit(code)
+			}
+		}
+		return false
+	}
+	return s, nil
+}
+
+// writeStubPort writes m to the fd given by -add-fd after
+// $STUB_QEMU_PORT_DELAY.
+func writeStubPort(m string) error {
+	if v := os.Getenv("STUB_QEMU_PORT_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+	}
+	for i := 0; i < len(os.Args)-1; i++ {
+		if os.Args[i] != "-add-fd" {
+			continue
+		}
+		for _, o := range strings.Split(os.Args[i+1], ",") {
+			if v, ok := strings.CutPrefix(o, "fd="); ok {
+				fd, err := strconv.Atoi(v)
+				if err != nil {
+					return err
+				}
+				_, err = os.NewFile(uintptr(fd), "port").WriteString(m)
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("no -add-fd to write %q to", m)
+}
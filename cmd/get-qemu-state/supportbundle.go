@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// supportBundleTimeout bounds each command run for the support bundle, so
+// that a hanging QEMU doesn't hold up the capture.
+const supportBundleTimeout = 10 * time.Second
+
+// supportBundleQueries are the QEMU invocations recorded in the support
+// bundle, by file name.
+var supportBundleQueries = []struct {
+	file string
+	args []string
+}{
+	{"qemu-version.txt", []string{"-version"}},
+	{"accelerators.txt", []string{"-accel", "help"}},
+	{"machines.txt", []string{"-machine", "help"}},
+	{"cpus.txt", []string{"-cpu", "help"}},
+	{"devices.txt", []string{"-device", "help"}},
+}
+
+// writeSupportBundle writes what a bug report about capturing with qemu
+// needs to dir: the output of the QEMU help and version queries, the host
+// (host.txt) and, if not nil, the args (args.txt, which the caller redacts).
+// A query failing is recorded in its file rather than failing the bundle.
+func writeSupportBundle(ctx context.Context, dir, qemu string, args []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(supportBundleQueries))
+	for i, q := range supportBundleQueries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = os.WriteFile(filepath.Join(dir, q.file), runSupportQuery(ctx, qemu, q.args...), 0644)
+		}()
+	}
+	host := hostInfo(ctx, qemu)
+	wg.Wait()
+	errs = append(errs, os.WriteFile(filepath.Join(dir, "host.txt"), host, 0644))
+	if args != nil {
+		errs = append(errs, os.WriteFile(filepath.Join(dir, "args.txt"), []byte(shellJoin(append([]string{qemu}, args...))+"\n"), 0644))
+	}
+	return errors.Join(errs...)
+}
+
+// runSupportQuery runs name with args and returns the command line and its
+// output, followed by the error if it failed.
+func runSupportQuery(ctx context.Context, name string, args ...string) []byte {
+	ctx, cancel := context.WithTimeout(ctx, supportBundleTimeout)
+	defer cancel()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "$ %s\n", shellJoin(append([]string{name}, args...)))
+	c := exec.CommandContext(ctx, name, args...)
+	c.Stdout, c.Stderr = &b, &b
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w (timed out after %v)", err, supportBundleTimeout)
+		}
+		fmt.Fprintf(&b, "\nfailed: %v\n", err)
+	}
+	return b.Bytes()
+}
+
+// hostInfo describes the host running qemu.
+func hostInfo(ctx context.Context, qemu string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "os/arch: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "go: %s\n", runtime.Version())
+	fmt.Fprintf(&b, "cpus: %d\n", runtime.NumCPU())
+	fmt.Fprintf(&b, "page size: %d\n", os.Getpagesize())
+	if thp := transparentHugePages(); thp != "" {
+		fmt.Fprintf(&b, "transparent hugepages: %s\n", thp)
+	}
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		if m, err := parseMeminfo(data); err == nil {
+			fmt.Fprintf(&b, "memory: %d MiB (%d MiB available)\n", m.TotalKiB/1024, m.AvailableKiB/1024)
+		}
+	}
+	fmt.Fprintf(&b, "kvm: %s\n", kvmAvailability())
+	if p, err := exec.LookPath(qemu); err == nil {
+		qemu = p
+	}
+	if fi, err := os.Stat(qemu); err == nil {
+		fmt.Fprintf(&b, "qemu: %s (%d bytes, modified %s)\n", qemu, fi.Size(), fi.ModTime().UTC().Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(&b, "qemu: %v\n", err)
+	}
+	if _, err := exec.LookPath("uname"); err == nil {
+		b.WriteString("\n")
+		b.Write(runSupportQuery(ctx, "uname", "-a"))
+	}
+	return b.Bytes()
+}
+
+// kvmAvailability tells whether this process can use KVM.
+func kvmAvailability() string {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Sprintf("unavailable (%v)", err)
+	}
+	f.Close()
+	return "available"
+}
+
+// runSupportBundle writes a support bundle without capturing.
+func runSupportBundle(args []string) error {
+	fs := flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	output := fs.String("output", "support-bundle", "directory to write the bundle to")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("specify QEMU binary")
+	}
+	if err := writeSupportBundle(context.Background(), *output, fs.Arg(0), nil); err != nil {
+		return err
+	}
+	log.Printf("wrote the support bundle to %s", *output)
+	return nil
+}
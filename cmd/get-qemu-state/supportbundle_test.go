@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteSupportBundle(t *testing.T) {
+	qemu := filepath.Join(t.TempDir(), "qemu-system-stub")
+	script := `#!/bin/sh
+case "$*" in
+-version) echo "QEMU emulator version 9.9.9" ;;
+"-cpu help") echo "no CPU models" >&2; exit 1 ;;
+*) echo "help for $1" ;;
+esac
+`
+	if err := os.WriteFile(qemu, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "bundle")
+	if err := writeSupportBundle(context.Background(), dir, qemu, []string{"-m", "512"}); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		"qemu-version.txt": "QEMU emulator version 9.9.9",
+		"accelerators.txt": "help for -accel",
+		"machines.txt":     "help for -machine",
+		"cpus.txt":         "no CPU models\n\nfailed: exit status 1",
+		"devices.txt":      "help for -device",
+		"host.txt":         "kvm: ",
+		"args.txt":         "'-m' '512'",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s doesn't contain %q:\n%s", file, want, data)
+		}
+	}
+}
+
+func TestCaptureSupportBundle(t *testing.T) {
+	// The bundle is written even if the capture fails.
+	dir := filepath.Join(t.TempDir(), "bundle")
+	_, stderr, err := runMain(t, "-support-bundle", dir, "-output", filepath.Join(t.TempDir(), "vm.state"), "-marker", "never", "-boot-timeout", "1s")
+	if err == nil {
+		t.Fatal("capture waiting for a marker never printed succeeded")
+	}
+	for _, file := range []string{"qemu-version.txt", "accelerators.txt", "machines.txt", "cpus.txt", "devices.txt", "host.txt", "args.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("%v\n%s", err, stderr)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// resolveOutputPath returns the path to write a file at path. A symlink at
+// path is refused so that e.g. a linked golden image isn't overwritten by
+// surprise, unless follow is set, in which case the link target is returned.
+// The target doesn't need to exist.
+func resolveOutputPath(path string, follow bool) (string, error) {
+	for i := 0; i < 40; i++ {
+		fi, err := os.Lstat(path)
+		if errors.Is(err, os.ErrNotExist) || (err == nil && fi.Mode()&os.ModeSymlink == 0) {
+			return path, nil
+		} else if err != nil {
+			return "", err
+		}
+		if !follow {
+			return "", fmt.Errorf("%s is a symlink; refusing to write through it (see -follow-symlinks)", path)
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return "", fmt.Errorf("too many levels of symlinks at %s", path)
+}
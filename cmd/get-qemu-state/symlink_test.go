@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveOutputPath(t *testing.T) {
+	dir := t.TempDir()
+	golden := filepath.Join(dir, "golden.state")
+	if err := os.WriteFile(golden, []byte("golden"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "vm.state")
+	if err := os.Symlink("golden.state", link); err != nil {
+		t.Fatal(err)
+	}
+	dangling := filepath.Join(dir, "dangling.state")
+	if err := os.Symlink(filepath.Join(dir, "sub", "new.state"), dangling); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		follow bool
+		want   string // empty if refused
+	}{
+		{path: golden, want: golden},
+		{path: filepath.Join(dir, "new.state"), want: filepath.Join(dir, "new.state")},
+		{path: link},
+		{path: link, follow: true, want: golden},
+		{path: dangling, follow: true, want: filepath.Join(dir, "sub", "new.state")},
+	} {
+		got, err := resolveOutputPath(tt.path, tt.follow)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s (follow=%v): not refused", tt.path, tt.follow)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s (follow=%v) = %q, %v; want %q", tt.path, tt.follow, got, err, tt.want)
+		}
+	}
+}
+
+func TestCaptureOutputSymlink(t *testing.T) {
+	t.Setenv("STUB_QEMU_STATE_SIZE", "4096")
+	cfg := stubConfig(t)
+	golden := filepath.Join(filepath.Dir(cfg.output), "golden.state")
+	if err := os.WriteFile(golden, []byte("golden"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(golden, cfg.output); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := capture(cfg); err == nil {
+		t.Fatal("wrote through a symlink")
+	}
+	if data, err := os.ReadFile(golden); err != nil || string(data) != "golden" {
+		t.Fatalf("golden image is modified: %v", err)
+	}
+
+	cfg.followSymlinks = true
+	if _, err := capture(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(cfg.output); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink is replaced: %v", err)
+	}
+	if fi, err := os.Stat(golden); err != nil || fi.Size() != 4096 {
+		t.Errorf("state isn't written to the link target: %v", err)
+	}
+}
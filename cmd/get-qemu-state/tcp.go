@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// freeTCPPort returns a currently unused TCP port on the loopback interface.
+func freeTCPPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// injectHostfwd adds a hostfwd rule forwarding hostPort to guestPort to the
+// first user-mode network backend (-netdev user or -nic user) in args.
+func injectHostfwd(args []string, hostPort, guestPort int) ([]string, error) {
+	rule := fmt.Sprintf("hostfwd=tcp:127.0.0.1:%d-:%d", hostPort, guestPort)
+	res := append([]string{}, args...)
+	for i := 0; i < len(res)-1; i++ {
+		if res[i] != "-netdev" && res[i] != "-nic" {
+			continue
+		}
+		if v := res[i+1]; v == "user" || strings.HasPrefix(v, "user,") {
+			res[i+1] = v + "," + rule
+			return res, nil
+		}
+	}
+	return nil, errors.New("no user-mode network backend (-netdev user or -nic user) found in args")
+}
+
+// waitTCP blocks until addr accepts connections that stay open at every
+// poll for debounce, or until ctx is done.
+func waitTCP(ctx context.Context, addr string, interval, debounce time.Duration) error {
+	d := debouncer{window: debounce}
+	for {
+		ok := tcpReady(ctx, addr)
+		if d.observe(ok) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if ok {
+				return fmt.Errorf("%s didn't stay open for %v: %w", addr, debounce, ctx.Err())
+			}
+			return fmt.Errorf("%s isn't accepting connections: %w", addr, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+func tcpReady(ctx context.Context, addr string) bool {
+	dialer := net.Dialer{Timeout: time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	// QEMU's user-mode network accepts host-side connections even if nothing
+	// listens in the guest and closes them right after. Treat an immediate EOF
+	// as "not ready yet".
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		var nerr net.Error
+		return errors.As(err, &nerr) && nerr.Timeout()
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInjectHostfwd(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			args: []string{"-m", "512", "-netdev", "user,id=net0", "-device", "virtio-net-pci,netdev=net0"},
+			want: []string{"-m", "512", "-netdev", "user,id=net0,hostfwd=tcp:127.0.0.1:8080-:80", "-device", "virtio-net-pci,netdev=net0"},
+		},
+		{
+			args: []string{"-nic", "user"},
+			want: []string{"-nic", "user,hostfwd=tcp:127.0.0.1:8080-:80"},
+		},
+		{
+			// The first user-mode backend gets the rule.
+			args: []string{"-netdev", "tap,id=net0", "-nic", "user,model=virtio", "-netdev", "user,id=net1"},
+			want: []string{"-netdev", "tap,id=net0", "-nic", "user,model=virtio,hostfwd=tcp:127.0.0.1:8080-:80", "-netdev", "user,id=net1"},
+		},
+		{args: []string{"-netdev", "tap,id=net0", "-nic", "usernet"}, wantErr: true},
+		{args: []string{"-netdev"}, wantErr: true},
+		{args: nil, wantErr: true},
+	} {
+		orig := slices.Clone(tc.args)
+		got, err := injectHostfwd(tc.args, 8080, 80)
+		if tc.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "no user-mode network backend") {
+				t.Errorf("%q: got %q, %v; want no user-mode network backend", tc.args, got, err)
+			}
+		} else if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("%q: got %q, %v; want %q", tc.args, got, err, tc.want)
+		}
+		if !slices.Equal(tc.args, orig) {
+			t.Errorf("%q: args modified to %q", orig, tc.args)
+		}
+	}
+}
+
+func TestTCPReady(t *testing.T) {
+	ctx := context.Background()
+	serve := func(t *testing.T, handle func(net.Conn)) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go handle(conn)
+			}
+		}()
+		return l.Addr().String()
+	}
+
+	t.Run("open", func(t *testing.T) {
+		addr := serve(t, func(conn net.Conn) {
+			defer conn.Close()
+			conn.Read(make([]byte, 1)) // until the client closes it
+		})
+		if !tcpReady(ctx, addr) {
+			t.Error("a connection staying open isn't ready")
+		}
+	})
+	t.Run("greeting", func(t *testing.T) {
+		addr := serve(t, func(conn net.Conn) {
+			defer conn.Close()
+			conn.Write([]byte("SSH-2.0-stub\r\n"))
+			conn.Read(make([]byte, 1))
+		})
+		if !tcpReady(ctx, addr) {
+			t.Error("a connection sending a greeting isn't ready")
+		}
+	})
+	t.Run("closed at once", func(t *testing.T) {
+		// Like QEMU's user-mode network with nothing listening in the guest.
+		addr := serve(t, func(conn net.Conn) { conn.Close() })
+		if tcpReady(ctx, addr) {
+			t.Error("a connection closed at once is ready")
+		}
+	})
+	t.Run("refused", func(t *testing.T) {
+		port, err := freeTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tcpReady(ctx, net.JoinHostPort("127.0.0.1", strconv.Itoa(port))) {
+			t.Error("a refused connection is ready")
+		}
+	})
+}
+
+func TestWaitTCPContext(t *testing.T) {
+	port, err := freeTCPPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = waitTCP(ctx, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 50*time.Millisecond, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v; want the context error", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("returned %v after the context was done", d)
+	}
+}